@@ -0,0 +1,55 @@
+package client
+
+import (
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// CallOption sets an option for a CALL message.
+type CallOption func(options wamp.Dict)
+
+// CallOptions returns an options dict, to pass to Call or CallProgress, with
+// the given call options set.  For example:
+//
+//	options := client.CallOptions(
+//	    client.WithTimeout(30*time.Second),
+//	    client.WithPartition(userID))
+//	result, err := c.Call(ctx, procedure, options, args, nil, "")
+func CallOptions(opts ...CallOption) wamp.Dict {
+	options := wamp.Dict{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// WithTimeout requests that the call be canceled if it does not complete
+// within the given duration.  The timeout is sent in milliseconds, and is
+// passed to the callee if the callee supports call timeout.  A duration of
+// zero or less requests no timeout.
+func WithTimeout(d time.Duration) CallOption {
+	return func(options wamp.Dict) {
+		if d <= 0 {
+			delete(options, wamp.OptTimeout)
+			return
+		}
+		ms := int64(d / time.Millisecond)
+		if ms == 0 {
+			// Do not round a short timeout down to no timeout.
+			ms = 1
+		}
+		options[wamp.OptTimeout] = ms
+	}
+}
+
+// WithPartition sets the partition key for the call, so that all calls with
+// the same key go to the same callee of a shared registration.  This also sets
+// the "partition" run mode, so that the call is partitioned even if the
+// registration does not use the "partition" invocation policy.
+func WithPartition(rkey string) CallOption {
+	return func(options wamp.Dict) {
+		options[wamp.OptRKey] = rkey
+		options[wamp.OptRunMode] = wamp.RunModePartition
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/gammazero/nexus/router"
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestCallOptions(t *testing.T) {
+	options := CallOptions()
+	if options == nil || len(options) != 0 {
+		t.Fatal("expected empty options, got", options)
+	}
+
+	options = CallOptions(WithTimeout(1500*time.Millisecond), WithPartition("k1"))
+	expect := wamp.Dict{
+		wamp.OptTimeout: int64(1500),
+		wamp.OptRKey:    "k1",
+		wamp.OptRunMode: wamp.RunModePartition,
+	}
+	if !reflect.DeepEqual(options, expect) {
+		t.Fatal("wrong options:", options)
+	}
+
+	// A short timeout is not rounded down to no timeout, and a later option
+	// overrides an earlier one.
+	options = CallOptions(WithTimeout(time.Microsecond))
+	if options[wamp.OptTimeout] != int64(1) {
+		t.Fatal("wrong timeout for short duration:", options[wamp.OptTimeout])
+	}
+	options = CallOptions(WithTimeout(time.Second), WithTimeout(0))
+	if _, ok := options[wamp.OptTimeout]; ok {
+		t.Fatal("expected no timeout, got", options[wamp.OptTimeout])
+	}
+}
+
+func TestCallOptionsInCall(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(&router.RealmConfig{
+		URI:           wamp.URI(testRealm),
+		AnonymousAuth: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	callee, err := newTestClient(r)
+	if err != nil {
+		t.Fatal("failed to connect callee:", err)
+	}
+	defer callee.Close()
+
+	// Connect a caller through a peer that records the messages it sends.
+	rec := wamp.NewRecordingPeer(getTestPeer(r))
+	caller, err := NewClient(rec, Config{
+		Realm:           testRealm,
+		ResponseTimeout: 500 * time.Millisecond,
+		Logger:          logger,
+	})
+	if err != nil {
+		t.Fatal("failed to connect caller:", err)
+	}
+	defer caller.Close()
+
+	// A partitioned registration fails calls that have no partition key.
+	handler := func(ctx context.Context, args wamp.List, kwargs, details wamp.Dict) *InvokeResult {
+		return &InvokeResult{Args: wamp.List{"ok"}}
+	}
+	err = callee.Register("partitioned", handler,
+		wamp.Dict{wamp.OptInvoke: wamp.InvokePartition})
+	if err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	options := CallOptions(WithTimeout(2*time.Second), WithPartition("user-7"))
+	result, err := caller.Call(context.Background(), "partitioned", options,
+		nil, nil, "")
+	if err != nil {
+		t.Fatal("failed to call procedure:", err)
+	}
+	if len(result.Arguments) != 1 || result.Arguments[0] != "ok" {
+		t.Fatal("wrong result:", result.Arguments)
+	}
+
+	var call *wamp.Call
+	for _, r := range rec.Records() {
+		if msg, ok := r.Message.(*wamp.Call); ok && r.Sent {
+			call = msg
+		}
+	}
+	if call == nil {
+		t.Fatal("CALL was not sent")
+	}
+	expect := wamp.Dict{
+		wamp.OptTimeout: int64(2000),
+		wamp.OptRKey:    "user-7",
+		wamp.OptRunMode: wamp.RunModePartition,
+	}
+	if !reflect.DeepEqual(call.Options, expect) {
+		t.Fatal("wrong options in CALL:", call.Options)
+	}
+}
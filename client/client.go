@@ -78,14 +78,19 @@ type Client struct {
 
 	eventHandlers map[wamp.ID]EventHandler
 	topicSubID    map[string]wamp.ID
+	subOptions    map[string]wamp.Dict
 
 	invHandlers    map[wamp.ID]InvocationHandler
 	nameProcID     map[string]wamp.ID
+	procOptions    map[string]wamp.Dict
 	invHandlerKill map[wamp.ID]context.CancelFunc
 	progGate       map[context.Context]wamp.ID
 
 	activeInvHandlers sync.WaitGroup
 
+	// Closed when the heartbeat goroutine exits.  Nil if there is none.
+	heartbeatDone chan struct{}
+
 	log   stdlog.StdLog
 	debug bool
 
@@ -96,6 +101,12 @@ type Client struct {
 
 	routerGoodbye *wamp.Goodbye
 	idGen         *wamp.SyncIDGen
+
+	// Used for reconnecting to the router.
+	cfg       Config
+	dial      dialFunc
+	reconnCfg *ReconnectConfig
+	rpeer     *reconnectPeer
 }
 
 // NewClient takes a connected Peer, joins the realm specified in cfg, and if
@@ -104,7 +115,16 @@ type Client struct {
 // NOTE: This method is exported for clients that use a Peer implementation not
 // provided with the nexus package.  Generally, clients are created using
 // ConnectNet() or ConnectLocal().
+//
+// A client created by NewClient does not reconnect, even if cfg.Reconnect is
+// set, since it does not know how to connect to the router again.
 func NewClient(p wamp.Peer, cfg Config) (*Client, error) {
+	return newClient(p, cfg, nil)
+}
+
+// newClient creates a new client.  If dial is not nil, then it is used to
+// reconnect to the router, if configured to do so.
+func newClient(p wamp.Peer, cfg Config, dial dialFunc) (*Client, error) {
 	if cfg.ResponseTimeout == 0 {
 		cfg.ResponseTimeout = defaultResponseTimeout
 	}
@@ -130,9 +150,11 @@ func NewClient(p wamp.Peer, cfg Config) (*Client, error) {
 
 		eventHandlers: map[wamp.ID]EventHandler{},
 		topicSubID:    map[string]wamp.ID{},
+		subOptions:    map[string]wamp.Dict{},
 
 		invHandlers:    map[wamp.ID]InvocationHandler{},
 		nameProcID:     map[string]wamp.ID{},
+		procOptions:    map[string]wamp.Dict{},
 		invHandlerKill: map[wamp.ID]context.CancelFunc{},
 		progGate:       map[context.Context]wamp.ID{},
 
@@ -141,10 +163,45 @@ func NewClient(p wamp.Peer, cfg Config) (*Client, error) {
 		idGen: new(wamp.SyncIDGen),
 	}
 	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if dial != nil && cfg.Reconnect != nil {
+		c.cfg = cfg
+		c.dial = dial
+		c.reconnCfg = cfg.Reconnect
+		c.rpeer = newReconnectPeer(p, c.ctx.Done())
+		sess.Peer = c.rpeer
+	}
 	go c.run() // start the core goroutine
+
+	// If the router expects heartbeats, then call the heartbeat procedure
+	// each interval so that the session is not ended when otherwise idle.
+	if ms, ok := wamp.AsInt64(welcome.Details["heartbeat_interval"]); ok && ms > 0 {
+		c.heartbeatDone = make(chan struct{})
+		go c.heartbeat(time.Duration(ms) * time.Millisecond)
+	}
 	return c, nil
 }
 
+// heartbeat calls the session heartbeat meta procedure every interval until
+// the client is closed.
+func (c *Client) heartbeat(interval time.Duration) {
+	defer close(c.heartbeatDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.Done():
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.ctx, interval)
+		_, err := c.Call(ctx, string(wamp.MetaProcSessionHeartbeat), nil, nil, nil, "")
+		cancel()
+		if err != nil && c.debug {
+			c.log.Println("Heartbeat failed:", err)
+		}
+	}
+}
+
 // Done returns a channel that signals when the client is no longer connected
 // to a router and has shutdown.
 func (c *Client) Done() <-chan struct{} { return c.ctx.Done() }
@@ -155,7 +212,11 @@ func (c *Client) Connected() bool { return c.ctx.Err() == nil }
 
 // ID returns the client's session ID which is assigned after attaching to a
 // router and joining a realm.
-func (c *Client) ID() wamp.ID { return c.sess.ID }
+func (c *Client) ID() wamp.ID {
+	c.sess.Lock()
+	defer c.sess.Unlock()
+	return c.sess.ID
+}
 
 // Logger returns the clients logger that was provided by Config when the
 // client was created, or the stdout logger if one was not provided in Config.
@@ -209,11 +270,14 @@ func (c *Client) Subscribe(topic string, fn EventHandler, options wamp.Dict) err
 	}
 	id := c.idGen.Next()
 	c.expectReply(id)
-	c.sess.Send(&wamp.Subscribe{
+	err := c.sendRequest(id, &wamp.Subscribe{
 		Request: id,
 		Options: options,
 		Topic:   wamp.URI(topic),
 	})
+	if err != nil {
+		return err
+	}
 
 	// Wait to receive SUBSCRIBED message.
 	msg, err := c.waitForReply(id)
@@ -226,6 +290,7 @@ func (c *Client) Subscribe(topic string, fn EventHandler, options wamp.Dict) err
 		c.sess.Lock()
 		c.eventHandlers[msg.Subscription] = fn
 		c.topicSubID[topic] = msg.Subscription
+		c.subOptions[topic] = options
 		c.sess.Unlock()
 		return nil
 	case *wamp.Error:
@@ -259,6 +324,7 @@ func (c *Client) Unsubscribe(topic string) error {
 	// Unsubscribe() then it has no interest in receiving any more events for
 	// the topic, and may expect any.
 	delete(c.topicSubID, topic)
+	delete(c.subOptions, topic)
 	delete(c.eventHandlers, subID)
 	c.sess.Unlock()
 
@@ -268,10 +334,13 @@ func (c *Client) Unsubscribe(topic string) error {
 
 	id := c.idGen.Next()
 	c.expectReply(id)
-	c.sess.Send(&wamp.Unsubscribe{
+	err := c.sendRequest(id, &wamp.Unsubscribe{
 		Request:      id,
 		Subscription: subID,
 	})
+	if err != nil {
+		return err
+	}
 
 	// Wait to receive UNSUBSCRIBED message.
 	msg, err := c.waitForReply(id)
@@ -338,13 +407,16 @@ func (c *Client) Publish(topic string, options wamp.Dict, args wamp.List, kwargs
 	if pubAck {
 		c.expectReply(id)
 	}
-	c.sess.Send(&wamp.Publish{
+	err := c.sendRequest(id, &wamp.Publish{
 		Request:     id,
 		Options:     options,
 		Topic:       wamp.URI(topic),
 		Arguments:   args,
 		ArgumentsKw: kwargs,
 	})
+	if err != nil {
+		return err
+	}
 
 	if !pubAck {
 		return nil
@@ -387,7 +459,11 @@ type InvocationHandler func(context.Context, wamp.List, wamp.Dict, wamp.Dict) (r
 //   options["match"] = "prefix" or "wildcard"
 //
 // To request a shared registration pattern set:
-//   options["invoke"] = "single", "roundrobin", "random", "first", "last"
+//   options["invoke"] = "single", "roundrobin", "random", "first", "last",
+//                       "partition"
+//
+// With the "partition" policy, each call must provide a partition key, and
+// calls with the same key are sent to the same callee.
 //
 // To request that caller identification is disclosed to this callee, set:
 //   options["disclose_caller"] = true
@@ -402,11 +478,14 @@ func (c *Client) Register(procedure string, fn InvocationHandler, options wamp.D
 	if options == nil {
 		options = wamp.Dict{}
 	}
-	c.sess.Send(&wamp.Register{
+	err := c.sendRequest(id, &wamp.Register{
 		Request:   id,
 		Options:   options,
 		Procedure: wamp.URI(procedure),
 	})
+	if err != nil {
+		return err
+	}
 
 	// Wait to receive REGISTERED message.
 	msg, err := c.waitForReply(id)
@@ -419,6 +498,9 @@ func (c *Client) Register(procedure string, fn InvocationHandler, options wamp.D
 		c.sess.Lock()
 		c.invHandlers[msg.Registration] = fn
 		c.nameProcID[procedure] = msg.Registration
+		// Keep the options so that the procedure can be registered again
+		// with the same options.
+		c.procOptions[procedure] = options
 		c.sess.Unlock()
 		if c.debug {
 			c.log.Println("Registered", procedure, "as registration",
@@ -456,6 +538,7 @@ func (c *Client) Unregister(procedure string) error {
 	// Unregister() then it has no interest in receiving any more invocations
 	// for the procedure, and may not expect any.
 	delete(c.nameProcID, procedure)
+	delete(c.procOptions, procedure)
 	delete(c.invHandlers, procID)
 	c.sess.Unlock()
 
@@ -465,10 +548,13 @@ func (c *Client) Unregister(procedure string) error {
 
 	id := c.idGen.Next()
 	c.expectReply(id)
-	c.sess.Send(&wamp.Unregister{
+	err := c.sendRequest(id, &wamp.Unregister{
 		Request:      id,
 		Registration: procID,
 	})
+	if err != nil {
+		return err
+	}
 
 	// Wait to receive UNREGISTERED message.
 	msg, err := c.waitForReply(id)
@@ -543,6 +629,9 @@ func (c *Client) Unregister(procedure string) error {
 // To request a remote call timeout, specify a timeout in milliseconds:
 //   options["timeout"] = 30000
 //
+// or use CallOptions with WithTimeout:
+//   options := client.CallOptions(client.WithTimeout(30 * time.Second))
+//
 // Caller Identification
 //
 // A caller may request the disclosure of its identity (its WAMP session ID) to
@@ -551,6 +640,20 @@ func (c *Client) Unregister(procedure string) error {
 // To request that this caller's identity disclosed to callees, set:
 //   options["disclose_me"] = true
 //
+// Partitioned Calls
+//
+// A call to a shared registration can be sent to the callee selected by a
+// partition key, so that calls with the same key go to the same callee.  This
+// is required by registrations with the "partition" invocation policy.
+//
+// To partition a call, set the partition key and, if the registration does
+// not use the "partition" policy, the run mode:
+//   options["rkey"] = "some-key"
+//   options["runmode"] = "partition"
+//
+// or use CallOptions with WithPartition, which sets both:
+//   options := client.CallOptions(client.WithPartition("some-key"))
+//
 // NOTE: Use consts defined in wamp/options.go instead of raw strings.
 //
 // Progressive Call Results
@@ -604,7 +707,14 @@ func (c *Client) CallProgress(ctx context.Context, procedure string, options wam
 	var progDone chan struct{}
 	if progcb != nil {
 		progChan = make(chan *wamp.Result)
-		options[wamp.OptReceiveProgress] = true
+		// Set receive_progress on a copy, so that the caller's options can be
+		// reused for calls that do not receive progressive results.
+		callOpts := make(wamp.Dict, len(options)+1)
+		for k, v := range options {
+			callOpts[k] = v
+		}
+		callOpts[wamp.OptReceiveProgress] = true
+		options = callOpts
 
 		progDone = make(chan struct{})
 		go func() {
@@ -617,17 +727,23 @@ func (c *Client) CallProgress(ctx context.Context, procedure string, options wam
 
 	id := c.idGen.Next()
 	c.expectReply(id)
-	c.sess.Send(&wamp.Call{
+	err := c.sendRequest(id, &wamp.Call{
 		Request:     id,
 		Procedure:   wamp.URI(procedure),
 		Options:     options,
 		Arguments:   args,
 		ArgumentsKw: kwargs,
 	})
+	if err != nil {
+		if progChan != nil {
+			close(progChan)
+			<-progDone
+		}
+		return nil, err
+	}
 
 	// Wait to receive RESULT message.
 	var msg wamp.Message
-	var err error
 	msg, err = c.waitForReplyWithCancel(ctx, id, cancelMode, procedure, progChan)
 
 	// Finish handling any remaining progressive results before returning the
@@ -707,6 +823,11 @@ func (c *Client) Close() error {
 
 	// When for any running invocation handlers to finish.
 	c.activeInvHandlers.Wait()
+	// Wait for the heartbeat to stop, so that it is not sending a call when
+	// the session is closed.
+	if c.heartbeatDone != nil {
+		<-c.heartbeatDone
+	}
 	c.sess.Close()
 
 	return nil
@@ -776,6 +897,10 @@ func joinRealm(peer wamp.Peer, cfg Config) (*wamp.Welcome, error) {
 	if _, ok := details[helloRoles]; !ok {
 		details[helloRoles] = clientRoles
 	}
+	// The client sends heartbeats if the router asks for them.
+	if _, ok := details[wamp.OptHeartbeat]; !ok {
+		details[wamp.OptHeartbeat] = true
+	}
 	if len(cfg.AuthHandlers) > 0 {
 		authmethods := make(wamp.List, len(cfg.AuthHandlers))
 		var i int
@@ -926,6 +1051,23 @@ func (c *Client) expectReply(id wamp.ID) {
 	c.sess.Unlock()
 }
 
+// sendRequest sends a request message to the router.  If the message cannot
+// be sent, then the client stops expecting a reply to the request.  Sending
+// stops if the client is disconnected, since the router may no longer be
+// receiving.
+func (c *Client) sendRequest(id wamp.ID, msg wamp.Message) error {
+	if err := c.sess.SendCtx(c.ctx, msg); err != nil {
+		c.sess.Lock()
+		delete(c.awaitingReply, id)
+		c.sess.Unlock()
+		if c.ctx.Err() != nil {
+			return ErrNotConn
+		}
+		return err
+	}
+	return nil
+}
+
 // waitForReply waits for an expected reply from the router.
 //
 // IMPORTANT: Must not block on anything requiring run() goroutine, since the
@@ -948,8 +1090,9 @@ func (c *Client) waitForReply(id wamp.ID) (wamp.Message, error) {
 	case msg, ok = <-wait:
 		timer.Stop()
 		if !ok {
-			// Return directly here, since awaitingReply entry already deleted.
-			return nil, ErrNotConn
+			// Return directly here, since awaitingReply entry already deleted
+			// when connection to router was lost.
+			return nil, ErrDisconnected
 		}
 	case <-timer.C:
 		err = ErrReplyTimeout
@@ -988,8 +1131,9 @@ CollectResults:
 	select {
 	case msg, ok = <-wait:
 		if !ok {
-			// Return here, since awaitingReply entry already deleted.
-			return nil, ErrNotConn
+			// Return here, since awaitingReply entry already deleted when
+			// connection to router was lost.
+			return nil, ErrDisconnected
 		}
 		// If this is a progressive result, put the Result message on the
 		// progress channel and go back to waiting for more results.
@@ -1052,6 +1196,10 @@ func (c *Client) run() {
 
 	recv := c.sess.Recv()
 	recvDone := c.sess.RecvDone()
+	var connLost <-chan struct{}
+	if c.rpeer != nil {
+		connLost = c.rpeer.lost
+	}
 	for {
 		select {
 		case msg, ok := <-recv:
@@ -1061,6 +1209,8 @@ func (c *Client) run() {
 			if c.runReceiveFromRouter(msg) {
 				return
 			}
+		case <-connLost:
+			c.runDisconnected()
 		case <-recvDone:
 			return
 		}
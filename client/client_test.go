@@ -359,6 +359,82 @@ func TestRemoteProcedureCall(t *testing.T) {
 	r.Close()
 }
 
+func TestRegisterErrorResult(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	// Connect two clients to the same server
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+
+	// Handler returns an error result when called with no arguments.
+	handler := func(ctx context.Context, args wamp.List, kwargs, details wamp.Dict) *InvokeResult {
+		if len(args) == 0 {
+			return &InvokeResult{
+				Args: wamp.List{"missing argument"},
+				Err:  wamp.ErrInvalidArgument,
+			}
+		}
+		return &InvokeResult{Args: args}
+	}
+	procName := "nexus.test.checkargs"
+	options := wamp.Dict{wamp.OptInvoke: wamp.InvokeRoundRobin}
+	if err = callee.Register(procName, handler, options); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+	callee.sess.Lock()
+	regOpts := callee.procOptions[procName]
+	callee.sess.Unlock()
+	if regOpts[wamp.OptInvoke] != wamp.InvokeRoundRobin {
+		t.Fatal("registration options not kept")
+	}
+
+	// Registering the same procedure again is an error.
+	if err = callee.Register(procName, handler, nil); err == nil {
+		t.Fatal("expected error registering procedure twice")
+	}
+
+	ctx := context.Background()
+	result, err := caller.Call(ctx, procName, nil, wamp.List{1}, nil, "")
+	if err != nil {
+		t.Fatal("failed to call procedure:", err)
+	}
+	if result.Arguments[0] != 1 {
+		t.Fatal("wrong result:", result.Arguments)
+	}
+
+	// Error result from handler is returned to caller as ERROR.
+	_, err = caller.Call(ctx, procName, nil, nil, nil, "")
+	rpcErr, ok := err.(RPCError)
+	if !ok {
+		t.Fatal("expected RPCError, got:", err)
+	}
+	if rpcErr.Err.Error != wamp.ErrInvalidArgument {
+		t.Fatal("wrong error URI:", rpcErr.Err.Error)
+	}
+	if len(rpcErr.Err.Arguments) == 0 || rpcErr.Err.Arguments[0] != "missing argument" {
+		t.Fatal("wrong error arguments:", rpcErr.Err.Arguments)
+	}
+
+	if err = callee.Unregister(procName); err != nil {
+		t.Fatal("failed to unregister procedure:", err)
+	}
+	callee.sess.Lock()
+	_, ok = callee.procOptions[procName]
+	callee.sess.Unlock()
+	if ok {
+		t.Fatal("registration options not removed")
+	}
+	if err = callee.Unregister(procName); err != ErrNotRegistered {
+		t.Fatal("expected ErrNotRegistered, got:", err)
+	}
+
+	caller.Close()
+	callee.Close()
+	r.Close()
+}
+
 func TestProgressiveCall(t *testing.T) {
 	// Connect two clients to the same server
 	callee, caller, r, err := connectedTestClients()
@@ -552,6 +628,215 @@ func TestCancelRemoteProcedureCall(t *testing.T) {
 	r.Close()
 }
 
+func TestCallEchoAndKill(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	// Connect two clients to the same server
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+
+	// Register a procedure that echoes its arguments.
+	echo := func(ctx context.Context, args wamp.List, kwargs, details wamp.Dict) *InvokeResult {
+		return &InvokeResult{Args: args, Kwargs: kwargs}
+	}
+	if err = callee.Register("nexus.test.echo", echo, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	ctx := context.Background()
+	result, err := caller.Call(ctx, "nexus.test.echo", nil, wamp.List{"hello"},
+		wamp.Dict{"name": "nexus"}, "")
+	if err != nil {
+		t.Fatal("failed to call procedure:", err)
+	}
+	if len(result.Arguments) != 1 || result.Arguments[0] != "hello" {
+		t.Fatal("wrong result args:", result.Arguments)
+	}
+	if name, _ := wamp.AsString(result.ArgumentsKw["name"]); name != "nexus" {
+		t.Fatal("wrong result kwargs:", result.ArgumentsKw)
+	}
+
+	// Register a procedure that blocks until interrupted.
+	interrupted := make(chan struct{})
+	blocker := func(ctx context.Context, args wamp.List, kwargs, details wamp.Dict) *InvokeResult {
+		<-ctx.Done()
+		close(interrupted)
+		return &InvokeResult{Err: wamp.ErrCanceled}
+	}
+	if err = callee.Register("nexus.test.block", blocker, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	// Cancel the call with mode "kill", which waits for the callee to respond
+	// to the INTERRUPT.
+	cctx, cancel := context.WithCancel(ctx)
+	errChan := make(chan error)
+	go func() {
+		_, e := caller.Call(cctx, "nexus.test.block", nil, nil, nil,
+			wamp.CancelModeKill)
+		errChan <- e
+	}()
+	select {
+	case err = <-errChan:
+		t.Fatal("call should have been blocked")
+	case <-time.After(200 * time.Millisecond):
+	}
+	cancel()
+
+	select {
+	case err = <-errChan:
+	case <-time.After(time.Second):
+		t.Fatal("call should have been canceled")
+	}
+	if err != context.Canceled {
+		t.Fatal("expected context.Canceled error, got:", err)
+	}
+	select {
+	case <-interrupted:
+	case <-time.After(time.Second):
+		t.Fatal("callee was not interrupted")
+	}
+
+	// Invalid cancel mode is an error.
+	if _, err = caller.Call(ctx, "nexus.test.echo", nil, nil, nil, "bogus"); err == nil {
+		t.Fatal("expected error for invalid cancel mode")
+	}
+
+	caller.Close()
+	callee.Close()
+	r.Close()
+}
+
+func TestReconnect(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	// Connect a client that reconnects, and a normal client.
+	callee, other, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	other.Close()
+	disconnected := make(chan struct{}, 1)
+	reconnected := make(chan struct{}, 1)
+	cfg := Config{
+		Realm:           testRealm,
+		ResponseTimeout: 500 * time.Millisecond,
+		Logger:          logger,
+		Reconnect: &ReconnectConfig{
+			MaxRetries:   3,
+			Backoff:      10 * time.Millisecond,
+			OnDisconnect: func() { disconnected <- struct{}{} },
+			OnReconnect:  func() { reconnected <- struct{}{} },
+		},
+	}
+	// Use loopback peers, since these can be safely closed while in use.
+	dial := func(context.Context) (wamp.Peer, error) {
+		cliSide, rtrSide := transport.NewLoopbackPeers(16)
+		go r.Attach(rtrSide)
+		return cliSide, nil
+	}
+	p, _ := dial(context.Background())
+	cli, err := newClient(p, cfg, dial)
+	if err != nil {
+		t.Fatal("failed to connect client:", err)
+	}
+
+	events := make(chan string, 1)
+	evtHandler := func(args wamp.List, kwargs, details wamp.Dict) {
+		s, _ := wamp.AsString(args[0])
+		events <- s
+	}
+	if err = cli.Subscribe("nexus.test.topic", evtHandler, nil); err != nil {
+		t.Fatal("subscribe error:", err)
+	}
+	echo := func(ctx context.Context, args wamp.List, kwargs, details wamp.Dict) *InvokeResult {
+		return &InvokeResult{Args: args}
+	}
+	if err = cli.Register("nexus.test.echo", echo, nil); err != nil {
+		t.Fatal("register error:", err)
+	}
+	oldID := cli.ID()
+
+	// Start a call that is in progress when the connection is lost.
+	block := func(ctx context.Context, args wamp.List, kwargs, details wamp.Dict) *InvokeResult {
+		<-ctx.Done()
+		return &InvokeResult{Err: wamp.ErrCanceled}
+	}
+	if err = callee.Register("nexus.test.block", block, nil); err != nil {
+		t.Fatal("register error:", err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		_, e := cli.Call(context.Background(), "nexus.test.block", nil, nil, nil, "")
+		errChan <- e
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Kill the transport.
+	if p, err = cli.rpeer.current(); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	select {
+	case err = <-errChan:
+		if err != ErrDisconnected {
+			t.Fatal("expected ErrDisconnected, got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call in progress did not fail on disconnect")
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("not notified of disconnect")
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second):
+		t.Fatal("not notified of reconnect")
+	}
+	if !cli.Connected() {
+		t.Fatal("client should be connected")
+	}
+	if cli.ID() == oldID {
+		t.Fatal("expected new session ID after reconnect")
+	}
+
+	// Check that subscription is restored.
+	if _, ok := cli.SubscriptionID("nexus.test.topic"); !ok {
+		t.Fatal("subscription not restored")
+	}
+	err = callee.Publish("nexus.test.topic", nil, wamp.List{"hello"}, nil)
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	select {
+	case s := <-events:
+		if s != "hello" {
+			t.Fatal("wrong event:", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not receive event after reconnect")
+	}
+
+	// Check that registration is restored.
+	result, err := callee.Call(context.Background(), "nexus.test.echo", nil,
+		wamp.List{"echo"}, nil, "")
+	if err != nil {
+		t.Fatal("call error after reconnect:", err)
+	}
+	if result.Arguments[0] != "echo" {
+		t.Fatal("wrong result:", result.Arguments)
+	}
+
+	cli.Close()
+	callee.Close()
+	r.Close()
+}
+
 func TestTimeoutRemoteProcedureCall(t *testing.T) {
 	defer leaktest.Check(t)()
 
@@ -897,6 +1182,77 @@ func TestInvocationHandlerMissedDone(t *testing.T) {
 	r.Close()
 }
 
+func TestConcurrentProgressiveCalls(t *testing.T) {
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer callee.Close()
+	defer caller.Close()
+
+	// Handler sends several progressive results that echo the call argument,
+	// followed by a final result that also echoes the argument.
+	const chunks = 5
+	handler := func(ctx context.Context, args wamp.List, kwargs, details wamp.Dict) *InvokeResult {
+		for i := 0; i < chunks; i++ {
+			if err := callee.SendProgress(ctx, wamp.List{args[0], i}, nil); err != nil {
+				return &InvokeResult{Err: "test.failed"}
+			}
+		}
+		return &InvokeResult{Args: wamp.List{args[0]}}
+	}
+	const procName = "nexus.test.progecho"
+	if err = callee.Register(procName, handler, nil); err != nil {
+		t.Fatal("Failed to register procedure:", err)
+	}
+
+	options := wamp.Dict{}
+	errs := make(chan error, 2)
+	for _, name := range []string{"a", "b"} {
+		go func(name string) {
+			var count int
+			var wrong interface{}
+			progHandler := func(result *wamp.Result) {
+				if result.Arguments[0] != name {
+					wrong = result.Arguments[0]
+					return
+				}
+				count++
+			}
+			result, err := caller.CallProgress(context.Background(), procName,
+				options, wamp.List{name}, nil, "", progHandler)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if wrong != nil {
+				errs <- fmt.Errorf("call %s got progress for %v", name, wrong)
+				return
+			}
+			if result.Arguments[0] != name {
+				errs <- fmt.Errorf("call %s got result %v", name,
+					result.Arguments[0])
+				return
+			}
+			if count != chunks {
+				errs <- fmt.Errorf("call %s got %d progressive results, "+
+					"expected %d", name, count, chunks)
+				return
+			}
+			errs <- nil
+		}(name)
+	}
+	for i := 0; i < 2; i++ {
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(options) != 0 {
+		t.Fatal("caller's call options were modified:", options)
+	}
+}
+
 func TestProgressDisconnect(t *testing.T) {
 	defer leaktest.Check(t)()
 
@@ -976,9 +1332,15 @@ func TestProgressDisconnect(t *testing.T) {
 	r.Close()
 	close(disconnected)
 
-	// Check for expected error from caller.
+	// Check for expected error from caller.  The router cancels the pending
+	// call when it closes, unless the connection is lost first.
 	err = <-progErr
-	if err != ErrNotConn {
+	if rpcErr, ok := err.(RPCError); ok {
+		if rpcErr.Err.Error != wamp.ErrSystemShutdown {
+			t.Fatalf("expected %s from caller, got %s", wamp.ErrSystemShutdown,
+				rpcErr.Err.Error)
+		}
+	} else if err != ErrNotConn {
 		t.Fatalf("expected error from caller: %q got %q", ErrNotConn, err)
 	}
 
@@ -988,3 +1350,91 @@ func TestProgressDisconnect(t *testing.T) {
 		t.Fatalf("wrong error from SendProgress: %s", err)
 	}
 }
+
+func TestHeartbeat(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := getTestRouter(&router.RealmConfig{
+		URI:               wamp.URI(testRealm),
+		AnonymousAuth:     true,
+		HeartbeatInterval: 20 * time.Millisecond,
+		HeartbeatGrace:    20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	c, err := newTestClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Client stays connected while idle, because it sends heartbeats.
+	select {
+	case <-c.Done():
+		t.Fatal("idle client was disconnected")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestConnectLocalTrusted(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := getTestRouter(&router.RealmConfig{
+		URI:              wamp.URI(testRealm),
+		AnonymousAuth:    true,
+		RequireLocalAuth: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	closer, err := router.NewWebsocketServer(r).ListenAndServe(testAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	cfg := Config{
+		Realm:           testRealm,
+		ResponseTimeout: time.Second,
+		Logger:          logger,
+	}
+	callee, err := ConnectLocalTrusted(r, cfg, "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer callee.Close()
+	echo := func(ctx context.Context, args wamp.List, kwargs, details wamp.Dict) *InvokeResult {
+		return &InvokeResult{Args: args}
+	}
+	if err = callee.Register("nexus.test.echo", echo, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	caller, err := ConnectNet("ws://"+testAddress+"/", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	ctx := context.Background()
+	result, err := caller.Call(ctx, "nexus.test.echo", nil, wamp.List{"hello"}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Arguments) == 0 || result.Arguments[0] != "hello" {
+		t.Fatal("wrong result:", result.Arguments)
+	}
+
+	// Callee has the trusted authrole, even though the realm requires local
+	// clients to authenticate.
+	result, err = caller.Call(ctx, string(wamp.MetaProcSessionGet), nil, wamp.List{callee.ID()}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	details, _ := wamp.AsDict(result.Arguments[0])
+	if authrole, _ := wamp.AsString(details["authrole"]); authrole != "service" {
+		t.Fatal("expected authrole service, got", details["authrole"])
+	}
+}
@@ -54,6 +54,10 @@ type Config struct {
 
 	// Websocket transport configuration.
 	WsCfg transport.WebsocketConfig
+
+	// Reconnect, if not nil, configures the client to reconnect to the router
+	// when the connection is lost.  See ReconnectConfig.
+	Reconnect *ReconnectConfig
 }
 
 // Deprecated: replaced by Config
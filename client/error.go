@@ -5,6 +5,7 @@ import "errors"
 var (
 	ErrAlreadyClosed = errors.New("already closed")
 	ErrCallerNoProg  = errors.New("caller not accepting progressive results")
+	ErrDisconnected  = errors.New("disconnected from router")
 	ErrNotConn       = errors.New("not connected")
 	ErrNotRegistered = errors.New("not registered for procedure")
 	ErrNotSubscribed = errors.New("not subscribed to topic")
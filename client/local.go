@@ -1,11 +1,13 @@
 package client
 
 import (
+	"context"
 	"log"
 	"os"
 
 	"github.com/gammazero/nexus/router"
 	"github.com/gammazero/nexus/transport"
+	"github.com/gammazero/nexus/wamp"
 )
 
 // ConnectLocal creates a new client directly connected to the router instance.
@@ -17,13 +19,43 @@ func ConnectLocal(router router.Router, cfg Config) (*Client, error) {
 	if cfg.Logger == nil {
 		cfg.Logger = log.New(os.Stderr, "", 0)
 	}
-	localSide, routerSide := transport.LinkedPeers()
+	dial := func(context.Context) (wamp.Peer, error) {
+		localSide, routerSide := transport.LinkedPeers()
 
-	go func() {
-		if err := router.Attach(routerSide); err != nil {
-			cfg.Logger.Print(err)
-		}
-	}()
+		go func() {
+			if err := router.Attach(routerSide); err != nil {
+				cfg.Logger.Print(err)
+			}
+		}()
+		return localSide, nil
+	}
+
+	localSide, _ := dial(context.Background())
+	return newClient(localSide, cfg, dial)
+}
+
+// ConnectLocalTrusted creates a new client directly connected to the router
+// instance, the same as ConnectLocal, but the client is not authenticated even
+// if the realm requires local clients to authenticate.  The client's session
+// is given the specified authrole, or "trusted" if authrole is empty.
+//
+// This is used to connect built-in services, such as server-side callees and
+// subscribers, that are part of the same application as the router.
+func ConnectLocalTrusted(router router.Router, cfg Config, authrole string) (*Client, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = log.New(os.Stderr, "", 0)
+	}
+	dial := func(context.Context) (wamp.Peer, error) {
+		localSide, routerSide := transport.LinkedPeers()
+
+		go func() {
+			if _, err := router.AttachLocal(routerSide, authrole); err != nil {
+				cfg.Logger.Print(err)
+			}
+		}()
+		return localSide, nil
+	}
 
-	return NewClient(localSide, cfg)
+	localSide, _ := dial(context.Background())
+	return newClient(localSide, cfg, dial)
 }
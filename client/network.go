@@ -41,6 +41,18 @@ func ConnectNetContext(ctx context.Context, routerURL string, cfg Config) (*Clie
 		cfg.Logger = log.New(os.Stderr, "", 0)
 	}
 
+	p, err := dialNet(ctx, routerURL, cfg)
+	if err != nil {
+		return nil, err
+	}
+	dial := func(ctx context.Context) (wamp.Peer, error) {
+		return dialNet(ctx, routerURL, cfg)
+	}
+	return newClient(p, cfg, dial)
+}
+
+// dialNet connects a new peer to the router at routerURL.
+func dialNet(ctx context.Context, routerURL string, cfg Config) (wamp.Peer, error) {
 	u, err := url.Parse(routerURL)
 	if err != nil {
 		return nil, err
@@ -74,7 +86,7 @@ func ConnectNetContext(ctx context.Context, routerURL string, cfg Config) (*Clie
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(p, cfg)
+	return p, nil
 }
 
 // CookieURL takes a websocket URL string and outputs a url.URL that can be
@@ -0,0 +1,289 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+const (
+	defaultReconnectBackoff    = time.Second
+	defaultReconnectMaxBackoff = 30 * time.Second
+)
+
+// ReconnectConfig configures a client to automatically reconnect to the router
+// when the connection to the router is lost.
+//
+// When the connection is lost, any calls and other requests waiting for a
+// reply from the router fail with ErrDisconnected, and running invocation
+// handlers are canceled.  The client then reconnects, joins the realm again,
+// and restores its subscriptions and registrations.  The client's session ID
+// changes, as do the IDs of its subscriptions and registrations.
+//
+// Receiving a GOODBYE from the router does not cause the client to reconnect,
+// since this is a deliberate end of the session.
+//
+// Reconnection is only available to clients created using ConnectNet() or
+// ConnectLocal(), since these know how to connect to the router again.
+type ReconnectConfig struct {
+	// MaxRetries is the number of times to try to reconnect each time the
+	// connection is lost.  A value of 0 means retry forever.  If all retries
+	// fail, then the client is closed.
+	MaxRetries int
+
+	// Backoff is the time to wait before the first reconnect attempt.  The
+	// wait doubles after each failed attempt, up to MaxBackoff.  Zero values
+	// use defaults of 1 second and 30 seconds.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// OnDisconnect, if set, is called when the connection to the router is
+	// lost and the client is about to reconnect.
+	OnDisconnect func()
+
+	// OnReconnect, if set, is called when the client has reconnected and has
+	// restored its subscriptions and registrations.
+	OnReconnect func()
+}
+
+// dialFunc creates a new peer connected to the router.
+type dialFunc func(context.Context) (wamp.Peer, error)
+
+// reconnectPeer is the peer of a client that is able to reconnect.  It gives
+// the client a Recv channel that stays open across connections, and forwards
+// messages received from the current connection to that channel.  While there
+// is no connection, sending returns ErrDisconnected.
+type reconnectPeer struct {
+	mu     sync.RWMutex
+	peer   wamp.Peer
+	closed bool
+
+	rd   chan wamp.Message
+	lost chan struct{}
+	done <-chan struct{}
+}
+
+func newReconnectPeer(p wamp.Peer, done <-chan struct{}) *reconnectPeer {
+	rp := &reconnectPeer{
+		rd:   make(chan wamp.Message),
+		lost: make(chan struct{}),
+		done: done,
+	}
+	rp.setPeer(p)
+	return rp
+}
+
+// setPeer makes p the current connection, and starts forwarding messages from
+// it.  If the reconnectPeer is already closed, then p is closed.
+func (rp *reconnectPeer) setPeer(p wamp.Peer) {
+	rp.mu.Lock()
+	if rp.closed {
+		rp.mu.Unlock()
+		p.Close()
+		return
+	}
+	rp.peer = p
+	rp.mu.Unlock()
+	go rp.forward(p)
+}
+
+// forward sends messages received from p to the Recv channel.  When p's Recv
+// channel is closed, this signals that the connection is lost, unless the
+// reconnectPeer is closed.
+func (rp *reconnectPeer) forward(p wamp.Peer) {
+	recv := p.Recv()
+	for {
+		select {
+		case msg, ok := <-recv:
+			if !ok {
+				rp.mu.Lock()
+				rp.peer = nil
+				closed := rp.closed
+				rp.mu.Unlock()
+				if closed {
+					return
+				}
+				select {
+				case rp.lost <- struct{}{}:
+				case <-rp.done:
+				}
+				return
+			}
+			select {
+			case rp.rd <- msg:
+			case <-rp.done:
+				return
+			}
+		case <-rp.done:
+			return
+		}
+	}
+}
+
+func (rp *reconnectPeer) current() (wamp.Peer, error) {
+	rp.mu.RLock()
+	p := rp.peer
+	rp.mu.RUnlock()
+	if p == nil {
+		return nil, ErrDisconnected
+	}
+	return p, nil
+}
+
+func (rp *reconnectPeer) Recv() <-chan wamp.Message { return rp.rd }
+
+func (rp *reconnectPeer) Send(msg wamp.Message) error {
+	p, err := rp.current()
+	if err != nil {
+		return err
+	}
+	return p.Send(msg)
+}
+
+func (rp *reconnectPeer) SendCtx(ctx context.Context, msg wamp.Message) error {
+	p, err := rp.current()
+	if err != nil {
+		return err
+	}
+	return p.SendCtx(ctx, msg)
+}
+
+func (rp *reconnectPeer) TrySend(msg wamp.Message) error {
+	p, err := rp.current()
+	if err != nil {
+		return err
+	}
+	return p.TrySend(msg)
+}
+
+// Close closes the current connection and prevents any new connection.
+func (rp *reconnectPeer) Close() {
+	rp.mu.Lock()
+	p := rp.peer
+	rp.peer = nil
+	rp.closed = true
+	rp.mu.Unlock()
+	if p != nil {
+		p.Close()
+	}
+}
+
+// runDisconnected handles the loss of the connection to the router.  Requests
+// waiting for replies are failed, invocation handlers are canceled, and a
+// goroutine is started to reconnect.
+func (c *Client) runDisconnected() {
+	c.sess.Lock()
+	for id, wait := range c.awaitingReply {
+		delete(c.awaitingReply, id)
+		close(wait)
+	}
+	for _, cancel := range c.invHandlerKill {
+		cancel()
+	}
+	c.sess.Unlock()
+
+	c.log.Println("Client", c.sess, "lost connection to router")
+	go c.reconnect()
+}
+
+// reconnect connects to the router again, retrying with backoff, and then
+// restores subscriptions and registrations.  If all retries fail, the client
+// is closed.
+func (c *Client) reconnect() {
+	cfg := c.reconnCfg
+	if cfg.OnDisconnect != nil {
+		cfg.OnDisconnect()
+	}
+	backoff := cfg.Backoff
+	if backoff <= 0 {
+		backoff = defaultReconnectBackoff
+	}
+	maxBackoff := cfg.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultReconnectMaxBackoff
+	}
+
+	for try := 1; cfg.MaxRetries == 0 || try <= cfg.MaxRetries; try++ {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-c.Done():
+			timer.Stop()
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		p, err := c.dial(c.ctx)
+		if err != nil {
+			c.log.Println("Reconnect attempt", try, "failed:", err)
+			continue
+		}
+		welcome, err := joinRealm(p, c.cfg)
+		if err != nil {
+			p.Close()
+			c.log.Println("Reconnect attempt", try, "failed:", err)
+			continue
+		}
+		c.sess.Lock()
+		c.sess.ID = welcome.ID
+		c.sess.Unlock()
+		c.rpeer.setPeer(p)
+		if c.debug {
+			c.log.Println("Client", c.sess, "reconnected to router")
+		}
+
+		c.restore()
+		if cfg.OnReconnect != nil {
+			cfg.OnReconnect()
+		}
+		return
+	}
+
+	c.log.Println("Client", c.sess, "failed to reconnect to router")
+	c.sess.EndRecv(nil)
+}
+
+// restore subscribes and registers again, using the handlers and options
+// from the previous connection.
+func (c *Client) restore() {
+	type subscription struct {
+		fn      EventHandler
+		options wamp.Dict
+	}
+	type registration struct {
+		fn      InvocationHandler
+		options wamp.Dict
+	}
+
+	c.sess.Lock()
+	subs := make(map[string]subscription, len(c.topicSubID))
+	for topic, subID := range c.topicSubID {
+		subs[topic] = subscription{c.eventHandlers[subID], c.subOptions[topic]}
+	}
+	regs := make(map[string]registration, len(c.nameProcID))
+	for proc, regID := range c.nameProcID {
+		regs[proc] = registration{c.invHandlers[regID], c.procOptions[proc]}
+	}
+	c.eventHandlers = map[wamp.ID]EventHandler{}
+	c.topicSubID = map[string]wamp.ID{}
+	c.subOptions = map[string]wamp.Dict{}
+	c.invHandlers = map[wamp.ID]InvocationHandler{}
+	c.nameProcID = map[string]wamp.ID{}
+	c.procOptions = map[string]wamp.Dict{}
+	c.sess.Unlock()
+
+	for topic, sub := range subs {
+		if err := c.Subscribe(topic, sub.fn, sub.options); err != nil {
+			c.log.Println("Failed to restore subscription to", topic, ":", err)
+		}
+	}
+	for proc, reg := range regs {
+		if err := c.Register(proc, reg.fn, reg.options); err != nil {
+			c.log.Println("Failed to restore registration of", proc, ":", err)
+		}
+	}
+}
@@ -23,6 +23,8 @@ type Config struct {
 		EnableCompression bool `json:"enable_compression"`
 		// Enable sending cookie to identify client in later connections.
 		EnableTrackingCookie bool `json:"enable_tracking_cookie"`
+		// Name of tracking cookie.  Default = "nexus-wamp-cookie".
+		TrackingCookieName string `json:"tracking_cookie_name"`
 		// Enable reading HTTP header from client requests.
 		EnableRequestCapture bool `json:"enable_request_capture"`
 		// Allow origins that match these glob patterns when an origin header
@@ -30,6 +32,9 @@ type Config struct {
 		AllowOrigins []string `json:"allow_origins"`
 		// Limit on number of pending messages to send to each client.
 		OutQueueSize int `json:"out_queue_size"`
+		// Serializers, by name, in order of preference.  If set, clients
+		// that offer none of these are rejected.
+		SerializerPreference []string `json:"serializer_preference"`
 	}
 
 	// RawSocket configuration parameters.
@@ -74,5 +79,18 @@ func LoadConfig(path string) *Config {
 	if config.RawSocket.TCPKeepAliveInterval != 0 {
 		config.RawSocket.TCPKeepAliveInterval *= time.Second
 	}
+	if config.Router.HelloTimeout != nil {
+		*config.Router.HelloTimeout *= time.Second
+	}
+	for _, realmConfig := range config.Router.RealmConfigs {
+		realmConfig.MaxCallTimeout *= time.Second
+		realmConfig.HeartbeatInterval *= time.Second
+		realmConfig.HeartbeatGrace *= time.Second
+	}
+	if config.Router.RealmTemplate != nil {
+		config.Router.RealmTemplate.MaxCallTimeout *= time.Second
+		config.Router.RealmTemplate.HeartbeatInterval *= time.Second
+		config.Router.RealmTemplate.HeartbeatGrace *= time.Second
+	}
 	return &config
 }
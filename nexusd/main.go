@@ -66,7 +66,7 @@ func main() {
 		}
 		if conf.WebSocket.EnableTrackingCookie {
 			wss.EnableTrackingCookie = true
-			logger.Printf("Tracking cookie enabled - not currently used")
+			wss.TrackingCookieName = conf.WebSocket.TrackingCookieName
 		}
 		if conf.WebSocket.EnableRequestCapture {
 			wss.EnableRequestCapture = true
@@ -89,6 +89,11 @@ func main() {
 			wss.OutQueueSize = conf.WebSocket.OutQueueSize
 			logger.Printf("Websocket outbound queue size: %d", wss.OutQueueSize)
 		}
+		if len(conf.WebSocket.SerializerPreference) != 0 {
+			wss.SerializerPreference = conf.WebSocket.SerializerPreference
+			logger.Println("Websocket serializer preference:",
+				strings.Join(wss.SerializerPreference, ", "))
+		}
 		var closer io.Closer
 		var sockDesc string
 		if conf.WebSocket.CertFile != "" && conf.WebSocket.KeyFile != "" {
@@ -0,0 +1,15 @@
+/*
+Package nexustest provides a harness for tests that use a nexus router and
+clients.  The harness runs an in-memory router with a single realm, connects
+clients to it over loopback peers, and provides helpers that publish,
+subscribe, and call procedures synchronously, failing the test if the router
+does not respond in time.
+
+	h := nexustest.New(t, nil)
+	defer h.Close()
+
+	sub := h.Subscribe(h.Client(), "com.example.topic", nil)
+	h.Publish(h.Client(), "com.example.topic", wamp.List{"hello"}, nil)
+	event := sub.Next()
+*/
+package nexustest
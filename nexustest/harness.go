@@ -0,0 +1,239 @@
+package nexustest
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/client"
+	"github.com/gammazero/nexus/router"
+	"github.com/gammazero/nexus/stdlog"
+	"github.com/gammazero/nexus/transport"
+	"github.com/gammazero/nexus/wamp"
+)
+
+const (
+	// DefaultRealm is the URI of the realm created when New is not given a
+	// realm configuration.
+	DefaultRealm = "nexus.test"
+
+	// DefaultTimeout is how long the helpers wait for the router to respond,
+	// unless Harness.Timeout is changed.
+	DefaultTimeout = 2 * time.Second
+
+	// peerQueueSize is the number of messages buffered in each direction
+	// between a client and the router.
+	peerQueueSize = 256
+
+	// eventQueueSize is the number of events buffered for a Subscription.
+	eventQueueSize = 256
+)
+
+// Harness is an in-memory router with a single realm, and the clients
+// connected to it.
+type Harness struct {
+	// Router is the router that clients are connected to.
+	Router router.Router
+	// Realm is the URI of the realm that clients join.
+	Realm wamp.URI
+	// Timeout is how long helpers wait for a response from the router.
+	Timeout time.Duration
+
+	t   testing.TB
+	log stdlog.StdLog
+
+	mu      sync.Mutex
+	clients []*client.Client
+}
+
+// Event is an event received by a Subscription.
+type Event struct {
+	Args    wamp.List
+	Kwargs  wamp.Dict
+	Details wamp.Dict
+}
+
+// Subscription receives the events for a subscription made by
+// Harness.Subscribe.
+type Subscription struct {
+	h      *Harness
+	topic  string
+	events chan Event
+}
+
+// New creates a router with a realm configured by realmConfig, and returns a
+// harness for connecting clients to it.  If realmConfig is nil, then the realm
+// is DefaultRealm with anonymous authentication.  Call Close when done with
+// the harness.
+//
+// Router and client logs are discarded unless tests are run in verbose mode.
+func New(t testing.TB, realmConfig *router.RealmConfig) *Harness {
+	t.Helper()
+	if realmConfig == nil {
+		realmConfig = &router.RealmConfig{
+			URI:           DefaultRealm,
+			AnonymousAuth: true,
+		}
+	}
+	var logger stdlog.StdLog
+	if testing.Verbose() {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	} else {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	r, err := router.NewRouter(&router.Config{
+		RealmConfigs: []*router.RealmConfig{realmConfig},
+	}, logger)
+	if err != nil {
+		t.Fatal("failed to create router:", err)
+	}
+	return &Harness{
+		Router:  r,
+		Realm:   realmConfig.URI,
+		Timeout: DefaultTimeout,
+		t:       t,
+		log:     logger,
+	}
+}
+
+// Close closes all clients created by the harness, and then closes the
+// router.
+func (h *Harness) Close() {
+	h.mu.Lock()
+	clients := h.clients
+	h.clients = nil
+	h.mu.Unlock()
+	for _, c := range clients {
+		c.Close()
+	}
+	h.Router.Close()
+}
+
+// Client returns a new client that has joined the harness realm.
+func (h *Harness) Client() *client.Client {
+	h.t.Helper()
+	return h.ClientWithConfig(client.Config{})
+}
+
+// ClientWithConfig returns a new client, created with the given
+// configuration, that has joined the realm.  If the configuration does not
+// specify a realm, then the client joins the harness realm.  If the client
+// cannot join the realm, then the test fails.
+func (h *Harness) ClientWithConfig(cfg client.Config) *client.Client {
+	h.t.Helper()
+	if cfg.Realm == "" {
+		cfg.Realm = string(h.Realm)
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = h.log
+	}
+	if cfg.ResponseTimeout == 0 {
+		cfg.ResponseTimeout = h.Timeout
+	}
+
+	cliSide, rtrSide := transport.NewLoopbackPeers(peerQueueSize)
+	go func() {
+		if err := h.Router.Attach(rtrSide); err != nil {
+			h.log.Println("Failed to attach client:", err)
+		}
+	}()
+	c, err := client.NewClient(cliSide, cfg)
+	if err != nil {
+		h.t.Fatal("failed to connect client:", err)
+	}
+	h.mu.Lock()
+	h.clients = append(h.clients, c)
+	h.mu.Unlock()
+	return c
+}
+
+// Subscribe subscribes the client to the topic, and returns a Subscription
+// that receives the events.  The subscription is in place when Subscribe
+// returns.
+func (h *Harness) Subscribe(c *client.Client, topic string, options wamp.Dict) *Subscription {
+	h.t.Helper()
+	sub := &Subscription{
+		h:      h,
+		topic:  topic,
+		events: make(chan Event, eventQueueSize),
+	}
+	handler := func(args wamp.List, kwargs, details wamp.Dict) {
+		sub.events <- Event{args, kwargs, details}
+	}
+	if err := c.Subscribe(topic, handler, options); err != nil {
+		h.t.Fatal("failed to subscribe to", topic, ":", err)
+	}
+	return sub
+}
+
+// Next returns the next event received by the subscription.  If no event is
+// received within the harness timeout, then the test fails.
+func (s *Subscription) Next() Event {
+	s.h.t.Helper()
+	timer := time.NewTimer(s.h.Timeout)
+	defer timer.Stop()
+	select {
+	case ev := <-s.events:
+		return ev
+	case <-timer.C:
+		s.h.t.Fatal("timed out waiting for event on", s.topic)
+	}
+	return Event{}
+}
+
+// NoEvent fails the test if the subscription receives an event within the
+// given duration.
+func (s *Subscription) NoEvent(d time.Duration) {
+	s.h.t.Helper()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case ev := <-s.events:
+		s.h.t.Fatal("unexpected event on", s.topic, ":", ev.Args)
+	case <-timer.C:
+	}
+}
+
+// Publish publishes an event to the topic, and waits for the router to
+// acknowledge the publication.  If the publication fails, then the test fails.
+func (h *Harness) Publish(c *client.Client, topic string, args wamp.List, kwargs wamp.Dict) {
+	h.t.Helper()
+	options := wamp.Dict{wamp.OptAcknowledge: true}
+	if err := c.Publish(topic, options, args, kwargs); err != nil {
+		h.t.Fatal("failed to publish to", topic, ":", err)
+	}
+}
+
+// Register registers the client to handle calls to the procedure.  The
+// registration is in place when Register returns.
+func (h *Harness) Register(c *client.Client, procedure string, fn client.InvocationHandler) {
+	h.t.Helper()
+	if err := c.Register(procedure, fn, nil); err != nil {
+		h.t.Fatal("failed to register", procedure, ":", err)
+	}
+}
+
+// Call calls the procedure and returns the result.  If the call does not
+// return a result within the harness timeout, then the test fails.
+func (h *Harness) Call(c *client.Client, procedure string, args wamp.List, kwargs wamp.Dict) *wamp.Result {
+	h.t.Helper()
+	result, err := h.CallErr(c, procedure, args, kwargs)
+	if err != nil {
+		h.t.Fatal("call to", procedure, "failed:", err)
+	}
+	return result
+}
+
+// CallErr calls the procedure and returns the result or the error returned by
+// the call, waiting no longer than the harness timeout.  Use this to test
+// calls that are expected to fail.
+func (h *Harness) CallErr(c *client.Client, procedure string, args wamp.List, kwargs wamp.Dict) (*wamp.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	return c.Call(ctx, procedure, nil, args, kwargs, "")
+}
@@ -0,0 +1,77 @@
+package nexustest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/gammazero/nexus/client"
+	"github.com/gammazero/nexus/router"
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestPubSub(t *testing.T) {
+	defer leaktest.Check(t)()
+	h := New(t, nil)
+	defer h.Close()
+
+	subscriber := h.Client()
+	publisher := h.Client()
+	sub := h.Subscribe(subscriber, "nexus.test.topic", nil)
+
+	h.Publish(publisher, "nexus.test.topic", wamp.List{"hello"}, wamp.Dict{"n": 1})
+	ev := sub.Next()
+	if len(ev.Args) != 1 || ev.Args[0] != "hello" {
+		t.Fatal("wrong event args:", ev.Args)
+	}
+	if n, _ := wamp.AsInt64(ev.Kwargs["n"]); n != 1 {
+		t.Fatal("wrong event kwargs:", ev.Kwargs)
+	}
+
+	h.Publish(publisher, "nexus.test.other", nil, nil)
+	sub.NoEvent(50 * time.Millisecond)
+}
+
+func TestRPC(t *testing.T) {
+	defer leaktest.Check(t)()
+	h := New(t, nil)
+	defer h.Close()
+
+	callee := h.Client()
+	caller := h.Client()
+	h.Register(callee, "nexus.test.sum", func(ctx context.Context, args wamp.List, kwargs, details wamp.Dict) *client.InvokeResult {
+		var sum int64
+		for i := range args {
+			n, _ := wamp.AsInt64(args[i])
+			sum += n
+		}
+		return &client.InvokeResult{Args: wamp.List{sum}}
+	})
+
+	result := h.Call(caller, "nexus.test.sum", wamp.List{1, 2, 3}, nil)
+	if sum, _ := wamp.AsInt64(result.Arguments[0]); sum != 6 {
+		t.Fatal("wrong result:", result.Arguments)
+	}
+
+	if _, err := h.CallErr(caller, "nexus.test.missing", nil, nil); err == nil {
+		t.Fatal("expected error calling unregistered procedure")
+	}
+}
+
+func TestRealmConfig(t *testing.T) {
+	defer leaktest.Check(t)()
+	h := New(t, &router.RealmConfig{
+		URI:           "nexus.test.custom",
+		AnonymousAuth: true,
+	})
+	defer h.Close()
+
+	c := h.Client()
+	if c.ID() == 0 {
+		t.Fatal("client did not join realm")
+	}
+	if _, ok := h.Router.GetRealm("nexus.test.custom"); !ok {
+		t.Fatal("realm not created")
+	}
+}
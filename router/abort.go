@@ -0,0 +1,28 @@
+package router
+
+import "github.com/gammazero/nexus/wamp"
+
+// newAbort returns an ABORT message with the given reason.  If err is not nil,
+// then its text is put in the "error" detail.
+//
+// The reason must be one of the wamp.Err or wamp.Close URI constants, so that
+// clients always see the canonical URI for each kind of abort.
+func newAbort(reason wamp.URI, err error) *wamp.Abort {
+	abort := &wamp.Abort{
+		Reason:  reason,
+		Details: wamp.Dict{},
+	}
+	if err != nil {
+		abort.Details["error"] = err.Error()
+	}
+	return abort
+}
+
+// sendAbort sends an ABORT message to a client that is being refused a
+// session, and then closes the client's peer.  Sending blocks until the
+// message is taken by the peer, so this must only be called from the
+// goroutine that is handling the client's connection.
+func sendAbort(peer wamp.Peer, reason wamp.URI, err error) {
+	peer.Send(newAbort(reason, err))
+	peer.Close()
+}
@@ -4,12 +4,13 @@ WAMP router can use.
 
 In addition in authentication and challenge-response authentication interface,
 this package provides default implementations for the following authentication
-methods: "wampcra", ticket", "anonymous".
+methods: "wampcra", "ticket", "cryptosign", "anonymous".
 
 */
 package auth
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/gammazero/nexus/wamp"
@@ -17,6 +18,35 @@ import (
 
 const defaultCRAuthTimeout = time.Minute
 
+// UnexpectedMessageError is returned by an authenticator when a client sends
+// a message other than AUTHENTICATE in response to a CHALLENGE.  This is a
+// protocol violation, unlike an AUTHENTICATE that fails to authenticate the
+// client.
+type UnexpectedMessageError struct {
+	MessageType wamp.MessageType
+}
+
+func (e *UnexpectedMessageError) Error() string {
+	return fmt.Sprintf("expected AUTHENTICATE, received %s", e.MessageType)
+}
+
+// recvAuthenticate waits for the client's AUTHENTICATE reply to a CHALLENGE.
+// An error is returned if no message is received before the timeout, the
+// client aborts, or the client sends any other message.
+func recvAuthenticate(client wamp.Peer, timeout time.Duration) (*wamp.Authenticate, error) {
+	msg, err := wamp.RecvTimeout(client, timeout)
+	if err != nil {
+		return nil, err
+	}
+	switch msg := msg.(type) {
+	case *wamp.Authenticate:
+		return msg, nil
+	case *wamp.Abort:
+		return nil, fmt.Errorf("client aborted authentication: %s", msg.Reason)
+	}
+	return nil, &UnexpectedMessageError{MessageType: msg.MessageType()}
+}
+
 // Authenticator is implemented by a type that handles authentication using
 // only the HELLO message.
 type Authenticator interface {
@@ -34,6 +64,20 @@ type Authenticator interface {
 	//     details.transport.auth.cookie|*http.Cookie
 	//     details.transport.auth.nextcookie|*http.Cookie
 	//
+	// If the client is a websocket peer connected using TLS, and presented a
+	// client certificate, then the certificate subject is available as:
+	//
+	//     details.transport.auth.client_cert_subject|string
+	//
+	// Websocket and rawsocket servers also provide these transport details,
+	// where peer_cert is only present when the client presented a TLS
+	// certificate, and http_headers_received only for websocket clients:
+	//
+	//     details.transport.type|string
+	//     details.transport.peer|string
+	//     details.transport.peer_cert|dict
+	//     details.transport.http_headers_received|dict
+	//
 	// The tracking cookie can be used to tell if a client was previously
 	// connected to the router, and look up information about that client, such
 	// as whether it was successfully authenticated.
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// CookieAuthMethod is the authmethod a client requests to be authenticated
+// by the tracking cookie from its websocket upgrade request.
+const CookieAuthMethod = "cookie"
+
+// CookieStore remembers the authid and authrole of authenticated clients,
+// keyed by the value of the tracking cookie issued to each client by the
+// websocket server.  A returning client that requests the "cookie" authmethod
+// and presents a remembered cookie is authenticated as the stored authid and
+// authrole, without using any other authentication method.
+//
+// The websocket server must have tracking cookies enabled for clients to be
+// issued cookies.  A CookieStore must be safe for concurrent use.
+type CookieStore interface {
+	// Lookup returns the authid and authrole stored for the cookie value.  If
+	// the cookie value is not recognized, then ok is false.
+	Lookup(cookie string) (authid, authrole string, ok bool)
+
+	// Store records the authid and authrole for a cookie value.  This is
+	// called with the next tracking cookie issued to a client each time the
+	// client is successfully authenticated.
+	Store(cookie, authid, authrole string)
+}
+
+// TrackingCookies returns the value of the tracking cookie from the client's
+// websocket upgrade request, and the value of the next tracking cookie issued
+// to the client.  A value is empty if it is not present in the HELLO details.
+func TrackingCookies(details wamp.Dict) (cookie, nextCookie string) {
+	return cookieValue(details, "cookie"), cookieValue(details, "nextcookie")
+}
+
+func cookieValue(details wamp.Dict, name string) string {
+	v, err := wamp.DictValue(details, []string{"transport", "auth", name})
+	if err != nil {
+		return ""
+	}
+	ck, ok := v.(*http.Cookie)
+	if !ok || ck == nil {
+		return ""
+	}
+	return ck.Value
+}
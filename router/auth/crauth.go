@@ -95,15 +95,10 @@ func (cr *CRAuthenticator) Authenticate(sid wamp.ID, details wamp.Dict, client w
 	}
 
 	// Read AUTHENTICATE response from client.
-	msg, err := wamp.RecvTimeout(client, cr.timeout)
+	authRsp, err := recvAuthenticate(client, cr.timeout)
 	if err != nil {
 		return nil, err
 	}
-	authRsp, ok := msg.(*wamp.Authenticate)
-	if !ok {
-		return nil, fmt.Errorf("unexpected %v message received from client %v",
-			msg.MessageType(), client)
-	}
 
 	// Check signature.
 	if !crsign.VerifySignature(authRsp.Signature, chStr, key) {
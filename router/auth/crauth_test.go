@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"crypto/sha256"
 	"errors"
 	"net/http"
 	"testing"
@@ -9,6 +10,7 @@ import (
 	"github.com/gammazero/nexus/transport"
 	"github.com/gammazero/nexus/wamp"
 	"github.com/gammazero/nexus/wamp/crsign"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 type testKeyStore struct {
@@ -187,6 +189,31 @@ func TestTicketAuth(t *testing.T) {
 	}
 }
 
+func TestRecvAuthenticateUnexpected(t *testing.T) {
+	cp, rp := transport.LinkedPeers()
+	defer cp.Close()
+	defer rp.Close()
+
+	go cp.Send(&wamp.Call{Request: 1, Procedure: "nexus.test"})
+	_, err := recvAuthenticate(rp, time.Second)
+	umErr, ok := err.(*UnexpectedMessageError)
+	if !ok {
+		t.Fatal("expected UnexpectedMessageError, got", err)
+	}
+	if umErr.MessageType != wamp.CALL {
+		t.Fatal("wrong message type in error:", umErr.MessageType)
+	}
+
+	// ABORT from client is not a protocol violation.
+	go cp.Send(&wamp.Abort{Reason: wamp.ErrCanceled, Details: wamp.Dict{}})
+	if _, err = recvAuthenticate(rp, time.Second); err == nil {
+		t.Fatal("expected error when client aborts")
+	}
+	if _, ok = err.(*UnexpectedMessageError); ok {
+		t.Fatal("client ABORT reported as unexpected message")
+	}
+}
+
 func TestCRAuth(t *testing.T) {
 	cp, rp := transport.LinkedPeers()
 	defer cp.Close()
@@ -249,3 +276,88 @@ func TestCRAuth(t *testing.T) {
 		t.Fatal("challenge failed: ", err.Error())
 	}
 }
+
+const (
+	testSalt   = "salt123"
+	testKeyLen = 32
+	testIters  = 1000
+)
+
+// saltedKeyStore stores a key derived from the user's secret using PBKDF2.
+type saltedKeyStore struct {
+	testKeyStore
+}
+
+func (ks *saltedKeyStore) AuthKey(authid, authmethod string) ([]byte, error) {
+	if authid != "jdoe" || authmethod != "wampcra" {
+		return nil, errors.New("no such user: " + authid)
+	}
+	return pbkdf2.Key([]byte(ks.secret), []byte(testSalt), testIters,
+		testKeyLen, sha256.New), nil
+}
+
+func (ks *saltedKeyStore) PasswordInfo(authid string) (string, int, int) {
+	return testSalt, testKeyLen, testIters
+}
+
+func TestCRAuthSalted(t *testing.T) {
+	cp, rp := transport.LinkedPeers()
+	defer cp.Close()
+	defer rp.Close()
+
+	// Client responds to challenge using the password in pwChan.
+	pwChan := make(chan string, 1)
+	chChan := make(chan *wamp.Challenge, 1)
+	go func() {
+		for msg := range cp.Recv() {
+			ch, ok := msg.(*wamp.Challenge)
+			if !ok {
+				continue
+			}
+			chChan <- ch
+			cp.Send(&wamp.Authenticate{
+				Signature: crsign.RespondChallenge(<-pwChan, ch, nil),
+				Extra:     wamp.Dict{},
+			})
+		}
+	}()
+
+	ks := &saltedKeyStore{testKeyStore{provider: "static", secret: goodSecret}}
+	crAuth := NewCRAuthenticator(ks, time.Second)
+	details := wamp.Dict{"authid": "jdoe"}
+
+	// Correct password.
+	pwChan <- goodSecret
+	welcome, err := crAuth.Authenticate(wamp.ID(212), details, rp)
+	if err != nil {
+		t.Fatal("challenge failed: ", err.Error())
+	}
+	if s, _ := wamp.AsString(welcome.Details["authrole"]); s != "user" {
+		t.Fatal("incorrect authrole in welcome details")
+	}
+	ch := <-chChan
+	if s, _ := wamp.AsString(ch.Extra["salt"]); s != testSalt {
+		t.Fatal("missing salt in challenge extra")
+	}
+	if n, _ := wamp.AsInt64(ch.Extra["keylen"]); n != testKeyLen {
+		t.Fatal("wrong keylen in challenge extra")
+	}
+	if n, _ := wamp.AsInt64(ch.Extra["iterations"]); n != testIters {
+		t.Fatal("wrong iterations in challenge extra")
+	}
+
+	// Wrong password.
+	pwChan <- "wrong"
+	if _, err = crAuth.Authenticate(wamp.ID(213), details, rp); err == nil {
+		t.Fatal("expected error with wrong password")
+	}
+	<-chChan
+
+	// Unknown authid still gets a challenge, but cannot authenticate.
+	pwChan <- goodSecret
+	details["authid"] = "unknown"
+	if _, err = crAuth.Authenticate(wamp.ID(214), details, rp); err == nil {
+		t.Fatal("expected error from unknown authid")
+	}
+	<-chChan
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Size of the random challenge sent to the client.
+const cryptosignChallengeSize = 32
+
+// CryptoSignAuthenticator implements WAMP-Cryptosign authentication, where the
+// client proves possession of an ed25519 private key by signing a challenge.
+//
+// The authorized public key for a user is looked up by calling
+// KeyStore.AuthKey with the authid and the "cryptosign" authmethod.  AuthKey
+// must return the raw 32-byte ed25519 public key.  If the client supplies its
+// public key in HELLO.Details.authextra.pubkey, then that key must match the
+// one from the KeyStore.
+type CryptoSignAuthenticator struct {
+	keyStore KeyStore
+	timeout  time.Duration
+}
+
+// NewCryptoSignAuthenticator creates a new CryptoSignAuthenticator with the
+// given key store and the maximum time to wait for a client to respond to a
+// CHALLENGE message.
+func NewCryptoSignAuthenticator(keyStore KeyStore, timeout time.Duration) *CryptoSignAuthenticator {
+	return &CryptoSignAuthenticator{
+		keyStore: keyStore,
+		timeout:  timeout,
+	}
+}
+
+func (cs *CryptoSignAuthenticator) AuthMethod() string { return "cryptosign" }
+
+func (cs *CryptoSignAuthenticator) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	authid, _ := wamp.AsString(details["authid"])
+	if authid == "" {
+		return nil, errors.New("missing authid")
+	}
+
+	authrole, err := cs.keyStore.AuthRole(authid)
+	if err != nil {
+		// Do not error here since that leaks authid info.
+		authrole = "user"
+	}
+
+	// Get the authorized public key for the user.  Do not return error here
+	// since that leaks authid info.  Instead, set the key to nil which will
+	// prevent it from authenticating.
+	pubkey, err := cs.keyStore.AuthKey(authid, cs.AuthMethod())
+	if err != nil || len(pubkey) != ed25519.PublicKeySize {
+		pubkey = nil
+	}
+
+	// If the client announced its public key, it must be the authorized key.
+	if pkStr, ok := wamp.DictString(details, "authextra", "pubkey"); ok {
+		pk, err := hex.DecodeString(pkStr)
+		if err != nil || !bytes.Equal(pk, pubkey) {
+			pubkey = nil
+		}
+	}
+
+	challenge := make([]byte, cryptosignChallengeSize)
+	if _, err = rand.Read(challenge); err != nil {
+		return nil, fmt.Errorf("failed to create challenge: %s", err)
+	}
+
+	// Challenge response needed.  Send CHALLENGE message to client.
+	err = client.Send(&wamp.Challenge{
+		AuthMethod: cs.AuthMethod(),
+		Extra:      wamp.Dict{"challenge": hex.EncodeToString(challenge)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Read AUTHENTICATE response from client.
+	authRsp, err := recvAuthenticate(client, cs.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check signature.
+	if pubkey == nil || !verifyCryptoSign(authRsp.Signature, challenge, pubkey) {
+		return nil, errors.New("invalid signature")
+	}
+
+	// Create welcome message containing auth info.
+	welcome := &wamp.Welcome{
+		Details: wamp.Dict{
+			"authid":       authid,
+			"authrole":     authrole,
+			"authmethod":   cs.AuthMethod(),
+			"authprovider": cs.keyStore.Provider(),
+		},
+	}
+
+	if ks, ok := cs.keyStore.(BypassKeyStore); ok {
+		// Tell the keystore that the client was authenticated, and provide the
+		// transport details if available.
+		if err = ks.OnWelcome(authid, welcome, details); err != nil {
+			return nil, err
+		}
+	}
+	return welcome, nil
+}
+
+// verifyCryptoSign checks the hex-encoded signature from an AUTHENTICATE
+// message.  The signature is the 64-byte ed25519 signature, optionally
+// followed by the 32-byte challenge that was signed.
+func verifyCryptoSign(sigStr string, challenge []byte, pubkey ed25519.PublicKey) bool {
+	sig, err := hex.DecodeString(sigStr)
+	if err != nil {
+		return false
+	}
+	switch len(sig) {
+	case ed25519.SignatureSize:
+	case ed25519.SignatureSize + len(challenge):
+		if !bytes.Equal(sig[ed25519.SignatureSize:], challenge) {
+			return false
+		}
+		sig = sig[:ed25519.SignatureSize]
+	default:
+		return false
+	}
+	return ed25519.Verify(pubkey, challenge, sig)
+}
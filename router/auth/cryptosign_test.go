@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/transport"
+	"github.com/gammazero/nexus/wamp"
+	"golang.org/x/crypto/ed25519"
+)
+
+type csKeyStore struct {
+	pubkey ed25519.PublicKey
+}
+
+func (ks *csKeyStore) AuthKey(authid, authmethod string) ([]byte, error) {
+	if authid != "jdoe" || authmethod != "cryptosign" {
+		return nil, errors.New("no such user: " + authid)
+	}
+	return ks.pubkey, nil
+}
+
+func (ks *csKeyStore) AuthRole(authid string) (string, error) {
+	if authid != "jdoe" {
+		return "", errors.New("no such user: " + authid)
+	}
+	return "user", nil
+}
+
+func (ks *csKeyStore) PasswordInfo(authid string) (string, int, int) {
+	return "", 0, 0
+}
+
+func (ks *csKeyStore) Provider() string { return "static" }
+
+// csClient responds to cryptosign challenges by signing them with the key
+// received on keyChan.
+func csClient(p wamp.Peer, keyChan <-chan ed25519.PrivateKey) {
+	for msg := range p.Recv() {
+		ch, ok := msg.(*wamp.Challenge)
+		if !ok {
+			continue
+		}
+		key := <-keyChan
+		chStr, _ := wamp.AsString(ch.Extra["challenge"])
+		challenge, _ := hex.DecodeString(chStr)
+		sig := ed25519.Sign(key, challenge)
+		p.Send(&wamp.Authenticate{
+			Signature: hex.EncodeToString(append(sig, challenge...)),
+			Extra:     wamp.Dict{},
+		})
+	}
+}
+
+func TestCryptoSignAuth(t *testing.T) {
+	cp, rp := transport.LinkedPeers()
+	defer cp.Close()
+	defer rp.Close()
+	keyChan := make(chan ed25519.PrivateKey, 1)
+	go csClient(cp, keyChan)
+
+	pubkey, privkey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csAuth := NewCryptoSignAuthenticator(&csKeyStore{pubkey: pubkey}, time.Second)
+	sid := wamp.ID(212)
+
+	// Test with missing authid
+	if _, err = csAuth.Authenticate(sid, wamp.Dict{}, rp); err == nil {
+		t.Fatal("expected error with missing authid")
+	}
+
+	// Test with known authid and correct key.
+	details := wamp.Dict{
+		"authid":    "jdoe",
+		"authextra": wamp.Dict{"pubkey": hex.EncodeToString(pubkey)},
+	}
+	keyChan <- privkey
+	welcome, err := csAuth.Authenticate(sid, details, rp)
+	if err != nil {
+		t.Fatal("challenge failed: ", err.Error())
+	}
+	if s, _ := wamp.AsString(welcome.Details["authmethod"]); s != "cryptosign" {
+		t.Fatal("invalid authmethod in welcome details")
+	}
+	if s, _ := wamp.AsString(welcome.Details["authrole"]); s != "user" {
+		t.Fatal("incorrect authrole in welcome details")
+	}
+
+	// Test signing with mismatched key.
+	keyChan <- otherPriv
+	if _, err = csAuth.Authenticate(sid, details, rp); err == nil {
+		t.Fatal("expected error with mismatched key")
+	}
+
+	// Test announcing a public key that is not authorized.
+	details["authextra"] = wamp.Dict{"pubkey": hex.EncodeToString(otherPub)}
+	keyChan <- otherPriv
+	if _, err = csAuth.Authenticate(sid, details, rp); err == nil {
+		t.Fatal("expected error with unknown pubkey")
+	}
+
+	// Test with unknown authid.
+	details = wamp.Dict{"authid": "unknown"}
+	keyChan <- privkey
+	if _, err = csAuth.Authenticate(sid, details, rp); err == nil {
+		t.Fatal("expected error from unknown authid")
+	}
+}
+
+func TestVerifyCryptoSign(t *testing.T) {
+	pubkey, privkey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := make([]byte, cryptosignChallengeSize)
+	challenge[0] = 1
+	sig := ed25519.Sign(privkey, challenge)
+
+	if !verifyCryptoSign(hex.EncodeToString(sig), challenge, pubkey) {
+		t.Error("signature without challenge did not verify")
+	}
+	if !verifyCryptoSign(hex.EncodeToString(append(sig, challenge...)), challenge, pubkey) {
+		t.Error("signature with challenge did not verify")
+	}
+	if verifyCryptoSign("not-hex", challenge, pubkey) {
+		t.Error("malformed signature verified")
+	}
+	if verifyCryptoSign(hex.EncodeToString(sig[:10]), challenge, pubkey) {
+		t.Error("short signature verified")
+	}
+	other := make([]byte, cryptosignChallengeSize)
+	if verifyCryptoSign(hex.EncodeToString(append(sig, other...)), challenge, pubkey) {
+		t.Error("signature with wrong challenge verified")
+	}
+}
@@ -2,7 +2,6 @@ package auth
 
 import (
 	"errors"
-	"fmt"
 	"time"
 
 	"github.com/gammazero/nexus/wamp"
@@ -82,15 +81,10 @@ func (t *TicketAuthenticator) Authenticate(sid wamp.ID, details wamp.Dict, clien
 	}
 
 	// Read AUTHENTICATE response from client.
-	msg, err := wamp.RecvTimeout(client, t.timeout)
+	authRsp, err := recvAuthenticate(client, t.timeout)
 	if err != nil {
 		return nil, err
 	}
-	authRsp, ok := msg.(*wamp.Authenticate)
-	if !ok {
-		return nil, fmt.Errorf("unexpected %v message received from client %v",
-			msg.MessageType(), client)
-	}
 
 	// The client will send an AUTHENTICATE message containing a ticket.  The
 	// server will then check if the ticket provided is permissible (for the
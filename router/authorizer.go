@@ -1,6 +1,10 @@
 package router
 
-import "github.com/gammazero/nexus/wamp"
+import (
+	"fmt"
+
+	"github.com/gammazero/nexus/wamp"
+)
 
 // Authorizer is the interface implemented by a type that provides the ability
 // to authorize sending messages.
@@ -19,3 +23,133 @@ type Authorizer interface {
 	// certain messages sent by that session.
 	Authorize(*wamp.Session, wamp.Message) (bool, error)
 }
+
+// Actions that a URIRule may allow.
+const (
+	ActionCall      = "call"
+	ActionRegister  = "register"
+	ActionPublish   = "publish"
+	ActionSubscribe = "subscribe"
+)
+
+// URIRule allows sessions having one of the listed authroles to perform the
+// listed actions on URIs that match the rule's URI, according to the rule's
+// match policy.
+type URIRule struct {
+	// URI, or URI pattern, that the rule applies to.
+	URI wamp.URI `json:"uri"`
+	// Match policy for URI: "exact", "prefix", or "wildcard".  Default is
+	// "exact".
+	Match string `json:"match"`
+	// Authroles the rule applies to.  If empty, the rule applies to all
+	// authroles.
+	Roles []string `json:"roles"`
+	// Actions allowed by the rule: "call", "register", "publish", and
+	// "subscribe".
+	Actions []string `json:"actions"`
+}
+
+// URIAuthorizer is an Authorizer that allows CALL, REGISTER, PUBLISH, and
+// SUBSCRIBE messages only if there is a rule that allows the action on the
+// message's URI for the authrole of the sending session.  All other messages
+// are allowed.
+//
+// For a SUBSCRIBE or REGISTER with a pattern-based match policy, the rule is
+// checked against the pattern URI itself.
+type URIAuthorizer struct {
+	rules []uriRule
+}
+
+// uriRule is a validated URIRule.
+type uriRule struct {
+	uri     wamp.URI
+	match   string
+	roles   map[string]struct{}
+	actions map[string]struct{}
+}
+
+// NewURIAuthorizer creates a URIAuthorizer with the given rules.  An error is
+// returned if any rule has an invalid URI, match policy, or action.
+func NewURIAuthorizer(rules []URIRule) (*URIAuthorizer, error) {
+	a := &URIAuthorizer{rules: make([]uriRule, len(rules))}
+	for i := range rules {
+		rule := &rules[i]
+		switch rule.Match {
+		case "", wamp.MatchExact, wamp.MatchPrefix, wamp.MatchWildcard:
+		default:
+			return nil, fmt.Errorf("authz rule %d: invalid match policy: %s",
+				i, rule.Match)
+		}
+		if rule.URI == "" || !rule.URI.ValidURI(false, rule.Match) {
+			return nil, fmt.Errorf("authz rule %d: invalid URI: %s", i, rule.URI)
+		}
+		if len(rule.Actions) == 0 {
+			return nil, fmt.Errorf("authz rule %d: no actions", i)
+		}
+		r := uriRule{
+			uri:     rule.URI,
+			match:   rule.Match,
+			actions: make(map[string]struct{}, len(rule.Actions)),
+		}
+		for _, action := range rule.Actions {
+			switch action {
+			case ActionCall, ActionRegister, ActionPublish, ActionSubscribe:
+			default:
+				return nil, fmt.Errorf("authz rule %d: invalid action: %s",
+					i, action)
+			}
+			r.actions[action] = struct{}{}
+		}
+		if len(rule.Roles) != 0 {
+			r.roles = make(map[string]struct{}, len(rule.Roles))
+			for _, role := range rule.Roles {
+				r.roles[role] = struct{}{}
+			}
+		}
+		a.rules[i] = r
+	}
+	return a, nil
+}
+
+// Authorize implements Authorizer.
+func (a *URIAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	var action string
+	var uri wamp.URI
+	switch msg := msg.(type) {
+	case *wamp.Call:
+		action, uri = ActionCall, msg.Procedure
+	case *wamp.Register:
+		action, uri = ActionRegister, msg.Procedure
+	case *wamp.Publish:
+		action, uri = ActionPublish, msg.Topic
+	case *wamp.Subscribe:
+		action, uri = ActionSubscribe, msg.Topic
+	default:
+		return true, nil
+	}
+	authrole, _ := wamp.AsString(sess.Details["authrole"])
+	for i := range a.rules {
+		if a.rules[i].allows(action, uri, authrole) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *uriRule) allows(action string, uri wamp.URI, authrole string) bool {
+	if _, ok := r.actions[action]; !ok {
+		return false
+	}
+	if r.roles != nil {
+		if _, ok := r.roles[authrole]; !ok {
+			return false
+		}
+	}
+	switch r.match {
+	case wamp.MatchPrefix:
+		return uri.PrefixMatch(r.uri)
+	case wamp.MatchWildcard:
+		return uri.WildcardMatch(r.uri)
+	}
+	return uri == r.uri
+}
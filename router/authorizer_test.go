@@ -78,6 +78,92 @@ func TestAuthorizer(t *testing.T) {
 	}
 }
 
+// testPubAuthz denies publishing to denyTopic, but allows subscribing to it.
+type testPubAuthz struct{}
+
+func (a *testPubAuthz) Authorize(session *wamp.Session, msg wamp.Message) (bool, error) {
+	if m, ok := msg.(*wamp.Publish); ok && m.Topic == denyTopic {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Test that authorizer can deny a PUBLISH to a topic that may be subscribed to.
+func TestAuthorizerDenyPublish(t *testing.T) {
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				Authorizer:        &testPubAuthz{},
+				RequireLocalAuthz: true,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	sub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: denyTopic})
+	msg, err := wamp.RecvTimeout(sub, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+	}
+
+	pub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubID := wamp.GlobalID()
+	pub.Send(&wamp.Publish{
+		Request: pubID,
+		Topic:   denyTopic,
+		Options: wamp.Dict{wamp.OptAcknowledge: true},
+	})
+	msg, err = wamp.RecvTimeout(pub, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errMsg, ok := msg.(*wamp.Error)
+	if !ok {
+		t.Fatal("Expected ERROR, got:", msg.MessageType())
+	}
+	if errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("Wrong error, got", errMsg.Error)
+	}
+	if errMsg.Request != pubID {
+		t.Fatal("Wrong request ID in ERROR")
+	}
+
+	// Subscriber must not receive the denied event.
+	if msg, err = wamp.RecvTimeout(sub, 10*time.Millisecond); err == nil {
+		t.Fatal("Unexpected message:", msg.MessageType())
+	}
+
+	// Publishing to another topic is allowed.
+	pub.Send(&wamp.Publish{
+		Request: wamp.GlobalID(),
+		Topic:   allowTopic,
+		Options: wamp.Dict{wamp.OptAcknowledge: true},
+	})
+	msg, err = wamp.RecvTimeout(pub, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = msg.(*wamp.Published); !ok {
+		t.Fatal("Expected PUBLISHED, got:", msg.MessageType())
+	}
+}
+
 // Test that authorizer is not called with a local session and config does not
 // specify RequireLocalAuthz=true.
 func TestAuthorizerBypassLocal(t *testing.T) {
@@ -250,3 +336,206 @@ func TestAuthorizerRace(t *testing.T) {
 	<-done
 	<-done
 }
+
+func TestURIAuthorizer(t *testing.T) {
+	rules := []URIRule{
+		{
+			URI:     "com.example.",
+			Match:   wamp.MatchPrefix,
+			Roles:   []string{"user"},
+			Actions: []string{ActionSubscribe},
+		},
+		{
+			URI:     "com..status",
+			Match:   wamp.MatchWildcard,
+			Actions: []string{ActionCall},
+		},
+	}
+	authz, err := NewURIAuthorizer(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &wamp.Session{Details: wamp.Dict{"authrole": "user"}}
+	guest := &wamp.Session{Details: wamp.Dict{"authrole": "guest"}}
+	for _, tc := range []struct {
+		sess   *wamp.Session
+		msg    wamp.Message
+		expect bool
+	}{
+		{user, &wamp.Subscribe{Topic: "com.example.topic"}, true},
+		{user, &wamp.Publish{Topic: "com.example.topic"}, false},
+		{user, &wamp.Subscribe{Topic: "com.other.topic"}, false},
+		{guest, &wamp.Subscribe{Topic: "com.example.topic"}, false},
+		{guest, &wamp.Call{Procedure: "com.example.status"}, true},
+		{user, &wamp.Call{Procedure: "com.example.other"}, false},
+		{user, &wamp.Register{Procedure: "com.example.status"}, false},
+		{user, &wamp.Unsubscribe{}, true},
+	} {
+		ok, err := authz.Authorize(tc.sess, tc.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.expect {
+			t.Errorf("%s by %v: expected authorized %v", tc.msg.MessageType(),
+				tc.sess.Details["authrole"], tc.expect)
+		}
+	}
+
+	// Check that invalid rules are rejected.
+	for _, rule := range []URIRule{
+		{URI: "com.example", Match: "regex", Actions: []string{ActionCall}},
+		{URI: "com..example", Actions: []string{ActionCall}},
+		{URI: "com.example", Actions: []string{"delete"}},
+		{URI: "com.example"},
+	} {
+		if _, err = NewURIAuthorizer([]URIRule{rule}); err == nil {
+			t.Error("expected error for invalid rule:", rule)
+		}
+	}
+}
+
+// Test that the realm uses a URIAuthorizer configured by AuthzRules.
+func TestAuthzRules(t *testing.T) {
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI: testRealm,
+				AuthzRules: []URIRule{
+					{
+						URI:     "allowed.",
+						Match:   wamp.MatchPrefix,
+						Roles:   []string{"trusted"},
+						Actions: []string{ActionSubscribe},
+					},
+				},
+				RequireLocalAuthz: true,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	sub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: allowTopic})
+	msg, err := wamp.RecvTimeout(sub, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+	}
+
+	sub.Send(&wamp.Publish{
+		Request: wamp.GlobalID(),
+		Topic:   allowTopic,
+		Options: wamp.Dict{wamp.OptAcknowledge: true},
+	})
+	if msg, err = wamp.RecvTimeout(sub, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	errMsg, ok := msg.(*wamp.Error)
+	if !ok {
+		t.Fatal("Expected ERROR, got:", msg.MessageType())
+	}
+	if errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+
+	// Check that invalid rules and conflicting config are rejected.
+	config.RealmConfigs[0].AuthzRules[0].Actions = []string{"delete"}
+	if _, err = NewRouter(config, logger); err == nil {
+		t.Fatal("expected error for invalid authz rule")
+	}
+	config.RealmConfigs[0].AuthzRules[0].Actions = []string{ActionCall}
+	config.RealmConfigs[0].Authorizer = &testAuthz{}
+	if _, err = NewRouter(config, logger); err == nil {
+		t.Fatal("expected error for both AuthzRules and Authorizer")
+	}
+}
+
+// Test that an unauthorized request gets an ERROR with the type and request
+// ID of the request.
+func TestAuthorizerErrorResponse(t *testing.T) {
+	authz, err := NewURIAuthorizer([]URIRule{
+		{
+			URI:     allowTopic,
+			Actions: []string{ActionSubscribe},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				Authorizer:        authz,
+				RequireLocalAuthz: true,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []wamp.Message{
+		&wamp.Call{Request: wamp.GlobalID(), Procedure: testProcedure},
+		&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure},
+		&wamp.Subscribe{Request: wamp.GlobalID(), Topic: denyTopic},
+		&wamp.Publish{
+			Request: wamp.GlobalID(),
+			Topic:   denyTopic,
+			Options: wamp.Dict{wamp.OptAcknowledge: true},
+		},
+	} {
+		cli.Send(req)
+		msg, err := wamp.RecvTimeout(cli, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errMsg, ok := msg.(*wamp.Error)
+		if !ok {
+			t.Fatal("Expected ERROR, got:", msg.MessageType())
+		}
+		if errMsg.Type != req.MessageType() {
+			t.Fatal("Expected error type", req.MessageType(), "got", errMsg.Type)
+		}
+		var reqID wamp.ID
+		switch req := req.(type) {
+		case *wamp.Call:
+			reqID = req.Request
+		case *wamp.Register:
+			reqID = req.Request
+		case *wamp.Subscribe:
+			reqID = req.Request
+		case *wamp.Publish:
+			reqID = req.Request
+		}
+		if errMsg.Request != reqID {
+			t.Fatal("Wrong request ID in", errMsg.Type, "error")
+		}
+		if errMsg.Error != wamp.ErrNotAuthorized {
+			t.Fatal("Wrong error URI:", errMsg.Error)
+		}
+		if errMsg.Details == nil {
+			t.Fatal("ERROR details must not be nil")
+		}
+	}
+}
@@ -2,6 +2,7 @@ package router
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/gammazero/nexus/stdlog"
 	"github.com/gammazero/nexus/wamp"
@@ -11,6 +12,7 @@ const (
 	rolePub = "publisher"
 	roleSub = "subscriber"
 
+	featureEventRetention       = "event_retention"
 	featurePatternSub           = "pattern_based_subscription"
 	featurePubExclusion         = "publisher_exclusion"
 	featurePubIdent             = "publisher_identification"
@@ -24,6 +26,7 @@ const (
 var brokerRole = wamp.Dict{
 	"features": wamp.Dict{
 		featurePatternSub:           true,
+		featurePayloadPassthru:      true,
 		featurePubExclusion:         true,
 		featurePubIdent:             true,
 		featureSessionMetaAPI:       true,
@@ -39,6 +42,26 @@ type subscription struct {
 	match       string   // match policy
 	created     string   // when subscription was created
 	subscribers map[*wamp.Session]struct{}
+
+	// Subscribers that receive events without payload.
+	noPayload map[*wamp.Session]struct{}
+}
+
+// retainedEvent is a publication kept by the broker to send to subscribers
+// that subscribe after the event was published.  The publication's exclusion
+// and eligibility filter is kept with it, so that a late subscriber is only
+// sent a retained event that it would have been sent live.
+//
+// The publisher's session is not kept, since the event may be retained long
+// after the publisher has left.  Only its ID, and its identity details if they
+// are disclosed, are kept, as they were when the event was published.
+type retainedEvent struct {
+	pubSessID  wamp.ID
+	disclosed  wamp.Dict // publisher details to disclose; nil if not disclosed
+	msg        *wamp.Publish
+	pubID      wamp.ID
+	excludePub bool
+	filter     PublishFilter
 }
 
 type broker struct {
@@ -53,21 +76,41 @@ type broker struct {
 	// Session -> subscription ID set
 	sessionSubIDSet map[*wamp.Session]map[wamp.ID]struct{}
 
+	// topic -> most recent retained events, oldest first
+	retained map[wamp.URI][]retainedEvent
+	// Maximum number of events retained per topic.  Zero disables retention.
+	retainEvents int
+
+	// Receives events that could not be sent to subscribers.  May be nil.
+	deadLetters *deadLetters
+	// Traces publications and events.  May be nil.
+	tracer Tracer
+	// Sends events to subscribers from worker goroutines.  If nil, events are
+	// sent from the broker goroutine.
+	fanout *fanout
+	// Limits the subscriptions of each authrole.  May be nil.
+	subQuota *roleQuota
+
 	actionChan chan func()
 
 	// Generate subscription IDs.
 	idGen *wamp.IDGen
+	// Generate publication IDs.
+	pubIDGen func() wamp.ID
 
 	strictURI     bool
 	allowDisclose bool
+	forceDisclose bool
 
 	log           stdlog.StdLog
 	debug         bool
 	filterFactory FilterFactory
 }
 
-// newBroker returns a new default broker implementation instance.
-func newBroker(logger stdlog.StdLog, strictURI, allowDisclose, debug bool, publishFilter FilterFactory) *broker {
+// newBroker returns a new default broker implementation instance.  If
+// retainEvents is non-zero, then the broker keeps up to that many of the most
+// recent events published to each topic with the retain option.
+func newBroker(logger stdlog.StdLog, strictURI, allowDisclose, forceDisclose, debug bool, publishFilter FilterFactory, retainEvents int) *broker {
 	if logger == nil {
 		panic("logger is nil")
 	}
@@ -82,15 +125,20 @@ func newBroker(logger stdlog.StdLog, strictURI, allowDisclose, debug bool, publi
 		subscriptions:   map[wamp.ID]*subscription{},
 		sessionSubIDSet: map[*wamp.Session]map[wamp.ID]struct{}{},
 
+		retained:     map[wamp.URI][]retainedEvent{},
+		retainEvents: retainEvents,
+
 		// The action handler should be nearly always runable, since it is the
 		// critical section that does the only routing.  So, and unbuffered
 		// channel is appropriate.
 		actionChan: make(chan func()),
 
-		idGen: new(wamp.IDGen),
+		idGen:    new(wamp.IDGen),
+		pubIDGen: wamp.GlobalID,
 
 		strictURI:     strictURI,
 		allowDisclose: allowDisclose,
+		forceDisclose: forceDisclose,
 
 		log:           logger,
 		debug:         debug,
@@ -101,9 +149,44 @@ func newBroker(logger stdlog.StdLog, strictURI, allowDisclose, debug bool, publi
 }
 
 // role returns the role information for the "broker" role.  The data returned
-// is suitable for use as broker role info in a WELCOME message.
+// is suitable for use as broker role info in a WELCOME message.  Features that
+// are not enabled by the broker's configuration are not included.
 func (b *broker) role() wamp.Dict {
-	return brokerRole
+	features := wamp.Dict{}
+	for f, v := range brokerRole["features"].(wamp.Dict) {
+		features[f] = v
+	}
+	if !b.allowDisclose {
+		delete(features, featurePubIdent)
+	}
+	if b.retainEvents > 0 {
+		features[featureEventRetention] = true
+	}
+	return wamp.Dict{"features": features}
+}
+
+// countSubscriptions returns the number of subscriptions currently held by the
+// broker.
+func (b *broker) countSubscriptions() int {
+	count := make(chan int)
+	b.actionChan <- func() {
+		count <- len(b.subscriptions)
+	}
+	return <-count
+}
+
+// sessionSubscriptions returns the IDs of the subscriptions held by the
+// session.
+func (b *broker) sessionSubscriptions(sess *wamp.Session) []wamp.ID {
+	ids := make(chan []wamp.ID)
+	b.actionChan <- func() {
+		subIDs := make([]wamp.ID, 0, len(b.sessionSubIDSet[sess]))
+		for id := range b.sessionSubIDSet[sess] {
+			subIDs = append(subIDs, id)
+		}
+		ids <- subIDs
+	}
+	return <-ids
 }
 
 // publish finds all subscriptions for the topic being published to, including
@@ -111,10 +194,21 @@ func (b *broker) role() wamp.Dict {
 // of that topic.
 //
 // When a single event matches more than one of a Subscriber's subscriptions,
-// the event will be delivered for each subscription.
+// the event is delivered only once, for the exact match subscription if there
+// is one.
+//
+// If event retention is enabled and the publisher sets the retain option, the
+// event is also kept to send to later subscribers that request it.
 //
-// The Subscriber can detect the delivery of that same event on multiple
-// subscriptions via EVENT.PUBLISHED.Publication, which will be identical.
+// Events published by one session to a topic are delivered to each subscriber
+// in the order they were published.  This holds because a session's messages
+// are passed to publish one at a time, publications are routed in order by the
+// broker goroutine, and each subscriber's events are sent, either from that
+// goroutine or from the one fan-out worker that handles the subscriber, to the
+// subscriber's FIFO outbound queue.  Any change that sends events from other
+// goroutines must keep the sends to each subscriber serialized.  SUBSCRIBED,
+// UNSUBSCRIBED, retained events, and meta events are sent the same way, so
+// they are not sent ahead of events already routed to the subscriber.
 func (b *broker) publish(pub *wamp.Session, msg *wamp.Publish) {
 	if pub == nil || msg == nil {
 		panic("broker.Publish with nil session or message")
@@ -135,12 +229,26 @@ func (b *broker) publish(pub *wamp.Session, msg *wamp.Publish) {
 		b.trySend(pub, &wamp.Error{
 			Type:      msg.MessageType(),
 			Request:   msg.Request,
+			Details:   wamp.Dict{},
 			Error:     wamp.ErrInvalidURI,
 			Arguments: wamp.List{errMsg},
 		})
 		return
 	}
 
+	if err := checkPPT(msg.Options, msg.Arguments, msg.ArgumentsKw); err != nil {
+		if pubAck {
+			b.trySend(pub, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrInvalidArgument,
+				Arguments: wamp.List{err.Error()},
+			})
+		}
+		return
+	}
+
 	excludePub := true
 	if exclude, ok := msg.Options[wamp.OptExcludeMe].(bool); ok {
 		excludePub = exclude
@@ -148,9 +256,8 @@ func (b *broker) publish(pub *wamp.Session, msg *wamp.Publish) {
 
 	// A Broker may also (automatically) disclose the identity of a
 	// publisher even without the publisher having explicitly requested to
-	// do so when the Broker configuration (for the publication topic) is
-	// set up to do so.  TODO: Currently no broker config for this.
-	var disclose bool
+	// do so when the Broker configuration is set up to do so.
+	disclose := b.forceDisclose
 	if opt, _ := msg.Options[wamp.OptDiscloseMe].(bool); opt {
 		// Broker MAY deny a publisher's request to disclose its identity.
 		if !b.allowDisclose {
@@ -168,13 +275,23 @@ func (b *broker) publish(pub *wamp.Session, msg *wamp.Publish) {
 		}
 		disclose = true
 	}
-	pubID := wamp.GlobalID()
+	pubID := b.pubIDGen()
 
 	// Get blacklists and whitelists, if any, from publish message.
 	filter := b.filterFactory(msg)
 
+	retain, _ := msg.Options[wamp.OptRetain].(bool)
+	retain = retain && b.retainEvents > 0
+
+	if b.tracer != nil {
+		b.tracer.OnPublish(traceInfo(pub, msg.Request, msg.Topic))
+	}
+
 	b.actionChan <- func() {
 		b.syncPublish(pub, msg, pubID, excludePub, disclose, filter)
+		if retain {
+			b.syncRetain(pub, msg, pubID, excludePub, disclose, filter)
+		}
 	}
 
 	// Send PUBLISHED message if acknowledge is present and true.
@@ -189,6 +306,17 @@ func (b *broker) publish(pub *wamp.Session, msg *wamp.Publish) {
 // already subscribed topic, Broker should answer with SUBSCRIBED message,
 // containing the existing Subscription|id.
 //
+// All sessions that subscribe to the same topic with the same match policy
+// share one subscription, and are sent the same subscription ID in SUBSCRIBED
+// and in the EVENTs for that subscription.  Subscribing to the same topic URI
+// with a different match policy is a different subscription, with its own ID.
+// The ID stays the same as long as the subscription has any subscribers.
+//
+// A subscriber that sets the x_no_payload option is sent EVENTs without the
+// publication's args and kwargs, for topics where only the event itself
+// matters.  This is a per-subscriber setting, so other sessions on the same
+// subscription still get the full payload.
+//
 // By default, Subscribers subscribe to topics with exact matching policy. A
 // Subscriber might want to subscribe to topics based on a pattern.  If the
 // Broker and the Subscriber support pattern-based subscriptions, this matching
@@ -201,7 +329,17 @@ func (b *broker) subscribe(sub *wamp.Session, msg *wamp.Subscribe) {
 	// loose), and all URI components must be non-empty for normal
 	// subscriptions, may be empty for wildcard subscriptions and must be
 	// non-empty for all but the last component for prefix subscriptions.
-	match, _ := wamp.AsString(msg.Options[wamp.OptMatch])
+	match, ok := policyOption(msg.Options, wamp.OptMatch, validMatchPolicy)
+	if !ok {
+		b.trySend(sub, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{fmt.Sprint("unknown match policy: ", msg.Options[wamp.OptMatch])},
+		})
+		return
+	}
 	if !msg.Topic.ValidURI(b.strictURI, match) {
 		errMsg := fmt.Sprintf(
 			"subscribe for invalid topic URI %v (URI strict checking %v)",
@@ -209,15 +347,46 @@ func (b *broker) subscribe(sub *wamp.Session, msg *wamp.Subscribe) {
 		b.trySend(sub, &wamp.Error{
 			Type:      msg.MessageType(),
 			Request:   msg.Request,
+			Details:   wamp.Dict{},
 			Error:     wamp.ErrInvalidURI,
 			Arguments: wamp.List{errMsg},
 		})
 		return
 	}
 
+	getRetained, _ := msg.Options[wamp.OptGetRetained].(bool)
+	noPayload, _ := msg.Options[wamp.OptNoPayload].(bool)
+
 	b.actionChan <- func() {
-		b.syncSubscribe(sub, msg, match)
+		if b.syncSubscribe(sub, msg, match, noPayload) && getRetained {
+			b.syncSendRetained(sub, msg.Topic, match)
+		}
+	}
+}
+
+// validMatchPolicy returns true if match is one of the URI matching policies,
+// or is empty for the default exact matching.
+func validMatchPolicy(match string) bool {
+	switch match {
+	case "", wamp.MatchExact, wamp.MatchPrefix, wamp.MatchWildcard:
+		return true
+	}
+	return false
+}
+
+// policyOption returns the value of the named option.  If the option is not
+// present, then an empty string is returned.  If the option is present, but
+// is not a string accepted by valid, then false is returned.
+func policyOption(options wamp.Dict, name string, valid func(string) bool) (string, bool) {
+	v, ok := options[name]
+	if !ok {
+		return "", true
+	}
+	policy, ok := wamp.AsString(v)
+	if !ok || !valid(policy) {
+		return "", false
 	}
+	return policy, true
 }
 
 // unsubscribe removes the requested subscription.
@@ -252,30 +421,59 @@ func (b *broker) run() {
 	for action := range b.actionChan {
 		action()
 	}
+	if b.fanout != nil {
+		b.fanout.close()
+	}
 	if b.debug {
-		b.log.Print("Broker stopped")
+		stdlog.Debug(b.log, "Broker stopped")
 	}
 }
 
 func (b *broker) syncPublish(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, excludePub, disclose bool, filter PublishFilter) {
-	// Publish to subscribers with exact match.
+	// Find subscriptions with exact match, then prefix match, then wildcard
+	// match.  Prefix and wildcard matches are each ordered from the most
+	// specific (longest) pattern, the same as the dealer prefers, so that the
+	// order does not depend on map iteration order.
+	var subs []*subscription
 	if sub, ok := b.topicSubscription[msg.Topic]; ok {
-		b.syncPubEvent(pub, msg, pubID, sub, excludePub, false, disclose, filter)
+		subs = append(subs, sub)
 	}
-
-	// Publish to subscribers with prefix match.
+	var pfxSubs []*subscription
 	for pfxTopic, sub := range b.pfxTopicSubscription {
 		if msg.Topic.PrefixMatch(pfxTopic) {
-			b.syncPubEvent(pub, msg, pubID, sub, excludePub, true, disclose, filter)
+			pfxSubs = append(pfxSubs, sub)
 		}
 	}
-
-	// Publish to subscribers with wildcard match.
+	sort.Slice(pfxSubs, func(i, j int) bool {
+		return len(pfxSubs[i].topic) > len(pfxSubs[j].topic)
+	})
+	subs = append(subs, pfxSubs...)
+	var wcSubs []*subscription
 	for wcTopic, sub := range b.wcTopicSubscription {
 		if msg.Topic.WildcardMatch(wcTopic) {
-			b.syncPubEvent(pub, msg, pubID, sub, excludePub, true, disclose, filter)
+			wcSubs = append(wcSubs, sub)
 		}
 	}
+	sort.Slice(wcSubs, func(i, j int) bool {
+		a, b := wcSubs[i].topic, wcSubs[j].topic
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return moreSpecificWildcard(a, b)
+	})
+	subs = append(subs, wcSubs...)
+
+	// If more than one subscription matches, then a session may have more
+	// than one of them.  Keep track of the sessions sent the event, so that
+	// each session gets only one event, for the first matching subscription.
+	var sent map[*wamp.Session]struct{}
+	if len(subs) > 1 {
+		sent = map[*wamp.Session]struct{}{}
+	}
+	for _, sub := range subs {
+		sendTopic := sub.match == wamp.MatchPrefix || sub.match == wamp.MatchWildcard
+		b.syncPubEvent(pub, msg, pubID, sub, excludePub, sendTopic, disclose, filter, sent)
+	}
 }
 
 func newSubscription(id wamp.ID, subscriber *wamp.Session, topic wamp.URI, match string) *subscription {
@@ -285,54 +483,55 @@ func newSubscription(id wamp.ID, subscriber *wamp.Session, topic wamp.URI, match
 		match:       match,
 		created:     wamp.NowISO8601(),
 		subscribers: map[*wamp.Session]struct{}{subscriber: struct{}{}},
+		noPayload:   map[*wamp.Session]struct{}{},
 	}
 }
 
-func (b *broker) syncSubscribe(subscriber *wamp.Session, msg *wamp.Subscribe, match string) {
-	var sub *subscription
-	var existingSub bool
-
+// syncSubscribe adds the subscriber to the subscription for the topic,
+// creating the subscription if needed.  Returns true if the subscriber was
+// added.
+func (b *broker) syncSubscribe(subscriber *wamp.Session, msg *wamp.Subscribe, match string, noPayload bool) bool {
+	var topicSubs map[wamp.URI]*subscription
 	switch match {
 	case wamp.MatchPrefix:
 		// Subscribe to any topic that matches by the given prefix URI
-		sub, existingSub = b.pfxTopicSubscription[msg.Topic]
-		if !existingSub {
-			// Create a new prefix subscription.
-			sub = newSubscription(b.idGen.Next(), subscriber, msg.Topic, match)
-			b.pfxTopicSubscription[msg.Topic] = sub
-		}
+		topicSubs = b.pfxTopicSubscription
 	case wamp.MatchWildcard:
 		// Subscribe to any topic that matches by the given wildcard URI.
-		sub, existingSub = b.wcTopicSubscription[msg.Topic]
-		if !existingSub {
-			// Create a new wildcard subscription.
-			sub = newSubscription(b.idGen.Next(), subscriber, msg.Topic, match)
-			b.wcTopicSubscription[msg.Topic] = sub
-		}
+		topicSubs = b.wcTopicSubscription
 	default:
 		// Subscribe to the topic that exactly matches the given URI.
-		sub, existingSub = b.topicSubscription[msg.Topic]
-		if !existingSub {
-			// Create a new subscription.
-			sub = newSubscription(b.idGen.Next(), subscriber, msg.Topic, match)
-			b.topicSubscription[msg.Topic] = sub
-		}
+		topicSubs = b.topicSubscription
 	}
-	b.subscriptions[sub.id] = sub
+	sub, existingSub := topicSubs[msg.Topic]
 
 	// If the topic already has subscribers, then see if the session requesting
 	// a subscription is already subscribed to the topic.
 	if existingSub {
 		if _, already := sub.subscribers[subscriber]; already {
 			// Already subscribed; send existing subscription ID.
-			b.trySend(subscriber, &wamp.Subscribed{
+			b.syncSend(subscriber, &wamp.Subscribed{
 				Request:      msg.Request,
 				Subscription: sub.id,
 			})
-			return
+			return false
 		}
+	}
+	if !b.subQuota.acquire(subscriber) {
+		b.syncSend(subscriber, quotaError(msg.MessageType(), msg.Request, "subscription"))
+		return false
+	}
+	if existingSub {
 		// Add subscriber to existing subscription.
 		sub.subscribers[subscriber] = struct{}{}
+	} else {
+		// Create a new subscription.
+		sub = newSubscription(b.idGen.Next(), subscriber, msg.Topic, match)
+		topicSubs[msg.Topic] = sub
+		b.subscriptions[sub.id] = sub
+	}
+	if noPayload {
+		sub.noPayload[subscriber] = struct{}{}
 	}
 
 	// Add the subscription ID to the set of subscriptions for the subscriber.
@@ -345,7 +544,7 @@ func (b *broker) syncSubscribe(subscriber *wamp.Session, msg *wamp.Subscribe, ma
 	subIdSet[sub.id] = struct{}{}
 
 	// Tell sender the new subscription ID.
-	b.trySend(subscriber, &wamp.Subscribed{Request: msg.Request, Subscription: sub.id})
+	b.syncSend(subscriber, &wamp.Subscribed{Request: msg.Request, Subscription: sub.id})
 
 	if !existingSub {
 		b.syncPubSubCreateMeta(msg.Topic, subscriber.ID, sub)
@@ -353,6 +552,107 @@ func (b *broker) syncSubscribe(subscriber *wamp.Session, msg *wamp.Subscribe, ma
 
 	// Publish WAMP on_subscribe meta event.
 	b.syncPubSubMeta(wamp.MetaEventSubOnSubscribe, subscriber.ID, sub.id)
+	return true
+}
+
+// syncRetain keeps the event for the topic, discarding the oldest retained
+// event for the topic if the limit is reached.
+func (b *broker) syncRetain(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, excludePub, disclose bool, filter PublishFilter) {
+	var disclosed wamp.Dict
+	if disclose {
+		disclosed = wamp.Dict{}
+		disclosePublisher(pub, disclosed)
+	}
+	events := append(b.retained[msg.Topic], retainedEvent{
+		pubSessID:  pub.ID,
+		disclosed:  disclosed,
+		msg:        msg,
+		pubID:      pubID,
+		excludePub: excludePub,
+		filter:     filter,
+	})
+	if len(events) > b.retainEvents {
+		events = append(events[:0], events[len(events)-b.retainEvents:]...)
+	}
+	b.retained[msg.Topic] = events
+}
+
+// syncSendRetained sends the retained events for topics that match the new
+// subscription to the subscriber.  Retained events have the "retained" detail
+// set, to distinguish them from live events.
+//
+// The publication's exclude and eligible options are checked against the
+// subscriber as it is now, when subscribing, so the subscriber is not sent a
+// retained event that the publication would not have sent it live.  Publisher
+// disclosure is likewise given only if the subscriber supports it now.
+func (b *broker) syncSendRetained(subscriber *wamp.Session, topic wamp.URI, match string) {
+	sub, ok := b.syncSubscriptionFor(topic, match)
+	if !ok {
+		return
+	}
+	_, noPayload := sub.noPayload[subscriber]
+	for retTopic, events := range b.retained {
+		switch match {
+		case wamp.MatchPrefix:
+			ok = retTopic.PrefixMatch(topic)
+		case wamp.MatchWildcard:
+			ok = retTopic.WildcardMatch(topic)
+		default:
+			ok = retTopic == topic
+		}
+		if !ok {
+			continue
+		}
+		for i := range events {
+			if events[i].excludePub && events[i].pubSessID == subscriber.ID {
+				continue
+			}
+			if events[i].filter != nil {
+				subscriber.Lock()
+				allowed := events[i].filter.Allowed(subscriber.SafeSession())
+				subscriber.Unlock()
+				if !allowed {
+					continue
+				}
+			}
+			details := wamp.Dict{wamp.OptRetained: true}
+			if match == wamp.MatchPrefix || match == wamp.MatchWildcard {
+				details[detailTopic] = retTopic
+			}
+			if events[i].disclosed != nil && subscriber.HasFeature(roleSub, featurePubIdent) {
+				for k, v := range events[i].disclosed {
+					details[k] = v
+				}
+			}
+			event := &wamp.Event{
+				Publication:  events[i].pubID,
+				Subscription: sub.id,
+				Details:      details,
+			}
+			if !noPayload {
+				event.Arguments = events[i].msg.Arguments
+				event.ArgumentsKw = events[i].msg.ArgumentsKw
+				addPPTDetails(details, events[i].msg.Options)
+			}
+			b.syncSend(subscriber, event)
+		}
+	}
+}
+
+// syncSubscriptionFor returns the subscription for the topic and match
+// policy.
+func (b *broker) syncSubscriptionFor(topic wamp.URI, match string) (*subscription, bool) {
+	var sub *subscription
+	var ok bool
+	switch match {
+	case wamp.MatchPrefix:
+		sub, ok = b.pfxTopicSubscription[topic]
+	case wamp.MatchWildcard:
+		sub, ok = b.wcTopicSubscription[topic]
+	default:
+		sub, ok = b.topicSubscription[topic]
+	}
+	return sub, ok
 }
 
 // syncDeleteSubscription removes the the ID->subscription mapping and removes
@@ -373,21 +673,40 @@ func (b *broker) syncDelSubscription(sub *subscription) {
 }
 
 // syncUnsibsubscribe removes the subscriber from the specified subscription.
+//
+// If the subscription does not exist, or the subscriber is not subscribed to
+// it, then an ERROR with wamp.error.no_such_subscription is returned.  The
+// same error is returned in both cases so that a session cannot discover the
+// subscriptions of other sessions.
 func (b *broker) syncUnsubscribe(subscriber *wamp.Session, msg *wamp.Unsubscribe) {
 	subID := msg.Subscription
 	sub, ok := b.subscriptions[subID]
 	if !ok {
-		b.trySend(subscriber, &wamp.Error{
+		b.syncSend(subscriber, &wamp.Error{
 			Type:    msg.MessageType(),
 			Request: msg.Request,
+			Details: wamp.Dict{},
 			Error:   wamp.ErrNoSuchSubscription,
 		})
 		b.log.Println("Error unsubscribing: no such subscription", subID)
 		return
 	}
+	if _, ok = sub.subscribers[subscriber]; !ok {
+		b.syncSend(subscriber, &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: wamp.Dict{},
+			Error:   wamp.ErrNoSuchSubscription,
+		})
+		b.log.Println("Error unsubscribing: session", subscriber,
+			"not subscribed to", subID)
+		return
+	}
 
 	// Remove subscribed session from subscription.
 	delete(sub.subscribers, subscriber)
+	delete(sub.noPayload, subscriber)
+	b.subQuota.release(subscriber, 1)
 
 	// If no more subscribers on this subscription, delete subscription and
 	// send on_delete meta event.
@@ -413,7 +732,7 @@ func (b *broker) syncUnsubscribe(subscriber *wamp.Session, msg *wamp.Unsubscribe
 	}
 
 	// Tell sender they are unsubscribed.
-	b.trySend(subscriber, &wamp.Unsubscribed{Request: msg.Request})
+	b.syncSend(subscriber, &wamp.Unsubscribed{Request: msg.Request})
 
 	// Publish WAMP unsubscribe meta event.
 	b.syncPubSubMeta(wamp.MetaEventSubOnUnsubscribe, subscriber.ID, subID)
@@ -431,6 +750,7 @@ func (b *broker) syncRemoveSession(subscriber *wamp.Session) {
 		return
 	}
 	delete(b.sessionSubIDSet, subscriber)
+	b.subQuota.release(subscriber, len(subIDSet))
 
 	// For each subscription ID, lookup the subscription and remove the
 	// subscriber from the subscription.  If there are no more subscribers on
@@ -443,6 +763,7 @@ func (b *broker) syncRemoveSession(subscriber *wamp.Session) {
 		}
 		// Remove subscribed session from subscription.
 		delete(sub.subscribers, subscriber)
+		delete(sub.noPayload, subscriber)
 
 		// If no more subscribers on this subscription.
 		if len(sub.subscribers) == 0 {
@@ -455,51 +776,96 @@ func (b *broker) syncRemoveSession(subscriber *wamp.Session) {
 }
 
 // syncPubEvent sends an event to all subscribers that are not excluded from
-// receiving the event.
-func (b *broker) syncPubEvent(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, sub *subscription, excludePublisher, sendTopic, disclose bool, filter PublishFilter) {
-	for subscriber, _ := range sub.subscribers {
+// receiving the event.  If the broker has fan-out workers, then the events are
+// sent by the workers.
+func (b *broker) syncPubEvent(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, sub *subscription, excludePublisher, sendTopic, disclose bool, filter PublishFilter, sent map[*wamp.Session]struct{}) {
+	subID := sub.id
+	// Subscribers that do not get the payload are batched separately, since
+	// the workers cannot look at the subscription.
+	var batches, noPayloadBatches [][]*wamp.Session
+	if b.fanout != nil {
+		batches = b.fanout.batches()
+		noPayloadBatches = b.fanout.batches()
+	}
+	for subscriber := range sub.subscribers {
 		// Do not send event to publisher.
 		if subscriber == pub && excludePublisher {
 			continue
 		}
 
-		// Check if receiver is restricted.
-		if filter != nil {
-			// Create a safe session to prevent access to the session.Peer.
-			safeSession := wamp.Session{
-				ID:      subscriber.ID,
-				Details: subscriber.Details,
-			}
-			subscriber.Lock()
-			ok := filter.Allowed(&safeSession)
-			subscriber.Unlock()
-			if !ok {
+		// Do not send more than one event to a session.
+		if sent != nil {
+			if _, ok := sent[subscriber]; ok {
 				continue
 			}
+			sent[subscriber] = struct{}{}
 		}
 
-		details := wamp.Dict{}
-
-		// If a subscription was established with a pattern-based matching
-		// policy, a Broker MUST supply the original PUBLISH.Topic as provided
-		// by the Publisher in EVENT.Details.topic|uri.
-		if sendTopic {
-			details[detailTopic] = msg.Topic
+		_, noPayload := sub.noPayload[subscriber]
+		if batches != nil {
+			if noPayload {
+				b.fanout.add(noPayloadBatches, subscriber)
+			} else {
+				b.fanout.add(batches, subscriber)
+			}
+			continue
 		}
+		b.sendEvent(pub, msg, pubID, subID, subscriber, sendTopic, disclose, noPayload, filter)
+	}
+	if batches != nil {
+		b.fanout.dispatch(batches, func(subscriber *wamp.Session) {
+			b.sendEvent(pub, msg, pubID, subID, subscriber, sendTopic, disclose, false, filter)
+		})
+		b.fanout.dispatch(noPayloadBatches, func(subscriber *wamp.Session) {
+			b.sendEvent(pub, msg, pubID, subID, subscriber, sendTopic, disclose, true, filter)
+		})
+	}
+}
 
-		if disclose && subscriber.HasFeature(roleSub, featurePubIdent) {
-			disclosePublisher(pub, details)
+// sendEvent sends an event for the publication to the subscriber, if the
+// subscriber is allowed by the publish filter.  If noPayload is true, then the
+// event is sent without the publication's args and kwargs.  This does not
+// access the broker's subscription tables, so that it can be called by fan-out
+// workers.
+func (b *broker) sendEvent(pub *wamp.Session, msg *wamp.Publish, pubID, subID wamp.ID, subscriber *wamp.Session, sendTopic, disclose, noPayload bool, filter PublishFilter) {
+	// Check if receiver is restricted.
+	if filter != nil {
+		subscriber.Lock()
+		ok := filter.Allowed(subscriber.SafeSession())
+		subscriber.Unlock()
+		if !ok {
+			return
 		}
+	}
 
-		// TODO: Handle publication trust levels
+	details := wamp.Dict{}
 
-		b.trySend(subscriber, &wamp.Event{
-			Publication:  pubID,
-			Subscription: sub.id,
-			Arguments:    msg.Arguments,
-			ArgumentsKw:  msg.ArgumentsKw,
-			Details:      details,
-		})
+	// If a subscription was established with a pattern-based matching
+	// policy, a Broker MUST supply the original PUBLISH.Topic as provided
+	// by the Publisher in EVENT.Details.topic|uri.
+	if sendTopic {
+		details[detailTopic] = msg.Topic
+	}
+
+	if disclose && subscriber.HasFeature(roleSub, featurePubIdent) {
+		disclosePublisher(pub, details)
+	}
+
+	// TODO: Handle publication trust levels
+
+	event := &wamp.Event{
+		Publication:  pubID,
+		Subscription: subID,
+		Details:      details,
+	}
+	if !noPayload {
+		event.Arguments = msg.Arguments
+		event.ArgumentsKw = msg.ArgumentsKw
+		addPPTDetails(details, msg.Options)
+	}
+	sent := b.trySend(subscriber, event)
+	if sent && b.tracer != nil {
+		b.tracer.OnEvent(traceInfo(subscriber, pubID, msg.Topic))
 	}
 }
 
@@ -527,7 +893,7 @@ func (b *broker) syncPubMeta(metaTopic wamp.URI, sendMeta func(metaSub *subscrip
 // syncPubSubMeta publishes a subscription meta event when a subscription is
 // added, removed, or deleted.
 func (b *broker) syncPubSubMeta(metaTopic wamp.URI, subSessID, subID wamp.ID) {
-	pubID := wamp.GlobalID() // create here so that it is same for all events
+	pubID := b.pubIDGen() // create here so that it is same for all events
 	b.syncPubMeta(metaTopic, func(metaSub *subscription, sendTopic bool) {
 		if len(metaSub.subscribers) == 0 {
 			return
@@ -543,7 +909,7 @@ func (b *broker) syncPubSubMeta(metaTopic wamp.URI, subSessID, subID wamp.ID) {
 			if subscriber.ID == subSessID {
 				continue
 			}
-			b.trySend(subscriber, &wamp.Event{
+			b.syncSend(subscriber, &wamp.Event{
 				Publication:  pubID,
 				Subscription: metaSub.id,
 				Details:      details,
@@ -558,7 +924,7 @@ func (b *broker) syncPubSubMeta(metaTopic wamp.URI, subSessID, subID wamp.ID) {
 // Fired when a subscription is created through a subscription request for a
 // topic which was previously without subscribers.
 func (b *broker) syncPubSubCreateMeta(topic wamp.URI, subSessID wamp.ID, sub *subscription) {
-	pubID := wamp.GlobalID() // create here so that it is same for all events
+	pubID := b.pubIDGen() // create here so that it is same for all events
 	b.syncPubMeta(wamp.MetaEventSubOnCreate, func(metaSub *subscription, sendTopic bool) {
 		if len(metaSub.subscribers) == 0 {
 			return
@@ -581,7 +947,7 @@ func (b *broker) syncPubSubCreateMeta(topic wamp.URI, subSessID wamp.ID, sub *su
 			if subscriber.ID == subSessID {
 				continue
 			}
-			b.trySend(subscriber, &wamp.Event{
+			b.syncSend(subscriber, &wamp.Event{
 				Publication:  pubID,
 				Subscription: metaSub.id,
 				Details:      details,
@@ -591,9 +957,26 @@ func (b *broker) syncPubSubCreateMeta(topic wamp.URI, subSessID wamp.ID, sub *su
 	})
 }
 
+// syncSend sends a message to the session from the broker goroutine.  If the
+// broker has fan-out workers, then the message is sent by the worker that
+// sends events to the session, so that it is not sent ahead of events already
+// dispatched to that worker.
+func (b *broker) syncSend(sess *wamp.Session, msg wamp.Message) {
+	if b.fanout == nil {
+		b.trySend(sess, msg)
+		return
+	}
+	b.fanout.send(sess, func(sess *wamp.Session) {
+		b.trySend(sess, msg)
+	})
+}
+
 func (b *broker) trySend(sess *wamp.Session, msg wamp.Message) bool {
 	if err := sess.TrySend(msg); err != nil {
-		b.log.Printf("!!! Dropped %s to session %s: %s", msg.MessageType(), sess, err)
+		stdlog.Errorf(b.log, "!!! Dropped %s to session %s: %s", msg.MessageType(), sess, err)
+		if msg.MessageType() == wamp.EVENT {
+			b.deadLetters.add(msg, sess, err)
+		}
 		return false
 	}
 	return true
@@ -691,22 +1074,16 @@ func (b *broker) subMatch(msg *wamp.Invocation) wamp.Message {
 			sync := make(chan struct{})
 			b.actionChan <- func() {
 				if sub, ok := b.topicSubscription[topic]; ok {
-					for subscriber := range sub.subscribers {
-						subIDs = append(subIDs, subscriber.ID)
-					}
+					subIDs = append(subIDs, sub.id)
 				}
 				for pfxTopic, sub := range b.pfxTopicSubscription {
 					if topic.PrefixMatch(pfxTopic) {
-						for subscriber := range sub.subscribers {
-							subIDs = append(subIDs, subscriber.ID)
-						}
+						subIDs = append(subIDs, sub.id)
 					}
 				}
 				for wcTopic, sub := range b.wcTopicSubscription {
 					if topic.WildcardMatch(wcTopic) {
-						for subscriber := range sub.subscribers {
-							subIDs = append(subIDs, subscriber.ID)
-						}
+						subIDs = append(subIDs, sub.id)
 					}
 				}
 				close(sync)
@@ -814,7 +1191,7 @@ func (b *broker) subCountSubscribers(msg *wamp.Invocation) wamp.Message {
 			Type:    msg.MessageType(),
 			Request: msg.Request,
 			Details: wamp.Dict{},
-			Error:   wamp.ErrNoSuchSession,
+			Error:   wamp.ErrNoSuchSubscription,
 		}
 	}
 	return &wamp.Yield{
@@ -2,6 +2,8 @@ package router
 
 import (
 	"context"
+	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -36,7 +38,7 @@ func (p *testPeer) Close()                    { return }
 
 func TestBasicSubscribe(t *testing.T) {
 	// Test subscribing to a topic.
-	broker := newBroker(logger, false, true, debug, nil)
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
 	subscriber := newTestPeer()
 	sess := wamp.NewSession(subscriber, 0, nil, nil)
 	testTopic := wamp.URI("nexus.test.topic")
@@ -142,7 +144,7 @@ func TestBasicSubscribe(t *testing.T) {
 }
 
 func TestUnsubscribe(t *testing.T) {
-	broker := newBroker(logger, false, true, debug, nil)
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
 	testTopic := wamp.URI("nexus.test.topic")
 
 	// Subscribe session1 to topic
@@ -248,9 +250,55 @@ func TestUnsubscribe(t *testing.T) {
 	}
 }
 
+func TestUnsubscribeErrors(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
+	defer broker.close()
+
+	sess1 := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.subscribe(sess1, &wamp.Subscribe{Request: 123, Topic: testTopic})
+	rsp := <-sess1.Recv()
+	subID := rsp.(*wamp.Subscribed).Subscription
+
+	checkNoSuchSub := func(sess *wamp.Session, reqID wamp.ID) {
+		rsp, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected", wamp.ERROR, "got:", rsp.MessageType())
+		}
+		if errMsg.Type != wamp.UNSUBSCRIBE || errMsg.Request != reqID {
+			t.Fatal("error not for UNSUBSCRIBE request", reqID)
+		}
+		if errMsg.Error != wamp.ErrNoSuchSubscription {
+			t.Fatal("expected", wamp.ErrNoSuchSubscription, "got", errMsg.Error)
+		}
+	}
+
+	// Unsubscribe from subscription that does not exist.
+	broker.unsubscribe(sess1, &wamp.Unsubscribe{Request: 124, Subscription: subID + 1})
+	checkNoSuchSub(sess1, 124)
+
+	// Unsubscribe from subscription owned by a different session.
+	sess2 := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.unsubscribe(sess2, &wamp.Unsubscribe{Request: 125, Subscription: subID})
+	checkNoSuchSub(sess2, 125)
+
+	// The subscription owner is still subscribed, and can unsubscribe.
+	broker.unsubscribe(sess1, &wamp.Unsubscribe{Request: 126, Subscription: subID})
+	rsp, err := wamp.RecvTimeout(sess1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsub, ok := rsp.(*wamp.Unsubscribed); !ok || unsub.Request != 126 {
+		t.Fatal("expected", wamp.UNSUBSCRIBED, "for request 126, got:", rsp)
+	}
+}
+
 func TestRemove(t *testing.T) {
 	// Subscribe to topic
-	broker := newBroker(logger, false, true, debug, nil)
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
 	subscriber := newTestPeer()
 	sess := wamp.NewSession(subscriber, 0, nil, nil)
 	testTopic := wamp.URI("nexus.test.topic")
@@ -292,7 +340,7 @@ func TestRemove(t *testing.T) {
 }
 
 func TestBasicPubSub(t *testing.T) {
-	broker := newBroker(logger, false, true, debug, nil)
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
 	subscriber := newTestPeer()
 	sess := wamp.NewSession(subscriber, 0, nil, nil)
 	testTopic := wamp.URI("nexus.test.topic")
@@ -327,11 +375,62 @@ func TestBasicPubSub(t *testing.T) {
 	}
 }
 
+func TestPublishAcknowledgeErrors(t *testing.T) {
+	broker := newBroker(logger, true, true, false, debug, nil, 0)
+	publisher := newTestPeer()
+	pubSess := wamp.NewSession(publisher, 0, nil, nil)
+	badTopic := wamp.URI("Nexus.Test.Topic!")
+
+	// Without acknowledge, an invalid publish gets no reply.
+	broker.publish(pubSess, &wamp.Publish{Request: 124, Topic: badTopic})
+	if _, err := wamp.RecvTimeout(pubSess, time.Millisecond); err == nil {
+		t.Fatal("expected no reply to unacknowledged publish")
+	}
+
+	// With acknowledge, an invalid publish gets an ERROR for the request.
+	broker.publish(pubSess, &wamp.Publish{
+		Request: 125,
+		Topic:   badTopic,
+		Options: wamp.Dict{wamp.OptAcknowledge: true},
+	})
+	rsp, err := wamp.RecvTimeout(pubSess, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected", wamp.ERROR, "got:", rsp.MessageType())
+	}
+	if errMsg.Type != wamp.PUBLISH || errMsg.Request != 125 || errMsg.Error != wamp.ErrInvalidURI {
+		t.Fatal("wrong error:", errMsg.Type, errMsg.Request, errMsg.Error)
+	}
+	if errMsg.Details == nil {
+		t.Fatal("ERROR missing details")
+	}
+
+	// With acknowledge, a valid publish gets PUBLISHED with a publication ID.
+	broker.publish(pubSess, &wamp.Publish{
+		Request: 126,
+		Topic:   "nexus.test.topic",
+		Options: wamp.Dict{wamp.OptAcknowledge: true},
+	})
+	if rsp, err = wamp.RecvTimeout(pubSess, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	published, ok := rsp.(*wamp.Published)
+	if !ok {
+		t.Fatal("expected", wamp.PUBLISHED, "got:", rsp.MessageType())
+	}
+	if published.Request != 126 || published.Publication == 0 {
+		t.Fatal("bad PUBLISHED:", published.Request, published.Publication)
+	}
+}
+
 // ----- WAMP v.2 Testing -----
 
 func TestPrefxPatternBasedSubscription(t *testing.T) {
 	// Test match=prefix
-	broker := newBroker(logger, false, true, debug, nil)
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
 	subscriber := newTestPeer()
 	sess := wamp.NewSession(subscriber, 0, nil, nil)
 	testTopic := wamp.URI("nexus.test.topic")
@@ -394,7 +493,7 @@ func TestPrefxPatternBasedSubscription(t *testing.T) {
 
 func TestWildcardPatternBasedSubscription(t *testing.T) {
 	// Test match=prefix
-	broker := newBroker(logger, false, true, debug, nil)
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
 	subscriber := newTestPeer()
 	sess := wamp.NewSession(subscriber, 0, nil, nil)
 	testTopic := wamp.URI("nexus.test.topic")
@@ -464,8 +563,359 @@ func TestWildcardPatternBasedSubscription(t *testing.T) {
 	}
 }
 
+func TestOverlappingPatternSubscriptions(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	// Subscribe a separate session to the topic by each matching policy.
+	subs := map[string]wamp.URI{
+		wamp.MatchExact:    testTopic,
+		wamp.MatchPrefix:   wamp.URI("nexus.test"),
+		wamp.MatchWildcard: wamp.URI("nexus..topic"),
+	}
+	sessions := map[string]*wamp.Session{}
+	subIDs := map[string]wamp.ID{}
+	for match, topic := range subs {
+		sess := wamp.NewSession(newTestPeer(), 0, nil, nil)
+		broker.subscribe(sess, &wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Topic:   topic,
+			Options: wamp.Dict{"match": match},
+		})
+		rsp := <-sess.Recv()
+		subMsg, ok := rsp.(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+		sessions[match] = sess
+		subIDs[match] = subMsg.Subscription
+	}
+
+	// Subscription that does not match the published topic.
+	otherSess := wamp.NewSession(newTestPeer(), 0, nil, nil)
+	broker.subscribe(otherSess, &wamp.Subscribe{
+		Request: wamp.GlobalID(),
+		Topic:   wamp.URI("nexus.other"),
+		Options: wamp.Dict{"match": wamp.MatchPrefix},
+	})
+	<-otherSess.Recv()
+
+	pubSess := wamp.NewSession(newTestPeer(), 0, nil, nil)
+	broker.publish(pubSess, &wamp.Publish{Request: 124, Topic: testTopic})
+
+	for match, sess := range sessions {
+		rsp, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for EVENT for", match, "subscription")
+		}
+		evt, ok := rsp.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+		}
+		if evt.Subscription != subIDs[match] {
+			t.Fatal("wrong subscription ID in", match, "event")
+		}
+		topic, hasTopic := evt.Details["topic"]
+		if match == wamp.MatchExact {
+			// Topic is only included for pattern-based subscriptions.
+			if hasTopic {
+				t.Fatal("exact subscription event should not include topic")
+			}
+			continue
+		}
+		if !hasTopic || topic.(wamp.URI) != testTopic {
+			t.Fatal("wrong topic in", match, "event:", topic)
+		}
+	}
+
+	if _, err := wamp.RecvTimeout(otherSess, 10*time.Millisecond); err == nil {
+		t.Fatal("non-matching subscription should not receive event")
+	}
+}
+
+func TestOverlappingSubscriptionsOneSession(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	// Subscribe one session to the topic by each matching policy.
+	sess := wamp.NewSession(newTestPeer(), 0, nil, nil)
+	subIDs := map[string]wamp.ID{}
+	for _, match := range []string{wamp.MatchPrefix, wamp.MatchExact, wamp.MatchWildcard} {
+		topic := testTopic
+		switch match {
+		case wamp.MatchPrefix:
+			topic = wamp.URI("nexus.test")
+		case wamp.MatchWildcard:
+			topic = wamp.URI("nexus..topic")
+		}
+		broker.subscribe(sess, &wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Topic:   topic,
+			Options: wamp.Dict{"match": match},
+		})
+		rsp := <-sess.Recv()
+		subMsg, ok := rsp.(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+		subIDs[match] = subMsg.Subscription
+	}
+
+	pubSess := wamp.NewSession(newTestPeer(), 0, nil, nil)
+	broker.publish(pubSess, &wamp.Publish{Request: 124, Topic: testTopic})
+
+	// Session should get one event, for the exact match subscription.
+	rsp, err := wamp.RecvTimeout(sess, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for EVENT")
+	}
+	evt, ok := rsp.(*wamp.Event)
+	if !ok {
+		t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+	}
+	if evt.Subscription != subIDs[wamp.MatchExact] {
+		t.Fatal("expected event for exact match subscription")
+	}
+	if _, err = wamp.RecvTimeout(sess, 10*time.Millisecond); err == nil {
+		t.Fatal("session should receive only one event per publication")
+	}
+
+	// Without the exact match subscription, the session gets one event for
+	// the prefix subscription.
+	unsubscribe := func(subID wamp.ID) {
+		broker.unsubscribe(sess, &wamp.Unsubscribe{
+			Request:      wamp.GlobalID(),
+			Subscription: subID,
+		})
+		if rsp := <-sess.Recv(); rsp.MessageType() != wamp.UNSUBSCRIBED {
+			t.Fatal("expected", wamp.UNSUBSCRIBED, "got:", rsp.MessageType())
+		}
+	}
+	unsubscribe(subIDs[wamp.MatchExact])
+
+	// Subscribe to a more specific prefix and a less specific wildcard.
+	subscribe := func(topic wamp.URI, match string) wamp.ID {
+		broker.subscribe(sess, &wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Topic:   topic,
+			Options: wamp.Dict{"match": match},
+		})
+		rsp := <-sess.Recv()
+		subMsg, ok := rsp.(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+		return subMsg.Subscription
+	}
+	longPfxID := subscribe("nexus.test.to", wamp.MatchPrefix)
+	subscribe("nexus..", wamp.MatchWildcard)
+
+	// expectEvent publishes several times, and checks that each publication
+	// gives one event for the expected subscription.
+	expectEvent := func(subID wamp.ID) {
+		for i := 0; i < 10; i++ {
+			broker.publish(pubSess, &wamp.Publish{Request: wamp.GlobalID(), Topic: testTopic})
+			rsp, err := wamp.RecvTimeout(sess, time.Second)
+			if err != nil {
+				t.Fatal("timed out waiting for EVENT")
+			}
+			evt, ok := rsp.(*wamp.Event)
+			if !ok {
+				t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+			}
+			if evt.Subscription != subID {
+				t.Fatal("event for wrong subscription")
+			}
+			if _, err = wamp.RecvTimeout(sess, 10*time.Millisecond); err == nil {
+				t.Fatal("session should receive only one event per publication")
+			}
+		}
+	}
+
+	// The most specific prefix subscription is chosen over the others.
+	expectEvent(longPfxID)
+
+	// Without prefix subscriptions, the most specific wildcard subscription is
+	// chosen.
+	unsubscribe(longPfxID)
+	unsubscribe(subIDs[wamp.MatchPrefix])
+	expectEvent(subIDs[wamp.MatchWildcard])
+}
+
+func TestRetainedEvents(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 2)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	if _, ok := broker.role()["features"].(wamp.Dict)[featureEventRetention]; !ok {
+		t.Fatal("broker should announce event_retention feature")
+	}
+
+	// Publish three retained events and one that is not retained.
+	pubSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	for i := 1; i <= 3; i++ {
+		broker.publish(pubSess, &wamp.Publish{
+			Request:   wamp.GlobalID(),
+			Topic:     testTopic,
+			Options:   wamp.Dict{wamp.OptRetain: true},
+			Arguments: wamp.List{i},
+		})
+	}
+	broker.publish(pubSess, &wamp.Publish{
+		Request:   wamp.GlobalID(),
+		Topic:     testTopic,
+		Arguments: wamp.List{4},
+	})
+
+	// Subscriber that does not ask for retained events does not get any.
+	sess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.subscribe(sess, &wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	if rsp := <-sess.Recv(); rsp.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+	if _, err := wamp.RecvTimeout(sess, 10*time.Millisecond); err == nil {
+		t.Fatal("should not receive retained events without get_retained")
+	}
+
+	// Subscribers asking for retained events get the last two retained
+	// events, for exact and pattern-based subscriptions.
+	for _, match := range []string{wamp.MatchExact, wamp.MatchPrefix} {
+		topic := testTopic
+		if match == wamp.MatchPrefix {
+			topic = wamp.URI("nexus.test")
+		}
+		// Peer needs room for SUBSCRIBED and retained events.
+		sess = wamp.NewSession(&testPeer{in: make(chan wamp.Message, 3)}, wamp.GlobalID(), nil, nil)
+		broker.subscribe(sess, &wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Topic:   topic,
+			Options: wamp.Dict{
+				wamp.OptMatch:       match,
+				wamp.OptGetRetained: true,
+			},
+		})
+		rsp := <-sess.Recv()
+		subMsg, ok := rsp.(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+		for _, expect := range []int{2, 3} {
+			rsp, err := wamp.RecvTimeout(sess, time.Second)
+			if err != nil {
+				t.Fatal("timed out waiting for retained EVENT")
+			}
+			evt, ok := rsp.(*wamp.Event)
+			if !ok {
+				t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+			}
+			if evt.Subscription != subMsg.Subscription {
+				t.Fatal("wrong subscription ID in retained event")
+			}
+			if evt.Arguments[0] != expect {
+				t.Fatal("wrong retained event, expected", expect, "got",
+					evt.Arguments[0])
+			}
+			if retained, _ := evt.Details[wamp.OptRetained].(bool); !retained {
+				t.Fatal("retained event missing retained detail")
+			}
+			_, hasTopic := evt.Details[detailTopic]
+			if hasTopic != (match == wamp.MatchPrefix) {
+				t.Fatal("topic detail should only be in pattern-based event")
+			}
+		}
+		if _, err := wamp.RecvTimeout(sess, 10*time.Millisecond); err == nil {
+			t.Fatal("received unexpected event")
+		}
+	}
+
+	// Live events are not flagged as retained.
+	broker.publish(pubSess, &wamp.Publish{
+		Request:   wamp.GlobalID(),
+		Topic:     testTopic,
+		Arguments: wamp.List{5},
+	})
+	rsp, err := wamp.RecvTimeout(sess, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for EVENT")
+	}
+	if _, ok := rsp.(*wamp.Event).Details[wamp.OptRetained]; ok {
+		t.Fatal("live event should not have retained detail")
+	}
+}
+
+func TestRetainedEventEligibility(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 2)
+	defer broker.close()
+
+	eligibleSess := wamp.NewSession(&testPeer{in: make(chan wamp.Message, 2)},
+		wamp.GlobalID(), wamp.Dict{"authrole": "user"}, nil)
+	lateSess := wamp.NewSession(&testPeer{in: make(chan wamp.Message, 2)},
+		wamp.GlobalID(), wamp.Dict{"authrole": "user"}, nil)
+
+	// Retained event published only to the eligible session, before any
+	// subscribers exist.
+	pubSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.publish(pubSess, &wamp.Publish{
+		Request: wamp.GlobalID(),
+		Topic:   testTopic,
+		Options: wamp.Dict{
+			wamp.OptRetain:    true,
+			wamp.WhitelistKey: wamp.List{eligibleSess.ID},
+		},
+		Arguments: wamp.List{"secret"},
+	})
+	// The publisher is excluded from its own retained event, as it would be
+	// from a live event.
+	broker.publish(pubSess, &wamp.Publish{
+		Request:   wamp.GlobalID(),
+		Topic:     "nexus.test.other",
+		Options:   wamp.Dict{wamp.OptRetain: true},
+		Arguments: wamp.List{"mine"},
+	})
+
+	subscribe := func(sess *wamp.Session, topic wamp.URI) {
+		broker.subscribe(sess, &wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Topic:   topic,
+			Options: wamp.Dict{wamp.OptGetRetained: true},
+		})
+		rsp, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rsp.(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+	}
+
+	// Late subscriber that the publication did not make eligible does not get
+	// the retained event.
+	subscribe(lateSess, testTopic)
+	if _, err := wamp.RecvTimeout(lateSess, 10*time.Millisecond); err == nil {
+		t.Fatal("ineligible subscriber received retained event")
+	}
+
+	// Eligible subscriber gets the retained event.
+	subscribe(eligibleSess, testTopic)
+	rsp, err := wamp.RecvTimeout(eligibleSess, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for retained EVENT")
+	}
+	evt, ok := rsp.(*wamp.Event)
+	if !ok {
+		t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+	}
+	if evt.Arguments[0] != "secret" {
+		t.Fatal("wrong retained event:", evt.Arguments)
+	}
+
+	subscribe(pubSess, "nexus.test.other")
+	if _, err := wamp.RecvTimeout(pubSess, 10*time.Millisecond); err == nil {
+		t.Fatal("publisher received its own retained event")
+	}
+}
+
 func TestSubscriberBlackwhiteListing(t *testing.T) {
-	broker := newBroker(logger, false, true, debug, nil)
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
 	subscriber := newTestPeer()
 	details := wamp.Dict{
 		"authid":   "jdoe",
@@ -571,8 +1021,44 @@ func TestSubscriberBlackwhiteListing(t *testing.T) {
 	}
 }
 
+func TestEligibleSubset(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	var subs []*wamp.Session
+	for i := 0; i < 3; i++ {
+		sess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+		broker.subscribe(sess, &wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+		rsp := <-sess.Recv()
+		if _, ok := rsp.(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+		subs = append(subs, sess)
+	}
+
+	pubSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.publish(pubSess, &wamp.Publish{
+		Request: wamp.GlobalID(),
+		Topic:   testTopic,
+		Options: wamp.Dict{"eligible": wamp.List{subs[0].ID, subs[2].ID}},
+	})
+
+	for _, i := range []int{0, 2} {
+		rsp, err := wamp.RecvTimeout(subs[i], time.Second)
+		if err != nil {
+			t.Fatal("eligible subscriber", i, "did not receive event")
+		}
+		if _, ok := rsp.(*wamp.Event); !ok {
+			t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+		}
+	}
+	if _, err := wamp.RecvTimeout(subs[1], 10*time.Millisecond); err == nil {
+		t.Fatal("subscriber not in eligible list received event")
+	}
+}
+
 func TestPublisherExclusion(t *testing.T) {
-	broker := newBroker(logger, false, true, debug, nil)
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
 	subscriber := newTestPeer()
 	sess := wamp.NewSession(subscriber, 0, nil, nil)
 	testTopic := wamp.URI("nexus.test.topic")
@@ -646,7 +1132,7 @@ func TestPublisherExclusion(t *testing.T) {
 }
 
 func TestPublisherIdentification(t *testing.T) {
-	broker := newBroker(logger, false, true, debug, nil)
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
 	subscriber := newTestPeer()
 
 	details := wamp.Dict{
@@ -691,3 +1177,645 @@ func TestPublisherIdentification(t *testing.T) {
 		t.Fatal("incorrect publisher ID disclosed")
 	}
 }
+
+func TestRetainedEventPublisherIdentity(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 1)
+	defer broker.close()
+
+	pubDetails := wamp.Dict{"authid": "jdoe", "authrole": "user"}
+	pubSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), pubDetails, nil)
+	broker.publish(pubSess, &wamp.Publish{
+		Request: 1,
+		Topic:   testTopic,
+		Options: wamp.Dict{
+			wamp.OptRetain:     true,
+			wamp.OptDiscloseMe: true,
+		},
+	})
+
+	// The publisher's details change after the event is retained.
+	pubSess.Lock()
+	pubSess.Details["authid"] = "other"
+	pubSess.Unlock()
+
+	details := wamp.Dict{
+		"roles": wamp.Dict{
+			"subscriber": wamp.Dict{
+				"features": wamp.Dict{
+					"publisher_identification": true,
+				},
+			},
+		},
+	}
+	sess := wamp.NewSession(&testPeer{in: make(chan wamp.Message, 2)}, wamp.GlobalID(), nil, details)
+	broker.subscribe(sess, &wamp.Subscribe{
+		Request: 2,
+		Topic:   testTopic,
+		Options: wamp.Dict{wamp.OptGetRetained: true},
+	})
+	if rsp := <-sess.Recv(); rsp.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+	rsp, err := wamp.RecvTimeout(sess, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for retained EVENT")
+	}
+	evt, ok := rsp.(*wamp.Event)
+	if !ok {
+		t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+	}
+	// The disclosed identity is the publisher's when the event was published.
+	if pub, _ := wamp.AsID(evt.Details["publisher"]); pub != pubSess.ID {
+		t.Fatal("wrong publisher ID disclosed:", evt.Details["publisher"])
+	}
+	if authid, _ := wamp.AsString(evt.Details["publisher_authid"]); authid != "jdoe" {
+		t.Fatal("wrong publisher authid disclosed:", evt.Details["publisher_authid"])
+	}
+	if authrole, _ := wamp.AsString(evt.Details["publisher_authrole"]); authrole != "user" {
+		t.Fatal("wrong publisher authrole disclosed:", evt.Details["publisher_authrole"])
+	}
+}
+
+func TestPublisherDisclosurePolicy(t *testing.T) {
+	details := wamp.Dict{
+		"roles": wamp.Dict{
+			"subscriber": wamp.Dict{
+				"features": wamp.Dict{
+					"publisher_identification": true,
+				},
+			},
+		},
+	}
+	testTopic := wamp.URI("nexus.test.topic")
+
+	// Test forced disclosure: publisher identity disclosed without request.
+	broker := newBroker(logger, false, true, true, debug, nil, 0)
+	sess := wamp.NewSession(newTestPeer(), 0, nil, details)
+	broker.subscribe(sess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+	rsp := <-sess.Recv()
+	if _, ok := rsp.(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+	pubDetails := wamp.Dict{"authid": "jdoe", "authrole": "user"}
+	pubSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), pubDetails, nil)
+	broker.publish(pubSess, &wamp.Publish{Request: 124, Topic: testTopic})
+	rsp = <-sess.Recv()
+	evt, ok := rsp.(*wamp.Event)
+	if !ok {
+		t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+	}
+	if pub, _ := wamp.AsID(evt.Details["publisher"]); pub != pubSess.ID {
+		t.Fatal("publisher identity not disclosed by forced policy")
+	}
+	if authid, _ := wamp.AsString(evt.Details["publisher_authid"]); authid != "jdoe" {
+		t.Fatal("publisher authid not disclosed by forced policy")
+	}
+
+	// Test forbidden disclosure: request to disclose is an error.
+	broker = newBroker(logger, false, false, false, debug, nil, 0)
+	sess = wamp.NewSession(newTestPeer(), 0, nil, details)
+	broker.subscribe(sess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+	<-sess.Recv()
+	pubSess = wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.publish(pubSess, &wamp.Publish{
+		Request: 125,
+		Topic:   testTopic,
+		Options: wamp.Dict{"disclose_me": true, "acknowledge": true},
+	})
+	rsp = <-pubSess.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected", wamp.ERROR, "got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrOptionDisallowedDiscloseMe {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+	if errMsg.Request != 125 {
+		t.Fatal("wrong request ID in error")
+	}
+	if _, err := wamp.RecvTimeout(sess, 10*time.Millisecond); err == nil {
+		t.Fatal("event should not be published when disclosure is forbidden")
+	}
+}
+
+func TestSubscribeMatchValidation(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
+	defer broker.close()
+	sess := wamp.NewSession(newTestPeer(), 0, nil, nil)
+
+	subscribe := func(topic wamp.URI, match string) wamp.Message {
+		broker.subscribe(sess, &wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Topic:   topic,
+			Options: wamp.SetOption(nil, wamp.OptMatch, match),
+		})
+		rsp, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp
+	}
+	checkError := func(rsp wamp.Message, reason wamp.URI) {
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got", rsp.MessageType())
+		}
+		if errMsg.Error != reason {
+			t.Fatal("expected", reason, "got", errMsg.Error)
+		}
+	}
+
+	// Empty components are allowed by wildcard subscriptions.
+	if rsp := subscribe("com..topic", wamp.MatchWildcard); rsp.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected SUBSCRIBED for wildcard URI, got", rsp.MessageType())
+	}
+	// A trailing dot is allowed by prefix subscriptions.
+	if rsp := subscribe("com.myapp.", wamp.MatchPrefix); rsp.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected SUBSCRIBED for prefix URI, got", rsp.MessageType())
+	}
+	// Empty components are not allowed by exact subscriptions.
+	checkError(subscribe("com..topic", wamp.MatchExact), wamp.ErrInvalidURI)
+	checkError(subscribe("com..topic", ""), wamp.ErrInvalidURI)
+	// Unknown match policy.
+	checkError(subscribe("com.myapp.topic", "regex"), wamp.ErrInvalidArgument)
+
+	// Match policy that is not a string.
+	broker.subscribe(sess, &wamp.Subscribe{
+		Request: wamp.GlobalID(),
+		Topic:   "com.myapp.topic",
+		Options: wamp.Dict{wamp.OptMatch: 5},
+	})
+	rsp, err := wamp.RecvTimeout(sess, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkError(rsp, wamp.ErrInvalidArgument)
+}
+
+func TestPublishOrder(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
+	defer broker.close()
+	checkPublishOrder(t, broker)
+
+	// Events sent by fan-out workers.
+	broker = newBroker(logger, false, true, false, debug, nil, 0)
+	broker.fanout = newFanout(context.Background(), 4)
+	defer broker.close()
+	checkPublishOrder(t, broker)
+}
+
+func checkPublishOrder(t *testing.T, broker *broker) {
+	const numEvents = 500
+
+	// Subscribers with exact and pattern subscriptions, each with room to
+	// queue all the events.
+	exactSess := wamp.NewSession(&testPeer{in: make(chan wamp.Message, numEvents+1)}, wamp.GlobalID(), nil, nil)
+	broker.subscribe(exactSess, &wamp.Subscribe{Request: 1, Topic: testTopic})
+	wcSess := wamp.NewSession(&testPeer{in: make(chan wamp.Message, numEvents+1)}, wamp.GlobalID(), nil, nil)
+	broker.subscribe(wcSess, &wamp.Subscribe{
+		Request: 2,
+		Topic:   "nexus..event",
+		Options: wamp.Dict{wamp.OptMatch: wamp.MatchWildcard},
+	})
+	for _, sess := range []*wamp.Session{exactSess, wcSess} {
+		if _, err := wamp.RecvTimeout(sess, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Publish from one session while another session publishes to the same
+	// topic, to interleave publications.
+	pubSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	otherSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < numEvents/2; i++ {
+			broker.publish(otherSess, &wamp.Publish{Request: wamp.ID(i + 1), Topic: testTopic})
+		}
+	}()
+	for i := 0; i < numEvents/2; i++ {
+		broker.publish(pubSess, &wamp.Publish{
+			Request:   wamp.ID(i + 1),
+			Topic:     testTopic,
+			Arguments: wamp.List{i},
+		})
+	}
+	<-done
+
+	for _, sess := range []*wamp.Session{exactSess, wcSess} {
+		next := 0
+		for i := 0; i < numEvents; i++ {
+			msg, err := wamp.RecvTimeout(sess, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			event, ok := msg.(*wamp.Event)
+			if !ok {
+				t.Fatal("expected", wamp.EVENT, "got:", msg.MessageType())
+			}
+			if len(event.Arguments) == 0 {
+				continue // from other publisher
+			}
+			if n, _ := wamp.AsInt64(event.Arguments[0]); n != int64(next) {
+				t.Fatal("event out of order: expected", next, "got", n)
+			}
+			next++
+		}
+		if next != numEvents/2 {
+			t.Fatal("expected", numEvents/2, "events from publisher, got", next)
+		}
+	}
+}
+
+func TestSubscriberMessageOrder(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 1)
+	defer broker.close()
+	checkSubscriberMessageOrder(t, broker)
+
+	// Events sent by fan-out workers.
+	broker = newBroker(logger, false, true, false, debug, nil, 1)
+	broker.fanout = newFanout(context.Background(), 4)
+	defer broker.close()
+	checkSubscriberMessageOrder(t, broker)
+}
+
+func checkSubscriberMessageOrder(t *testing.T, broker *broker) {
+	const numEvents = 500
+	const retainTopic = wamp.URI("nexus.test.retained")
+
+	pubSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.publish(pubSess, &wamp.Publish{
+		Request: 1,
+		Topic:   retainTopic,
+		Options: wamp.Dict{wamp.OptRetain: true},
+	})
+
+	sess := wamp.NewSession(&testPeer{in: make(chan wamp.Message, numEvents+4)}, wamp.GlobalID(), nil, nil)
+	broker.subscribe(sess, &wamp.Subscribe{Request: 1, Topic: testTopic})
+	msg, err := wamp.RecvTimeout(sess, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subMsg, ok := msg.(*wamp.Subscribed)
+	if !ok {
+		t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+	}
+
+	// Replies to the subscriber, and retained events, must not be sent ahead
+	// of the events already published.
+	for i := 0; i < numEvents; i++ {
+		broker.publish(pubSess, &wamp.Publish{
+			Request:   wamp.ID(i + 2),
+			Topic:     testTopic,
+			Arguments: wamp.List{i},
+		})
+	}
+	broker.subscribe(sess, &wamp.Subscribe{
+		Request: 2,
+		Topic:   retainTopic,
+		Options: wamp.Dict{wamp.OptGetRetained: true},
+	})
+	broker.unsubscribe(sess, &wamp.Unsubscribe{Request: 3, Subscription: subMsg.Subscription})
+
+	for i := 0; i < numEvents; i++ {
+		msg, err = wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		event, ok := msg.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected EVENT", i, "got", msg.MessageType())
+		}
+		if n, _ := wamp.AsInt64(event.Arguments[0]); n != int64(i) {
+			t.Fatal("event out of order: expected", i, "got", n)
+		}
+	}
+	for _, msgType := range []wamp.MessageType{wamp.SUBSCRIBED, wamp.EVENT, wamp.UNSUBSCRIBED} {
+		msg, err = wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.MessageType() != msgType {
+			t.Fatal("expected", msgType, "got", msg.MessageType())
+		}
+	}
+}
+
+func TestFanoutStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := newFanout(ctx, 2)
+	cancel()
+
+	// Once the context is canceled, dispatching does not block when the
+	// workers are no longer taking jobs.
+	sess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < fanoutQueueSize*2; i++ {
+			f.send(sess, func(*wamp.Session) {})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("fan-out blocked after context canceled")
+	}
+	f.close()
+}
+
+// countPeer counts the messages sent to it, and discards them.
+type countPeer struct {
+	count int64
+}
+
+func (p *countPeer) TrySend(msg wamp.Message) error {
+	atomic.AddInt64(&p.count, 1)
+	return nil
+}
+
+func (p *countPeer) Send(msg wamp.Message) error { return p.TrySend(msg) }
+
+func (p *countPeer) SendCtx(ctx context.Context, msg wamp.Message) error {
+	return p.TrySend(msg)
+}
+
+func (p *countPeer) Recv() <-chan wamp.Message { return nil }
+func (p *countPeer) Close()                    {}
+
+func BenchmarkPublish10kSubscribers(b *testing.B) {
+	for _, workers := range []int{0, 4, 16} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			benchPublish(b, 10000, workers)
+		})
+	}
+}
+
+func benchPublish(b *testing.B, numSubs, workers int) {
+	broker := newBroker(logger, false, true, false, false, nil, 0)
+	broker.fanout = newFanout(context.Background(), workers)
+	defer broker.close()
+
+	peers := make([]*countPeer, numSubs)
+	for i := range peers {
+		peers[i] = &countPeer{}
+		sess := wamp.NewSession(peers[i], wamp.GlobalID(), nil, nil)
+		broker.subscribe(sess, &wamp.Subscribe{Request: 1, Topic: testTopic})
+	}
+	// waitCount waits until each subscriber has been sent n messages.
+	waitCount := func(n int64) {
+		for _, p := range peers {
+			for atomic.LoadInt64(&p.count) != n {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	waitCount(1) // SUBSCRIBED
+
+	pubSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	args := wamp.List{"hello world"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		broker.publish(pubSess, &wamp.Publish{
+			Request:   wamp.ID(i + 1),
+			Topic:     testTopic,
+			Arguments: args,
+		})
+	}
+	waitCount(int64(b.N + 1))
+}
+
+func TestSharedSubscriptionID(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
+	defer broker.close()
+
+	subscribe := func(sess *wamp.Session, match string) wamp.ID {
+		broker.subscribe(sess, &wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Topic:   testTopic,
+			Options: wamp.SetOption(nil, wamp.OptMatch, match),
+		})
+		msg, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subMsg, ok := msg.(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+		}
+		return subMsg.Subscription
+	}
+
+	sess1 := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	sess2 := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	subID1 := subscribe(sess1, wamp.MatchExact)
+	subID2 := subscribe(sess2, wamp.MatchExact)
+	if subID1 != subID2 {
+		t.Fatal("subscribers to same topic got different subscription IDs")
+	}
+
+	// Same topic with a different match policy is a different subscription.
+	sess3 := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	if pfxID := subscribe(sess3, wamp.MatchPrefix); pfxID == subID1 {
+		t.Fatal("prefix subscription has same ID as exact subscription")
+	}
+
+	// Each subscriber's EVENT has the subscription ID from its SUBSCRIBED.
+	pubSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.publish(pubSess, &wamp.Publish{Request: 1, Topic: testTopic})
+	for _, sess := range []*wamp.Session{sess1, sess2} {
+		msg, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		event, ok := msg.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected EVENT, got", msg.MessageType())
+		}
+		if event.Subscription != subID1 {
+			t.Fatal("EVENT has wrong subscription ID:", event.Subscription)
+		}
+	}
+
+	// The ID is kept while the subscription still has a subscriber.
+	broker.unsubscribe(sess1, &wamp.Unsubscribe{Request: 2, Subscription: subID1})
+	if _, err := wamp.RecvTimeout(sess1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if subID := subscribe(sess1, wamp.MatchExact); subID != subID1 {
+		t.Fatal("resubscribe got different subscription ID")
+	}
+}
+
+func TestNoPayloadSubscriber(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
+	defer broker.close()
+	checkNoPayload(t, broker)
+
+	// Events sent by fan-out workers.
+	broker = newBroker(logger, false, true, false, debug, nil, 0)
+	broker.fanout = newFanout(context.Background(), 4)
+	defer broker.close()
+	checkNoPayload(t, broker)
+}
+
+func checkNoPayload(t *testing.T, broker *broker) {
+	fullSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.subscribe(fullSess, &wamp.Subscribe{Request: 1, Topic: testTopic})
+	metaSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.subscribe(metaSess, &wamp.Subscribe{
+		Request: 2,
+		Topic:   testTopic,
+		Options: wamp.Dict{wamp.OptNoPayload: true},
+	})
+	for _, sess := range []*wamp.Session{fullSess, metaSess} {
+		if _, err := wamp.RecvTimeout(sess, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pubSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.publish(pubSess, &wamp.Publish{
+		Request:     1,
+		Topic:       testTopic,
+		Arguments:   wamp.List{"hello"},
+		ArgumentsKw: wamp.Dict{"n": 1},
+	})
+
+	recvEvent := func(sess *wamp.Session) *wamp.Event {
+		msg, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		event, ok := msg.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected EVENT, got", msg.MessageType())
+		}
+		return event
+	}
+
+	event := recvEvent(fullSess)
+	if len(event.Arguments) != 1 || event.Arguments[0] != "hello" {
+		t.Fatal("normal subscriber did not get args:", event.Arguments)
+	}
+	if len(event.ArgumentsKw) != 1 {
+		t.Fatal("normal subscriber did not get kwargs:", event.ArgumentsKw)
+	}
+	fullPubID := event.Publication
+
+	event = recvEvent(metaSess)
+	if len(event.Arguments) != 0 || len(event.ArgumentsKw) != 0 {
+		t.Fatal("metadata-only subscriber got payload:", event.Arguments,
+			event.ArgumentsKw)
+	}
+	if event.Publication != fullPubID {
+		t.Fatal("metadata-only subscriber got different publication ID")
+	}
+}
+
+func TestDuplicateSubscribe(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
+	defer broker.close()
+
+	sess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	var subIDs []wamp.ID
+	for i := 0; i < 2; i++ {
+		broker.subscribe(sess, &wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+		msg, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subMsg, ok := msg.(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+		}
+		subIDs = append(subIDs, subMsg.Subscription)
+	}
+	if subIDs[0] != subIDs[1] {
+		t.Fatal("duplicate subscribe returned different subscription ID")
+	}
+
+	// Only one event is delivered for the duplicate subscription.
+	pubSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.publish(pubSess, &wamp.Publish{Request: 1, Topic: testTopic})
+	if _, err := wamp.RecvTimeout(sess, time.Second); err != nil {
+		t.Fatal("did not receive EVENT")
+	}
+	if _, err := wamp.RecvTimeout(sess, 10*time.Millisecond); err == nil {
+		t.Fatal("received duplicate EVENT")
+	}
+}
+
+func TestSubscriptionQuota(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
+	broker.subQuota = newRoleQuota(map[string]Quota{
+		"user": {MaxSubscriptions: 2},
+	}, func(q Quota) int { return q.MaxSubscriptions })
+	defer broker.close()
+
+	userDetails := wamp.Dict{"authrole": "user"}
+	sess1 := wamp.NewSession(newTestPeer(), wamp.GlobalID(), userDetails, nil)
+	sess2 := wamp.NewSession(newTestPeer(), wamp.GlobalID(), userDetails, nil)
+	admin := wamp.NewSession(newTestPeer(), wamp.GlobalID(), wamp.Dict{"authrole": "admin"}, nil)
+
+	subscribe := func(sess *wamp.Session, topic wamp.URI) wamp.Message {
+		broker.subscribe(sess, &wamp.Subscribe{Request: wamp.GlobalID(), Topic: topic})
+		msg, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	checkQuotaError := func(msg wamp.Message) {
+		if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNotAuthorized {
+			t.Fatal("expected ERROR", wamp.ErrNotAuthorized, "got", msg)
+		}
+	}
+
+	msg := subscribe(sess1, "nexus.test.quota.a")
+	subMsg, ok := msg.(*wamp.Subscribed)
+	if !ok {
+		t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+	}
+	if _, ok = subscribe(sess2, "nexus.test.quota.b").(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED")
+	}
+	// The quota is for all sessions with the authrole.
+	checkQuotaError(subscribe(sess1, "nexus.test.quota.c"))
+	checkQuotaError(subscribe(sess2, "nexus.test.quota.a"))
+	// Subscribing again to the same topic does not count.
+	if _, ok = subscribe(sess1, "nexus.test.quota.a").(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED for existing subscription")
+	}
+	// Other authroles are not limited.
+	for _, topic := range []wamp.URI{"nexus.test.quota.a", "nexus.test.quota.c", "nexus.test.quota.d"} {
+		if _, ok = subscribe(admin, topic).(*wamp.Subscribed); !ok {
+			t.Fatal("expected SUBSCRIBED for unlimited authrole")
+		}
+	}
+
+	// Unsubscribing releases quota.
+	broker.unsubscribe(sess1, &wamp.Unsubscribe{
+		Request:      wamp.GlobalID(),
+		Subscription: subMsg.Subscription,
+	})
+	if msg, err := wamp.RecvTimeout(sess1, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok = msg.(*wamp.Unsubscribed); !ok {
+		t.Fatal("expected UNSUBSCRIBED, got", msg.MessageType())
+	}
+	if _, ok = subscribe(sess2, "nexus.test.quota.c").(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED after quota released")
+	}
+	checkQuotaError(subscribe(sess1, "nexus.test.quota.d"))
+
+	// Removing a session releases its quota.
+	broker.removeSession(sess2)
+	for _, topic := range []wamp.URI{"nexus.test.quota.b", "nexus.test.quota.c"} {
+		if _, ok = subscribe(sess1, topic).(*wamp.Subscribed); !ok {
+			t.Fatal("expected SUBSCRIBED after session removed")
+		}
+	}
+	checkQuotaError(subscribe(sess1, "nexus.test.quota.d"))
+}
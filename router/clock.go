@@ -0,0 +1,60 @@
+package router
+
+import "time"
+
+// Clock provides the current time and timers to the router.  The router,
+// realms, and dealers use it for the hello timeout, heartbeat timeouts, drain
+// grace periods, and call timeouts, so that tests can control when timeouts
+// happen instead of waiting for them.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTimer creates a Timer that sends the current time on its channel
+	// after at least duration d.
+	NewTimer(d time.Duration) Timer
+
+	// AfterFunc waits for the duration to elapse and then calls f in its own
+	// goroutine.  The returned Timer has a nil channel.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock.  It behaves like time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+
+	// Stop prevents the Timer from firing.  It returns false if the timer
+	// has already expired or been stopped.
+	Stop() bool
+
+	// Reset changes the timer to expire after duration d.  It returns true if
+	// the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// realClock is the Clock that uses the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
@@ -0,0 +1,199 @@
+package router
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// fakeClock is a Clock whose time only changes when advanced by a test.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	c     chan time.Time
+	f     func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Unix(1500000000, 0),
+		timers: map[*fakeTimer]struct{}{},
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &fakeTimer{clock: c, f: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward, and fires any timers that expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var expired []*fakeTimer
+	for t := range c.timers {
+		if !t.when.After(now) {
+			expired = append(expired, t)
+			delete(c.timers, t)
+		}
+	}
+	c.mu.Unlock()
+	for _, t := range expired {
+		t.fire(now)
+	}
+}
+
+// countTimers returns the number of active timers.
+func (c *fakeClock) countTimers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+func (t *fakeTimer) fire(now time.Time) {
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	_, active := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	_, active := c.timers[t]
+	t.when = c.now.Add(d)
+	if d > 0 {
+		c.timers[t] = struct{}{}
+	} else {
+		delete(c.timers, t)
+	}
+	now := c.now
+	c.mu.Unlock()
+	if d <= 0 {
+		t.fire(now)
+	}
+	return active
+}
+
+func TestFakeClockCallTimeout(t *testing.T) {
+	clock := newFakeClock()
+	dealer := newDealer(context.Background(), logger, false, true, false, debug, 0)
+	dealer.clock = clock
+	defer dealer.close()
+
+	callee := wamp.NewSession(newTestPeer(), 0, nil, nil)
+	dealer.register(callee, &wamp.Register{Request: 123, Procedure: testProcedure})
+	if rsp := <-callee.Recv(); rsp.MessageType() != wamp.REGISTERED {
+		t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+	}
+	caller := wamp.NewSession(newTestPeer(), 0, nil, nil)
+
+	// A call timeout of one hour.
+	dealer.call(caller, &wamp.Call{
+		Request:   125,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: int64(time.Hour / time.Millisecond)},
+	})
+	if rsp := <-callee.Recv(); rsp.MessageType() != wamp.INVOCATION {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	if n := clock.countTimers(); n != 1 {
+		t.Fatal("expected 1 call timeout timer, got", n)
+	}
+
+	clock.Advance(time.Hour - time.Millisecond)
+	if rsp, err := wamp.RecvTimeout(caller, 10*time.Millisecond); err == nil {
+		t.Fatal("call timed out early:", rsp)
+	}
+
+	clock.Advance(time.Millisecond)
+	rsp, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for ERROR")
+	}
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Request != 125 || errMsg.Error != wamp.ErrCanceled {
+		t.Fatal("wrong ERROR for timed out call")
+	}
+}
+
+func TestCallTimeoutStoppedByContext(t *testing.T) {
+	clock := newFakeClock()
+	ctx, cancel := context.WithCancel(context.Background())
+	dealer := newDealer(ctx, logger, false, true, false, debug, 0)
+	dealer.clock = clock
+	defer dealer.close()
+
+	callee := wamp.NewSession(newTestPeer(), 0, nil, nil)
+	dealer.register(callee, &wamp.Register{Request: 123, Procedure: testProcedure})
+	if rsp := <-callee.Recv(); rsp.MessageType() != wamp.REGISTERED {
+		t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+	}
+	caller := wamp.NewSession(newTestPeer(), 0, nil, nil)
+	dealer.call(caller, &wamp.Call{
+		Request:   125,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: int64(time.Hour / time.Millisecond)},
+	})
+	if rsp := <-callee.Recv(); rsp.MessageType() != wamp.INVOCATION {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+
+	// Canceling the realm's context stops the call timeout timer.
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for clock.countTimers() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("call timeout timer not stopped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Hour)
+	if rsp, err := wamp.RecvTimeout(caller, 10*time.Millisecond); err == nil {
+		t.Fatal("call timed out after context canceled:", rsp)
+	}
+}
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"fmt"
+
+	"github.com/gammazero/nexus/stdlog"
+	"github.com/gammazero/nexus/wamp"
+)
+
+// deadLetterQueueSize is the number of undeliverable messages buffered for a
+// realm's DeadLetterHandler.  When the buffer is full, further messages are
+// logged and dropped.
+const deadLetterQueueSize = 256
+
+// DeadLetterHandler is called with a message that the router was unable to
+// deliver, and the reason it could not be delivered.  This is called for
+// EVENT messages that could not be sent to a subscriber, and for INVOCATION
+// messages that could not be sent to a callee.
+//
+// The handler is called from a separate goroutine, one message at a time, so
+// that a slow handler does not stall routing.  The message must not be
+// modified by the handler.
+type DeadLetterHandler func(msg wamp.Message, reason error)
+
+type deadLetter struct {
+	msg    wamp.Message
+	reason error
+}
+
+// deadLetters passes undeliverable messages to a DeadLetterHandler.  Adding a
+// message never blocks; if the queue is full, then the message is dropped.
+type deadLetters struct {
+	handler DeadLetterHandler
+	queue   chan deadLetter
+	stop    chan struct{}
+	done    chan struct{}
+	log     stdlog.StdLog
+}
+
+// newDeadLetters starts a goroutine that calls the handler for each message
+// added.  If the handler is nil, then nil is returned.
+func newDeadLetters(handler DeadLetterHandler, logger stdlog.StdLog) *deadLetters {
+	if handler == nil {
+		return nil
+	}
+	d := &deadLetters{
+		handler: handler,
+		queue:   make(chan deadLetter, deadLetterQueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		log:     logger,
+	}
+	go d.run()
+	return d
+}
+
+func (d *deadLetters) run() {
+	defer close(d.done)
+	for {
+		select {
+		case dl := <-d.queue:
+			d.handler(dl.msg, dl.reason)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// add queues a message that could not be delivered to the session.  It is
+// safe to call on a nil deadLetters, in which case nothing is done.
+func (d *deadLetters) add(msg wamp.Message, sess *wamp.Session, err error) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.queue <- deadLetter{msg, fmt.Errorf("cannot send to session %s: %s", sess, err)}:
+	default:
+		d.log.Println("Dead letter queue full, dropped", msg.MessageType())
+	}
+}
+
+// close stops calling the handler and waits for any call in progress to
+// return.  Messages remaining in the queue are discarded.
+func (d *deadLetters) close() {
+	if d == nil {
+		return
+	}
+	close(d.stop)
+	<-d.done
+}
@@ -0,0 +1,132 @@
+package router
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// closingPeer is a test peer that fails to send any message once it is
+// closed, as happens when a client's connection is lost.
+type closingPeer struct {
+	*testPeer
+	closed int32
+}
+
+func (p *closingPeer) TrySend(msg wamp.Message) error {
+	if atomic.LoadInt32(&p.closed) != 0 {
+		return errors.New("peer closed")
+	}
+	return p.testPeer.TrySend(msg)
+}
+
+func (p *closingPeer) Close() { atomic.StoreInt32(&p.closed, 1) }
+
+type deadLetterRecorder chan deadLetter
+
+func (r deadLetterRecorder) handle(msg wamp.Message, reason error) {
+	r <- deadLetter{msg, reason}
+}
+
+func (r deadLetterRecorder) wait(t *testing.T, msgType wamp.MessageType) {
+	select {
+	case dl := <-r:
+		if dl.msg.MessageType() != msgType {
+			t.Fatal("expected dead letter", msgType, "got", dl.msg.MessageType())
+		}
+		if dl.reason == nil {
+			t.Fatal("dead letter has no reason")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for dead letter")
+	}
+}
+
+func TestDeadLetterEvent(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
+	defer broker.close()
+	recorder := make(deadLetterRecorder, 1)
+	broker.deadLetters = newDeadLetters(recorder.handle, logger)
+	defer broker.deadLetters.close()
+
+	subscriber := &closingPeer{testPeer: newTestPeer()}
+	subSess := wamp.NewSession(subscriber, wamp.GlobalID(), nil, nil)
+	broker.subscribe(subSess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+	if _, err := wamp.RecvTimeout(subSess, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscriber's peer closes before the event is delivered.
+	subscriber.Close()
+
+	publisher := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.publish(publisher, &wamp.Publish{Request: 124, Topic: testTopic})
+	recorder.wait(t, wamp.EVENT)
+}
+
+func TestDeadLetterInvocation(t *testing.T) {
+	dealer, _ := newTestDealer()
+	defer dealer.close()
+	recorder := make(deadLetterRecorder, 1)
+	dealer.deadLetters = newDeadLetters(recorder.handle, logger)
+	defer dealer.deadLetters.close()
+
+	callee := &closingPeer{testPeer: newTestPeer()}
+	calleeSess := wamp.NewSession(callee, wamp.GlobalID(), nil, nil)
+	dealer.register(calleeSess, &wamp.Register{Request: 123, Procedure: testProcedure})
+	if _, err := wamp.RecvTimeout(calleeSess, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Callee's peer closes before the invocation is delivered.
+	callee.Close()
+
+	caller := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	dealer.call(caller, &wamp.Call{Request: 124, Procedure: testProcedure})
+	recorder.wait(t, wamp.INVOCATION)
+
+	// Caller is still sent an error.
+	rsp, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNetworkFailure {
+		t.Fatal("expected ERROR", wamp.ErrNetworkFailure, "got", rsp)
+	}
+}
+
+func TestDeadLetterHandlerNotBlocking(t *testing.T) {
+	release := make(chan struct{})
+	handled := make(chan struct{}, deadLetterQueueSize+10)
+	deadLetters := newDeadLetters(func(msg wamp.Message, reason error) {
+		<-release
+		handled <- struct{}{}
+	}, logger)
+
+	// Adding more dead letters than the queue holds, while the handler is
+	// blocked, must not block the caller.
+	done := make(chan struct{})
+	go func() {
+		sess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+		for i := 0; i < deadLetterQueueSize+10; i++ {
+			deadLetters.add(&wamp.Event{}, sess, errors.New("blocked"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("adding dead letters blocked")
+	}
+
+	close(release)
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("handler not called")
+	}
+	deadLetters.close()
+}
@@ -1,7 +1,9 @@
 package router
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"strings"
 	"time"
@@ -20,6 +22,7 @@ const (
 	featurePatternBasedReg  = "pattern_based_registration"
 	featureProgCallResults  = "progressive_call_results"
 	featureSessionMetaAPI   = "session_meta_api"
+	featureShardedReg       = "sharded_registration"
 	featureSharedReg        = "shared_registration"
 	featureRegMetaAPI       = "registration_meta_api"
 	featureTestamentMetaAPI = "testament_meta_api"
@@ -39,8 +42,10 @@ var dealerRole = wamp.Dict{
 		featureCallTimeout:      true,
 		featureCallerIdent:      true,
 		featurePatternBasedReg:  true,
+		featurePayloadPassthru:  true,
 		featureProgCallResults:  true,
 		featureSessionMetaAPI:   true,
+		featureShardedReg:       true,
 		featureSharedReg:        true,
 		featureRegMetaAPI:       true,
 		featureTestamentMetaAPI: true,
@@ -60,14 +65,72 @@ type registration struct {
 	// Multiple sessions can register as callees depending on invocation policy
 	// resulting in multiple procedures for the same registration ID.
 	callees []*wamp.Session
+
+	// Maximum number of concurrent invocations for each callee that
+	// registered with a concurrency limit, and the number of invocations in
+	// progress for those callees.
+	concurrency map[*wamp.Session]int
+	inflight    map[*wamp.Session]int
+}
+
+// setConcurrency sets the maximum number of concurrent invocations for the
+// callee.  A limit of zero means no limit.
+func (reg *registration) setConcurrency(callee *wamp.Session, limit int) {
+	if limit <= 0 {
+		return
+	}
+	if reg.concurrency == nil {
+		reg.concurrency = map[*wamp.Session]int{}
+		reg.inflight = map[*wamp.Session]int{}
+	}
+	reg.concurrency[callee] = limit
+}
+
+// available returns true if the callee may be sent another invocation.
+func (reg *registration) available(callee *wamp.Session) bool {
+	limit, ok := reg.concurrency[callee]
+	return !ok || reg.inflight[callee] < limit
+}
+
+// nextAvailable returns the first callee after the given one, in registration
+// order, that may be sent another invocation.  Returns nil if there is none.
+func (reg *registration) nextAvailable(callee *wamp.Session) *wamp.Session {
+	start := 0
+	for i := range reg.callees {
+		if reg.callees[i] == callee {
+			start = i + 1
+			break
+		}
+	}
+	for i := 0; i < len(reg.callees); i++ {
+		c := reg.callees[(start+i)%len(reg.callees)]
+		if reg.available(c) {
+			return c
+		}
+	}
+	return nil
 }
 
 // invocation tracks in-progress invocation
 type invocation struct {
 	callID     requestID
 	callee     *wamp.Session
+	procedure  wamp.URI
 	canceled   bool
+	progress   bool // caller requested and callee supports progress
 	retryCount int
+	timer      Timer // enforces call timeout, if any
+
+	// Registration whose concurrency limit the invocation counts against.
+	// This is nil if the callee has no concurrency limit.
+	reg *registration
+}
+
+// stopTimeout stops the invocation's call timeout timer, if there is one.
+func (invk *invocation) stopTimeout() {
+	if invk.timer != nil {
+		invk.timer.Stop()
+	}
 }
 
 type requestID struct {
@@ -100,6 +163,16 @@ type dealer struct {
 
 	actionChan chan func()
 
+	// Call timeout timers submit actions here, since actionChan may be
+	// closed by the time a timer fires.  Closed when run() exits.
+	timeoutChan chan func()
+	done        chan struct{}
+
+	// The realm's context.  When it is canceled, call timeout timers are
+	// stopped.  The dealer itself keeps running until close is called, since
+	// the realm still removes its sessions and calls while closing.
+	ctx context.Context
+
 	// Generate registration IDs.
 	idGen *wamp.IDGen
 
@@ -109,9 +182,22 @@ type dealer struct {
 	// Dealer behavior flags.
 	strictURI     bool
 	allowDisclose bool
+	forceDisclose bool
+
+	// Maximum time a call may wait for a result.  Zero means no limit.
+	maxCallTimeout time.Duration
 
 	metaPeer wamp.Peer
 
+	// Receives invocations that could not be sent to callees.  May be nil.
+	deadLetters *deadLetters
+	// Traces calls and their results.  May be nil.
+	tracer Tracer
+	// Times call timeouts and RESULT retries.
+	clock Clock
+	// Limits the registrations of each authrole.  May be nil.
+	regQuota *roleQuota
+
 	// Meta-procedure registration ID -> handler func.
 	metaProcMap map[wamp.ID]func(*wamp.Invocation) wamp.Message
 
@@ -125,7 +211,7 @@ type dealer struct {
 // This serialization is limited to the work of determining the message's
 // destination, and then the message is handed off to the next goroutine,
 // typically the receiving client's send handler.
-func newDealer(logger stdlog.StdLog, strictURI, allowDisclose, debug bool) *dealer {
+func newDealer(ctx context.Context, logger stdlog.StdLog, strictURI, allowDisclose, forceDisclose, debug bool, maxCallTimeout time.Duration) *dealer {
 	d := &dealer{
 		procRegMap:    map[wamp.URI]*registration{},
 		pfxProcRegMap: map[wamp.URI]*registration{},
@@ -143,11 +229,18 @@ func newDealer(logger stdlog.StdLog, strictURI, allowDisclose, debug bool) *deal
 		// channel is appropriate.
 		actionChan: make(chan func()),
 
+		timeoutChan: make(chan func()),
+		done:        make(chan struct{}),
+		ctx:         ctx,
+
 		idGen: new(wamp.IDGen),
 		prng:  rand.New(rand.NewSource(time.Now().Unix())),
 
-		strictURI:     strictURI,
-		allowDisclose: allowDisclose,
+		strictURI:      strictURI,
+		allowDisclose:  allowDisclose,
+		forceDisclose:  forceDisclose,
+		maxCallTimeout: maxCallTimeout,
+		clock:          realClock{},
 
 		log:   logger,
 		debug: debug,
@@ -166,7 +259,38 @@ func (d *dealer) setMetaPeer(metaPeer wamp.Peer) {
 // role returns the role information for the "dealer" role.  The data returned
 // is suitable for use as broker role info in a WELCOME message.
 func (d *dealer) role() wamp.Dict {
-	return dealerRole
+	features := wamp.Dict{}
+	for f, v := range dealerRole["features"].(wamp.Dict) {
+		features[f] = v
+	}
+	if !d.allowDisclose {
+		delete(features, featureCallerIdent)
+	}
+	return wamp.Dict{"features": features}
+}
+
+// countRegistrations returns the number of registrations currently held by the
+// dealer.
+func (d *dealer) countRegistrations() int {
+	count := make(chan int)
+	d.actionChan <- func() {
+		count <- len(d.registrations)
+	}
+	return <-count
+}
+
+// sessionRegistrations returns the IDs of the registrations held by the
+// session.
+func (d *dealer) sessionRegistrations(sess *wamp.Session) []wamp.ID {
+	ids := make(chan []wamp.ID)
+	d.actionChan <- func() {
+		regIDs := make([]wamp.ID, 0, len(d.calleeRegIDSet[sess]))
+		for id := range d.calleeRegIDSet[sess] {
+			regIDs = append(regIDs, id)
+		}
+		ids <- regIDs
+	}
+	return <-ids
 }
 
 // register registers a callee to handle calls to a procedure.
@@ -182,7 +306,28 @@ func (d *dealer) register(callee *wamp.Session, msg *wamp.Register) {
 	// Validate procedure URI.  For REGISTER, must be valid URI (either strict
 	// or loose), and all URI components must be non-empty other than for
 	// wildcard or prefix matched procedures.
-	match, _ := wamp.AsString(msg.Options[wamp.OptMatch])
+	match, ok := policyOption(msg.Options, wamp.OptMatch, validMatchPolicy)
+	if !ok {
+		d.trySend(callee, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{fmt.Sprint("unknown match policy: ", msg.Options[wamp.OptMatch])},
+		})
+		return
+	}
+	invoke, ok := policyOption(msg.Options, wamp.OptInvoke, validInvokePolicy)
+	if !ok {
+		d.trySend(callee, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{fmt.Sprint("unknown invocation policy: ", msg.Options[wamp.OptInvoke])},
+		})
+		return
+	}
 	if !msg.Procedure.ValidURI(d.strictURI, match) {
 		errMsg := fmt.Sprintf(
 			"register for invalid procedure URI %v (URI strict checking %v)",
@@ -190,6 +335,7 @@ func (d *dealer) register(callee *wamp.Session, msg *wamp.Register) {
 		d.trySend(callee, &wamp.Error{
 			Type:      msg.MessageType(),
 			Request:   msg.Request,
+			Details:   wamp.Dict{},
 			Error:     wamp.ErrInvalidURI,
 			Arguments: wamp.List{errMsg},
 		})
@@ -206,6 +352,7 @@ func (d *dealer) register(callee *wamp.Session, msg *wamp.Register) {
 		d.trySend(callee, &wamp.Error{
 			Type:      msg.MessageType(),
 			Request:   msg.Request,
+			Details:   wamp.Dict{},
 			Error:     wamp.ErrInvalidURI,
 			Arguments: wamp.List{errMsg},
 		})
@@ -231,11 +378,12 @@ func (d *dealer) register(callee *wamp.Session, msg *wamp.Register) {
 		}
 	}
 
-	invoke, _ := wamp.AsString(msg.Options[wamp.OptInvoke])
+	// A callee may limit the number of concurrent invocations it is sent.
+	concurrency, _ := wamp.AsInt64(msg.Options[wamp.OptConcurrency])
 	var metaPubs []*wamp.Publish
 	done := make(chan struct{})
 	d.actionChan <- func() {
-		metaPubs = d.syncRegister(callee, msg, match, invoke, disclose, wampURI)
+		metaPubs = d.syncRegister(callee, msg, match, invoke, disclose, wampURI, int(concurrency))
 		close(done)
 	}
 	<-done
@@ -267,11 +415,64 @@ func (d *dealer) call(caller *wamp.Session, msg *wamp.Call) {
 	if caller == nil || msg == nil {
 		panic("dealer.Call with nil session or message")
 	}
+	if d.tracer != nil {
+		d.tracer.OnCall(traceInfo(caller, msg.Request, msg.Procedure))
+	}
+
+	// Validate procedure URI.  For CALL, must be valid URI (either strict or
+	// loose), and all URI components must be non-empty.
+	if !msg.Procedure.ValidURI(d.strictURI, "") {
+		errMsg := fmt.Sprintf(
+			"call with invalid procedure URI %v (URI strict checking %v)",
+			msg.Procedure, d.strictURI)
+		d.trySend(caller, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrInvalidURI,
+			Arguments: wamp.List{errMsg},
+		})
+		return
+	}
+	if timeout, ok := msg.Options[wamp.OptTimeout]; ok {
+		if _, ok = wamp.AsInt64(timeout); !ok {
+			d.trySend(caller, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrInvalidArgument,
+				Arguments: wamp.List{fmt.Sprint("invalid call timeout: ", timeout)},
+			})
+			return
+		}
+	}
+	if err := checkPPT(msg.Options, msg.Arguments, msg.ArgumentsKw); err != nil {
+		d.trySend(caller, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{err.Error()},
+		})
+		return
+	}
+
 	d.actionChan <- func() {
 		d.syncCall(caller, msg)
 	}
 }
 
+// validInvokePolicy returns true if invoke is one of the invocation policies,
+// or is empty for the default single policy.
+func validInvokePolicy(invoke string) bool {
+	switch invoke {
+	case "", wamp.InvokeSingle, wamp.InvokeRoundRobin, wamp.InvokeRandom,
+		wamp.InvokeFirst, wamp.InvokeLast, wamp.InvokePartition:
+		return true
+	}
+	return false
+}
+
 // cancel actively cancels a call that is in progress.
 //
 // Cancellation behaves differently depending on the mode:
@@ -304,6 +505,7 @@ func (d *dealer) cancel(caller *wamp.Session, msg *wamp.Cancel) {
 		d.trySend(caller, &wamp.Error{
 			Type:      msg.MessageType(),
 			Request:   msg.Request,
+			Details:   wamp.Dict{},
 			Error:     wamp.ErrInvalidArgument,
 			Arguments: wamp.List{fmt.Sprint("invalid cancel mode ", mode)},
 		})
@@ -336,15 +538,15 @@ func (d *dealer) yield(callee *wamp.Session, msg *wamp.Yield) {
 	if again {
 		retry := true
 		delay := yieldRetryDelay
-		start := time.Now()
+		start := d.clock.Now()
 		// Retry processing YIELD until caller gone or deadline reached
 		for {
 			if d.debug {
-				d.log.Println("Retry sending RESULT after", delay)
+				stdlog.Debug(d.log, "Retry sending RESULT after", delay)
 			}
-			<-time.After(delay)
+			<-d.clock.After(delay)
 			// Do not retry if the elapsed time exceeds deadline
-			if time.Since(start) >= sendResultDeadline {
+			if d.clock.Now().Sub(start) >= sendResultDeadline {
 				retry = false
 			}
 			d.actionChan <- func() {
@@ -374,7 +576,8 @@ func (d *dealer) error(msg *wamp.Error) {
 // client leaves the realm by sending a GOODBYE message or by disconnecting
 // from the router.  If there are any registrations for this session
 // wamp.registration.on_unregister and wamp.registration.on_delete meta events
-// are published for each.
+// are published for each.  Callers with invocations pending on the session
+// are sent an ERROR with wamp.ErrCanceled.
 func (d *dealer) removeSession(sess *wamp.Session) {
 	if sess == nil {
 		// No session specified, no session removed.
@@ -396,21 +599,60 @@ func (d *dealer) removeSession(sess *wamp.Session) {
 	}
 }
 
+// cancelCalls fails every call that is waiting for a result, by sending the
+// caller an ERROR with the given reason, and removes the call's invocation.
+// Callees that support call canceling are sent an INTERRUPT with mode
+// "killnowait", so they can stop work on the canceled invocations.  This is
+// called when the realm is shutting down, so that callers are not left
+// waiting for results that will never come.  Returns the number of calls that
+// were canceled.
+func (d *dealer) cancelCalls(reason wamp.URI) int {
+	var n int
+	done := make(chan struct{})
+	d.actionChan <- func() {
+		n = d.syncCancelCalls(reason)
+		close(done)
+	}
+	<-done
+	return n
+}
+
 // close stops the dealer, letting already queued actions finish.
 func (d *dealer) close() {
 	close(d.actionChan)
 }
 
 func (d *dealer) run() {
-	for action := range d.actionChan {
-		action()
+	defer close(d.done)
+	ctxDone := d.ctx.Done()
+	for {
+		select {
+		case action, ok := <-d.actionChan:
+			if !ok {
+				d.stopTimeouts()
+				if d.debug {
+					stdlog.Debug(d.log, "Dealer stopped")
+				}
+				return
+			}
+			action()
+		case action := <-d.timeoutChan:
+			action()
+		case <-ctxDone:
+			d.stopTimeouts()
+			ctxDone = nil
+		}
 	}
-	if d.debug {
-		d.log.Print("Dealer stopped")
+}
+
+// stopTimeouts stops the timers for any calls still pending.
+func (d *dealer) stopTimeouts() {
+	for _, invk := range d.invocations {
+		invk.stopTimeout()
 	}
 }
 
-func (d *dealer) syncRegister(callee *wamp.Session, msg *wamp.Register, match, invokePolicy string, disclose, wampURI bool) []*wamp.Publish {
+func (d *dealer) syncRegister(callee *wamp.Session, msg *wamp.Register, match, invokePolicy string, disclose, wampURI bool, concurrency int) []*wamp.Publish {
 	var metaPubs []*wamp.Publish
 	var reg *registration
 	switch match {
@@ -427,6 +669,10 @@ func (d *dealer) syncRegister(callee *wamp.Session, msg *wamp.Register, match, i
 	// If no existing registration found for the procedure, then create a new
 	// registration.
 	if reg == nil {
+		if !d.regQuota.acquire(callee) {
+			d.trySend(callee, quotaError(msg.MessageType(), msg.Request, "registration"))
+			return metaPubs
+		}
 		regID = d.idGen.Next()
 		created = wamp.NowISO8601()
 		reg = &registration{
@@ -469,6 +715,22 @@ func (d *dealer) syncRegister(callee *wamp.Session, msg *wamp.Register, match, i
 		// There is an existing registration(s) for this procedure.  See if
 		// invocation policy allows another.
 
+		// The session is already a callee of a shared registration.  Adding
+		// it again would make it a callee twice.
+		for i := range reg.callees {
+			if reg.callees[i] == callee {
+				d.log.Println("REGISTER for procedure", msg.Procedure,
+					"already registered by callee", callee)
+				d.trySend(callee, &wamp.Error{
+					Type:    msg.MessageType(),
+					Request: msg.Request,
+					Details: wamp.Dict{},
+					Error:   wamp.ErrProcedureAlreadyExists,
+				})
+				return metaPubs
+			}
+		}
+
 		// Found an existing registration that has an invocation strategy that
 		// only allows a single callee on a the given registration.
 		if reg.policy == "" || reg.policy == wamp.InvokeSingle {
@@ -498,11 +760,16 @@ func (d *dealer) syncRegister(callee *wamp.Session, msg *wamp.Register, match, i
 			return metaPubs
 		}
 
+		if !d.regQuota.acquire(callee) {
+			d.trySend(callee, quotaError(msg.MessageType(), msg.Request, "registration"))
+			return metaPubs
+		}
 		regID = reg.id
 
 		// Add callee for the registration.
 		reg.callees = append(reg.callees, callee)
 	}
+	reg.setConcurrency(callee, concurrency)
 
 	// Add the registration ID to the callees set of registrations.
 	if _, ok := d.calleeRegIDSet[callee]; !ok {
@@ -511,7 +778,7 @@ func (d *dealer) syncRegister(callee *wamp.Session, msg *wamp.Register, match, i
 	d.calleeRegIDSet[callee][regID] = struct{}{}
 
 	if d.debug {
-		d.log.Printf("Registered procedure %v (regID=%v) to callee %v",
+		stdlog.Debugf(d.log, "Registered procedure %v (regID=%v) to callee %v",
 			msg.Procedure, regID, callee)
 	}
 	d.trySend(callee, &wamp.Registered{
@@ -556,6 +823,7 @@ func (d *dealer) syncUnregister(callee *wamp.Session, msg *wamp.Unregister) []*w
 		return metaPubs
 	}
 
+	d.regQuota.release(callee, 1)
 	d.trySend(callee, &wamp.Unregistered{Request: msg.Request})
 
 	if d.metaPeer == nil {
@@ -613,10 +881,15 @@ func (d *dealer) syncMatchProcedure(procedure wamp.URI) (*registration, bool) {
 			return reg, ok
 		}
 
+		// If wildcard patterns of the same length match, then prefer the one
+		// that is more specific, so that the choice does not depend on map
+		// iteration order.
+		var wcMatch wamp.URI
 		for wcProc, wcReg := range d.wcProcRegMap {
 			if procedure.WildcardMatch(wcProc) {
-				if len(wcProc) > matchCount {
+				if len(wcProc) > matchCount || (len(wcProc) == matchCount && moreSpecificWildcard(wcProc, wcMatch)) {
 					reg = wcReg
+					wcMatch = wcProc
 					matchCount = len(wcProc)
 					ok = true
 				}
@@ -626,6 +899,54 @@ func (d *dealer) syncMatchProcedure(procedure wamp.URI) (*registration, bool) {
 	return reg, ok
 }
 
+// moreSpecificWildcard returns true if wildcard pattern a is more specific
+// than wildcard pattern b.  At the first component where only one of the
+// patterns has a wildcard, the pattern without the wildcard is more specific.
+// If neither is more specific, then the lesser pattern is chosen.
+func moreSpecificWildcard(a, b wamp.URI) bool {
+	aParts := strings.Split(string(a), ".")
+	bParts := strings.Split(string(b), ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if (aParts[i] == "") != (bParts[i] == "") {
+			return aParts[i] != ""
+		}
+	}
+	return a < b
+}
+
+// partitionCallee selects the callee for a partition key using rendezvous
+// hashing.  Each callee is scored by hashing the key together with the
+// callee's session ID, and the callee with the highest score is selected.
+// This maps a key to the same callee for as long as that callee is registered,
+// and when a callee is removed, only the keys that mapped to it are moved to
+// the remaining callees.
+func partitionCallee(callees []*wamp.Session, rkey string) *wamp.Session {
+	h := fnv.New64a()
+	h.Write([]byte(rkey))
+	keyHash := h.Sum64()
+
+	var best *wamp.Session
+	var bestScore uint64
+	for _, callee := range callees {
+		score := mix64(keyHash ^ mix64(uint64(callee.ID)))
+		if best == nil || score > bestScore {
+			best, bestScore = callee, score
+		}
+	}
+	return best
+}
+
+// mix64 is the 64-bit finalizer from MurmurHash3.  It spreads the bits of x so
+// that similar inputs, such as sequential session IDs, give unrelated scores.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
 func (d *dealer) syncCall(caller *wamp.Session, msg *wamp.Call) {
 	reg, ok := d.syncMatchProcedure(msg.Procedure)
 	if !ok || len(reg.callees) == 0 {
@@ -641,9 +962,28 @@ func (d *dealer) syncCall(caller *wamp.Session, msg *wamp.Call) {
 
 	var callee *wamp.Session
 
-	// If there are multiple callees, then select a callee based invocation
-	// policy.
-	if len(reg.callees) > 1 {
+	// A partitioned call is sent to the callee selected by the call's
+	// partition key, so that calls with the same key go to the same callee.
+	// A call is partitioned if the registration has the partition invocation
+	// policy, or if the caller requests the partition run mode.
+	runMode, _ := wamp.AsString(msg.Options[wamp.OptRunMode])
+	partitioned := reg.policy == wamp.InvokePartition || runMode == wamp.RunModePartition
+	if partitioned {
+		rkey, _ := wamp.AsString(msg.Options[wamp.OptRKey])
+		if rkey == "" {
+			d.trySend(caller, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrInvalidArgument,
+				Arguments: wamp.List{"partitioned call requires rkey option"},
+			})
+			return
+		}
+		callee = partitionCallee(reg.callees, rkey)
+	} else if len(reg.callees) > 1 {
+		// If there are multiple callees, then select a callee based
+		// invocation policy.
 		switch reg.policy {
 		case wamp.InvokeFirst:
 			callee = reg.callees[0]
@@ -667,6 +1007,30 @@ func (d *dealer) syncCall(caller *wamp.Session, msg *wamp.Call) {
 	} else {
 		callee = reg.callees[0]
 	}
+
+	// If the selected callee is already handling as many invocations as it
+	// allows, then try the other callees of a shared registration.  A
+	// partitioned call is not moved to another callee, since that callee does
+	// not have the state for the call's partition key.
+	if !reg.available(callee) {
+		errArg := "all callees at maximum concurrency"
+		if partitioned {
+			callee = nil
+			errArg = "partition callee at maximum concurrency"
+		} else {
+			callee = reg.nextAvailable(callee)
+		}
+		if callee == nil {
+			d.trySend(caller, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrMaxConcurrencyReached,
+				Arguments: wamp.List{errArg},
+			})
+			return
+		}
+	}
 	details := wamp.Dict{}
 
 	// A Caller might want to issue a call providing a timeout for the call to
@@ -674,16 +1038,18 @@ func (d *dealer) syncCall(caller *wamp.Session, msg *wamp.Call) {
 	//
 	// A timeout allows to automatically cancel a call after a specified time
 	// either at the Callee or at the Dealer.
-	timeout, _ := wamp.AsInt64(msg.Options[wamp.OptTimeout])
+	timeoutMs, _ := wamp.AsInt64(msg.Options[wamp.OptTimeout])
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	// Do not let the caller wait longer than the maximum allowed, including
+	// when the caller did not request any timeout.
+	if d.maxCallTimeout > 0 && (timeout <= 0 || timeout > d.maxCallTimeout) {
+		timeout = d.maxCallTimeout
+	}
 	if timeout > 0 {
 		// Check that callee supports call_timeout.
 		if callee.HasFeature(roleCallee, featureCallTimeout) {
-			details[wamp.OptTimeout] = timeout
+			details[wamp.OptTimeout] = int64(timeout / time.Millisecond)
 		}
-
-		// TODO: Start a goroutine to cancel the pending call on timeout.
-		// Should be implemented like Cancel with mode=killnowait, and error
-		// message argument should say "call timeout"
 	}
 
 	// TODO: handle trust levels
@@ -714,6 +1080,9 @@ func (d *dealer) syncCall(caller *wamp.Session, msg *wamp.Call) {
 			if callee.HasFeature(roleCallee, featureCallerIdent) {
 				discloseCaller(caller, details)
 			}
+		} else if d.forceDisclose && callee.HasFeature(roleCallee, featureCallerIdent) {
+			// Realm policy is to always disclose caller identity.
+			discloseCaller(caller, details)
 		}
 	}
 
@@ -730,12 +1099,14 @@ func (d *dealer) syncCall(caller *wamp.Session, msg *wamp.Call) {
 			details[wamp.OptReceiveProgress] = true
 		}
 	}
+	_, progress := details[wamp.OptReceiveProgress]
 
 	if reg.match != wamp.MatchExact {
 		// According to the spec, a router must provide the actual procedure to
 		// the client.
 		details[wamp.OptProcedure] = msg.Procedure
 	}
+	addPPTDetails(details, msg.Options)
 
 	reqID := requestID{
 		session: caller.ID,
@@ -743,11 +1114,29 @@ func (d *dealer) syncCall(caller *wamp.Session, msg *wamp.Call) {
 	}
 	d.calls[reqID] = caller
 	invocationID := d.idGen.Next()
-	d.invocations[invocationID] = &invocation{
-		callID: reqID,
-		callee: callee,
+	invk := &invocation{
+		callID:    reqID,
+		callee:    callee,
+		procedure: msg.Procedure,
+		progress:  progress,
 	}
+	d.invocations[invocationID] = invk
 	d.invocationByCall[reqID] = invocationID
+	if _, ok = reg.concurrency[callee]; ok {
+		invk.reg = reg
+		reg.inflight[callee]++
+	}
+
+	// Cancel the call if the callee does not respond in time.
+	if timeout > 0 {
+		invk.timer = d.clock.AfterFunc(timeout, func() {
+			select {
+			case d.timeoutChan <- func() { d.syncCallTimeout(invocationID, invk) }:
+			case <-d.done:
+			case <-d.ctx.Done():
+			}
+		})
+	}
 
 	// Send INVOCATION to the endpoint that has registered the requested
 	// procedure.
@@ -840,7 +1229,7 @@ func (d *dealer) syncCancel(caller *wamp.Session, msg *wamp.Cancel, mode string,
 	// This also stops repeated CANCEL messages.
 	delete(d.calls, reqID)
 	delete(d.invocationByCall, reqID)
-	delete(d.invocations, invocationID)
+	d.syncDelInvocation(invocationID, invk)
 
 	// Send error to the caller.
 	d.trySend(caller, &wamp.Error{
@@ -851,6 +1240,45 @@ func (d *dealer) syncCancel(caller *wamp.Session, msg *wamp.Cancel, mode string,
 	})
 }
 
+// syncCallTimeout cancels a call that has not completed within its timeout.
+// This works like a cancel with mode "killnowait": the callee is sent an
+// INTERRUPT, if it supports call canceling, and the caller is immediately sent
+// an ERROR.
+func (d *dealer) syncCallTimeout(invocationID wamp.ID, invk *invocation) {
+	// If the invocation has already finished, then nothing to do.
+	if d.invocations[invocationID] != invk {
+		return
+	}
+	callID := invk.callID
+	caller, ok := d.calls[callID]
+	if !ok {
+		return
+	}
+	if !invk.canceled && invk.callee.HasFeature(roleCallee, featureCallCanceling) {
+		if d.trySend(invk.callee, &wamp.Interrupt{
+			Request: invocationID,
+			Options: wamp.Dict{
+				wamp.OptReason: wamp.ErrCanceled,
+				wamp.OptMode:   wamp.CancelModeKillNoWait,
+			},
+		}) && d.debug {
+			stdlog.Debug(d.log, "Dealer sent INTERRUPT for timed out invocation",
+				invocationID, "for call", callID.request)
+		}
+	}
+	delete(d.calls, callID)
+	delete(d.invocationByCall, callID)
+	d.syncDelInvocation(invocationID, invk)
+
+	d.trySend(caller, &wamp.Error{
+		Type:      wamp.CALL,
+		Request:   callID.request,
+		Error:     wamp.ErrCanceled,
+		Details:   wamp.Dict{},
+		Arguments: wamp.List{"call timeout"},
+	})
+}
+
 func (d *dealer) syncYield(callee *wamp.Session, msg *wamp.Yield, canRetry bool) bool {
 	progress, _ := msg.Options[wamp.OptProgress].(bool)
 
@@ -888,11 +1316,42 @@ func (d *dealer) syncYield(callee *wamp.Session, msg *wamp.Yield, canRetry bool)
 		return false
 	}
 
+	// The callee must not send progressive results unless the caller asked
+	// for them.  Treat this as a protocol violation by the callee: interrupt
+	// the invocation and return an error to the caller.
+	if progress && !invk.progress {
+		d.log.Println("Callee", callee, "sent progressive YIELD for request",
+			msg.Request, "that did not request progress")
+		if caller, ok := d.calls[invk.callID]; ok {
+			d.syncCancel(caller, &wamp.Cancel{Request: invk.callID.request},
+				wamp.CancelModeKillNoWait, wamp.ErrProtocolViolation)
+		}
+		return false
+	}
+
+	// A YIELD with invalid payload passthru options cannot be delivered as a
+	// RESULT.  Cancel the call, returning an error to the caller, and
+	// interrupt the invocation if more progressive results may follow.
+	if err := checkPPT(msg.Options, msg.Arguments, msg.ArgumentsKw); err != nil {
+		d.log.Println("Callee", callee, "sent invalid YIELD for request",
+			msg.Request, ":", err)
+		if caller, ok := d.calls[invk.callID]; ok {
+			mode := wamp.CancelModeSkip
+			if progress {
+				mode = wamp.CancelModeKillNoWait
+			}
+			d.syncCancel(caller, &wamp.Cancel{Request: invk.callID.request},
+				mode, wamp.ErrInvalidArgument)
+		}
+		return false
+	}
+
 	callID := invk.callID
 	// Find caller for this result.
 	caller, ok := d.calls[callID]
 
 	details := wamp.Dict{}
+	addPPTDetails(details, msg.Options)
 
 	var keepInvocation bool
 	if progress {
@@ -904,7 +1363,7 @@ func (d *dealer) syncYield(callee *wamp.Session, msg *wamp.Yield, canRetry bool)
 			if keepInvocation {
 				return
 			}
-			delete(d.invocations, msg.Request)
+			d.syncDelInvocation(msg.Request, invk)
 			// Delete callID -> invocation.
 			delete(d.invocationByCall, callID)
 			// Delete pending call since it is finished.
@@ -931,12 +1390,15 @@ func (d *dealer) syncYield(callee *wamp.Session, msg *wamp.Yield, canRetry bool)
 		ArgumentsKw: msg.ArgumentsKw,
 	}
 	err := caller.TrySend(res)
+	if err == nil && d.tracer != nil {
+		d.tracer.OnResult(traceInfo(caller, callID.request, invk.procedure))
+	}
 	if err != nil {
 		if canRetry {
 			keepInvocation = true
 			return true
 		}
-		d.log.Printf("!!! Dropped %s to caller %s: %s", res.MessageType(), caller, err)
+		stdlog.Errorf(d.log, "!!! Dropped %s to caller %s: %s", res.MessageType(), caller, err)
 		d.syncCancel(caller, &wamp.Cancel{Request: callID.request},
 			wamp.CancelModeKillNoWait, wamp.ErrCanceled)
 	}
@@ -951,7 +1413,7 @@ func (d *dealer) syncError(msg *wamp.Error) {
 			msg.Request, "(response to canceled call)")
 		return
 	}
-	delete(d.invocations, msg.Request)
+	d.syncDelInvocation(msg.Request, invk)
 	callID := invk.callID
 
 	// Delete invocationsByCall entry.  This will already be deleted if the
@@ -979,6 +1441,16 @@ func (d *dealer) syncError(msg *wamp.Error) {
 	})
 }
 
+// syncDelInvocation removes a finished invocation, and releases its slot in
+// the callee's concurrency limit.
+func (d *dealer) syncDelInvocation(invocationID wamp.ID, invk *invocation) {
+	invk.stopTimeout()
+	delete(d.invocations, invocationID)
+	if invk.reg != nil && invk.reg.inflight[invk.callee] > 0 {
+		invk.reg.inflight[invk.callee]--
+	}
+}
+
 func (d *dealer) syncRemoveSession(sess *wamp.Session) []*wamp.Publish {
 	var metaPubs []*wamp.Publish
 	// Remove any remaining registrations for the removed session.
@@ -1013,6 +1485,7 @@ func (d *dealer) syncRemoveSession(sess *wamp.Session) []*wamp.Publish {
 			Arguments: wamp.List{sess.ID, regID},
 		})
 	}
+	d.regQuota.release(sess, len(d.calleeRegIDSet[sess]))
 	delete(d.calleeRegIDSet, sess)
 
 	// Remove any pending calls for the removed session.
@@ -1026,12 +1499,74 @@ func (d *dealer) syncRemoveSession(sess *wamp.Session) []*wamp.Publish {
 		// If there is a pending invocation for the call, remove it.
 		if invkID, ok := d.invocationByCall[req]; ok {
 			delete(d.invocationByCall, req)
-			delete(d.invocations, invkID)
+			if invk, ok := d.invocations[invkID]; ok {
+				d.syncDelInvocation(invkID, invk)
+			}
 		}
 	}
+
+	// Fail any invocations pending on the removed session, since the callee
+	// will never respond.  Otherwise the callers would wait forever, unless
+	// their calls had a timeout.
+	for invkID, invk := range d.invocations {
+		if invk.callee != sess {
+			continue
+		}
+		d.syncDelInvocation(invkID, invk)
+		callID := invk.callID
+		delete(d.invocationByCall, callID)
+		caller, ok := d.calls[callID]
+		if !ok {
+			continue
+		}
+		delete(d.calls, callID)
+		if d.debug {
+			stdlog.Debugf(d.log, "Callee %v left with pending invocation %v for call %v",
+				sess.ID, invkID, callID.request)
+		}
+		d.trySend(caller, &wamp.Error{
+			Type:      wamp.CALL,
+			Request:   callID.request,
+			Error:     wamp.ErrCanceled,
+			Details:   wamp.Dict{},
+			Arguments: wamp.List{"callee left the realm"},
+		})
+	}
 	return metaPubs
 }
 
+func (d *dealer) syncCancelCalls(reason wamp.URI) int {
+	n := len(d.calls)
+	for callID, caller := range d.calls {
+		delete(d.calls, callID)
+		if invkID, ok := d.invocationByCall[callID]; ok {
+			delete(d.invocationByCall, callID)
+			if invk, ok := d.invocations[invkID]; ok {
+				d.syncDelInvocation(invkID, invk)
+				// An invocation that is already canceled has been sent an
+				// INTERRUPT, if the callee supports it.
+				if !invk.canceled && invk.callee.HasFeature(roleCallee, featureCallCanceling) {
+					d.trySend(invk.callee, &wamp.Interrupt{
+						Request: invkID,
+						Options: wamp.Dict{
+							wamp.OptReason: reason,
+							wamp.OptMode:   wamp.CancelModeKillNoWait,
+						},
+					})
+				}
+			}
+		}
+		d.trySend(caller, &wamp.Error{
+			Type:      wamp.CALL,
+			Request:   callID.request,
+			Error:     reason,
+			Details:   wamp.Dict{},
+			Arguments: wamp.List{"realm is shutting down"},
+		})
+	}
+	return n
+}
+
 // syncDelCalleeReg deletes the the callee from the specified registration and
 // deletes the registration from the set of registrations for the callee.
 //
@@ -1046,10 +1581,12 @@ func (d *dealer) syncDelCalleeReg(callee *wamp.Session, regID wamp.ID) (bool, er
 	}
 
 	// Remove the callee from the registration.
+	delete(reg.concurrency, callee)
+	delete(reg.inflight, callee)
 	for i := range reg.callees {
 		if reg.callees[i] == callee {
 			if d.debug {
-				d.log.Printf("Unregistered procedure %v (regID=%v) (callee=%v)",
+				stdlog.Debugf(d.log, "Unregistered procedure %v (regID=%v) (callee=%v)",
 					reg.procedure, regID, callee.ID)
 			}
 			if len(reg.callees) == 1 {
@@ -1075,7 +1612,7 @@ func (d *dealer) syncDelCalleeReg(callee *wamp.Session, regID wamp.ID) (bool, er
 			delete(d.wcProcRegMap, reg.procedure)
 		}
 		if d.debug {
-			d.log.Printf("Deleted registration %v for procedure %v", regID,
+			stdlog.Debugf(d.log, "Deleted registration %v for procedure %v", regID,
 				reg.procedure)
 		}
 		return true, nil
@@ -1278,9 +1815,17 @@ func (d *dealer) regCountCallees(msg *wamp.Invocation) wamp.Message {
 
 func (d *dealer) trySend(sess *wamp.Session, msg wamp.Message) bool {
 	if err := sess.TrySend(msg); err != nil {
-		d.log.Printf("!!! Dropped %s to session %s: %s", msg.MessageType(), sess, err)
+		stdlog.Errorf(d.log, "!!! Dropped %s to session %s: %s", msg.MessageType(), sess, err)
+		if msg.MessageType() == wamp.INVOCATION {
+			d.deadLetters.add(msg, sess, err)
+		}
 		return false
 	}
+	if d.tracer != nil {
+		if errMsg, ok := msg.(*wamp.Error); ok && errMsg.Type == wamp.CALL {
+			d.tracer.OnError(traceInfo(sess, errMsg.Request, errMsg.Error))
+		}
+	}
 	return true
 }
 
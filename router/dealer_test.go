@@ -1,6 +1,8 @@
 package router
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"testing"
@@ -11,7 +13,7 @@ import (
 )
 
 func newTestDealer() (*dealer, wamp.Peer) {
-	d := newDealer(logger, false, true, debug)
+	d := newDealer(context.Background(), logger, false, true, false, debug, 0)
 	metaClient, rtr := transport.LinkedPeers()
 	d.setMetaPeer(rtr)
 	return d, metaClient
@@ -287,6 +289,84 @@ func TestRemovePeer(t *testing.T) {
 
 // ----- WAMP v.2 Testing -----
 
+func TestCancelCallsInterruptsCallee(t *testing.T) {
+	dealer, _ := newTestDealer()
+	defer dealer.close()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"call_canceling": true,
+				},
+			},
+		},
+	}
+	const otherProcedure = wamp.URI("nexus.test.other")
+
+	// One callee supports call canceling, and the other does not.
+	callee := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, calleeRoles)
+	plainCallee := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	for _, reg := range []struct {
+		sess *wamp.Session
+		proc wamp.URI
+	}{{callee, testProcedure}, {plainCallee, otherProcedure}} {
+		dealer.register(reg.sess, &wamp.Register{Request: 1, Procedure: reg.proc})
+		if rsp := <-reg.sess.Recv(); rsp.MessageType() != wamp.REGISTERED {
+			t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+		}
+	}
+
+	caller := wamp.NewSession(&testPeer{in: make(chan wamp.Message, 2)}, wamp.GlobalID(), nil, nil)
+	dealer.call(caller, &wamp.Call{Request: 2, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	dealer.call(caller, &wamp.Call{Request: 3, Procedure: otherProcedure})
+	if rsp = <-plainCallee.Recv(); rsp.MessageType() != wamp.INVOCATION {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+
+	if n := dealer.cancelCalls(wamp.ErrSystemShutdown); n != 2 {
+		t.Fatal("expected 2 calls canceled, got", n)
+	}
+
+	// The callee that supports call canceling is interrupted.
+	rsp, err := wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for INTERRUPT")
+	}
+	interrupt, ok := rsp.(*wamp.Interrupt)
+	if !ok {
+		t.Fatal("expected INTERRUPT, got:", rsp.MessageType())
+	}
+	if interrupt.Request != inv.Request {
+		t.Fatal("INTERRUPT request ID does not match INVOCATION request ID")
+	}
+	if mode, _ := wamp.AsString(interrupt.Options[wamp.OptMode]); mode != wamp.CancelModeKillNoWait {
+		t.Fatal("wrong INTERRUPT mode:", mode)
+	}
+	if reason, _ := wamp.AsURI(interrupt.Options[wamp.OptReason]); reason != wamp.ErrSystemShutdown {
+		t.Fatal("wrong INTERRUPT reason:", reason)
+	}
+	if rsp, err = wamp.RecvTimeout(plainCallee, 10*time.Millisecond); err == nil {
+		t.Fatal("callee without call canceling got:", rsp.MessageType())
+	}
+
+	// Both callers get an ERROR.
+	for i := 0; i < 2; i++ {
+		rsp, err = wamp.RecvTimeout(caller, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for ERROR")
+		}
+		if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrSystemShutdown {
+			t.Fatal("expected ERROR", wamp.ErrSystemShutdown, "got", rsp)
+		}
+	}
+}
+
 func TestCancelCallModeKill(t *testing.T) {
 	dealer, metaClient := newTestDealer()
 
@@ -510,6 +590,200 @@ func TestCancelCallModeSkip(t *testing.T) {
 	}
 }
 
+func TestCancelYieldCross(t *testing.T) {
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"call_canceling": true,
+				},
+			},
+		},
+	}
+
+	// newCall registers a procedure and calls it, returning the sessions and
+	// the INVOCATION received by the callee.
+	newCall := func() (*dealer, *wamp.Session, *wamp.Session, *wamp.Invocation) {
+		dealer, _ := newTestDealer()
+		calleeSess := wamp.NewSession(newTestPeer(), 0, nil, calleeRoles)
+		dealer.register(calleeSess,
+			&wamp.Register{Request: 123, Procedure: testProcedure})
+		rsp := <-calleeSess.Recv()
+		if _, ok := rsp.(*wamp.Registered); !ok {
+			t.Fatal("did not receive REGISTERED response")
+		}
+		// Caller has room for more than one response, so that any extra
+		// response is not dropped and can be detected.
+		caller := &testPeer{in: make(chan wamp.Message, 4)}
+		callerSess := wamp.NewSession(caller, 0, nil, nil)
+		dealer.call(callerSess,
+			&wamp.Call{Request: 125, Procedure: testProcedure})
+		rsp = <-calleeSess.Recv()
+		inv, ok := rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+		return dealer, calleeSess, callerSess, inv
+	}
+
+	// expectOnly checks that the caller receives exactly one response of the
+	// expected type.
+	expectOnly := func(callerSess *wamp.Session, msgType wamp.MessageType) {
+		rsp, err := wamp.RecvTimeout(callerSess, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for", msgType)
+		}
+		if rsp.MessageType() != msgType {
+			t.Fatal("expected", msgType, "got:", rsp.MessageType())
+		}
+		if rsp, err = wamp.RecvTimeout(callerSess, 50*time.Millisecond); err == nil {
+			t.Fatal("caller received unexpected message:", rsp.MessageType())
+		}
+	}
+
+	// YIELD arrives after CANCEL with mode=skip: late YIELD is discarded.
+	dealer, calleeSess, callerSess, inv := newCall()
+	dealer.cancel(callerSess, &wamp.Cancel{
+		Request: 125, Options: wamp.SetOption(nil, "mode", "skip")})
+	dealer.yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	expectOnly(callerSess, wamp.ERROR)
+
+	// YIELD arrives after CANCEL with mode=killnowait: late YIELD is discarded.
+	dealer, calleeSess, callerSess, inv = newCall()
+	dealer.cancel(callerSess, &wamp.Cancel{
+		Request: 125, Options: wamp.SetOption(nil, "mode", "killnowait")})
+	rsp := <-calleeSess.Recv()
+	if _, ok := rsp.(*wamp.Interrupt); !ok {
+		t.Fatal("expected INTERRUPT, got:", rsp.MessageType())
+	}
+	dealer.yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	expectOnly(callerSess, wamp.ERROR)
+
+	// YIELD crosses INTERRUPT with mode=kill: the callee finished first, so
+	// the caller gets the RESULT and nothing else.
+	dealer, calleeSess, callerSess, inv = newCall()
+	dealer.cancel(callerSess, &wamp.Cancel{
+		Request: 125, Options: wamp.SetOption(nil, "mode", "kill")})
+	rsp = <-calleeSess.Recv()
+	if _, ok := rsp.(*wamp.Interrupt); !ok {
+		t.Fatal("expected INTERRUPT, got:", rsp.MessageType())
+	}
+	dealer.yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	dealer.error(&wamp.Error{
+		Type:    wamp.INVOCATION,
+		Request: inv.Request,
+		Error:   wamp.ErrCanceled,
+	})
+	expectOnly(callerSess, wamp.RESULT)
+
+	// CANCEL arrives after YIELD: cancel is ignored.
+	dealer, calleeSess, callerSess, inv = newCall()
+	dealer.yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	dealer.cancel(callerSess, &wamp.Cancel{
+		Request: 125, Options: wamp.SetOption(nil, "mode", "kill")})
+	expectOnly(callerSess, wamp.RESULT)
+	if _, err := wamp.RecvTimeout(calleeSess, 50*time.Millisecond); err == nil {
+		t.Fatal("callee should not be interrupted for completed call")
+	}
+}
+
+func TestProgressiveResults(t *testing.T) {
+	dealer, _ := newTestDealer()
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"call_canceling":           true,
+					"progressive_call_results": true,
+				},
+			},
+		},
+	}
+	calleeSess := wamp.NewSession(newTestPeer(), 0, nil, calleeRoles)
+	dealer.register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-calleeSess.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+
+	caller := &testPeer{in: make(chan wamp.Message, 8)}
+	callerSess := wamp.NewSession(caller, 0, nil, nil)
+	dealer.call(callerSess, &wamp.Call{
+		Request:   125,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptReceiveProgress: true},
+	})
+	rsp = <-calleeSess.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	if prog, _ := wamp.AsBool(inv.Details[wamp.OptReceiveProgress]); !prog {
+		t.Fatal("INVOCATION missing receive_progress")
+	}
+
+	// Stream five progressive results, then the final result.
+	for i := 1; i <= 5; i++ {
+		dealer.yield(calleeSess, &wamp.Yield{
+			Request:   inv.Request,
+			Options:   wamp.Dict{wamp.OptProgress: true},
+			Arguments: wamp.List{i},
+		})
+		rsp = <-caller.Recv()
+		rslt, ok := rsp.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got:", rsp.MessageType())
+		}
+		if prog, _ := wamp.AsBool(rslt.Details[wamp.OptProgress]); !prog {
+			t.Fatal("progressive RESULT missing progress flag")
+		}
+		if n, _ := wamp.AsInt64(rslt.Arguments[0]); n != int64(i) {
+			t.Fatal("wrong progressive result:", n)
+		}
+	}
+	dealer.yield(calleeSess, &wamp.Yield{
+		Request:   inv.Request,
+		Arguments: wamp.List{"done"},
+	})
+	rsp = <-caller.Recv()
+	rslt, ok := rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if prog, _ := wamp.AsBool(rslt.Details[wamp.OptProgress]); prog {
+		t.Fatal("final RESULT should not have progress flag")
+	}
+	if rslt.Arguments[0] != "done" {
+		t.Fatal("wrong final result")
+	}
+
+	// Callee sends progressive result that caller did not request.
+	dealer.call(callerSess, &wamp.Call{Request: 126, Procedure: testProcedure})
+	rsp = <-calleeSess.Recv()
+	inv = rsp.(*wamp.Invocation)
+	dealer.yield(calleeSess, &wamp.Yield{
+		Request: inv.Request,
+		Options: wamp.Dict{wamp.OptProgress: true},
+	})
+	rsp = <-calleeSess.Recv()
+	intr, ok := rsp.(*wamp.Interrupt)
+	if !ok {
+		t.Fatal("expected INTERRUPT, got:", rsp.MessageType())
+	}
+	if intr.Request != inv.Request {
+		t.Fatal("INTERRUPT has wrong request ID")
+	}
+	rsp = <-caller.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Request != 126 || errMsg.Error != wamp.ErrProtocolViolation {
+		t.Fatal("wrong ERROR for unrequested progressive result:", errMsg)
+	}
+}
+
 func TestSharedRegistrationRoundRobin(t *testing.T) {
 	dealer, metaClient := newTestDealer()
 
@@ -629,6 +903,217 @@ func TestSharedRegistrationRoundRobin(t *testing.T) {
 	}
 }
 
+func TestCalleeConcurrencyLimit(t *testing.T) {
+	dealer, _ := newTestDealer()
+
+	const limit = 2
+	callee := &testPeer{in: make(chan wamp.Message, 8)}
+	calleeSess := wamp.NewSession(callee, 0, nil, nil)
+	dealer.register(calleeSess, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptConcurrency: limit},
+	})
+	if rsp := <-callee.Recv(); rsp.MessageType() != wamp.REGISTERED {
+		t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+	}
+
+	caller := &testPeer{in: make(chan wamp.Message, 8)}
+	callerSess := wamp.NewSession(caller, 0, nil, nil)
+	var invs []*wamp.Invocation
+	for i := 0; i < limit; i++ {
+		dealer.call(callerSess, &wamp.Call{Request: wamp.ID(i + 1), Procedure: testProcedure})
+		rsp, err := wamp.RecvTimeout(calleeSess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inv, ok := rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+		invs = append(invs, inv)
+	}
+
+	// Call N+1 is rejected.
+	dealer.call(callerSess, &wamp.Call{Request: 100, Procedure: testProcedure})
+	rsp, err := wamp.RecvTimeout(callerSess, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrMaxConcurrencyReached || errMsg.Request != 100 {
+		t.Fatal("wrong error:", errMsg.Error, "request:", errMsg.Request)
+	}
+	if _, err = wamp.RecvTimeout(calleeSess, time.Millisecond); err == nil {
+		t.Fatal("callee should not have received INVOCATION")
+	}
+
+	// Completing an invocation allows another call.
+	dealer.yield(calleeSess, &wamp.Yield{Request: invs[0].Request})
+	if rsp, err = wamp.RecvTimeout(callerSess, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = rsp.(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	dealer.call(callerSess, &wamp.Call{Request: 101, Procedure: testProcedure})
+	if rsp, err = wamp.RecvTimeout(calleeSess, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = rsp.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+}
+
+func TestSharedRegistrationConcurrencyLimit(t *testing.T) {
+	dealer, _ := newTestDealer()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"shared_registration": true,
+				},
+			},
+		},
+	}
+
+	// The first callee accepts only one invocation at a time.
+	var callees []*wamp.Session
+	for i, limit := range []int{1, 0} {
+		callee := &testPeer{in: make(chan wamp.Message, 8)}
+		calleeSess := wamp.NewSession(callee, wamp.ID(i+1), nil, calleeRoles)
+		dealer.register(calleeSess, &wamp.Register{
+			Request:   wamp.ID(i + 1),
+			Procedure: testProcedure,
+			Options: wamp.Dict{
+				wamp.OptInvoke:      wamp.InvokeFirst,
+				wamp.OptConcurrency: limit,
+			},
+		})
+		if rsp := <-callee.Recv(); rsp.MessageType() != wamp.REGISTERED {
+			t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+		}
+		callees = append(callees, calleeSess)
+	}
+
+	caller := &testPeer{in: make(chan wamp.Message, 8)}
+	callerSess := wamp.NewSession(caller, 0, nil, nil)
+
+	// The first call goes to the first callee, and the second call goes to
+	// the second callee since the first callee is at its limit.
+	for i, calleeSess := range callees {
+		dealer.call(callerSess, &wamp.Call{Request: wamp.ID(i + 1), Procedure: testProcedure})
+		rsp, err := wamp.RecvTimeout(calleeSess, time.Second)
+		if err != nil {
+			t.Fatalf("callee %d did not receive INVOCATION: %s", i+1, err)
+		}
+		if _, ok := rsp.(*wamp.Invocation); !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+	}
+}
+
+func TestSharedRegistrationRoundRobinFailover(t *testing.T) {
+	dealer, _ := newTestDealer()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"shared_registration": true,
+				},
+			},
+		},
+	}
+
+	// Register three callees with roundrobin shared registration.
+	var callees []*wamp.Session
+	var regID wamp.ID
+	for i := 0; i < 3; i++ {
+		sess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, calleeRoles)
+		dealer.register(sess, &wamp.Register{
+			Request:   wamp.GlobalID(),
+			Procedure: testProcedure,
+			Options:   wamp.SetOption(nil, "invoke", "roundrobin"),
+		})
+		rsp := <-sess.Recv()
+		regMsg, ok := rsp.(*wamp.Registered)
+		if !ok {
+			t.Fatal("did not receive REGISTERED response")
+		}
+		regID = regMsg.Registration
+		callees = append(callees, sess)
+	}
+
+	caller := wamp.NewSession(newTestPeer(), 0, nil, nil)
+
+	// callAndYield makes a call and returns the index of the callee that was
+	// invoked, after the callee yields a result.
+	callAndYield := func() int {
+		callID := wamp.GlobalID()
+		dealer.call(caller, &wamp.Call{Request: callID, Procedure: testProcedure})
+		invoked := -1
+		for i, callee := range callees {
+			if callee == nil {
+				continue
+			}
+			rsp, err := wamp.RecvTimeout(callee, 10*time.Millisecond)
+			if err != nil {
+				continue
+			}
+			if invoked != -1 {
+				t.Fatal("more than one callee invoked")
+			}
+			inv, ok := rsp.(*wamp.Invocation)
+			if !ok {
+				t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+			}
+			dealer.yield(callee, &wamp.Yield{Request: inv.Request})
+			invoked = i
+		}
+		if invoked == -1 {
+			t.Fatal("no callee invoked")
+		}
+		rsp, err := wamp.RecvTimeout(caller, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for RESULT")
+		}
+		if rslt, ok := rsp.(*wamp.Result); !ok || rslt.Request != callID {
+			t.Fatal("did not receive RESULT for call")
+		}
+		return invoked
+	}
+
+	// Each callee is invoked in turn.
+	for _, expect := range []int{0, 1, 2, 0} {
+		if got := callAndYield(); got != expect {
+			t.Fatalf("expected callee %d to be invoked, got %d", expect, got)
+		}
+	}
+
+	// Unregister the callee that was just invoked.  Calls must fail over to
+	// the remaining callees, which continue to share calls in turn.
+	dealer.unregister(callees[0], &wamp.Unregister{
+		Request:      wamp.GlobalID(),
+		Registration: regID,
+	})
+	rsp := <-callees[0].Recv()
+	if _, ok := rsp.(*wamp.Unregistered); !ok {
+		t.Fatal("expected UNREGISTERED, got:", rsp.MessageType())
+	}
+	callees[0] = nil
+
+	for _, expect := range []int{2, 1, 2, 1} {
+		if got := callAndYield(); got != expect {
+			t.Fatalf("expected callee %d to be invoked, got %d", expect, got)
+		}
+	}
+}
+
 func TestSharedRegistrationFirst(t *testing.T) {
 	dealer, metaClient := newTestDealer()
 
@@ -1039,6 +1524,78 @@ func TestPatternBasedRegistration(t *testing.T) {
 	}
 }
 
+func TestPatternRegistrationMatch(t *testing.T) {
+	dealer, _ := newTestDealer()
+	defer dealer.close()
+
+	register := func(procedure wamp.URI, match string) *wamp.Session {
+		sess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+		dealer.register(sess, &wamp.Register{
+			Request:   wamp.GlobalID(),
+			Procedure: procedure,
+			Options:   wamp.Dict{wamp.OptMatch: match},
+		})
+		rsp, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rsp.(*wamp.Registered); !ok {
+			t.Fatal("expected REGISTERED, got:", rsp)
+		}
+		return sess
+	}
+	anyPfx := register("nexus.test.", wamp.MatchPrefix)
+	mathPfx := register("nexus.test.math.", wamp.MatchPrefix)
+	add := register("nexus.test.math.add", wamp.MatchExact)
+	wcAny := register("nexus..calc.add", wamp.MatchWildcard)
+	wcTest := register("nexus.othr..add", wamp.MatchWildcard)
+
+	caller := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	// call checks that the procedure is invoked at the callee, and that the
+	// INVOCATION has the concrete procedure only for a pattern match.
+	call := func(procedure wamp.URI, callee *wamp.Session, pattern bool) {
+		dealer.call(caller, &wamp.Call{Request: wamp.GlobalID(), Procedure: procedure})
+		rsp, err := wamp.RecvTimeout(callee, time.Second)
+		if err != nil {
+			t.Fatal("callee not invoked for", procedure)
+		}
+		inv, ok := rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+		proc, ok := wamp.AsURI(inv.Details[wamp.OptProcedure])
+		if pattern && proc != procedure {
+			t.Fatal("INVOCATION has wrong procedure detail:", proc)
+		}
+		if !pattern && ok {
+			t.Fatal("INVOCATION for exact match has procedure detail")
+		}
+		dealer.yield(callee, &wamp.Yield{Request: inv.Request})
+		if _, err = wamp.RecvTimeout(caller, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Prefix registration serves several procedures.
+	call("nexus.test.echo", anyPfx, true)
+	call("nexus.test.time.now", anyPfx, true)
+	// Longest prefix wins.
+	call("nexus.test.math.sub", mathPfx, true)
+	call("nexus.test.math.mul", mathPfx, true)
+	// Exact beats prefix.
+	call("nexus.test.math.add", add, false)
+	// Prefix beats wildcard.
+	call("nexus.test.calc.add", anyPfx, true)
+	// Wildcard patterns of the same length resolve to the more specific one,
+	// regardless of map order.
+	wcAnyOther := register("nexus...add", wamp.MatchWildcard)
+	for i := 0; i < 10; i++ {
+		call("nexus.othr.calc.add", wcTest, true)
+	}
+	call("nexus.any.calc.add", wcAny, true)
+	call("nexus.any.thing.add", wcAnyOther, true)
+}
+
 func TestRPCBlockedUnresponsiveCallee(t *testing.T) {
 	const (
 		rpcExecTime    = time.Second
@@ -1155,18 +1712,96 @@ func TestCallerIdentification(t *testing.T) {
 	}
 }
 
-func TestWrongYielder(t *testing.T) {
-	dealer := newDealer(logger, false, true, debug)
+func TestCallerDisclosurePolicy(t *testing.T) {
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"caller_identification": true,
+				},
+			},
+		},
+	}
 
-	// Register a procedure.
-	callee := newTestPeer()
-	calleeSess := wamp.NewSession(callee, 7777, nil, nil)
-	dealer.register(calleeSess,
-		&wamp.Register{Request: 4321, Procedure: testProcedure})
-	rsp := <-callee.Recv()
-	_, ok := rsp.(*wamp.Registered)
+	// call registers a procedure and calls it with the given options,
+	// returning the INVOCATION received by the callee or the ERROR received by
+	// the caller.
+	call := func(dealer *dealer, opts wamp.Dict) wamp.Message {
+		callee := newTestPeer()
+		calleeSess := wamp.NewSession(callee, wamp.GlobalID(), nil, calleeRoles)
+		dealer.register(calleeSess,
+			&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+		if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+			t.Fatal("did not receive REGISTERED response")
+		}
+		defer dealer.removeSession(calleeSess)
+
+		caller := newTestPeer()
+		callerSess := wamp.NewSession(caller, wamp.GlobalID(),
+			wamp.Dict{"authid": "alice", "authrole": "user"}, nil)
+		dealer.call(callerSess, &wamp.Call{
+			Request:   wamp.GlobalID(),
+			Procedure: testProcedure,
+			Options:   opts,
+		})
+		select {
+		case msg := <-callee.Recv():
+			return msg
+		case msg := <-caller.Recv():
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for INVOCATION or ERROR")
+		}
+		return nil
+	}
+
+	// Policy "always": caller identity disclosed without being requested.
+	dealer := newDealer(context.Background(), logger, false, true, true, debug, 0)
+	msg := call(dealer, nil)
+	inv, ok := msg.(*wamp.Invocation)
 	if !ok {
-		t.Fatal("did not receive REGISTERED response")
+		t.Fatal("expected INVOCATION, got:", msg.MessageType())
+	}
+	if authid, _ := wamp.AsString(inv.Details["caller_authid"]); authid != "alice" {
+		t.Fatal("expected caller_authid in INVOCATION details, got:", inv.Details)
+	}
+	if _, ok = inv.Details["caller"]; !ok {
+		t.Fatal("expected caller in INVOCATION details")
+	}
+	dealer.close()
+
+	// Policy "never": caller identity not disclosed, and request is an error.
+	dealer = newDealer(context.Background(), logger, false, false, false, debug, 0)
+	msg = call(dealer, nil)
+	if inv, ok = msg.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got:", msg.MessageType())
+	}
+	if _, ok = inv.Details["caller_authid"]; ok {
+		t.Fatal("caller identity disclosed when forbidden")
+	}
+	msg = call(dealer, wamp.Dict{wamp.OptDiscloseMe: true})
+	errMsg, ok := msg.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", msg.MessageType())
+	}
+	if errMsg.Error != wamp.ErrOptionDisallowedDiscloseMe {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+	dealer.close()
+}
+
+func TestWrongYielder(t *testing.T) {
+	dealer := newDealer(context.Background(), logger, false, true, false, debug, 0)
+
+	// Register a procedure.
+	callee := newTestPeer()
+	calleeSess := wamp.NewSession(callee, 7777, nil, nil)
+	dealer.register(calleeSess,
+		&wamp.Register{Request: 4321, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	_, ok := rsp.(*wamp.Registered)
+	if !ok {
+		t.Fatal("did not receive REGISTERED response")
 	}
 
 	// Create caller
@@ -1198,3 +1833,705 @@ func TestWrongYielder(t *testing.T) {
 	case <-time.After(200 * time.Millisecond):
 	}
 }
+
+func TestCallTimeout(t *testing.T) {
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"call_canceling": true,
+					"call_timeout":   true,
+				},
+			},
+		},
+	}
+	dealer := newDealer(context.Background(), logger, false, true, false, debug, 0)
+	defer dealer.close()
+	calleeSess := wamp.NewSession(newTestPeer(), 0, nil, calleeRoles)
+	dealer.register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-calleeSess.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	caller := &testPeer{in: make(chan wamp.Message, 4)}
+	callerSess := wamp.NewSession(caller, 0, nil, nil)
+
+	// Test that timeout fires when callee does not respond.
+	dealer.call(callerSess, &wamp.Call{
+		Request:   125,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: 50},
+	})
+	rsp = <-calleeSess.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	if to, _ := wamp.AsInt64(inv.Details[wamp.OptTimeout]); to != 50 {
+		t.Fatal("INVOCATION has wrong timeout:", to)
+	}
+	rsp, err := wamp.RecvTimeout(calleeSess, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for INTERRUPT")
+	}
+	if intr, ok := rsp.(*wamp.Interrupt); !ok || intr.Request != inv.Request {
+		t.Fatal("expected INTERRUPT for invocation, got:", rsp.MessageType())
+	}
+	rsp, err = wamp.RecvTimeout(callerSess, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for ERROR")
+	}
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Request != 125 || errMsg.Error != wamp.ErrCanceled {
+		t.Fatal("wrong ERROR for timed out call")
+	}
+	// Late YIELD is discarded.
+	dealer.yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	if rsp, err = wamp.RecvTimeout(callerSess, 50*time.Millisecond); err == nil {
+		t.Fatal("caller received unexpected message:", rsp.MessageType())
+	}
+
+	// Test that result arriving before timeout stops the timer.
+	dealer.call(callerSess, &wamp.Call{
+		Request:   126,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: 50},
+	})
+	rsp = <-calleeSess.Recv()
+	inv = rsp.(*wamp.Invocation)
+	dealer.yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	if rslt, ok := rsp.(*wamp.Result); !ok || rslt.Request != 126 {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	// Nothing more for caller or callee after timeout would have expired.
+	time.Sleep(100 * time.Millisecond)
+	if rsp, err = wamp.RecvTimeout(callerSess, time.Millisecond); err == nil {
+		t.Fatal("caller received unexpected message:", rsp.MessageType())
+	}
+	if rsp, err = wamp.RecvTimeout(calleeSess, time.Millisecond); err == nil {
+		t.Fatal("callee received unexpected message:", rsp.MessageType())
+	}
+}
+
+func TestMaxCallTimeout(t *testing.T) {
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"call_timeout": true,
+				},
+			},
+		},
+	}
+	dealer := newDealer(context.Background(), logger, false, true, false, debug, 50*time.Millisecond)
+	defer dealer.close()
+	calleeSess := wamp.NewSession(newTestPeer(), 0, nil, calleeRoles)
+	dealer.register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	<-calleeSess.Recv()
+	callerSess := wamp.NewSession(newTestPeer(), 0, nil, nil)
+
+	// Requested timeout greater than maximum is clamped.  Call without
+	// timeout is also limited.
+	for _, opts := range []wamp.Dict{{wamp.OptTimeout: 60000}, nil} {
+		dealer.call(callerSess, &wamp.Call{
+			Request:   125,
+			Procedure: testProcedure,
+			Options:   opts,
+		})
+		rsp := <-calleeSess.Recv()
+		inv, ok := rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+		if to, _ := wamp.AsInt64(inv.Details[wamp.OptTimeout]); to != 50 {
+			t.Fatal("INVOCATION timeout not clamped:", to)
+		}
+		rsp, err := wamp.RecvTimeout(callerSess, time.Second)
+		if err != nil {
+			t.Fatal("call was not timed out")
+		}
+		if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrCanceled {
+			t.Fatal("expected canceled ERROR, got:", rsp)
+		}
+	}
+}
+
+func TestRegMetaEventOrder(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	checkEvent := func(topic wamp.URI, sessID, regID wamp.ID) {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for", topic)
+		case msg := <-metaClient.Recv():
+			pub, ok := msg.(*wamp.Publish)
+			if !ok {
+				t.Fatal("expected PUBLISH, got", msg.MessageType())
+			}
+			if pub.Topic != topic {
+				t.Fatal("expected", topic, "got", pub.Topic)
+			}
+			if sid, _ := wamp.AsID(pub.Arguments[0]); sid != sessID {
+				t.Fatal("wrong session ID in", topic)
+			}
+			if topic == wamp.MetaEventRegOnCreate {
+				return
+			}
+			if rid, _ := wamp.AsID(pub.Arguments[1]); rid != regID {
+				t.Fatal("wrong registration ID in", topic)
+			}
+		}
+	}
+
+	// Register two callees on the same procedure.
+	callee1 := newTestPeer()
+	sess1 := wamp.NewSession(callee1, wamp.GlobalID(), nil, nil)
+	dealer.register(sess1, &wamp.Register{
+		Request:   wamp.GlobalID(),
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptInvoke: wamp.InvokeRoundRobin},
+	})
+	rsp := <-callee1.Recv()
+	regID := rsp.(*wamp.Registered).Registration
+	checkEvent(wamp.MetaEventRegOnCreate, sess1.ID, regID)
+	checkEvent(wamp.MetaEventRegOnRegister, sess1.ID, regID)
+
+	callee2 := newTestPeer()
+	sess2 := wamp.NewSession(callee2, wamp.GlobalID(), nil, nil)
+	dealer.register(sess2, &wamp.Register{
+		Request:   wamp.GlobalID(),
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptInvoke: wamp.InvokeRoundRobin},
+	})
+	rsp = <-callee2.Recv()
+	if rsp.(*wamp.Registered).Registration != regID {
+		t.Fatal("expected same registration for second callee")
+	}
+	// No on_create for second callee.
+	checkEvent(wamp.MetaEventRegOnRegister, sess2.ID, regID)
+
+	// Check callee count.
+	yield, ok := dealer.regCountCallees(&wamp.Invocation{
+		Request:   wamp.GlobalID(),
+		Arguments: wamp.List{regID},
+	}).(*wamp.Yield)
+	if !ok {
+		t.Fatal("expected YIELD from count_callees")
+	}
+	if n, _ := wamp.AsInt64(yield.Arguments[0]); n != 2 {
+		t.Fatal("expected 2 callees, got", n)
+	}
+
+	// Unregister first callee; registration is not deleted.
+	dealer.unregister(sess1, &wamp.Unregister{Request: wamp.GlobalID(), Registration: regID})
+	<-callee1.Recv()
+	checkEvent(wamp.MetaEventRegOnUnregister, sess1.ID, regID)
+
+	// Unregister last callee; registration is deleted.
+	dealer.unregister(sess2, &wamp.Unregister{Request: wamp.GlobalID(), Registration: regID})
+	<-callee2.Recv()
+	checkEvent(wamp.MetaEventRegOnUnregister, sess2.ID, regID)
+	checkEvent(wamp.MetaEventRegOnDelete, sess2.ID, regID)
+
+	select {
+	case msg := <-metaClient.Recv():
+		t.Fatal("unexpected meta event:", msg)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestPartitionedCall(t *testing.T) {
+	dealer, _ := newTestDealer()
+	defer dealer.close()
+
+	// Register three callees with the partition invocation policy.
+	var callees []*wamp.Session
+	for i := 0; i < 3; i++ {
+		sess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+		dealer.register(sess, &wamp.Register{
+			Request:   wamp.GlobalID(),
+			Procedure: testProcedure,
+			Options:   wamp.Dict{wamp.OptInvoke: wamp.InvokePartition},
+		})
+		rsp, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rsp.(*wamp.Registered); !ok {
+			t.Fatal("expected REGISTERED, got", rsp.MessageType())
+		}
+		callees = append(callees, sess)
+	}
+
+	caller := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+
+	// call sends a CALL with the given options, answers the INVOCATION, and
+	// returns the callee that was invoked.  If no callee is invoked, then the
+	// message sent to the caller is returned.
+	call := func(options wamp.Dict) (*wamp.Session, wamp.Message) {
+		dealer.call(caller, &wamp.Call{
+			Request:   wamp.GlobalID(),
+			Procedure: testProcedure,
+			Options:   options,
+		})
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			for _, sess := range callees {
+				select {
+				case msg := <-sess.Recv():
+					inv := msg.(*wamp.Invocation)
+					dealer.yield(sess, &wamp.Yield{Request: inv.Request})
+					rsp, err := wamp.RecvTimeout(caller, time.Second)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if _, ok := rsp.(*wamp.Result); !ok {
+						t.Fatal("expected RESULT, got", rsp.MessageType())
+					}
+					return sess, nil
+				default:
+				}
+			}
+			select {
+			case msg := <-caller.Recv():
+				return nil, msg
+			case <-time.After(time.Millisecond):
+			}
+		}
+		t.Fatal("timed out waiting for call")
+		return nil, nil
+	}
+
+	// Calls with the same key go to the same callee.
+	assigned := map[string]*wamp.Session{}
+	used := map[*wamp.Session]struct{}{}
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprint("key-", i)
+		callee, _ := call(wamp.Dict{wamp.OptRKey: key})
+		if callee == nil {
+			t.Fatal("no callee invoked for", key)
+		}
+		if again, _ := call(wamp.Dict{wamp.OptRKey: key}); again != callee {
+			t.Fatal("calls with key", key, "sent to different callees")
+		}
+		assigned[key] = callee
+		used[callee] = struct{}{}
+	}
+	if len(used) != len(callees) {
+		t.Fatal("expected keys to be spread over all callees, used", len(used))
+	}
+
+	// A call without a partition key is an error.
+	callee, rsp := call(nil)
+	if callee != nil {
+		t.Fatal("callee invoked for call without rkey")
+	}
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected ERROR with", wamp.ErrInvalidArgument, "got", rsp)
+	}
+
+	// Removing a callee moves only its keys to the remaining callees.
+	removed := callees[0]
+	dealer.removeSession(removed)
+	callees = callees[1:]
+	for key, prev := range assigned {
+		callee, _ := call(wamp.Dict{wamp.OptRKey: key})
+		if callee == nil {
+			t.Fatal("no callee invoked for", key)
+		}
+		if prev != removed && callee != prev {
+			t.Fatal("key", key, "moved from a callee that was not removed")
+		}
+	}
+}
+
+func TestPartitionRunMode(t *testing.T) {
+	dealer, _ := newTestDealer()
+	defer dealer.close()
+
+	// Callees use the roundrobin policy, and the caller requests that calls
+	// are partitioned.
+	callee1 := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	callee2 := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	for _, sess := range []*wamp.Session{callee1, callee2} {
+		dealer.register(sess, &wamp.Register{
+			Request:   wamp.GlobalID(),
+			Procedure: testProcedure,
+			Options:   wamp.Dict{wamp.OptInvoke: wamp.InvokeRoundRobin},
+		})
+		if _, err := wamp.RecvTimeout(sess, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := partitionCallee([]*wamp.Session{callee1, callee2}, "abc")
+	caller := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	for i := 0; i < 4; i++ {
+		dealer.call(caller, &wamp.Call{
+			Request:   wamp.GlobalID(),
+			Procedure: testProcedure,
+			Options: wamp.Dict{
+				wamp.OptRunMode: wamp.RunModePartition,
+				wamp.OptRKey:    "abc",
+			},
+		})
+		rsp, err := wamp.RecvTimeout(expect, time.Second)
+		if err != nil {
+			t.Fatal("partitioned call not sent to expected callee")
+		}
+		dealer.yield(expect, &wamp.Yield{Request: rsp.(*wamp.Invocation).Request})
+		if _, err = wamp.RecvTimeout(caller, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPartitionCalleeAtConcurrencyLimit(t *testing.T) {
+	dealer, _ := newTestDealer()
+	defer dealer.close()
+
+	// Each callee accepts only one invocation at a time.
+	callee1 := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	callee2 := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	for _, sess := range []*wamp.Session{callee1, callee2} {
+		dealer.register(sess, &wamp.Register{
+			Request:   wamp.GlobalID(),
+			Procedure: testProcedure,
+			Options: wamp.Dict{
+				wamp.OptInvoke:      wamp.InvokePartition,
+				wamp.OptConcurrency: 1,
+			},
+		})
+		rsp, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rsp.(*wamp.Registered); !ok {
+			t.Fatal("expected REGISTERED, got", rsp.MessageType())
+		}
+	}
+
+	expect := partitionCallee([]*wamp.Session{callee1, callee2}, "abc")
+	other := callee1
+	if expect == callee1 {
+		other = callee2
+	}
+	caller := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	call := func(request wamp.ID) {
+		dealer.call(caller, &wamp.Call{
+			Request:   request,
+			Procedure: testProcedure,
+			Options:   wamp.Dict{wamp.OptRKey: "abc"},
+		})
+	}
+
+	// The first call saturates the callee for the key.
+	call(1)
+	if _, err := wamp.RecvTimeout(expect, time.Second); err != nil {
+		t.Fatal("partitioned call not sent to expected callee")
+	}
+
+	// The second call with the same key is not sent to the other callee.
+	call(2)
+	rsp, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrMaxConcurrencyReached || errMsg.Request != 2 {
+		t.Fatal("wrong error:", errMsg.Error, errMsg.Request)
+	}
+	if rsp, err = wamp.RecvTimeout(other, 10*time.Millisecond); err == nil {
+		t.Fatal("partitioned call sent to other callee:", rsp.MessageType())
+	}
+}
+
+func TestRegisterMatchValidation(t *testing.T) {
+	dealer, _ := newTestDealer()
+	defer dealer.close()
+	sess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+
+	register := func(procedure wamp.URI, match string) wamp.Message {
+		dealer.register(sess, &wamp.Register{
+			Request:   wamp.GlobalID(),
+			Procedure: procedure,
+			Options:   wamp.SetOption(nil, wamp.OptMatch, match),
+		})
+		rsp, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp
+	}
+
+	if rsp := register("com..proc", wamp.MatchWildcard); rsp.MessageType() != wamp.REGISTERED {
+		t.Fatal("expected REGISTERED for wildcard URI, got", rsp.MessageType())
+	}
+	rsp := register("com..proc", wamp.MatchExact)
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidURI {
+		t.Fatal("expected ERROR", wamp.ErrInvalidURI, "got", rsp)
+	}
+	rsp = register("com.myapp.proc", "regex")
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected ERROR", wamp.ErrInvalidArgument, "got", rsp)
+	}
+
+	// Unknown invocation policy.
+	dealer.register(sess, &wamp.Register{
+		Request:   wamp.GlobalID(),
+		Procedure: "com.myapp.proc",
+		Options:   wamp.Dict{wamp.OptInvoke: "fastest"},
+	})
+	rsp, err := wamp.RecvTimeout(sess, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected ERROR", wamp.ErrInvalidArgument, "got", rsp)
+	}
+}
+
+func TestCallValidation(t *testing.T) {
+	dealer, _ := newTestDealer()
+	defer dealer.close()
+	sess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+
+	call := func(procedure wamp.URI, options wamp.Dict) wamp.Message {
+		dealer.call(sess, &wamp.Call{
+			Request:   wamp.GlobalID(),
+			Procedure: procedure,
+			Options:   options,
+		})
+		rsp, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp
+	}
+
+	rsp := call("com..proc", nil)
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidURI {
+		t.Fatal("expected ERROR", wamp.ErrInvalidURI, "got", rsp)
+	}
+	rsp = call("com.myapp.proc", wamp.Dict{wamp.OptTimeout: "soon"})
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected ERROR", wamp.ErrInvalidArgument, "got", rsp)
+	}
+	// A valid call to an unregistered procedure.
+	rsp = call("com.myapp.proc", wamp.Dict{wamp.OptTimeout: 1000})
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchProcedure {
+		t.Fatal("expected ERROR", wamp.ErrNoSuchProcedure, "got", rsp)
+	}
+}
+
+func TestDuplicateRegister(t *testing.T) {
+	dealer := newDealer(context.Background(), logger, false, true, false, debug, 0)
+	defer dealer.close()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"shared_registration": true,
+				},
+			},
+		},
+	}
+
+	for _, policy := range []string{wamp.InvokeSingle, wamp.InvokeRoundRobin} {
+		procedure := wamp.URI(fmt.Sprint(testProcedure, ".", policy))
+		callee := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, calleeRoles)
+		register := func() wamp.Message {
+			dealer.register(callee, &wamp.Register{
+				Request:   wamp.GlobalID(),
+				Procedure: procedure,
+				Options:   wamp.SetOption(nil, wamp.OptInvoke, policy),
+			})
+			msg, err := wamp.RecvTimeout(callee, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return msg
+		}
+		regMsg, ok := register().(*wamp.Registered)
+		if !ok {
+			t.Fatal("did not receive REGISTERED response")
+		}
+
+		// Same session registering same procedure again is an error.
+		errMsg, ok := register().(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR for duplicate", policy, "registration")
+		}
+		if errMsg.Error != wamp.ErrProcedureAlreadyExists {
+			t.Fatal("wrong error:", errMsg.Error)
+		}
+		if n := dealer.countRegistrations(); n != 1 {
+			t.Fatal("expected 1 registration, got", n)
+		}
+
+		// A single unregister removes the callee, so no duplicate remains.
+		dealer.unregister(callee, &wamp.Unregister{
+			Request:      wamp.GlobalID(),
+			Registration: regMsg.Registration,
+		})
+		if msg, err := wamp.RecvTimeout(callee, time.Second); err != nil {
+			t.Fatal(err)
+		} else if _, ok = msg.(*wamp.Unregistered); !ok {
+			t.Fatal("expected UNREGISTERED, got", msg.MessageType())
+		}
+		if n := dealer.countRegistrations(); n != 0 {
+			t.Fatal("registration not removed by unregister")
+		}
+	}
+}
+
+func TestPayloadPassthru(t *testing.T) {
+	dealer := newDealer(context.Background(), logger, false, true, false, debug, 0)
+	defer dealer.close()
+
+	if _, ok := dealer.role()["features"].(wamp.Dict)[featurePayloadPassthru]; !ok {
+		t.Fatal("dealer does not announce", featurePayloadPassthru)
+	}
+
+	callee := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	dealer.register(callee, &wamp.Register{
+		Request:   wamp.GlobalID(),
+		Procedure: testProcedure,
+	})
+	if msg, err := wamp.RecvTimeout(callee, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got", msg.MessageType())
+	}
+
+	// An opaque payload that is not valid in any serialization.
+	blob := []byte{0x00, 0xff, 0xc1, 0x80, 0x7f, 0x01, 0xfe}
+	pptOpts := wamp.Dict{
+		wamp.OptPPTScheme:     "x_custom",
+		wamp.OptPPTSerializer: "native",
+	}
+
+	caller := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	callID := wamp.GlobalID()
+	dealer.call(caller, &wamp.Call{
+		Request:   callID,
+		Procedure: testProcedure,
+		Options:   pptOpts,
+		Arguments: wamp.List{blob},
+	})
+	msg, err := wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, ok := msg.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got", msg.MessageType())
+	}
+	checkPayload := func(args wamp.List, details wamp.Dict) {
+		if len(args) != 1 {
+			t.Fatal("expected 1 argument, got", len(args))
+		}
+		payload, ok := args[0].([]byte)
+		if !ok || !bytes.Equal(payload, blob) {
+			t.Fatalf("payload changed: %v", args[0])
+		}
+		// The router passes the payload along without copying it.
+		if &payload[0] != &blob[0] {
+			t.Fatal("payload was not passed through")
+		}
+		for opt, val := range pptOpts {
+			if details[opt] != val {
+				t.Fatalf("expected %s=%v in details, got %v", opt, val, details[opt])
+			}
+		}
+	}
+	checkPayload(inv.Arguments, inv.Details)
+
+	dealer.yield(callee, &wamp.Yield{
+		Request:   inv.Request,
+		Options:   pptOpts,
+		Arguments: inv.Arguments,
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	checkPayload(result.Arguments, result.Details)
+
+	// Passthru mode requires the payload as the only argument.
+	dealer.call(caller, &wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: testProcedure,
+		Options:   pptOpts,
+		Arguments: wamp.List{blob, blob},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected ERROR", wamp.ErrInvalidArgument, "got", msg)
+	}
+
+	// Other ppt options are not valid without ppt_scheme.
+	dealer.call(caller, &wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptPPTSerializer: "native"},
+		Arguments: wamp.List{blob},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected ERROR", wamp.ErrInvalidArgument, "got", msg)
+	}
+
+	// A YIELD with invalid ppt options is not delivered as a RESULT, and the
+	// caller gets an error instead.
+	callID = wamp.GlobalID()
+	dealer.call(caller, &wamp.Call{
+		Request:   callID,
+		Procedure: testProcedure,
+		Options:   pptOpts,
+		Arguments: wamp.List{blob},
+	})
+	if msg, err = wamp.RecvTimeout(callee, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	inv = msg.(*wamp.Invocation)
+	dealer.yield(callee, &wamp.Yield{
+		Request:   inv.Request,
+		Options:   pptOpts,
+		Arguments: wamp.List{blob, blob},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errMsg, ok := msg.(*wamp.Error)
+	if !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected ERROR", wamp.ErrInvalidArgument, "got", msg)
+	}
+	if errMsg.Request != callID {
+		t.Fatal("wrong request ID in ERROR")
+	}
+}
@@ -0,0 +1,121 @@
+package router
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// fanoutQueueSize is the number of publications queued for each fan-out
+// worker.  When a worker's queue is full, the broker waits for it.
+const fanoutQueueSize = 64
+
+// fanoutJob calls send for each session in a batch of subscribers.
+type fanoutJob struct {
+	sessions []*wamp.Session
+	send     func(*wamp.Session)
+}
+
+// fanout sends events to subscribers from a fixed set of worker goroutines,
+// so that sending a publication to many subscribers does not hold up the
+// broker goroutine.  Each subscriber is always handled by the same worker, so
+// events are sent to each subscriber in the order they were dispatched.
+//
+// The workers stop when the context is canceled, discarding any queued jobs,
+// since the realm is closing and its sessions are being ended.
+type fanout struct {
+	queues []chan fanoutJob
+	ctx    context.Context
+	wg     sync.WaitGroup
+}
+
+// newFanout starts the specified number of workers.  If workers is less than
+// one, then nil is returned.
+func newFanout(ctx context.Context, workers int) *fanout {
+	if workers < 1 {
+		return nil
+	}
+	f := &fanout{
+		queues: make([]chan fanoutJob, workers),
+		ctx:    ctx,
+	}
+	f.wg.Add(workers)
+	for i := range f.queues {
+		f.queues[i] = make(chan fanoutJob, fanoutQueueSize)
+		go f.run(f.queues[i])
+	}
+	return f
+}
+
+func (f *fanout) run(queue <-chan fanoutJob) {
+	defer f.wg.Done()
+	for {
+		select {
+		case job, ok := <-queue:
+			if !ok {
+				return
+			}
+			for _, sess := range job.sessions {
+				job.send(sess)
+			}
+		case <-f.ctx.Done():
+			return
+		}
+	}
+}
+
+// batches returns an empty batch of sessions for each worker, to fill using
+// add.
+func (f *fanout) batches() [][]*wamp.Session {
+	return make([][]*wamp.Session, len(f.queues))
+}
+
+// worker returns the index of the worker that handles the session.
+func (f *fanout) worker(sess *wamp.Session) int {
+	return int(uint64(sess.ID) % uint64(len(f.queues)))
+}
+
+// add appends the session to the batch of the worker that handles it.
+func (f *fanout) add(batches [][]*wamp.Session, sess *wamp.Session) {
+	w := f.worker(sess)
+	batches[w] = append(batches[w], sess)
+}
+
+// send queues a call to send for the session to the worker that handles it,
+// so that the call is made after everything already dispatched to the
+// session.
+func (f *fanout) send(sess *wamp.Session, send func(*wamp.Session)) {
+	f.queue(f.worker(sess), fanoutJob{
+		sessions: []*wamp.Session{sess},
+		send:     send,
+	})
+}
+
+// dispatch queues each batch of sessions to its worker, which calls send for
+// each session in the batch.
+func (f *fanout) dispatch(batches [][]*wamp.Session, send func(*wamp.Session)) {
+	for w, sessions := range batches {
+		if len(sessions) == 0 {
+			continue
+		}
+		f.queue(w, fanoutJob{sessions: sessions, send: send})
+	}
+}
+
+// queue queues the job to the worker, unless the workers are stopped.
+func (f *fanout) queue(w int, job fanoutJob) {
+	select {
+	case f.queues[w] <- job:
+	case <-f.ctx.Done():
+	}
+}
+
+// close stops the workers after they finish sending all queued jobs, or when
+// the context is canceled.
+func (f *fanout) close() {
+	for _, q := range f.queues {
+		close(q)
+	}
+	f.wg.Wait()
+}
@@ -0,0 +1,141 @@
+package router
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// ExpvarName is the name of the expvar map that holds the metrics of each
+// realm that has RealmConfig.Expvar set.  The map is keyed by realm URI, and
+// each realm's value is a map with these entries:
+//
+//	messages_in    messages received from client sessions, by message type
+//	messages_out   messages sent to sessions, by message type
+//	sessions       number of sessions attached to the realm
+//	subscriptions  number of subscriptions in the realm's broker
+//	registrations  number of registrations in the realm's dealer
+//
+// Importing expvar serves the variables at /debug/vars on
+// http.DefaultServeMux.
+const ExpvarName = "nexus_realms"
+
+var (
+	expvarOnce   sync.Once
+	expvarRealms *expvar.Map
+)
+
+// realmsExpvar returns the published map of realm metrics, creating it the
+// first time it is needed.  expvar panics if a name is published twice.
+func realmsExpvar() *expvar.Map {
+	expvarOnce.Do(func() {
+		expvarRealms = expvar.NewMap(ExpvarName)
+	})
+	return expvarRealms
+}
+
+// realmMetrics holds the expvar counters of a realm.
+type realmMetrics struct {
+	vars     *expvar.Map
+	in       *expvar.Map
+	out      *expvar.Map
+	sessions *expvar.Int
+}
+
+// statsTimeout is how long reading a realm's subscription or registration
+// count waits for the realm before giving up.
+const statsTimeout = time.Second
+
+// newRealmMetrics creates the realm's counters.  They are not visible until
+// published.
+func newRealmMetrics(r *realm) *realmMetrics {
+	m := &realmMetrics{
+		vars:     new(expvar.Map).Init(),
+		in:       new(expvar.Map).Init(),
+		out:      new(expvar.Map).Init(),
+		sessions: new(expvar.Int),
+	}
+	m.vars.Set("messages_in", m.in)
+	m.vars.Set("messages_out", m.out)
+	m.vars.Set("sessions", m.sessions)
+	m.vars.Set("subscriptions", statsFunc(r, func(s RealmStats) int {
+		return s.Subscriptions
+	}))
+	m.vars.Set("registrations", statsFunc(r, func(s RealmStats) int {
+		return s.Registrations
+	}))
+	return m
+}
+
+// statsFunc returns an expvar.Func that reports a value from the realm's
+// stats.  Reading the value never blocks for longer than statsTimeout, since
+// the realm may be busy or closing.  If the stats are not available, then the
+// value is null.
+func statsFunc(r *realm, value func(RealmStats) int) expvar.Func {
+	return func() interface{} {
+		statsChan := make(chan RealmStats, 1)
+		go func() {
+			statsChan <- r.Stats()
+		}()
+		timer := time.NewTimer(statsTimeout)
+		defer timer.Stop()
+		select {
+		case stats := <-statsChan:
+			return value(stats)
+		case <-r.ctx.Done():
+		case <-timer.C:
+		}
+		return nil
+	}
+}
+
+// publish publishes the realm's counters under the realm's URI, replacing any
+// previous realm with the same URI.  This is called once the realm is running,
+// so that reading the counters does not wait on a realm that never runs.
+func (m *realmMetrics) publish(uri wamp.URI) {
+	realmsExpvar().Set(string(uri), m.vars)
+}
+
+// unpublish removes the realm's counters from the expvar map, unless they
+// have already been replaced by another realm with the same URI.
+func (m *realmMetrics) unpublish(uri wamp.URI) {
+	realms := realmsExpvar()
+	if realms.Get(string(uri)) == m.vars {
+		realms.Delete(string(uri))
+	}
+}
+
+// countingPeer wraps the peer of a session to count the messages sent to the
+// session, by message type.
+type countingPeer struct {
+	wamp.Peer
+	out *expvar.Map
+}
+
+func (p *countingPeer) count(msg wamp.Message, err error) error {
+	if err == nil {
+		p.out.Add(msg.MessageType().String(), 1)
+	}
+	return err
+}
+
+func (p *countingPeer) Send(msg wamp.Message) error {
+	return p.count(msg, p.Peer.Send(msg))
+}
+
+func (p *countingPeer) SendCtx(ctx context.Context, msg wamp.Message) error {
+	return p.count(msg, p.Peer.SendCtx(ctx, msg))
+}
+
+func (p *countingPeer) TrySend(msg wamp.Message) error {
+	return p.count(msg, p.Peer.TrySend(msg))
+}
+
+// RemoteAddr returns the network address of the wrapped peer, if it has one.
+func (p *countingPeer) RemoteAddr() string {
+	addr, _ := wamp.PeerAddr(p.Peer)
+	return addr
+}
@@ -0,0 +1,163 @@
+package router
+
+import (
+	"expvar"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestExpvarMetrics(t *testing.T) {
+	defer leaktest.Check(t)()
+	const realmURI = wamp.URI("nexus.test.expvar")
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           realmURI,
+				AnonymousAuth: true,
+				Expvar:        true,
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	realms, ok := expvar.Get(ExpvarName).(*expvar.Map)
+	if !ok {
+		t.Fatal("expvar map not published")
+	}
+	vars, ok := realms.Get(string(realmURI)).(*expvar.Map)
+	if !ok {
+		t.Fatal("realm metrics not published")
+	}
+	count := func(name, msgType string) int64 {
+		m := vars.Get(name).(*expvar.Map)
+		n, ok := m.Get(msgType).(*expvar.Int)
+		if !ok {
+			return 0
+		}
+		return n.Value()
+	}
+
+	// The realm's meta procedures are registrations too.
+	regsBefore, err := strconv.Atoi(vars.Get("registrations").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := testClientInRealm(r, realmURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	if msg, err := wamp.RecvTimeout(cli, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+	}
+	cli.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	if msg, err := wamp.RecvTimeout(cli, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got", msg.MessageType())
+	}
+	for i := 0; i < 3; i++ {
+		cli.Send(&wamp.Publish{
+			Request: wamp.GlobalID(),
+			Topic:   testTopic,
+			Options: wamp.Dict{wamp.OptAcknowledge: true},
+		})
+		if _, err = wamp.RecvTimeout(cli, time.Second); err != nil {
+			t.Fatal("timed out waiting for PUBLISHED")
+		}
+	}
+
+	if n := count("messages_in", "SUBSCRIBE"); n != 1 {
+		t.Error("expected 1 SUBSCRIBE in, got", n)
+	}
+	if n := count("messages_in", "REGISTER"); n != 1 {
+		t.Error("expected 1 REGISTER in, got", n)
+	}
+	if n := count("messages_in", "PUBLISH"); n != 3 {
+		t.Error("expected 3 PUBLISH in, got", n)
+	}
+	if n := count("messages_out", "SUBSCRIBED"); n != 1 {
+		t.Error("expected 1 SUBSCRIBED out, got", n)
+	}
+	if n := count("messages_out", "REGISTERED"); n != 1 {
+		t.Error("expected 1 REGISTERED out, got", n)
+	}
+	if n := count("messages_out", "PUBLISHED"); n != 3 {
+		t.Error("expected 3 PUBLISHED out, got", n)
+	}
+	if n := vars.Get("sessions").(*expvar.Int).Value(); n != 1 {
+		t.Error("expected 1 session, got", n)
+	}
+	if s := vars.Get("subscriptions").String(); s != "1" {
+		t.Error("expected 1 subscription, got", s)
+	}
+	if s := vars.Get("registrations").String(); s != strconv.Itoa(regsBefore+1) {
+		t.Error("expected 1 more registration, got", s)
+	}
+
+	cli.Close()
+	r.Close()
+	if realms.Get(string(realmURI)) != nil {
+		t.Error("realm metrics not removed when realm closed")
+	}
+}
+
+func TestExpvarRealmTemplate(t *testing.T) {
+	defer leaktest.Check(t)()
+	const realmURI = wamp.URI("nexus.test.expvar.template")
+	r, err := NewRouter(&Config{
+		RealmTemplate: &RealmConfig{
+			AnonymousAuth: true,
+			Expvar:        true,
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// The realm created to validate the template is never published.
+	realms := realmsExpvar()
+	if realms.Get("some.valid.realm") != nil {
+		t.Fatal("template validation realm was published")
+	}
+
+	cli, err := testClientInRealm(r, realmURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if realms.Get(string(realmURI)) == nil {
+		t.Fatal("realm created from template was not published")
+	}
+
+	// Reading every realm's metrics, as /debug/vars does, must not block.
+	done := make(chan string, 1)
+	go func() {
+		done <- realms.String()
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * statsTimeout):
+		t.Fatal("reading realm metrics blocked")
+	}
+
+	cli.Close()
+	if err = r.RemoveRealm(realmURI); err != nil {
+		t.Fatal(err)
+	}
+	if realms.Get(string(realmURI)) != nil {
+		t.Fatal("realm metrics not removed when realm removed")
+	}
+}
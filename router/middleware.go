@@ -0,0 +1,62 @@
+package router
+
+import (
+	"sync/atomic"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// Handler handles a message received by a realm from a session.
+type Handler func(sess *wamp.Session, msg wamp.Message)
+
+// Middleware wraps the Handler that routes messages, to inspect or change
+// messages before they are routed.  The Handler returned by Middleware calls
+// next to pass a message on, or does not call next to drop the message.  A
+// middleware that drops a message is responsible for sending any error
+// response to the session.
+//
+// Middleware is called for PUBLISH, SUBSCRIBE, UNSUBSCRIBE, REGISTER,
+// UNREGISTER, CALL, YIELD, CANCEL, and INVOCATION ERROR messages.  It is
+// called before authorization, so a message changed by middleware is
+// authorized as changed.  Messages from a session are passed to the middleware
+// one at a time, from the session's goroutine, so middleware for a session
+// must not block.  Middleware is called concurrently for different sessions.
+type Middleware func(next Handler) Handler
+
+// chainMiddleware returns a Handler that calls the middleware in order, with
+// the first middleware outermost, and ends with the final Handler.
+func chainMiddleware(final Handler, middleware []Middleware) Handler {
+	h := final
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// MessageCounter is a Middleware that counts the messages received by the
+// router, by message type.
+//
+//	counter := &router.MessageCounter{}
+//	config := &router.Config{Middleware: []router.Middleware{counter.Middleware}}
+type MessageCounter struct {
+	counts [wamp.YIELD + 1]uint64
+}
+
+// Middleware counts each message and passes it to next.
+func (c *MessageCounter) Middleware(next Handler) Handler {
+	return func(sess *wamp.Session, msg wamp.Message) {
+		if mt := int(msg.MessageType()); mt < len(c.counts) {
+			atomic.AddUint64(&c.counts[mt], 1)
+		}
+		next(sess, msg)
+	}
+}
+
+// Count returns the number of messages of the given type that have been
+// counted.
+func (c *MessageCounter) Count(msgType wamp.MessageType) uint64 {
+	if int(msgType) >= len(c.counts) {
+		return 0
+	}
+	return atomic.LoadUint64(&c.counts[msgType])
+}
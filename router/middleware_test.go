@@ -0,0 +1,105 @@
+package router
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestMiddleware(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(sess *wamp.Session, msg wamp.Message) {
+				mu.Lock()
+				calls = append(calls, name)
+				mu.Unlock()
+				next(sess, msg)
+			}
+		}
+	}
+	// Reject subscriptions to a forbidden topic, without passing them on.
+	reject := func(next Handler) Handler {
+		return func(sess *wamp.Session, msg wamp.Message) {
+			if sub, ok := msg.(*wamp.Subscribe); ok && sub.Topic == "nexus.forbidden" {
+				sess.TrySend(&wamp.Error{
+					Type:    wamp.SUBSCRIBE,
+					Request: sub.Request,
+					Details: wamp.Dict{},
+					Error:   wamp.ErrNotAuthorized,
+				})
+				return
+			}
+			next(sess, msg)
+		}
+	}
+	counter := &MessageCounter{}
+
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+			},
+		},
+		Middleware: []Middleware{record("first"), counter.Middleware, reject, record("last")},
+		Debug:      debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	cli.Send(&wamp.Subscribe{Request: 1, Topic: testTopic, Options: wamp.Dict{}})
+	msg, err := wamp.RecvTimeout(cli, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+	}
+	mu.Lock()
+	if len(calls) != 2 || calls[0] != "first" || calls[1] != "last" {
+		t.Fatal("middleware called in wrong order:", calls)
+	}
+	calls = nil
+	mu.Unlock()
+
+	// Middleware short-circuits message, which is not routed.
+	cli.Send(&wamp.Subscribe{Request: 2, Topic: "nexus.forbidden", Options: wamp.Dict{}})
+	msg, err = wamp.RecvTimeout(cli, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("expected ERROR", wamp.ErrNotAuthorized, "got", msg)
+	}
+	mu.Lock()
+	if len(calls) != 1 || calls[0] != "first" {
+		t.Fatal("middleware after short-circuit was called:", calls)
+	}
+	mu.Unlock()
+	rlm, _ := r.GetRealm(testRealm)
+	if subs, _, _ := rlm.SessionResources(cli.ID); len(subs) != 1 {
+		t.Fatal("rejected subscription was routed")
+	}
+
+	if n := counter.Count(wamp.SUBSCRIBE); n != 2 {
+		t.Fatal("expected 2 SUBSCRIBE messages counted, got", n)
+	}
+	if n := counter.Count(wamp.PUBLISH); n != 0 {
+		t.Fatal("expected 0 PUBLISH messages counted, got", n)
+	}
+}
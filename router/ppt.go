@@ -0,0 +1,65 @@
+package router
+
+import (
+	"errors"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// featurePayloadPassthru is announced by both the broker and dealer.  In
+// payload passthru mode, the arguments of a PUBLISH, CALL, or YIELD hold a
+// single payload that the router delivers as-is, and the ppt_* options
+// describing the payload are copied to the EVENT, INVOCATION, or RESULT.
+//
+// This is passthru of the options only.  The transports still decode each
+// whole message, including the payload argument, and encode it again for the
+// receiver.  What the router guarantees is that it does not inspect or change
+// the payload, so a payload that the client has already serialized or
+// encrypted, such as a binary blob, arrives unchanged.
+const featurePayloadPassthru = "payload_passthru_mode"
+
+// pptOptions are the options that describe a payload in passthru mode.
+var pptOptions = []string{
+	wamp.OptPPTScheme,
+	wamp.OptPPTSerializer,
+	wamp.OptPPTCipher,
+	wamp.OptPPTKeyID,
+}
+
+// checkPPT returns an error if the message options request payload passthru
+// mode, but the options or the form of the payload are not valid.  The
+// payload itself is never inspected.
+func checkPPT(options wamp.Dict, args wamp.List, kwargs wamp.Dict) error {
+	scheme, ok := options[wamp.OptPPTScheme]
+	if !ok {
+		for _, opt := range pptOptions[1:] {
+			if _, ok = options[opt]; ok {
+				return errors.New(opt + " option requires ppt_scheme")
+			}
+		}
+		return nil
+	}
+	if s, _ := wamp.AsString(scheme); s == "" {
+		return errors.New("ppt_scheme must be a non-empty string")
+	}
+	for _, opt := range pptOptions[1:] {
+		if val, ok := options[opt]; ok {
+			if _, ok = wamp.AsString(val); !ok {
+				return errors.New(opt + " must be a string")
+			}
+		}
+	}
+	if len(args) != 1 || len(kwargs) != 0 {
+		return errors.New("payload passthru mode requires a single argument")
+	}
+	return nil
+}
+
+// addPPTDetails copies any payload passthru options into details.
+func addPPTDetails(details, options wamp.Dict) {
+	for _, opt := range pptOptions {
+		if val, ok := options[opt]; ok {
+			details[opt] = val
+		}
+	}
+}
@@ -7,7 +7,8 @@ import (
 )
 
 // PublishFilter is an interface to check whether a publication should be sent
-// to a specific session
+// to a specific session.  If the realm has publish workers, then Allowed may
+// be called concurrently.
 type PublishFilter interface {
 	Allowed(sess *wamp.Session) bool
 }
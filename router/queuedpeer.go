@@ -0,0 +1,210 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// Values for RealmConfig.OutQueuePolicy.
+const (
+	// OutQueueDrop drops a session whose outbound queue is full.  The session
+	// is sent a GOODBYE with reason wamp.ErrSystemShutdown and is removed
+	// from the realm.
+	OutQueueDrop = "drop"
+	// OutQueueBlock blocks the sender until the session's outbound queue has
+	// room for the message.
+	OutQueueBlock = "block"
+)
+
+// outQueueFlushTimeout is how long a closing queuedPeer waits for the messages
+// still in its queue to be sent to the wrapped peer.
+const outQueueFlushTimeout = time.Second
+
+var (
+	errOutQueueFull   = errors.New("outbound queue full")
+	errOutQueueClosed = errors.New("outbound queue closed")
+)
+
+// checkOutQueuePolicy returns an error if the outbound queue policy is not one
+// of the recognized values.
+func checkOutQueuePolicy(policy string) error {
+	switch policy {
+	case "", OutQueueDrop, OutQueueBlock:
+		return nil
+	}
+	return errors.New("invalid out_queue_policy: " + policy)
+}
+
+// queuedPeer wraps the peer of a session with a bounded outbound queue.  A
+// goroutine forwards messages from the queue to the wrapped peer, so that a
+// peer that is slow to accept messages does not block the broker or dealer.
+// When the queue is full, TrySend either blocks or calls onFull, according to
+// the realm's outbound queue policy.
+//
+// A GOODBYE or ABORT ends the session, so it is not queued.  Instead, the queue
+// is flushed and the message is sent directly to the wrapped peer.  This way
+// the message is delivered even if the session is being dropped because its
+// queue is full.
+type queuedPeer struct {
+	wamp.Peer
+
+	queue  chan wamp.Message
+	block  bool
+	onFull func()
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	stop      chan struct{}
+	done      chan struct{}
+	flushOnce sync.Once
+	closeOnce sync.Once
+}
+
+func newQueuedPeer(peer wamp.Peer, size int, block bool, onFull func()) *queuedPeer {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &queuedPeer{
+		Peer:   peer,
+		queue:  make(chan wamp.Message, size),
+		block:  block,
+		onFull: onFull,
+		ctx:    ctx,
+		cancel: cancel,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go p.forward()
+	return p
+}
+
+// forward sends queued messages to the wrapped peer until the queuedPeer is
+// flushed or closed.
+func (p *queuedPeer) forward() {
+	defer close(p.done)
+	for {
+		select {
+		case msg := <-p.queue:
+			if err := p.Peer.SendCtx(p.ctx, msg); err != nil {
+				return
+			}
+		case <-p.stop:
+			// Send whatever is left in the queue.  flush cancels p.ctx if
+			// this takes too long.
+			for {
+				select {
+				case msg := <-p.queue:
+					if err := p.Peer.SendCtx(p.ctx, msg); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// flush stops the queue from accepting messages, and waits for the messages
+// already queued to be sent to the wrapped peer.  Any messages that cannot be
+// sent within outQueueFlushTimeout are discarded.
+func (p *queuedPeer) flush() {
+	p.flushOnce.Do(func() {
+		close(p.stop)
+		timer := time.AfterFunc(outQueueFlushTimeout, p.cancel)
+		<-p.done
+		timer.Stop()
+	})
+}
+
+// isTerminal returns true if the message ends the session.
+func isTerminal(msg wamp.Message) bool {
+	switch msg.MessageType() {
+	case wamp.GOODBYE, wamp.ABORT:
+		return true
+	}
+	return false
+}
+
+// TrySend queues the message without blocking, unless the policy is to block.
+// If the queue is full and the policy is not to block, then onFull is called
+// and an error is returned.
+func (p *queuedPeer) TrySend(msg wamp.Message) error {
+	if isTerminal(msg) {
+		p.flush()
+		return p.Peer.TrySend(msg)
+	}
+	select {
+	case <-p.stop:
+		return errOutQueueClosed
+	default:
+	}
+	select {
+	case p.queue <- msg:
+		return nil
+	default:
+	}
+	if p.block {
+		return p.SendCtx(p.ctx, msg)
+	}
+	if p.onFull != nil {
+		p.onFull()
+	}
+	return errOutQueueFull
+}
+
+// Send queues the message, waiting for room in the queue if necessary.
+func (p *queuedPeer) Send(msg wamp.Message) error {
+	return p.SendCtx(p.ctx, msg)
+}
+
+func (p *queuedPeer) SendCtx(ctx context.Context, msg wamp.Message) error {
+	if isTerminal(msg) {
+		p.flush()
+		return p.Peer.SendCtx(ctx, msg)
+	}
+	select {
+	case p.queue <- msg:
+		return nil
+	case <-p.stop:
+		return errOutQueueClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// RemoteAddr returns the network address of the wrapped peer, if it has one.
+func (p *queuedPeer) RemoteAddr() string {
+	addr, _ := wamp.PeerAddr(p.Peer)
+	return addr
+}
+
+// Close flushes the queue and closes the wrapped peer.
+func (p *queuedPeer) Close() {
+	p.closeOnce.Do(func() {
+		p.flush()
+		p.cancel()
+		p.Peer.Close()
+	})
+}
+
+// unwrapPeer returns the transport peer of a session, which may be wrapped in
+// a queuedPeer and a countingPeer.
+func unwrapPeer(peer wamp.Peer) wamp.Peer {
+	for {
+		switch p := peer.(type) {
+		case *countingPeer:
+			peer = p.Peer
+		case *queuedPeer:
+			peer = p.Peer
+		default:
+			return peer
+		}
+	}
+}
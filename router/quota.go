@@ -0,0 +1,126 @@
+package router
+
+import (
+	"fmt"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// Quota limits the resources held by all the sessions in a realm that have
+// the same authrole.  A limit of zero means no limit.
+type Quota struct {
+	// Maximum number of sessions attached to the realm.  A client that would
+	// exceed this is sent an ABORT with reason wamp.error.not_authorized.
+	MaxSessions int `json:"max_sessions"`
+	// Maximum number of subscriptions.  A SUBSCRIBE that would exceed this
+	// gets an ERROR with wamp.error.not_authorized.
+	MaxSubscriptions int `json:"max_subscriptions"`
+	// Maximum number of registrations.  A REGISTER that would exceed this gets
+	// an ERROR with wamp.error.not_authorized.
+	MaxRegistrations int `json:"max_registrations"`
+}
+
+// checkQuotas returns an error if any authrole quota has a negative limit.
+func checkQuotas(quotas map[string]Quota) error {
+	for role, q := range quotas {
+		if q.MaxSessions < 0 || q.MaxSubscriptions < 0 || q.MaxRegistrations < 0 {
+			return fmt.Errorf("negative limit in quota for authrole %q", role)
+		}
+	}
+	return nil
+}
+
+// roleQuota counts one kind of resource held by sessions, by authrole, and
+// limits the total held by the sessions of each authrole.  A roleQuota is only
+// used by the goroutine of the realm, broker, or dealer that owns it.  A nil
+// roleQuota has no limits.
+type roleQuota struct {
+	limits map[string]int
+	counts map[string]int
+	held   map[*wamp.Session]*quotaHold
+}
+
+// quotaHold is the amount of a resource held by one session, and the authrole
+// that it counts against.
+type quotaHold struct {
+	role string
+	n    int
+}
+
+// newRoleQuota returns a roleQuota for the limits selected from each
+// authrole's quota, or nil if there are no limits.
+func newRoleQuota(quotas map[string]Quota, limit func(Quota) int) *roleQuota {
+	var limits map[string]int
+	for role, q := range quotas {
+		if n := limit(q); n > 0 {
+			if limits == nil {
+				limits = map[string]int{}
+			}
+			limits[role] = n
+		}
+	}
+	if limits == nil {
+		return nil
+	}
+	return &roleQuota{
+		limits: limits,
+		counts: map[string]int{},
+		held:   map[*wamp.Session]*quotaHold{},
+	}
+}
+
+// acquire counts one more resource held by the session.  If that would exceed
+// the limit for the session's authrole, then false is returned and nothing is
+// counted.  The meta session is never limited.
+func (q *roleQuota) acquire(sess *wamp.Session) bool {
+	if q == nil || sess.ID == metaID {
+		return true
+	}
+	h, ok := q.held[sess]
+	if !ok {
+		sess.Lock()
+		role, _ := wamp.AsString(sess.Details["authrole"])
+		sess.Unlock()
+		if _, limited := q.limits[role]; !limited {
+			return true
+		}
+		h = &quotaHold{role: role}
+	}
+	if q.counts[h.role] >= q.limits[h.role] {
+		return false
+	}
+	q.counts[h.role]++
+	h.n++
+	q.held[sess] = h
+	return true
+}
+
+// release stops counting n resources held by the session.
+func (q *roleQuota) release(sess *wamp.Session, n int) {
+	if q == nil {
+		return
+	}
+	h, ok := q.held[sess]
+	if !ok {
+		return
+	}
+	if n > h.n {
+		n = h.n
+	}
+	h.n -= n
+	q.counts[h.role] -= n
+	if h.n == 0 {
+		delete(q.held, sess)
+	}
+}
+
+// quotaError returns the ERROR for a request that would exceed a quota.
+func quotaError(msgType wamp.MessageType, request wamp.ID, resource string) *wamp.Error {
+	return &wamp.Error{
+		Type:      msgType,
+		Request:   request,
+		Details:   wamp.Dict{},
+		Error:     wamp.ErrNotAuthorized,
+		Arguments: wamp.List{resource + " quota exceeded for authrole"},
+	}
+}
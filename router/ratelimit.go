@@ -0,0 +1,54 @@
+package router
+
+import "time"
+
+// tokenBucket limits the rate of messages from a session.  It is only used by
+// the goroutine handling the session's inbound messages, so it does not need
+// to be synchronized.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// Number of messages dropped since a message was last allowed.
+	dropped int
+}
+
+// newTokenBucket creates a full bucket that allows rate messages per second,
+// and up to burst messages at once.
+func newTokenBucket(rate, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket, and returns false if there are no
+// tokens available.
+func (b *tokenBucket) allow() bool {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		b.dropped++
+		return false
+	}
+	b.tokens--
+	b.dropped = 0
+	return true
+}
+
+// sustained returns true if the bucket has dropped more than a full burst of
+// messages without allowing any.
+func (b *tokenBucket) sustained() bool {
+	return float64(b.dropped) > b.burst
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/gammazero/nexus/transport"
+	"github.com/gammazero/nexus/wamp"
 )
 
 // RawSocketServer handles socket connections.
@@ -115,7 +116,19 @@ func (s *RawSocketServer) handleRawSocket(conn net.Conn) {
 		return
 	}
 
-	if err := s.router.Attach(peer); err != nil {
+	transportDetails := wamp.Dict{
+		"type": "rawsocket",
+		"peer": conn.RemoteAddr().String(),
+	}
+	// The TLS handshake is complete, since the rawsocket handshake was read.
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		if certDetails := peerCertDetails(&state); certDetails != nil {
+			transportDetails["peer_cert"] = certDetails
+		}
+	}
+
+	if err := s.router.AttachClient(peer, transportDetails); err != nil {
 		s.router.Logger().Println("Error attaching to router:", err)
 	}
 }
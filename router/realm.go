@@ -1,10 +1,15 @@
 package router
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gammazero/nexus/router/auth"
 	"github.com/gammazero/nexus/stdlog"
@@ -20,14 +25,110 @@ type RealmConfig struct {
 	// Enforce strict URI format validation.
 	StrictURI bool `json:"strict_uri"`
 	// Allow anonymous authentication.  If an auth.AnonymousAuth Authenticator
-	// if not supplied, then router supplies on with AuthRole of "anonymous".
+	// is not supplied, then router supplies one with AuthRole of "anonymous".
+	// When false, a client that does not request one of the realm's
+	// configured authmethods is rejected with ABORT
+	// wamp.error.authentication_failed.
 	AnonymousAuth bool `json:"anonymous_auth"`
 	// Allow publisher and caller identity disclosure when requested.
 	AllowDisclose bool `json:"allow_disclose"`
+	// DisclosePublisher overrides publisher identity disclosure, regardless
+	// of whether the publisher requested it.  DiscloseAlways includes the
+	// publisher identity in every EVENT.  DiscloseNever forbids disclosure,
+	// and a publisher requesting it gets an ERROR.  When empty, disclosure is
+	// done when requested by the publisher and allowed by AllowDisclose.
+	DisclosePublisher string `json:"disclose_publisher"`
+	// DiscloseCaller overrides caller identity disclosure, regardless of
+	// whether the caller or callee requested it.  DiscloseAlways includes the
+	// caller identity in every INVOCATION to a callee that supports
+	// caller_identification.  DiscloseNever forbids disclosure, and a caller
+	// requesting it gets an ERROR.  When empty, disclosure is done when
+	// requested and allowed by AllowDisclose.
+	DiscloseCaller string `json:"disclose_caller"`
+	// MaxCallTimeout limits how long a call may wait for its result.  A
+	// call that requests a longer timeout, or no timeout, is canceled after
+	// MaxCallTimeout.  Zero means calls are only limited by the timeout the
+	// caller requests.
+	MaxCallTimeout time.Duration `json:"max_call_timeout"`
+	// HeartbeatInterval, if non-zero, is how often sessions that support
+	// heartbeats are expected to send a message.  A session supports
+	// heartbeats by setting x_heartbeat to true in HELLO.Details.  A session
+	// that has nothing else to send can call the wamp.session.heartbeat meta
+	// procedure.  The interval is announced to these sessions in
+	// WELCOME.Details.heartbeat_interval, in milliseconds.  A session that
+	// supports heartbeats, and sends no messages for HeartbeatInterval plus
+	// HeartbeatGrace, is sent a GOODBYE with reason wamp.close.timeout and is
+	// removed from the realm.  Sessions that do not support heartbeats are
+	// never ended for being idle.  Zero, the default, disables heartbeats.
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+	// HeartbeatGrace is how long past HeartbeatInterval to wait for a message
+	// from a session before ending it.  If zero, HeartbeatInterval is used.
+	HeartbeatGrace time.Duration `json:"heartbeat_grace"`
+	// OutQueueSize, if non-zero, gives each session a router-side queue of
+	// this many outbound messages, so that the broker and dealer do not wait
+	// on a session that is slow to accept messages.  When zero, messages that
+	// cannot be handed to the session's transport without blocking are
+	// dropped.
+	OutQueueSize int `json:"out_queue_size"`
+	// OutQueuePolicy selects what happens when a session's outbound queue is
+	// full.  OutQueueDrop, the default, removes the session from the realm.
+	// OutQueueBlock waits for room in the queue, which stalls delivery to all
+	// other sessions until the slow session catches up.  Only used when
+	// OutQueueSize is non-zero.
+	OutQueuePolicy string `json:"out_queue_policy"`
+	// MessageRate limits the number of messages per second that each session
+	// may send to the realm.  Messages exceeding the limit are dropped.  Zero
+	// means no limit.
+	MessageRate int `json:"message_rate"`
+	// MessageBurst is the number of messages a session may send at once
+	// before being limited by MessageRate.  The default is MessageRate.
+	MessageBurst int `json:"message_burst"`
+	// RateLimitReason, if set, ends any session that has more than
+	// MessageBurst consecutive messages dropped for exceeding MessageRate.
+	// The session is sent a GOODBYE with this reason URI.
+	RateLimitReason wamp.URI `json:"rate_limit_reason"`
+	// MaxPayloadSize limits the size, in bytes, of the arguments and keyword
+	// arguments of PUBLISH, CALL, and YIELD messages.  The size is that of
+	// the payload serialized as JSON.  A message over the limit is not routed
+	// and an ERROR with wamp.error.payload_size_exceeded is returned instead.
+	// Zero means no limit.
+	MaxPayloadSize int `json:"max_payload_size"`
+	// AuthroleQuotas limits the sessions, subscriptions, and registrations of
+	// the sessions that have each authrole, keyed by authrole.  The sessions
+	// of an authrole that is not in the map are not limited.
+	AuthroleQuotas map[string]Quota `json:"authrole_quotas"`
+	// RetainEvents is the number of events the broker keeps for each topic,
+	// when the publisher sets the retain option.  A subscriber that sets the
+	// get_retained option is sent the retained events for the topics matching
+	// its new subscription, with the "retained" detail set.  Zero disables
+	// event retention.
+	RetainEvents int `json:"retain_events"`
+	// PublishWorkers is the number of goroutines that send each publication's
+	// events to subscribers.  This takes event delivery off of the broker's
+	// routing goroutine, which helps topics with very many subscribers.
+	// Events are still sent to each subscriber in the order published.  When
+	// set, a PublishFilter's Allowed method may be called concurrently.  Zero
+	// sends events from the broker's routing goroutine.
+	PublishWorkers int `json:"publish_workers"`
+	// Expvar publishes the realm's message, session, subscription, and
+	// registration counters through the expvar package, in the map named by
+	// ExpvarName under the realm's URI.
+	Expvar bool `json:"expvar"`
 	// Slice of Authenticator interfaces.
 	Authenticators []auth.Authenticator
+	// CookieStore, if set, remembers the authid and authrole of each
+	// authenticated websocket client by its tracking cookie, so that a
+	// returning client requesting the "cookie" authmethod is authenticated by
+	// its cookie.  The websocket server must have tracking cookies enabled.
+	//
+	// This value is not set via json config, but is configured when
+	// embedding nexus.
+	CookieStore auth.CookieStore
 	// Authorizer called for each message.
 	Authorizer Authorizer
+	// AuthzRules, if not empty, configures a URIAuthorizer with these rules as
+	// the realm's Authorizer.  Cannot be used together with Authorizer.
+	AuthzRules []URIRule `json:"authz_rules"`
 	// Require authentication for local clients.  Normally local clients are
 	// always trusted.  Setting this treats local clients the same as remote.
 	RequireLocalAuth bool `json:"require_local_auth"`
@@ -39,18 +140,36 @@ type RealmConfig struct {
 	// When true, only include standard session details in on_join event and
 	// session_get response.  Standard details include: session, authid,
 	// authrole, authmethod, transport.  When false, all session details are
-	// included, except transport.auth.
+	// included, except transport.auth and transport.http_headers_received.
 	MetaStrict bool `json:"meta_strict"`
 	// When MetaStrict is true, MetaIncludeSessionDetails specifies session
 	// details to include that are in addition to the standard details
 	// specified by the WAMP specification.  This is a list of the names of
 	// additional session details values to include.
 	MetaIncludeSessionDetails []string `json:"meta_include_session_details"`
+	// DisableMetaAPI stops the realm from registering the wamp.* session,
+	// registration, and subscription meta procedures.  Calls to these get
+	// wamp.error.no_such_procedure.  Meta events are still published.
+	DisableMetaAPI bool `json:"disable_meta_api"`
+	// MetaStrictURI reserves the wamp.* topic namespace for the router's meta
+	// events.  A client that publishes to a wamp.* topic gets an ERROR with
+	// wamp.error.invalid_uri, if acknowledge was requested, and the event is
+	// not published.  Registration of wamp.* procedures by clients is always
+	// disallowed.
+	MetaStrictURI bool `json:"meta_strict_uri"`
 
 	// EnableMetaKill enables the wamp.session.kill* session meta procedures.
 	// These are disabled by default to avoid requiring Authorizer logic when
 	// it may not be needed otherwise.
 	EnableMetaKill bool `json:"enable_meta_kill"`
+	// MetaKillRoles, if not empty, restricts the wamp.session.kill* session
+	// meta procedures to callers having one of the listed authroles.
+	MetaKillRoles []string `json:"meta_kill_roles"`
+	// MetaDrainRoles, if not empty, enables the wamp.realm.drain meta
+	// procedure for callers having one of the listed authroles.  Since
+	// draining ends every session in the realm, the procedure is never
+	// enabled for all callers.
+	MetaDrainRoles []string `json:"meta_drain_roles"`
 	// EnableMetaModify enables the wamp.session.modify_details session meta
 	// procedure.  This is disabled by default to avoid requiring Authorizer
 	// logic when it may not be needed otherwise.
@@ -63,11 +182,87 @@ type RealmConfig struct {
 	// This value is not set via json config, but is configured when
 	// embedding nexus.  A value of nil enables the default filtering.
 	PublishFilterFactory FilterFactory
+
+	// DeadLetterHandler, if set, is called with each EVENT that could not be
+	// sent to a subscriber and each INVOCATION that could not be sent to a
+	// callee, such as when the session's peer is closed or blocked.
+	//
+	// This value is not set via json config, but is configured when
+	// embedding nexus.
+	DeadLetterHandler DeadLetterHandler
+
+	// WelcomeDecorator, if set, is called with the details of each WELCOME
+	// message just before it is sent to a client, and the details it returns
+	// are sent instead.  Use this to add custom details, such as server
+	// metadata, to the WELCOME.
+	//
+	// This value is not set via json config, but is configured when
+	// embedding nexus.
+	WelcomeDecorator WelcomeDecorator
+
+	// Tracer, if set, is called as publications and calls are routed in the
+	// realm.
+	//
+	// This value is not set via json config, but is configured when
+	// embedding nexus.
+	Tracer Tracer
+}
+
+// WelcomeDecorator is called with the session that is joining a realm and the
+// details of the WELCOME message for that session, and returns the details to
+// send in the WELCOME.  The details may be modified and returned, or new
+// details returned.  If nil is returned, the details are sent unchanged.
+// Custom details should use keys prefixed with "x_" to avoid conflicting with
+// details defined by WAMP.  The details must keep the "roles" advertised by
+// the router.
+//
+// The decorator is called before the session joins the realm, so no messages
+// have been sent to the session yet.  If the session then fails to join, the
+// WELCOME is not sent.  The session details must not be modified, and changes
+// to the WELCOME details do not change the session details.
+type WelcomeDecorator func(sess *wamp.Session, details wamp.Dict) wamp.Dict
+
+// Values for RealmConfig.DisclosePublisher and RealmConfig.DiscloseCaller.
+const (
+	DiscloseAlways = "always"
+	DiscloseNever  = "never"
+)
+
+// checkDisclosePolicies returns an error if a disclosure policy is not one of
+// the recognized values.
+func checkDisclosePolicies(config *RealmConfig) error {
+	for name, policy := range map[string]string{
+		"disclose_publisher": config.DisclosePublisher,
+		"disclose_caller":    config.DiscloseCaller,
+	} {
+		switch policy {
+		case "", DiscloseAlways, DiscloseNever:
+		default:
+			return fmt.Errorf("invalid %s policy: %q", name, policy)
+		}
+	}
+	return nil
+}
+
+// disclosePolicy applies a disclosure policy to the AllowDisclose setting, and
+// returns whether disclosure is allowed and whether it is forced.
+func disclosePolicy(allowDisclose bool, policy string) (allow, force bool) {
+	switch policy {
+	case DiscloseAlways:
+		return true, true
+	case DiscloseNever:
+		return false, false
+	}
+	return allowDisclose, false
 }
 
 // Special ID for meta session.
 const metaID = wamp.ID(1)
 
+// drainTimeout is how long a realm drained by the wamp.realm.drain meta
+// procedure waits for its sessions to reply GOODBYE before closing.
+const drainTimeout = 5 * time.Second
+
 type testament struct {
 	topic   wamp.URI
 	args    wamp.List
@@ -79,10 +274,50 @@ type testamentBucket struct {
 	destroyed []testament
 }
 
+// Realm is the interface to a realm in the router, and allows the realm to be
+// inspected by applications that embed the router.
+type Realm interface {
+	// URI returns the URI that identifies the realm.
+	URI() wamp.URI
+
+	// CountSessions returns the number of sessions attached to the realm.
+	CountSessions() int
+
+	// Stats returns a snapshot of the realm's statistics.
+	Stats() RealmStats
+
+	// SessionResources returns the IDs of the subscriptions and registrations
+	// held by the specified session.  This shows which resources a client
+	// owns, for example to find a client that forgot to unsubscribe.  If the
+	// session is not attached to the realm, then false is returned.
+	SessionResources(wamp.ID) (subIDs, regIDs []wamp.ID, ok bool)
+
+	// Close shuts down the realm, sending GOODBYE to all attached sessions.
+	// This does not remove the realm from the router.  Use
+	// Router.RemoveRealm to close and remove the realm.
+	Close()
+}
+
+// RealmStats is a snapshot of realm statistics returned by Realm.Stats.
+type RealmStats struct {
+	// Number of sessions attached to the realm.
+	Sessions int
+	// Number of subscriptions in the realm's broker.
+	Subscriptions int
+	// Number of registrations in the realm's dealer.
+	Registrations int
+	// Number of messages routed, by message type, since the realm started.
+	Messages map[wamp.MessageType]uint64
+	// Time since the realm started.
+	Uptime time.Duration
+}
+
 // A Realm is a WAMP routing and administrative domain, optionally protected by
 // authentication and authorization.  WAMP messages are only routed within a
 // Realm.
 type realm struct {
+	uri wamp.URI
+
 	broker *broker
 	dealer *dealer
 
@@ -91,7 +326,9 @@ type realm struct {
 	// authmethod -> Authenticator
 	authenticators map[string]auth.Authenticator
 
-	// session ID -> Session
+	// session ID -> Session.  Sessions are shared with the broker, dealer,
+	// and session handlers, so session details are only accessed while
+	// holding the session lock.
 	clients map[wamp.ID]*wamp.Session
 	// session ID -> testament
 	testaments map[wamp.ID]testamentBucket
@@ -108,10 +345,53 @@ type realm struct {
 	// Session meta-procedure registration ID -> handler map.
 	metaProcMap map[wamp.ID]func(*wamp.Invocation) wamp.Message
 	metaDone    chan struct{}
+	// Closed when the meta session's handleInboundMessages() exits.
+	metaStopped chan struct{}
 
 	closed    bool
 	closeLock sync.Mutex
 
+	// Canceled when the realm starts to close.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Receives session lifecycle events.  May be nil.
+	events *sessionEvents
+
+	// Passes undeliverable messages from the broker and dealer to the
+	// realm's DeadLetterHandler.  May be nil.
+	deadLetters *deadLetters
+
+	// Called when a client session leaves the realm.  May be nil.
+	sessionEnded func()
+
+	// Set to 1 when the realm has sent GOODBYE to its sessions and is
+	// waiting for them to leave.  Accessed atomically.
+	draining int32
+	// Set to 1 when the realm is told to drain by a meta procedure call, and
+	// is rejecting new sessions, subscriptions, and registrations until the
+	// grace period ends.  Accessed atomically.
+	quiescing int32
+
+	// Removes the realm from its router.  May be nil.
+	removeFromRouter func()
+
+	// Times heartbeat timeouts and drain grace periods.
+	clock Clock
+
+	// Limits the sessions of each authrole.  May be nil.  Only accessed by
+	// the realm goroutine.
+	sessionQuota *roleQuota
+
+	// Number of messages routed, indexed by message type.  The counters are
+	// accessed atomically, so that counting does not require a round trip
+	// through the realm goroutine for every message.
+	msgCounts []uint64
+	created   time.Time
+
+	// Counters published through expvar.  May be nil.
+	metrics *realmMetrics
+
 	log   stdlog.StdLog
 	debug bool
 
@@ -120,9 +400,38 @@ type realm struct {
 
 	metaStrict     bool
 	metaIncDetails []string
+	metaAPI        bool
+	metaStrictURI  bool
 
 	enableMetaKill   bool
 	enableMetaModify bool
+
+	// authroles allowed to call session kill meta procedures, if restricted.
+	metaKillRoles map[string]struct{}
+	// authroles allowed to call the realm drain meta procedure.
+	metaDrainRoles map[string]struct{}
+
+	outQueueSize  int
+	outQueueBlock bool
+
+	messageRate     int
+	messageBurst    int
+	rateLimitReason wamp.URI
+
+	maxPayloadSize int
+
+	// Heartbeat interval announced to clients, and how long a session may be
+	// silent before it is ended.  Zero disables heartbeats.
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+
+	// Handles messages from sessions: the middleware chain ending in
+	// routeMessage.
+	handler Handler
+
+	welcomeDecorator WelcomeDecorator
+
+	cookieStore auth.CookieStore
 }
 
 var (
@@ -133,38 +442,114 @@ var (
 )
 
 // newRealm creates a new realm with the given RealmConfig, broker and dealer.
-func newRealm(config *RealmConfig, broker *broker, dealer *dealer, logger stdlog.StdLog, debug bool) (*realm, error) {
+// The realm's context is ctx, which the broker and dealer also watch, and
+// cancel is called to cancel it when the realm starts to close.
+func newRealm(ctx context.Context, cancel context.CancelFunc, config *RealmConfig, broker *broker, dealer *dealer, logger stdlog.StdLog, debug bool) (*realm, error) {
 	if !config.URI.ValidURI(config.StrictURI, "") {
 		return nil, fmt.Errorf(
 			"invalid realm URI %v (URI strict checking %v)", config.URI, config.StrictURI)
 	}
+	if err := checkDisclosePolicies(config); err != nil {
+		return nil, err
+	}
+	if err := checkOutQueuePolicy(config.OutQueuePolicy); err != nil {
+		return nil, err
+	}
+	if config.RateLimitReason != "" && !config.RateLimitReason.ValidURI(false, "") {
+		return nil, fmt.Errorf("invalid rate_limit_reason URI: %v",
+			config.RateLimitReason)
+	}
+	if err := checkQuotas(config.AuthroleQuotas); err != nil {
+		return nil, err
+	}
+
+	authorizer := config.Authorizer
+	if len(config.AuthzRules) != 0 {
+		if authorizer != nil {
+			return nil, errors.New("authz_rules cannot be used with Authorizer")
+		}
+		uriAuthz, err := NewURIAuthorizer(config.AuthzRules)
+		if err != nil {
+			return nil, err
+		}
+		authorizer = uriAuthz
+	}
 
 	r := &realm{
+		uri:         config.URI,
 		broker:      broker,
 		dealer:      dealer,
-		authorizer:  config.Authorizer,
+		authorizer:  authorizer,
 		clients:     map[wamp.ID]*wamp.Session{},
 		testaments:  map[wamp.ID]testamentBucket{},
 		actionChan:  make(chan func()),
 		metaIDGen:   new(wamp.IDGen),
 		metaDone:    make(chan struct{}),
+		metaStopped: make(chan struct{}),
 		metaProcMap: make(map[wamp.ID]func(*wamp.Invocation) wamp.Message, 9),
 		log:         logger,
 		debug:       debug,
 		localAuth:   config.RequireLocalAuth,
 		localAuthz:  config.RequireLocalAuthz,
 		metaStrict:  config.MetaStrict,
+		msgCounts:   make([]uint64, wamp.YIELD+1),
+		created:     time.Now(),
+		clock:       realClock{},
 
 		enableMetaKill:   config.EnableMetaKill,
 		enableMetaModify: config.EnableMetaModify,
+
+		metaAPI:       !config.DisableMetaAPI,
+		metaStrictURI: config.MetaStrictURI,
+
+		outQueueSize:  config.OutQueueSize,
+		outQueueBlock: config.OutQueuePolicy == OutQueueBlock,
+
+		messageRate:     config.MessageRate,
+		messageBurst:    config.MessageBurst,
+		rateLimitReason: config.RateLimitReason,
+
+		maxPayloadSize: config.MaxPayloadSize,
+		sessionQuota: newRoleQuota(config.AuthroleQuotas, func(q Quota) int {
+			return q.MaxSessions
+		}),
+
+		welcomeDecorator: config.WelcomeDecorator,
+
+		cookieStore: config.CookieStore,
+	}
+
+	r.ctx, r.cancel = ctx, cancel
+	r.handler = r.routeMessage
+
+	if config.HeartbeatInterval > 0 {
+		r.heartbeatInterval = config.HeartbeatInterval
+		grace := config.HeartbeatGrace
+		if grace <= 0 {
+			grace = config.HeartbeatInterval
+		}
+		r.heartbeatTimeout = config.HeartbeatInterval + grace
+	}
+
+	if len(config.MetaKillRoles) != 0 {
+		r.metaKillRoles = make(map[string]struct{}, len(config.MetaKillRoles))
+		for _, role := range config.MetaKillRoles {
+			r.metaKillRoles[role] = struct{}{}
+		}
+	}
+	if len(config.MetaDrainRoles) != 0 {
+		r.metaDrainRoles = make(map[string]struct{}, len(config.MetaDrainRoles))
+		for _, role := range config.MetaDrainRoles {
+			r.metaDrainRoles[role] = struct{}{}
+		}
 	}
 
 	if debug {
 		if r.enableMetaKill {
-			r.log.Println("Session meta kill procedures enabled")
+			stdlog.Debug(r.log, "Session meta kill procedures enabled")
 		}
-		if r.enableMetaKill {
-			r.log.Println("Session meta modify_details procedure enabled")
+		if r.enableMetaModify {
+			stdlog.Debug(r.log, "Session meta modify_details procedure enabled")
 		}
 	}
 	if r.metaStrict && len(config.MetaIncludeSessionDetails) != 0 {
@@ -187,9 +572,86 @@ func newRealm(config *RealmConfig, broker *broker, dealer *dealer, logger stdlog
 		}
 	}
 
+	if config.Expvar {
+		r.metrics = newRealmMetrics(r)
+	}
+
 	return r, nil
 }
 
+// URI returns the URI that identifies the realm.
+func (r *realm) URI() wamp.URI { return r.uri }
+
+// CountSessions returns the number of sessions attached to the realm, not
+// including the meta session.  Returns 0 if the realm is closed.
+func (r *realm) CountSessions() int {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.closed {
+		return 0
+	}
+	count := make(chan int)
+	r.actionChan <- func() {
+		count <- len(r.clients)
+	}
+	return <-count
+}
+
+// Stats returns a snapshot of the realm's statistics.  If the realm is
+// closed, then only the message counts and uptime are returned.
+func (r *realm) Stats() RealmStats {
+	stats := RealmStats{
+		Messages: make(map[wamp.MessageType]uint64),
+		Uptime:   time.Since(r.created),
+	}
+	for i := range r.msgCounts {
+		if n := atomic.LoadUint64(&r.msgCounts[i]); n != 0 {
+			stats.Messages[wamp.MessageType(i)] = n
+		}
+	}
+
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.closed {
+		return stats
+	}
+	count := make(chan int)
+	r.actionChan <- func() {
+		count <- len(r.clients)
+	}
+	stats.Sessions = <-count
+	stats.Subscriptions = r.broker.countSubscriptions()
+	stats.Registrations = r.dealer.countRegistrations()
+	return stats
+}
+
+// SessionResources returns the IDs of the subscriptions and registrations held
+// by the specified session, and false if there is no such session.
+func (r *realm) SessionResources(sid wamp.ID) ([]wamp.ID, []wamp.ID, bool) {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.closed {
+		return nil, nil, false
+	}
+	retChan := make(chan *wamp.Session)
+	r.actionChan <- func() {
+		retChan <- r.clients[sid]
+	}
+	sess := <-retChan
+	if sess == nil {
+		return nil, nil, false
+	}
+	return r.broker.sessionSubscriptions(sess), r.dealer.sessionRegistrations(sess), true
+}
+
+// Close performs an orderly shutdown of the realm.
+func (r *realm) Close() { r.close() }
+
+// Context returns the realm's context, which is derived from the router's
+// context and is canceled when the realm starts to close.  Components of the
+// realm use it to stop work that must not outlive the realm.
+func (r *realm) Context() context.Context { return r.ctx }
+
 // waitReady waits for the realm to be fully initialized and running.
 func (r *realm) waitReady() {
 	sync := make(chan struct{})
@@ -205,7 +667,10 @@ func (r *realm) waitReady() {
 // realm and makes sure any clients already in the process of joining finish
 // joining.
 //
-// Next, each client session is killed, removing it from the broker and dealer,
+// Next, any calls waiting for results are canceled, so that each caller is
+// sent an ERROR with reason wamp.close.system_shutdown.
+//
+// Then, each client session is killed, removing it from the broker and dealer,
 // triggering a GOODBYE message to the client, and causing the session's
 // message handler to exit.  This ensures there are no messages remaining to be
 // sent to the router.
@@ -229,11 +694,19 @@ func (r *realm) close() {
 		return
 	}
 	r.closed = true
+	r.cancel()
 
 	// Make sure that realm is fully initialized, by checking that it is
 	// running, before closing.
 	r.waitReady()
 
+	// Fail any calls still waiting for results, since sessions are not
+	// removed from the dealer during shutdown and the callers would otherwise
+	// get no reply.  Each ERROR is sent ahead of the caller's GOODBYE.
+	if n := r.dealer.cancelCalls(wamp.ErrSystemShutdown); n != 0 {
+		r.log.Println("Canceled", n, "pending calls in realm", r.uri)
+	}
+
 	// Kick all clients off.  Sending shutdownGoodbye causes client message
 	// handlers to exit without sending meta events.
 	sync := make(chan struct{})
@@ -255,6 +728,9 @@ func (r *realm) close() {
 	// broker, and it is finally safe to exit and close the broker.
 	r.metaSess.EndRecv(shutdownGoodbye)
 	<-r.metaDone
+	// The meta procedure handler may have exited when the realm's context was
+	// canceled, so also wait for the meta session itself to stop.
+	<-r.metaStopped
 
 	// handleInboundMessages() and metaProcedureHandler() are the only things
 	// than can submit request to the broker and dealer, so now that these are
@@ -264,9 +740,56 @@ func (r *realm) close() {
 	// dealer so they can be GC'd, and then so can this realm.
 	r.dealer.close()
 	r.broker.close()
+	r.deadLetters.close()
 
 	// Finally close realm's action channel.
 	close(r.actionChan)
+
+	if r.metrics != nil {
+		r.metrics.unpublish(r.uri)
+	}
+}
+
+// drain gracefully shuts down the realm.  A GOODBYE is sent to every session,
+// and sessions are allowed to continue sending messages, such as RPC results,
+// until they reply with GOODBYE and leave.  Once all sessions have left, or
+// when the context is done, the realm is closed.  If the context expires
+// before all sessions leave, then ctx.Err() is returned.
+func (r *realm) drain(ctx context.Context) error {
+	r.closeLock.Lock()
+	if r.closed || !atomic.CompareAndSwapInt32(&r.draining, 0, 1) {
+		r.closeLock.Unlock()
+		return nil
+	}
+	r.waitReady()
+
+	// Setting draining while holding closeLock prevents any new sessions from
+	// joining, so it is safe to wait on waitHandlers once the lock is released.
+	sync := make(chan struct{})
+	r.actionChan <- func() {
+		for _, c := range r.clients {
+			c.TrySend(shutdownGoodbye)
+		}
+		close(sync)
+	}
+	<-sync
+	r.closeLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.waitHandlers.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	// Forcibly close any sessions that did not leave in time.
+	r.close()
+	return err
 }
 
 // run must be called to start the Realm.
@@ -275,19 +798,40 @@ func (r *realm) run() {
 	// Create a local client for publishing meta events.
 	r.createMetaSession()
 
+	if r.metaAPI {
+		r.registerMetaProcedures()
+	}
+	// Sessions need the heartbeat procedure even if the meta API is
+	// disabled.
+	if r.heartbeatInterval > 0 {
+		r.registerMetaProcedure(wamp.MetaProcSessionHeartbeat, r.sessionHeartbeat)
+	}
+	go r.metaProcedureHandler()
+
+	for action := range r.actionChan {
+		action()
+	}
+}
+
+// registerMetaProcedures registers the meta session to handle the meta
+// procedures.
+func (r *realm) registerMetaProcedures() {
 	// Register to handle session meta procedures.
 	r.registerMetaProcedure(wamp.MetaProcSessionCount, r.sessionCount)
 	r.registerMetaProcedure(wamp.MetaProcSessionList, r.sessionList)
 	r.registerMetaProcedure(wamp.MetaProcSessionGet, r.sessionGet)
 	if r.enableMetaKill {
-		r.registerMetaProcedure(wamp.MetaProcSessionKill, r.sessionKill)
-		r.registerMetaProcedure(wamp.MetaProcSessionKillByAuthid, r.sessionKillByAuthid)
-		r.registerMetaProcedure(wamp.MetaProcSessionKillByAuthrole, r.sessionKillByAuthrole)
-		r.registerMetaProcedure(wamp.MetaProcSessionKillAll, r.sessionKillAll)
+		r.registerMetaProcedure(wamp.MetaProcSessionKill, r.metaKillGuard(r.sessionKill))
+		r.registerMetaProcedure(wamp.MetaProcSessionKillByAuthid, r.metaKillGuard(r.sessionKillByAuthid))
+		r.registerMetaProcedure(wamp.MetaProcSessionKillByAuthrole, r.metaKillGuard(r.sessionKillByAuthrole))
+		r.registerMetaProcedure(wamp.MetaProcSessionKillAll, r.metaKillGuard(r.sessionKillAll))
 	}
 	if r.enableMetaModify {
 		r.registerMetaProcedure(wamp.MetaProcSessionModifyDetails, r.sessionModifyDetails)
 	}
+	if len(r.metaDrainRoles) != 0 {
+		r.registerMetaProcedure(wamp.MetaProcRealmDrain, r.realmDrain)
+	}
 	// Register to handle registration meta procedures.
 	r.registerMetaProcedure(wamp.MetaProcRegList, r.dealer.regList)
 	r.registerMetaProcedure(wamp.MetaProcRegLookup, r.dealer.regLookup)
@@ -307,12 +851,6 @@ func (r *realm) run() {
 	// Register to handle testament meta procedures.
 	r.registerMetaProcedure(wamp.MetaProcSessionAddTestament, r.testamentAdd)
 	r.registerMetaProcedure(wamp.MetaProcSessionFlushTestaments, r.testamentFlush)
-
-	go r.metaProcedureHandler()
-
-	for action := range r.actionChan {
-		action()
-	}
 }
 
 // createMetaSession creates and starts a session that runs in this realm, and
@@ -331,12 +869,26 @@ func (r *realm) createMetaSession() {
 	r.metaSess = wamp.NewSession(rtr, metaID, wamp.Dict{"authrole": "trusted"}, nil)
 
 	// Run the handler for messages from the meta session.
-	go r.handleInboundMessages(r.metaSess)
+	go func() {
+		r.handleInboundMessages(r.metaSess)
+		close(r.metaStopped)
+	}()
 	if r.debug {
-		r.log.Println("Started meta-session", r.metaSess)
+		stdlog.Debug(r.log, "Started meta-session", r.metaSess)
 	}
 }
 
+// acquireSessionQuota counts the session against the session quota for its
+// authrole, and returns false if the quota is exceeded.  The session is
+// released from the quota when it leaves the realm.
+func (r *realm) acquireSessionQuota(sess *wamp.Session) bool {
+	ok := make(chan bool)
+	r.actionChan <- func() {
+		ok <- r.sessionQuota.acquire(sess)
+	}
+	return <-ok
+}
+
 // onJoin is called when a non-meta session joins this realm.  The session is
 // stored in the realm's clients and a meta event is published.
 //
@@ -347,6 +899,9 @@ func (r *realm) onJoin(sess *wamp.Session) {
 	sync := make(chan struct{})
 	r.actionChan <- func() {
 		r.clients[sess.ID] = sess
+		if r.metrics != nil {
+			r.metrics.sessions.Add(1)
+		}
 		close(sync)
 	}
 	<-sync
@@ -358,7 +913,12 @@ func (r *realm) onJoin(sess *wamp.Session) {
 	// "authmethod", "authprovider", "transport".  This implementation
 	// publishes all details except transport.auth.
 	sess.Lock()
-	output := r.cleanSessionDetails(sess.Details)
+	details := r.cleanSessionDetails(sess.Details)
+	// Copy details, since they may be the session's own details.
+	output := make(wamp.Dict, len(details))
+	for k, v := range details {
+		output[k] = v
+	}
 	sess.Unlock()
 	r.metaPeer.Send(&wamp.Publish{
 		Request:   wamp.GlobalID(),
@@ -386,6 +946,10 @@ func (r *realm) onLeave(sess *wamp.Session, shutdown, killAll bool) {
 	sync := make(chan struct{})
 	r.actionChan <- func() {
 		delete(r.clients, sess.ID)
+		r.sessionQuota.release(sess, 1)
+		if r.metrics != nil {
+			r.metrics.sessions.Add(-1)
+		}
 		testaments, hasTstm = r.testaments[sess.ID]
 		if hasTstm {
 			delete(r.testaments, sess.ID)
@@ -403,6 +967,16 @@ func (r *realm) onLeave(sess *wamp.Session, shutdown, killAll bool) {
 
 	defer r.waitHandlers.Done()
 
+	sess.Lock()
+	authidVal := sess.Details["authid"]
+	authroleVal := sess.Details["authrole"]
+	sess.Unlock()
+	authid, _ := wamp.AsString(authidVal)
+	r.events.emit(SessionEnded, sess.ID, r.uri, authid)
+	if r.sessionEnded != nil {
+		r.sessionEnded()
+	}
+
 	if shutdown || killAll {
 		return
 	}
@@ -426,8 +1000,8 @@ func (r *realm) onLeave(sess *wamp.Session, shutdown, killAll bool) {
 		Topic:   wamp.MetaEventSessionOnLeave,
 		Arguments: wamp.List{
 			sess.ID,
-			sess.Details["authid"],
-			sess.Details["authrole"]},
+			authidVal,
+			authroleVal},
 	})
 }
 
@@ -440,28 +1014,40 @@ func (r *realm) handleSession(sess *wamp.Session) error {
 	// closing, during which the realm waits for all existing session handlers
 	// to exit.
 	r.closeLock.Lock()
-	if r.closed {
+	if r.closed || atomic.LoadInt32(&r.draining) != 0 || atomic.LoadInt32(&r.quiescing) != 0 {
 		r.closeLock.Unlock()
 		err := errors.New("realm closed")
 		return err
 	}
+	if r.sessionQuota != nil && !r.acquireSessionQuota(sess) {
+		r.closeLock.Unlock()
+		return errSessionQuota
+	}
+
+	if r.outQueueSize > 0 {
+		sess.Peer = newQueuedPeer(sess.Peer, r.outQueueSize, r.outQueueBlock,
+			func() {
+				if sess.EndRecv(makeGoodbye(wamp.ErrSystemShutdown, "outbound queue full")) {
+					r.log.Println("Dropping session", sess, ": outbound queue full")
+				}
+			})
+	}
+	if r.metrics != nil {
+		sess.Peer = &countingPeer{Peer: sess.Peer, out: r.metrics.out}
+	}
 
 	// Ensure session is capable of receiving exit signal before releasing lock
 	r.onJoin(sess)
 	r.closeLock.Unlock()
 
 	if r.debug {
-		r.log.Println("Started session", sess)
+		stdlog.Debug(r.log, "Started session", sessionLabel(sess))
 	}
 	go func() {
 		shutdown, killAll, err := r.handleInboundMessages(sess)
 		if err != nil {
-			abortMsg := wamp.Abort{
-				Reason:  wamp.ErrProtocolViolation,
-				Details: wamp.Dict{"error": err.Error()},
-			}
-			r.log.Println("Aborting session", sess, ":", err)
-			sess.TrySend(&abortMsg)
+			stdlog.Error(r.log, "Aborting session", sess, ":", err)
+			sess.TrySend(newAbort(wamp.ErrProtocolViolation, err))
 		}
 		r.onLeave(sess, shutdown, killAll)
 		sess.Close()
@@ -470,35 +1056,88 @@ func (r *realm) handleSession(sess *wamp.Session) error {
 	return nil
 }
 
+// supportsHeartbeat returns true if the session announced, in HELLO.Details,
+// that it sends heartbeats when the router asks for them.
+func supportsHeartbeat(sess *wamp.Session) bool {
+	sess.Lock()
+	defer sess.Unlock()
+	ok, _ := wamp.AsBool(sess.Details[wamp.OptHeartbeat])
+	return ok
+}
+
+// sessionLabel returns the session ID, followed by the remote address of the
+// session's client if the address is known, for use in log messages.
+func sessionLabel(sess *wamp.Session) string {
+	sess.Lock()
+	addr, ok := wamp.DictString(sess.Details, "transport", "peer")
+	sess.Unlock()
+	if ok && addr != "" {
+		return sess.String() + " (" + addr + ")"
+	}
+	return sess.String()
+}
+
 // handleInboundMessages handles the messages sent from a client session to
 // the router.
 func (r *realm) handleInboundMessages(sess *wamp.Session) (bool, bool, error) {
 	if r.debug {
-		defer r.log.Println("Ended session", sess)
+		defer stdlog.Debug(r.log, "Ended session", sessionLabel(sess))
 	}
 	recv := sess.Recv()
 	recvDone := sess.RecvDone()
+	var limiter *tokenBucket
+	if r.messageRate > 0 && sess != r.metaSess {
+		limiter = newTokenBucket(r.messageRate, r.messageBurst)
+	}
+	// End the session if it supports heartbeats and does not send a message
+	// within the heartbeat timeout.
+	var idleTimer Timer
+	var idle <-chan time.Time
+	if r.heartbeatTimeout > 0 && sess != r.metaSess && supportsHeartbeat(sess) {
+		idleTimer = r.clock.NewTimer(r.heartbeatTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C()
+	}
 	for {
 		var msg wamp.Message
 		var open bool
 		select {
 		case msg, open = <-recv:
 			if !open {
-				r.log.Println("Lost", sess)
+				// The client closed its transport without saying GOODBYE,
+				// which is a normal way to disconnect, so it is not logged
+				// unless debugging.  End the session so that anything still
+				// trying to end it sees that it is already gone.
+				sess.EndRecv(nil)
+				if r.debug {
+					stdlog.Debug(r.log, "Lost", sessionLabel(sess))
+				}
 				return false, false, nil
 			}
+			if idleTimer != nil {
+				if !idleTimer.Stop() {
+					<-idle
+				}
+				idleTimer.Reset(r.heartbeatTimeout)
+			}
+		case <-idle:
+			idleTimer, idle = nil, nil
+			if sess.EndRecv(makeGoodbye(wamp.CloseTimeout, "no heartbeat from session")) {
+				r.log.Println("Ending session", sessionLabel(sess), ": no heartbeat")
+			}
+			continue
 		case <-recvDone:
 			goodbye := sess.Goodbye()
 			switch goodbye {
 			case shutdownGoodbye, wamp.NoGoodbye:
 				if r.debug {
-					r.log.Printf("Stop session %s: system shutdown", sess)
+					stdlog.Debugf(r.log, "Stop session %s: system shutdown", sess)
 				}
 				sess.TrySend(goodbye)
 				return true, false, nil
 			}
 			if r.debug {
-				r.log.Printf("Kill session %s: %s", sess, goodbye.Reason)
+				stdlog.Debugf(r.log, "Kill session %s: %s", sess, goodbye.Reason)
 			}
 			var killAll bool
 			if _, ok := goodbye.Details["all"]; ok {
@@ -508,35 +1147,28 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) (bool, bool, error) {
 			return false, killAll, nil
 		}
 
-		if r.debug {
-			r.log.Printf("Session %s submitting %s: %+v", sess,
-				msg.MessageType(), msg)
+		if limiter != nil && msg.MessageType() != wamp.GOODBYE && !limiter.allow() {
+			if r.debug {
+				stdlog.Debugf(r.log, "Session %s exceeded message rate, dropped %s",
+					sess, msg.MessageType())
+			}
+			if r.rateLimitReason != "" && limiter.sustained() {
+				if sess.EndRecv(makeGoodbye(r.rateLimitReason, "message rate exceeded")) {
+					r.log.Println("Ending session", sess, ": message rate exceeded")
+				}
+			}
+			continue
 		}
 
-		// Note: meta session is always authorized
-		if r.authorizer != nil && sess != r.metaSess && !r.authzMessage(sess, msg) {
-			// Not authorized; error response sent; do not process message.
-			continue
+		if r.debug {
+			stdlog.Debugf(r.log, "Session %s submitting %s: %+v", sess,
+				msg.MessageType(), msg)
 		}
 
 		switch msg := msg.(type) {
-		case *wamp.Publish:
-			r.broker.publish(sess, msg)
-		case *wamp.Subscribe:
-			r.broker.subscribe(sess, msg)
-		case *wamp.Unsubscribe:
-			r.broker.unsubscribe(sess, msg)
-
-		case *wamp.Register:
-			r.dealer.register(sess, msg)
-		case *wamp.Unregister:
-			r.dealer.unregister(sess, msg)
-		case *wamp.Call:
-			r.dealer.call(sess, msg)
-		case *wamp.Yield:
-			r.dealer.yield(sess, msg)
-		case *wamp.Cancel:
-			r.dealer.cancel(sess, msg)
+		case *wamp.Publish, *wamp.Subscribe, *wamp.Unsubscribe,
+			*wamp.Register, *wamp.Unregister, *wamp.Call, *wamp.Yield,
+			*wamp.Cancel:
 
 		case *wamp.Error:
 			// An INVOCATION error is the only type of ERROR message the
@@ -544,16 +1176,22 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) (bool, bool, error) {
 			if msg.Type != wamp.INVOCATION {
 				return false, false, fmt.Errorf("invalid ERROR received: %v", msg)
 			}
-			r.dealer.error(msg)
 
 		case *wamp.Goodbye:
-			// Handle client leaving realm.
-			sess.TrySend(&wamp.Goodbye{
+			// Handle client leaving realm.  Mark the session as ended, so that
+			// it is not sent another GOODBYE if killed at the same time.  If
+			// the realm is draining, then the router already sent GOODBYE and
+			// this is the client's reply.
+			goodbye := &wamp.Goodbye{
 				Reason:  wamp.ErrGoodbyeAndOut,
 				Details: wamp.Dict{},
-			})
+			}
+			sess.EndRecv(goodbye)
+			if atomic.LoadInt32(&r.draining) == 0 {
+				sess.TrySend(goodbye)
+			}
 			if r.debug {
-				r.log.Println("GOODBYE from session", sess, "reason:",
+				stdlog.Debug(r.log, "GOODBYE from session", sess, "reason:",
 					msg.Reason)
 			}
 			return false, false, nil
@@ -562,6 +1200,74 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) (bool, bool, error) {
 			// Received unrecognized message type.
 			return false, false, fmt.Errorf("unexpected %v", msg.MessageType())
 		}
+
+		// Note: meta session messages do not pass through middleware.
+		if sess == r.metaSess {
+			r.routeMessage(sess, msg)
+		} else {
+			r.handler(sess, msg)
+		}
+	}
+}
+
+// routeMessage checks that the session may send the message, and then passes
+// the message to the broker or dealer.  This is the Handler at the end of the
+// middleware chain.  If the message is not allowed, then an error response is
+// sent to the session and the message is not routed.
+func (r *realm) routeMessage(sess *wamp.Session, msg wamp.Message) {
+	// Note: meta session is always authorized
+	if r.authorizer != nil && sess != r.metaSess && !r.authzMessage(sess, msg) {
+		// Not authorized; error response sent; do not process message.
+		return
+	}
+
+	if r.maxPayloadSize > 0 && sess != r.metaSess && !r.checkPayloadSize(sess, msg) {
+		// Payload too large; error response sent; do not process message.
+		return
+	}
+
+	if r.metaStrictURI && sess != r.metaSess && !r.checkMetaPublish(sess, msg) {
+		// Publish to reserved topic; error response sent; do not process
+		// message.
+		return
+	}
+
+	if atomic.LoadInt32(&r.quiescing) != 0 && sess != r.metaSess && !r.checkQuiescing(sess, msg) {
+		// Realm is draining; error response sent; do not process message.
+		return
+	}
+
+	if mt := int(msg.MessageType()); mt < len(r.msgCounts) {
+		atomic.AddUint64(&r.msgCounts[mt], 1)
+	}
+	if r.metrics != nil && sess != r.metaSess {
+		r.metrics.in.Add(msg.MessageType().String(), 1)
+	}
+
+	switch msg := msg.(type) {
+	case *wamp.Publish:
+		r.broker.publish(sess, msg)
+	case *wamp.Subscribe:
+		r.broker.subscribe(sess, msg)
+	case *wamp.Unsubscribe:
+		r.broker.unsubscribe(sess, msg)
+
+	case *wamp.Register:
+		r.dealer.register(sess, msg)
+	case *wamp.Unregister:
+		r.dealer.unregister(sess, msg)
+	case *wamp.Call:
+		r.dealer.call(sess, msg)
+	case *wamp.Yield:
+		r.dealer.yield(sess, msg)
+	case *wamp.Cancel:
+		r.dealer.cancel(sess, msg)
+
+	case *wamp.Error:
+		r.dealer.error(msg)
+
+	default:
+		r.log.Println("Not routing", msg.MessageType(), "from session", sess)
 	}
 }
 
@@ -571,25 +1277,19 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) (bool, bool, error) {
 func (r *realm) authzMessage(sess *wamp.Session, msg wamp.Message) bool {
 	// If the client is local, then do not check authorization, unless
 	// requested in config.
-	if transport.IsLocal(sess.Peer) && !r.localAuthz {
+	if transport.IsLocal(unwrapPeer(sess.Peer)) && !r.localAuthz {
 		return true
 	}
 
-	// Create a safe session to prevent access to the session.Peer.
-	safeSession := &wamp.Session{
-		ID:      sess.ID,
-		Details: sess.Details,
-	}
-
 	// Write-lock the session, becuase there is no telling what the Authorizer
 	// will do to the session details.
 	sess.Lock()
-	isAuthz, err := r.authorizer.Authorize(safeSession, msg)
+	isAuthz, err := r.authorizer.Authorize(sess.SafeSession(), msg)
 	sess.Unlock()
 
 	if !isAuthz {
 		skipResponse := false
-		errRsp := &wamp.Error{Type: msg.MessageType()}
+		errRsp := &wamp.Error{Type: msg.MessageType(), Details: wamp.Dict{}}
 		// Get the Request from request types of messages.
 		switch msg := msg.(type) {
 		case *wamp.Publish:
@@ -611,7 +1311,14 @@ func (r *realm) authzMessage(sess *wamp.Session, msg wamp.Message) bool {
 		case *wamp.Cancel:
 			errRsp.Request = msg.Request
 		case *wamp.Yield:
+			// There is no ERROR response to YIELD.  The caller gets the error
+			// in place of the result.
+			errRsp.Type = wamp.INVOCATION
 			errRsp.Request = msg.Request
+			skipResponse = true
+		default:
+			// Message has no request ID to respond to.
+			skipResponse = true
 		}
 		if err != nil {
 			// Error trying to authorize.  Include error message.
@@ -625,10 +1332,12 @@ func (r *realm) authzMessage(sess *wamp.Session, msg wamp.Message) bool {
 			errRsp.Error = wamp.ErrNotAuthorized
 			r.log.Println("Client", sess, msg.MessageType(), "not authorized")
 		}
-		if !skipResponse {
+		if errRsp.Type == wamp.INVOCATION {
+			r.dealer.error(errRsp)
+		} else if !skipResponse {
 			err = sess.TrySend(errRsp)
 			if err != nil {
-				r.log.Println("!!! client blocked, could not send authz error")
+				stdlog.Error(r.log, "!!! client blocked, could not send authz error")
 			}
 		}
 		return false
@@ -636,27 +1345,149 @@ func (r *realm) authzMessage(sess *wamp.Session, msg wamp.Message) bool {
 	return true
 }
 
-// authClient authenticates the client according to the authmethods in the
-// HELLO message details and the authenticators available for this realm.
-func (r *realm) authClient(sid wamp.ID, client wamp.Peer, details wamp.Dict) (*wamp.Welcome, error) {
-	// If the client is local, then no authentication is required.
-	if transport.IsLocal(client) && !r.localAuth {
-		// Create welcome details for local client.
-		authid, _ := wamp.AsString(details["authid"])
-		if authid == "" {
-			authid = strconv.FormatInt(int64(wamp.GlobalID()), 16)
+// checkMetaPublish checks that a PUBLISH message is not for a topic in the
+// reserved wamp.* namespace.  If it is, then an error response is sent and this
+// method returns false.
+func (r *realm) checkMetaPublish(sess *wamp.Session, msg wamp.Message) bool {
+	pub, ok := msg.(*wamp.Publish)
+	if !ok || !strings.HasPrefix(string(pub.Topic), "wamp.") {
+		return true
+	}
+	r.log.Println("Client", sess, "publish to reserved topic", pub.Topic)
+	// A publish error should only be sent when OptAcknowledge is set.
+	if pubAck, _ := pub.Options[wamp.OptAcknowledge].(bool); pubAck {
+		errRsp := &wamp.Error{
+			Type:      pub.MessageType(),
+			Request:   pub.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrInvalidURI,
+			Arguments: wamp.List{fmt.Sprintf("publish to restricted topic URI %v", pub.Topic)},
+		}
+		if err := sess.TrySend(errRsp); err != nil {
+			stdlog.Error(r.log, "!!! client blocked, could not send publish error")
+		}
+	}
+	return false
+}
+
+// checkQuiescing checks that a message does not create a new subscription or
+// registration while the realm is draining.  If it does, then an error response
+// is sent and this method returns false.
+func (r *realm) checkQuiescing(sess *wamp.Session, msg wamp.Message) bool {
+	var req wamp.ID
+	switch msg := msg.(type) {
+	case *wamp.Subscribe:
+		req = msg.Request
+	case *wamp.Register:
+		req = msg.Request
+	default:
+		return true
+	}
+	errRsp := &wamp.Error{
+		Type:      msg.MessageType(),
+		Request:   req,
+		Details:   wamp.Dict{},
+		Error:     wamp.ErrSystemShutdown,
+		Arguments: wamp.List{"realm is draining"},
+	}
+	if err := sess.TrySend(errRsp); err != nil {
+		stdlog.Error(r.log, "!!! client blocked, could not send", msg.MessageType(), "error")
+	}
+	return false
+}
+
+// checkPayloadSize checks that the payload of a PUBLISH, CALL, or YIELD
+// message is within the realm's size limit.  If the payload is too large, then
+// an error response is sent and this method returns false.
+func (r *realm) checkPayloadSize(sess *wamp.Session, msg wamp.Message) bool {
+	var errRsp *wamp.Error
+	switch msg := msg.(type) {
+	case *wamp.Publish:
+		if payloadSize(msg.Arguments, msg.ArgumentsKw) <= r.maxPayloadSize {
+			return true
+		}
+		// A publish error should only be sent when OptAcknowledge is set.
+		if pubAck, _ := msg.Options[wamp.OptAcknowledge].(bool); pubAck {
+			errRsp = &wamp.Error{Type: msg.MessageType(), Request: msg.Request}
+		}
+	case *wamp.Call:
+		if payloadSize(msg.Arguments, msg.ArgumentsKw) <= r.maxPayloadSize {
+			return true
+		}
+		errRsp = &wamp.Error{Type: msg.MessageType(), Request: msg.Request}
+	case *wamp.Yield:
+		if payloadSize(msg.Arguments, msg.ArgumentsKw) <= r.maxPayloadSize {
+			return true
+		}
+		// The caller gets the error in place of the result.
+		r.dealer.error(&wamp.Error{
+			Type:    wamp.INVOCATION,
+			Request: msg.Request,
+			Details: wamp.Dict{},
+			Error:   wamp.ErrPayloadSizeExceeded,
+		})
+	default:
+		return true
+	}
+
+	r.log.Println("Client", sess, msg.MessageType(), "payload size exceeded")
+	if errRsp != nil {
+		errRsp.Details = wamp.Dict{}
+		errRsp.Error = wamp.ErrPayloadSizeExceeded
+		errRsp.Arguments = wamp.List{
+			fmt.Sprintf("payload exceeds %d bytes", r.maxPayloadSize)}
+		if err := sess.TrySend(errRsp); err != nil {
+			stdlog.Error(r.log, "!!! client blocked, could not send payload size error")
 		}
-		details = wamp.Dict{
+	}
+	return false
+}
+
+// payloadSize returns the size of the arguments and keyword arguments of a
+// message, serialized as JSON.
+func payloadSize(args wamp.List, kwArgs wamp.Dict) int {
+	var size int
+	if len(args) != 0 {
+		b, _ := json.Marshal(args)
+		size += len(b)
+	}
+	if len(kwArgs) != 0 {
+		b, _ := json.Marshal(kwArgs)
+		size += len(b)
+	}
+	return size
+}
+
+// localWelcome creates the welcome for a local client that is not
+// authenticated.
+func (r *realm) localWelcome(details wamp.Dict, authrole string) *wamp.Welcome {
+	authid, _ := wamp.AsString(details["authid"])
+	if authid == "" {
+		authid = strconv.FormatInt(int64(wamp.GlobalID()), 16)
+	}
+	return &wamp.Welcome{
+		Details: wamp.Dict{
 			"authid":       authid,
-			"authrole":     "trusted",
+			"authrole":     authrole,
 			"authmethod":   "local",
 			"authprovider": "static",
-			"roles": wamp.Dict{
-				"broker": r.broker.role(),
-				"dealer": r.dealer.role(),
-			},
-		}
-		return &wamp.Welcome{Details: details}, nil
+			"roles":        r.routerRoles(),
+		},
+	}
+}
+
+// authClient authenticates the client according to the authmethods in the
+// HELLO message details and the authenticators available for this realm.
+//
+// If trustedRole is not empty, then the client is not authenticated, and is
+// welcomed with that authrole.
+func (r *realm) authClient(sid wamp.ID, client wamp.Peer, details wamp.Dict, trustedRole string) (*wamp.Welcome, error) {
+	if trustedRole != "" {
+		return r.localWelcome(details, trustedRole), nil
+	}
+	// If the client is local, then no authentication is required.
+	if transport.IsLocal(client) && !r.localAuth {
+		return r.localWelcome(details, "trusted"), nil
 	}
 
 	// The default authentication method is "WAMP-Anonymous" if client does not
@@ -682,22 +1513,104 @@ func (r *realm) authClient(sid wamp.ID, client wamp.Peer, details wamp.Dict) (*w
 		return nil, errors.New("no authentication supplied")
 	}
 
-	authr, method := r.getAuthenticator(authmethods)
-	if authr == nil {
-		return nil, errors.New("could not authenticate with any method")
+	// A returning client that asks for cookie authentication is welcomed as
+	// the authid and authrole remembered for its cookie.
+	welcome := r.cookieWelcome(details, authmethods)
+	if welcome == nil {
+		authr, method := r.getAuthenticator(authmethods)
+		if authr == nil {
+			return nil, errors.New("could not authenticate with any method")
+		}
+
+		// Return welcome message or error.
+		var err error
+		welcome, err = authr.Authenticate(sid, details, client)
+		if err != nil {
+			return nil, err
+		}
+		welcome.Details["authmethod"] = method
 	}
+	r.storeCookie(details, welcome)
+	welcome.Details["roles"] = r.routerRoles()
+	return welcome, nil
+}
 
-	// Return welcome message or error.
-	welcome, err := authr.Authenticate(sid, details, client)
-	if err != nil {
-		return nil, err
+// cookieWelcome returns a WELCOME message for a client that requests cookie
+// authentication and presents a tracking cookie recognized by the realm's
+// CookieStore.  Otherwise nil is returned.
+func (r *realm) cookieWelcome(details wamp.Dict, authmethods []string) *wamp.Welcome {
+	if r.cookieStore == nil {
+		return nil
+	}
+	var wantCookie bool
+	for _, am := range authmethods {
+		if am == auth.CookieAuthMethod {
+			wantCookie = true
+			break
+		}
 	}
-	welcome.Details["authmethod"] = method
-	welcome.Details["roles"] = wamp.Dict{
-		"broker": r.broker.role(),
-		"dealer": r.dealer.role(),
+	if !wantCookie {
+		return nil
+	}
+	cookie, _ := auth.TrackingCookies(details)
+	if cookie == "" {
+		return nil
+	}
+	authid, authrole, ok := r.cookieStore.Lookup(cookie)
+	if !ok {
+		return nil
+	}
+	return &wamp.Welcome{
+		Details: wamp.Dict{
+			"authid":       authid,
+			"authrole":     authrole,
+			"authmethod":   auth.CookieAuthMethod,
+			"authprovider": "cookie",
+		},
+	}
+}
+
+// storeCookie remembers the authid and authrole of an authenticated client by
+// the next tracking cookie issued to the client.
+func (r *realm) storeCookie(details wamp.Dict, welcome *wamp.Welcome) {
+	if r.cookieStore == nil {
+		return
+	}
+	_, nextCookie := auth.TrackingCookies(details)
+	if nextCookie == "" {
+		return
+	}
+	authid, _ := wamp.AsString(welcome.Details["authid"])
+	authrole, _ := wamp.AsString(welcome.Details["authrole"])
+	r.cookieStore.Store(nextCookie, authid, authrole)
+}
+
+// metaFeatures are the features provided by the meta API, which are not
+// advertised when the meta API is disabled.
+var metaFeatures = []string{
+	featureSessionMetaAPI,
+	featureSubMetaAPI,
+	featureRegMetaAPI,
+	featureTestamentMetaAPI,
+}
+
+// routerRoles returns the roles of the router, and the features of each role
+// that are enabled in this realm, for use in a WELCOME message.
+func (r *realm) routerRoles() wamp.Dict {
+	brokerRole := r.broker.role()
+	dealerRole := r.dealer.role()
+	if !r.metaAPI {
+		for _, role := range []wamp.Dict{brokerRole, dealerRole} {
+			features := role["features"].(wamp.Dict)
+			for _, f := range metaFeatures {
+				delete(features, f)
+			}
+		}
+	}
+	return wamp.Dict{
+		"broker": brokerRole,
+		"dealer": dealerRole,
 	}
-	return welcome, nil
 }
 
 // getAuthenticator finds the first authenticator registered for the methods.
@@ -745,7 +1658,7 @@ func (r *realm) registerMetaProcedure(procedure wamp.URI, f func(*wamp.Invocatio
 				r.log.Println("Shutdown during meta procedure registration")
 				return
 			}
-			r.log.Println("PANIC! Received unexpected", msg.MessageType())
+			stdlog.Error(r.log, "PANIC! Received unexpected", msg.MessageType())
 			panic("cannot register meta procedure")
 		}
 		errMsg := fmt.Sprintf(
@@ -761,13 +1674,40 @@ func (r *realm) registerMetaProcedure(procedure wamp.URI, f func(*wamp.Invocatio
 
 func (r *realm) metaProcedureHandler() {
 	defer close(r.metaDone)
+	// Once the realm is closing, or the meta session has exited and no longer
+	// reads messages, any reply still being sent to it must be abandoned.
+	// Otherwise a backlog of meta procedure calls at shutdown blocks this
+	// handler forever.
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.metaStopped:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	recv := r.metaPeer.Recv()
 	var rsp wamp.Message
-	for msg := range r.metaPeer.Recv() {
+	for {
+		var msg wamp.Message
+		var open bool
+		select {
+		case msg, open = <-recv:
+			if !open {
+				return
+			}
+		case <-ctx.Done():
+			if r.debug {
+				stdlog.Debug(r.log, "Session meta procedure handler exiting")
+			}
+			return
+		}
 		switch msg := msg.(type) {
 		case *wamp.Invocation:
 			metaProcHandler, ok := r.metaProcMap[msg.Registration]
 			if !ok {
-				r.metaPeer.Send(&wamp.Error{
+				r.metaPeer.SendCtx(ctx, &wamp.Error{
 					Type:    msg.MessageType(),
 					Request: msg.Request,
 					Details: wamp.Dict{},
@@ -778,16 +1718,22 @@ func (r *realm) metaProcedureHandler() {
 			rsp = metaProcHandler(msg)
 		case *wamp.Goodbye:
 			if r.debug {
-				r.log.Print("Session meta procedure handler exiting GOODBYE")
+				stdlog.Debug(r.log, "Session meta procedure handler exiting GOODBYE")
 			}
 			return
 		default:
 			r.log.Println("Meta procedure received unexpected", msg.MessageType())
 		}
-		r.metaPeer.Send(rsp)
+		r.metaPeer.SendCtx(ctx, rsp)
 	}
 }
 
+// sessionHeartbeat is a session meta procedure that does nothing.  A session
+// calls it to show that it is still alive when it has nothing else to send.
+func (r *realm) sessionHeartbeat(msg *wamp.Invocation) wamp.Message {
+	return &wamp.Yield{Request: msg.Request}
+}
+
 // sessionCount is a session meta procedure that obtains the number of sessions
 // currently attached to the realm.
 func (r *realm) sessionCount(msg *wamp.Invocation) wamp.Message {
@@ -799,6 +1745,7 @@ func (r *realm) sessionCount(msg *wamp.Invocation) wamp.Message {
 				Type:    wamp.INVOCATION,
 				Error:   wamp.ErrInvalidArgument,
 				Request: msg.Request,
+				Details: wamp.Dict{},
 			}
 		}
 		filter, ok = wamp.ListToStrings(filterList)
@@ -807,6 +1754,7 @@ func (r *realm) sessionCount(msg *wamp.Invocation) wamp.Message {
 				Type:    wamp.INVOCATION,
 				Error:   wamp.ErrInvalidArgument,
 				Request: msg.Request,
+				Details: wamp.Dict{},
 			}
 		}
 	}
@@ -851,6 +1799,7 @@ func (r *realm) sessionList(msg *wamp.Invocation) wamp.Message {
 				Type:    wamp.INVOCATION,
 				Error:   wamp.ErrInvalidArgument,
 				Request: msg.Request,
+				Details: wamp.Dict{},
 			}
 		}
 		filter, ok = wamp.ListToStrings(filterList)
@@ -859,6 +1808,7 @@ func (r *realm) sessionList(msg *wamp.Invocation) wamp.Message {
 				Type:    wamp.INVOCATION,
 				Error:   wamp.ErrInvalidArgument,
 				Request: msg.Request,
+				Details: wamp.Dict{},
 			}
 		}
 	}
@@ -920,10 +1870,23 @@ func (r *realm) sessionGet(msg *wamp.Invocation) wamp.Message {
 	// WAMP spec only specifies returning "session", "authid", "authrole",
 	// "authmethod", "authprovider", and "transport".  All details are returned
 	// in this implementation, except transport.auth, unless Config.MetaStrict
-	// is set to true.
+	// is set to true.  The roles announced by the session are also returned.
 	sess.Lock()
-	output := r.cleanSessionDetails(sess.Details)
+	details := r.cleanSessionDetails(sess.Details)
+	// Copy details, since they may be the session's own details.
+	output := make(wamp.Dict, len(details)+1)
+	for k, v := range details {
+		output[k] = v
+	}
 	sess.Unlock()
+	output["roles"] = sess.Roles()
+
+	// Unless MetaStrict is set, also return the IDs of the session's
+	// subscriptions and registrations.
+	if !r.metaStrict {
+		output["subscriptions"] = idList(r.broker.sessionSubscriptions(sess))
+		output["registrations"] = idList(r.dealer.sessionRegistrations(sess))
+	}
 
 	return &wamp.Yield{
 		Request:   msg.Request,
@@ -931,6 +1894,31 @@ func (r *realm) sessionGet(msg *wamp.Invocation) wamp.Message {
 	}
 }
 
+// idList converts a slice of IDs to a list for use as a meta procedure result.
+func idList(ids []wamp.ID) wamp.List {
+	list := make(wamp.List, len(ids))
+	for i := range ids {
+		list[i] = ids[i]
+	}
+	return list
+}
+
+// metaKillGuard wraps a session kill meta procedure so that it is only run if
+// the caller has one of the authroles allowed to kill sessions.  If no roles
+// are configured, then the meta procedure is not restricted.
+func (r *realm) metaKillGuard(f func(*wamp.Invocation) wamp.Message) func(*wamp.Invocation) wamp.Message {
+	if len(r.metaKillRoles) == 0 {
+		return f
+	}
+	return func(msg *wamp.Invocation) wamp.Message {
+		authrole, _ := wamp.AsString(msg.Details["caller_authrole"])
+		if _, ok := r.metaKillRoles[authrole]; !ok {
+			return makeError(msg.Request, wamp.ErrNotAuthorized)
+		}
+		return f(msg)
+	}
+}
+
 // sessionKill is a session meta procedure that closes a single session
 // identified by session ID.
 //
@@ -1041,6 +2029,79 @@ func (r *realm) sessionKillAll(msg *wamp.Invocation) wamp.Message {
 	}
 }
 
+// realmDrain is a non-standard meta procedure that drains the caller's realm.
+// New sessions, subscriptions, and registrations are rejected at once, and
+// after the grace period the realm is removed from its router and all
+// sessions, including the caller's, are sent GOODBYE.  The realm closes when
+// the sessions have left, or after drainTimeout.  The caller must have one of
+// the realm's MetaDrainRoles.
+//
+// Positional arguments
+//
+// 1. `grace|int` - Optional grace period in milliseconds.  Default is 0.
+//
+// Positional results
+//
+// 1. `count|int` - The number of sessions being drained.
+func (r *realm) realmDrain(msg *wamp.Invocation) wamp.Message {
+	authrole, _ := wamp.AsString(msg.Details["caller_authrole"])
+	if _, ok := r.metaDrainRoles[authrole]; !ok {
+		return makeError(msg.Request, wamp.ErrNotAuthorized)
+	}
+	var grace time.Duration
+	if len(msg.Arguments) != 0 {
+		ms, ok := wamp.AsInt64(msg.Arguments[0])
+		if !ok || ms < 0 {
+			return makeError(msg.Request, wamp.ErrInvalidArgument)
+		}
+		grace = time.Duration(ms) * time.Millisecond
+	}
+
+	// Do not take closeLock here.  This runs on the meta procedure handler,
+	// which close() waits for while holding closeLock.  Once quiescing is set,
+	// no new session can join, and any session already joining is sent
+	// GOODBYE with the others when the realm is drained.
+	if r.ctx.Err() != nil || !atomic.CompareAndSwapInt32(&r.quiescing, 0, 1) {
+		return makeError(msg.Request, wamp.ErrSystemShutdown)
+	}
+	count := make(chan int, 1)
+	select {
+	case r.actionChan <- func() { count <- len(r.clients) }:
+	case <-r.ctx.Done():
+		return makeError(msg.Request, wamp.ErrSystemShutdown)
+	}
+	var n int
+	select {
+	case n = <-count:
+	case <-r.ctx.Done():
+		return makeError(msg.Request, wamp.ErrSystemShutdown)
+	}
+
+	r.log.Printf("Draining realm %s of %d sessions in %s", r.uri, n, grace)
+	go func() {
+		timer := r.clock.NewTimer(grace)
+		select {
+		case <-timer.C():
+		case <-r.ctx.Done():
+			timer.Stop()
+			return
+		}
+		if r.removeFromRouter != nil {
+			r.removeFromRouter()
+		}
+		ctx, cancel := context.WithTimeout(r.ctx, drainTimeout)
+		defer cancel()
+		if err := r.drain(ctx); err != nil {
+			r.log.Println("Realm", r.uri, "drain did not complete:", err)
+		}
+	}()
+
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{n},
+	}
+}
+
 // sessionModifyDetails is a non-standard session meta procedure that modifies
 // the details of a session.
 //
@@ -1117,7 +2178,7 @@ func (r *realm) testamentAdd(msg *wamp.Invocation) wamp.Message {
 		return makeError(msg.Request, wamp.ErrInvalidArgument)
 	}
 	if r.debug {
-		r.log.Println("Adding", scope, "testament for session", caller)
+		stdlog.Debug(r.log, "Adding", scope, "testament for session", caller)
 	}
 
 	r.actionChan <- func() {
@@ -1156,7 +2217,7 @@ func (r *realm) testamentFlush(msg *wamp.Invocation) wamp.Message {
 		return makeError(msg.Request, wamp.ErrInvalidArgument)
 	}
 	if r.debug {
-		r.log.Println("Flushing", scope, "testaments for session", caller)
+		stdlog.Debug(r.log, "Flushing", scope, "testaments for session", caller)
 	}
 
 	r.actionChan <- func() {
@@ -1181,6 +2242,8 @@ func (r *realm) testamentFlush(msg *wamp.Invocation) wamp.Message {
 // cleanSessionDetails returns a dictionary that only contains allowed session
 // details. transport.auth is never allowed, because the data in transport.auth
 // may not be serializable and may expose auth information to session meta.
+// transport.http_headers_received is not allowed since it may also contain
+// auth information.
 func (r *realm) cleanSessionDetails(details wamp.Dict) wamp.Dict {
 	var clean wamp.Dict
 	// If in strict mode, only include allowed values.
@@ -1211,9 +2274,11 @@ func (r *realm) cleanSessionDetails(details wamp.Dict) wamp.Dict {
 		return clean
 	}
 
-	// If transport detail does not have auth, then use transport as-is.
-	authDict := wamp.DictChild(transDict, "auth")
-	if authDict == nil {
+	// If transport detail does not have auth or HTTP headers, then use
+	// transport as-is.
+	_, hasAuth := transDict["auth"]
+	_, hasHeaders := transDict["http_headers_received"]
+	if !hasAuth && !hasHeaders {
 		return clean
 	}
 
@@ -1225,11 +2290,12 @@ func (r *realm) cleanSessionDetails(details wamp.Dict) wamp.Dict {
 		}
 	}
 
-	// If details.transport.auth exists, then provide version of transport
-	// detail without auth.
+	// If details.transport.auth or details.transport.http_headers_received
+	// exists, then provide version of transport detail without these, since
+	// they may contain credentials.
 	var altTrans wamp.Dict
 	for n, v := range transDict {
-		if n == "auth" {
+		if n == "auth" || n == "http_headers_received" {
 			continue
 		}
 		if altTrans == nil {
@@ -1350,13 +2416,13 @@ func (r *realm) modifySessionDetails(sess *wamp.Session, delta wamp.Dict) {
 	for k, v := range delta {
 		if v == nil {
 			if r.debug {
-				r.log.Println("Deleted", k, "from session details")
+				stdlog.Debug(r.log, "Deleted", k, "from session details")
 			}
 			delete(sess.Details, k)
 			continue
 		}
 		if r.debug {
-			r.log.Println("Updated", k, "in session details")
+			stdlog.Debug(r.log, "Updated", k, "in session details")
 		}
 		sess.Details[k] = v
 	}
@@ -0,0 +1,219 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/transport"
+	"github.com/gammazero/nexus/wamp"
+)
+
+// linkWelcomeTimeout is how long to wait for a new link session's WELCOME.
+// The WELCOME has already been sent when the session is attached, so this
+// only bounds the wait if the session ends first.
+const linkWelcomeTimeout = time.Second
+
+// realmLink is a trusted local session, attached to a realm, that bridges
+// events between linked realms.  The session subscribes to the topics that are
+// linked out of its realm, and publishes the events that are linked into its
+// realm.
+//
+// Because the one session does both, and a broker does not send a publisher
+// its own events, an event that is bridged into a realm is never bridged out
+// of that realm again.  This prevents events from looping when realms are
+// linked in both directions or in a cycle.
+type realmLink struct {
+	realm  wamp.URI
+	client wamp.Peer
+
+	// Canceled when the session has ended.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// subscription ID -> links to publish the subscription's events to.
+	targets map[wamp.ID][]*realmLink
+	// SUBSCRIBE request ID -> subscription waiting for a reply.
+	pending map[wamp.ID]*pendingLink
+}
+
+// pendingLink is a SUBSCRIBE for a link that is waiting for its reply.
+type pendingLink struct {
+	to    *realmLink
+	reply chan wamp.Message
+}
+
+// LinkRealms links realm a to realm b, so that events published in realm a to
+// topics starting with topicPrefix are also published in realm b.  A link is
+// one way; link b to a as well to bridge events in both directions.  An event
+// that is bridged into a realm is not bridged again, so realms can be linked
+// in any arrangement without events looping.
+//
+// The events are bridged by a trusted local session in each linked realm, so
+// the publisher of a bridged event is not disclosed.  If a linked realm is
+// removed, then its links are removed with it.
+//
+// Bridging is best effort.  A link session republishes the events it receives
+// one at a time, so it reads events no faster than the linked realms accept
+// its publications.  If events arrive faster than that, and the session's
+// outbound queue fills, then the broker drops the events sent to the session,
+// as it does for any slow subscriber, and gives them to the realm's
+// DeadLetterHandler if there is one.
+func (r *router) LinkRealms(a, b wamp.URI, topicPrefix string) error {
+	if a == b {
+		return errors.New("cannot link a realm to itself")
+	}
+	prefix := wamp.URI(topicPrefix)
+	if !prefix.ValidURI(false, wamp.MatchPrefix) {
+		return fmt.Errorf("invalid topic prefix %q", topicPrefix)
+	}
+
+	r.linkLock.Lock()
+	defer r.linkLock.Unlock()
+	from, err := r.getRealmLink(a)
+	if err != nil {
+		return err
+	}
+	to, err := r.getRealmLink(b)
+	if err != nil {
+		return err
+	}
+	return from.subscribe(prefix, to)
+}
+
+// getRealmLink returns the realm's link session, attaching a new session to
+// the realm if there is none.  The caller must hold linkLock.
+func (r *router) getRealmLink(uri wamp.URI) (*realmLink, error) {
+	if l, ok := r.links[uri]; ok && l.ctx.Err() == nil {
+		return l, nil
+	}
+	client, server := transport.LinkedPeers()
+	go client.SendCtx(r.ctx, &wamp.Hello{
+		Realm: uri,
+		Details: wamp.Dict{
+			"roles": wamp.Dict{
+				"publisher":  wamp.Dict{},
+				"subscriber": wamp.Dict{},
+			},
+		},
+	})
+	if _, err := r.AttachLocal(server, ""); err != nil {
+		return nil, err
+	}
+	msg, err := wamp.RecvTimeout(client, linkWelcomeTimeout)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("realm %s link: %s", uri, err)
+	}
+	if msg.MessageType() != wamp.WELCOME {
+		client.Close()
+		return nil, fmt.Errorf("expected %v, got %v", wamp.WELCOME,
+			msg.MessageType())
+	}
+
+	l := &realmLink{
+		realm:   uri,
+		client:  client,
+		targets: map[wamp.ID][]*realmLink{},
+		pending: map[wamp.ID]*pendingLink{},
+	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	go l.run()
+	r.links[uri] = l
+	return l, nil
+}
+
+// subscribe subscribes the link session to the topic prefix, and publishes the
+// events for the subscription to the other link's realm.
+func (l *realmLink) subscribe(prefix wamp.URI, to *realmLink) error {
+	req := wamp.GlobalID()
+	p := &pendingLink{to: to, reply: make(chan wamp.Message, 1)}
+	l.mu.Lock()
+	l.pending[req] = p
+	l.mu.Unlock()
+
+	err := l.client.SendCtx(l.ctx, &wamp.Subscribe{
+		Request: req,
+		Topic:   prefix,
+		Options: wamp.Dict{wamp.OptMatch: wamp.MatchPrefix},
+	})
+	if err != nil {
+		return fmt.Errorf("realm %s link closed", l.realm)
+	}
+	select {
+	case msg := <-p.reply:
+		if errMsg, ok := msg.(*wamp.Error); ok {
+			return fmt.Errorf("cannot subscribe to %s in realm %s: %s",
+				prefix, l.realm, errMsg.Error)
+		}
+	case <-l.ctx.Done():
+		return fmt.Errorf("realm %s link closed", l.realm)
+	}
+	return nil
+}
+
+// run handles the messages that the router sends to the link session, until
+// the session ends.
+func (l *realmLink) run() {
+	defer l.cancel()
+	for msg := range l.client.Recv() {
+		switch msg := msg.(type) {
+		case *wamp.Event:
+			l.mu.Lock()
+			targets := l.targets[msg.Subscription]
+			l.mu.Unlock()
+			topic, _ := wamp.AsURI(msg.Details[detailTopic])
+			for _, to := range targets {
+				to.publish(topic, msg.Arguments, msg.ArgumentsKw)
+			}
+		case *wamp.Subscribed:
+			l.mu.Lock()
+			if p, ok := l.pending[msg.Request]; ok {
+				delete(l.pending, msg.Request)
+				l.addTarget(msg.Subscription, p.to)
+				p.reply <- msg
+			}
+			l.mu.Unlock()
+		case *wamp.Error:
+			l.mu.Lock()
+			if p, ok := l.pending[msg.Request]; ok {
+				delete(l.pending, msg.Request)
+				p.reply <- msg
+			}
+			l.mu.Unlock()
+		case *wamp.Goodbye:
+			// Reply in case the realm is draining, without blocking if the
+			// session has already been stopped.
+			go l.client.SendCtx(l.ctx, &wamp.Goodbye{
+				Reason:  wamp.ErrGoodbyeAndOut,
+				Details: wamp.Dict{},
+			})
+		}
+	}
+}
+
+// addTarget adds a link to publish a subscription's events to, if it is not
+// already there.  The caller must hold l.mu.
+func (l *realmLink) addTarget(subID wamp.ID, to *realmLink) {
+	for _, t := range l.targets[subID] {
+		if t == to {
+			return
+		}
+	}
+	l.targets[subID] = append(l.targets[subID], to)
+}
+
+// publish publishes an event bridged from another realm to the link's realm.
+// If the link session has ended, then the event is dropped.
+func (l *realmLink) publish(topic wamp.URI, args wamp.List, kwargs wamp.Dict) {
+	l.client.SendCtx(l.ctx, &wamp.Publish{
+		Request:     wamp.GlobalID(),
+		Options:     wamp.Dict{},
+		Topic:       topic,
+		Arguments:   args,
+		ArgumentsKw: kwargs,
+	})
+}
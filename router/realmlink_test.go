@@ -0,0 +1,99 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestLinkRealms(t *testing.T) {
+	defer leaktest.Check(t)()
+	const (
+		realmA = wamp.URI("nexus.test.link.a")
+		realmB = wamp.URI("nexus.test.link.b")
+	)
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{URI: realmA, AnonymousAuth: true},
+			{URI: realmB, AnonymousAuth: true},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err = r.LinkRealms(realmA, realmA, "nexus.test"); err == nil {
+		t.Fatal("expected error linking realm to itself")
+	}
+	if err = r.LinkRealms(realmA, "nexus.test.link.none", "nexus.test"); err == nil {
+		t.Fatal("expected error linking to realm that does not exist")
+	}
+	// Link in both directions, so that a bridged event would loop if it were
+	// bridged again.
+	if err = r.LinkRealms(realmA, realmB, "nexus.test"); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.LinkRealms(realmB, realmA, "nexus.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	subscribe := func(realm wamp.URI) *wamp.Session {
+		sub, err := testClientInRealm(r, realm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+		msg, err := wamp.RecvTimeout(sub, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := msg.(*wamp.Subscribed); !ok {
+			t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+		}
+		return sub
+	}
+	subA := subscribe(realmA)
+	subB := subscribe(realmB)
+	unlinked := wamp.URI("other.test.event")
+	subB.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: unlinked})
+	if _, err = wamp.RecvTimeout(subB, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := testClientInRealm(r, realmA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub.Send(&wamp.Publish{
+		Request:   wamp.GlobalID(),
+		Topic:     testTopic,
+		Arguments: wamp.List{"hello"},
+	})
+	pub.Send(&wamp.Publish{Request: wamp.GlobalID(), Topic: unlinked})
+
+	// Each subscriber gets the event exactly once.
+	for _, sub := range []*wamp.Session{subA, subB} {
+		msg, err := wamp.RecvTimeout(sub, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for EVENT")
+		}
+		event, ok := msg.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected EVENT, got", msg.MessageType())
+		}
+		if len(event.Arguments) != 1 || event.Arguments[0] != "hello" {
+			t.Fatal("wrong event arguments:", event.Arguments)
+		}
+		if msg, err = wamp.RecvTimeout(sub, 100*time.Millisecond); err == nil {
+			t.Fatal("unexpected message:", msg)
+		}
+	}
+
+	pub.Close()
+	subA.Close()
+	subB.Close()
+}
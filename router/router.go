@@ -2,11 +2,11 @@
 Package router provides a WAMP router implementation that supports most of the
 WAMP advanced profile, offers multiple transports and TLS, and extends
 publication filtering functionality.
-
 */
 package router
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -14,11 +14,22 @@ import (
 	"sync"
 	"time"
 
+	"github.com/gammazero/nexus/router/auth"
 	"github.com/gammazero/nexus/stdlog"
+	"github.com/gammazero/nexus/transport"
 	"github.com/gammazero/nexus/wamp"
 )
 
-const helloTimeout = 5 * time.Second
+// defaultHelloTimeout is how long the router waits for a HELLO message when
+// Config.HelloTimeout is not set.
+const defaultHelloTimeout = 5 * time.Second
+
+var (
+	errRouterClosed    = errors.New("router is closing, not accepting new clients")
+	errTooManySessions = errors.New("router has reached its session limit")
+	errSessionQuota    = errors.New("session quota exceeded for authrole")
+	errNotLocalPeer    = errors.New("AttachLocal requires a local peer")
+)
 
 // Deprecated: replaced by Config
 //
@@ -41,30 +52,168 @@ type Config struct {
 	// allows unauthenticated clients to create new realms.
 	RealmTemplate *RealmConfig `json:"realm_template"`
 
+	// RealmFactory, if set, is used instead of RealmTemplate to create new
+	// realms when a client requests to join a realm that does not yet exist.
+	// It is called with the URI of the requested realm, and returns the
+	// configuration for that realm, so that each realm can have its own
+	// authenticators, authorizer, and other settings.  The URI of the returned
+	// configuration is set to the requested URI.  Returning an error rejects
+	// the client with an ABORT with reason wamp.error.no_such_realm and the
+	// error in the details.  Realms created by RealmFactory are limited by
+	// MaxAutoRealms and AutoRealmAllowed, the same as realms created from
+	// RealmTemplate.  This is called from the router's goroutine, so it must
+	// return quickly and must not call the router.
+	//
+	// This value is not set via json config, but is configured when
+	// embedding nexus.
+	RealmFactory func(wamp.URI) (*RealmConfig, error)
+
+	// MaxAutoRealms is the maximum number of realms that the router creates
+	// from RealmTemplate or RealmFactory.  A client that requests a realm that
+	// would exceed this limit is sent an ABORT with reason
+	// wamp.error.no_such_realm.
+	// Auto-created realms that are removed no longer count against the
+	// limit.  If zero, there is no limit.
+	MaxAutoRealms int `json:"max_auto_realms"`
+
+	// AutoRealmAllowed, if set, is called with the URI of a realm that a
+	// client requested and that does not exist.  The realm is created from
+	// RealmTemplate or RealmFactory only if this returns true.  Otherwise, the client is sent
+	// an ABORT with reason wamp.error.no_such_realm.  This is called from the
+	// router's goroutine, so it must return quickly and must not call the
+	// router.
+	//
+	// This value is not set via json config, but is configured when
+	// embedding nexus.
+	AutoRealmAllowed func(wamp.URI) bool
+
+	// HelloTimeout is how long the router waits for a newly attached client
+	// to send its HELLO message.  If nil, the default of 5 seconds is used.
+	// If zero or negative, the router waits indefinitely, which may be needed
+	// for clients behind slow TLS handshakes or high-latency links.
+	HelloTimeout *time.Duration `json:"hello_timeout"`
+
+	// HelloInterceptor, if set, is called with each HELLO message before the
+	// requested realm is looked up.  This allows custom admission logic, such
+	// as IP allow-lists or header checks, to reject a client before it is
+	// attached to any realm.
+	//
+	// This value is not set via json config, but is configured when
+	// embedding nexus.
+	HelloInterceptor HelloInterceptor
+
+	// MaxSessions is the maximum number of sessions that can be attached to
+	// the router at the same time, counting the sessions of all realms.  A
+	// client that attaches when the limit is reached is sent an ABORT with
+	// reason wamp.close.system_shutdown.  If zero, there is no limit.
+	MaxSessions int `json:"max_sessions"`
+
+	// Middleware is a chain of middleware that messages from sessions pass
+	// through before they are routed, in every realm.  The first middleware
+	// in the list is called first.
+	//
+	// This value is not set via json config, but is configured when
+	// embedding nexus.
+	Middleware []Middleware
+
+	// IDGenerator, if set, generates the global scope IDs that the router
+	// assigns to sessions and publications.  A sequential generator makes IDs
+	// reproducible in tests, and a generator that puts a node prefix in IDs
+	// keeps the IDs of clustered routers from colliding.  It is called
+	// concurrently, so it must be safe for concurrent use, and must return
+	// IDs in the range [1, 2^53].  If nil, then random IDs from wamp.GlobalID
+	// are used.
+	//
+	// This value is not set via json config, but is configured when
+	// embedding nexus.
+	IDGenerator func() wamp.ID
+
+	// Clock, if set, provides the time and timers used for the hello
+	// timeout, heartbeat timeouts, drain grace periods, and call timeouts.
+	// This allows tests to trigger timeouts without waiting.  If nil, the
+	// system clock is used.
+	//
+	// This value is not set via json config, but is configured when
+	// embedding nexus.
+	Clock Clock
+
 	// Enable debug logging for router, realm, broker, dealer
 	Debug bool
 }
 
+// HelloInterceptor inspects the HELLO message sent by a client.  Returning a
+// non-nil error rejects the client, which is sent an ABORT message with reason
+// wamp.error.authorization_failed and the error string in the details.
+type HelloInterceptor func(peer wamp.Peer, hello *wamp.Hello) error
+
 // A Router handles new Peers and routes requests to the requested Realm.
 type Router interface {
 	// Attach connects a client to the router and to the requested realm.
 	Attach(wamp.Peer) error
 
+	// AttachContext connects a client to the router and to the requested
+	// realm.  The HELLO exchange and authentication are abandoned if the
+	// context is canceled.
+	AttachContext(context.Context, wamp.Peer) error
+
 	// AttachClient connects a client to the router and to the requested realm.
 	// It provides additional transport information details.
 	AttachClient(wamp.Peer, wamp.Dict) error
 
+	// AttachWithSession connects a client to the router and to the
+	// requested realm, and returns the session created for the client.
+	AttachWithSession(wamp.Peer) (*wamp.Session, error)
+
+	// AttachLocal connects an in-process client to the router without
+	// authentication, and gives its session the specified authrole.
+	AttachLocal(wamp.Peer, string) (*wamp.Session, error)
+
 	// Close stops the router and waits message processing to stop.
 	Close()
 
+	// Shutdown gracefully stops the router.  A GOODBYE is sent to every
+	// session, and the router waits for clients to reply or for the context
+	// to be done before closing the realms.
+	Shutdown(ctx context.Context) error
+
 	// Logger returns the logger the router is using.
 	Logger() stdlog.StdLog
 
-	// AddRealm will append a realm to this router
-	AddRealm(*RealmConfig) error
+	// AddRealm will append a realm to this router and return the new realm.
+	AddRealm(*RealmConfig) (Realm, error)
+
+	// RemoveRealm closes and removes a realm from this router.  An error is
+	// returned if the realm does not exist or if the router is closed.
+	RemoveRealm(wamp.URI) error
+
+	// DrainRealm gracefully removes a realm from this router.  A GOODBYE is
+	// sent to every session in the realm, and sessions may finish in-flight
+	// calls until they reply with GOODBYE or the context is done.  An error
+	// is returned if the realm does not exist, if the router is closed, or if
+	// the context is done before all sessions leave.
+	DrainRealm(context.Context, wamp.URI) error
+
+	// LinkRealms links realm a to realm b, so that events published in realm
+	// a to topics starting with the topic prefix are also published in realm
+	// b.  An event that is bridged into a realm is not bridged again.
+	LinkRealms(a, b wamp.URI, topicPrefix string) error
+
+	// ListRealms returns a snapshot of the URIs of the realms currently on
+	// this router.
+	ListRealms() []wamp.URI
 
-	// RemoveRealm will attempt to remove a realm from this router
-	RemoveRealm(wamp.URI)
+	// GetRealm returns the realm with the specified URI, and false if the
+	// realm does not exist.  The realm is not created if it does not exist.
+	GetRealm(wamp.URI) (Realm, bool)
+
+	// RealmStats returns a snapshot of the statistics for the specified
+	// realm.  An error is returned if the realm does not exist.
+	RealmStats(wamp.URI) (RealmStats, error)
+
+	// SessionEvents returns a channel that receives session lifecycle events
+	// from all realms.  The channel is buffered, and if the events are not
+	// read then the oldest events are dropped.
+	SessionEvents() <-chan SessionEvent
 }
 
 // router is the default WAMP router implementation.
@@ -72,10 +221,40 @@ type router struct {
 	realms map[wamp.URI]*realm
 
 	actionChan chan func()
+	done       chan struct{}
 	waitRealms sync.WaitGroup
 
+	// Canceled when the router is closed.  Each realm's context is derived
+	// from this context.
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	realmTemplate *RealmConfig
+	realmFactory  func(wamp.URI) (*RealmConfig, error)
 	closed        bool
+	helloTimeout  time.Duration
+
+	// Limits on realms created from realmTemplate, and the realms that were
+	// created from it.
+	maxAutoRealms    int
+	autoRealmAllowed func(wamp.URI) bool
+	autoRealms       map[wamp.URI]struct{}
+
+	helloInterceptor HelloInterceptor
+	middleware       []Middleware
+	events           *sessionEvents
+	idGenerator      func() wamp.ID
+	clock            Clock
+
+	// Sessions that bridge events between linked realms, by realm URI.
+	links    map[wamp.URI]*realmLink
+	linkLock sync.Mutex
+
+	// Session limit, and the number of sessions attached or attaching to the
+	// router.  The count is only maintained when there is a limit, and is
+	// only accessed by the router goroutine.
+	maxSessions  int
+	sessionCount int
 
 	log   stdlog.StdLog
 	debug bool
@@ -89,13 +268,42 @@ func NewRouter(config *Config, logger stdlog.StdLog) (Router, error) {
 	}
 	logger.Println("Starting router")
 
+	helloTimeout := defaultHelloTimeout
+	if config.HelloTimeout != nil {
+		helloTimeout = *config.HelloTimeout
+	}
+	idGenerator := config.IDGenerator
+	if idGenerator == nil {
+		idGenerator = wamp.GlobalID
+	}
+	clock := config.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+
 	r := &router{
 		realms:        map[wamp.URI]*realm{},
 		actionChan:    make(chan func()),
+		done:          make(chan struct{}),
 		realmTemplate: config.RealmTemplate,
-		log:           logger,
-		debug:         config.Debug,
+		realmFactory:  config.RealmFactory,
+
+		maxAutoRealms:    config.MaxAutoRealms,
+		autoRealmAllowed: config.AutoRealmAllowed,
+		autoRealms:       map[wamp.URI]struct{}{},
+		helloTimeout:     helloTimeout,
+		log:              logger,
+		debug:            config.Debug,
+
+		helloInterceptor: config.HelloInterceptor,
+		middleware:       config.Middleware,
+		events:           newSessionEvents(),
+		idGenerator:      idGenerator,
+		clock:            clock,
+		links:            map[wamp.URI]*realmLink{},
+		maxSessions:      config.MaxSessions,
 	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
 
 	for _, realmConfig := range config.RealmConfigs {
 		if _, err := r.addRealm(realmConfig); err != nil {
@@ -107,7 +315,11 @@ func NewRouter(config *Config, logger stdlog.StdLog) (Router, error) {
 	if r.realmTemplate != nil {
 		realmTemplate := *r.realmTemplate
 		realmTemplate.URI = "some.valid.realm"
-		if _, err := newRealm(&realmTemplate, nil, nil, r.log, r.debug); err != nil {
+		ctx, cancel := context.WithCancel(r.ctx)
+		_, err := newRealm(ctx, cancel, &realmTemplate, nil, nil, r.log, r.debug)
+		// The realm is never run, so cancel its context now.
+		cancel()
+		if err != nil {
 			return nil, fmt.Errorf("Invalid realmTemplate: %s", err)
 		}
 	}
@@ -116,13 +328,67 @@ func NewRouter(config *Config, logger stdlog.StdLog) (Router, error) {
 	return r, nil
 }
 
+// recvHello receives the first message from a client, waiting no longer than
+// the router's hello timeout.  A timeout that is not positive waits
+// indefinitely.  If the context is done before a message is received, then
+// ctx.Err() is returned.
+func (r *router) recvHello(ctx context.Context, client wamp.Peer) (wamp.Message, error) {
+	var timeout <-chan time.Time
+	if r.helloTimeout > 0 {
+		timer := r.clock.NewTimer(r.helloTimeout)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	select {
+	case msg, open := <-client.Recv():
+		if !open {
+			return nil, errors.New("receive channel closed")
+		}
+		return msg, nil
+	case <-timeout:
+		return nil, errors.New("timeout waiting for message")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SessionEvents returns the channel that receives session lifecycle events.
+func (r *router) SessionEvents() <-chan SessionEvent { return r.events.ch }
+
 // Logger returns the StdLog that the router uses for logging.
 func (r *router) Logger() stdlog.StdLog { return r.log }
 
 // Attach connects a client to the router and to the requested realm.  If
 // successful, Attach returns after sending a WELCOME message to the client.
 func (r *router) Attach(client wamp.Peer) error {
-	return r.AttachClient(client, nil)
+	return r.AttachContext(context.Background(), client)
+}
+
+// AttachContext connects a client to the router and to the requested realm,
+// the same as Attach.  If the context is canceled before the HELLO exchange
+// and authentication complete, then an ABORT is sent to the client and
+// ctx.Err() is returned.
+func (r *router) AttachContext(ctx context.Context, client wamp.Peer) error {
+	_, err := r.attachClient(ctx, client, nil, "")
+	return err
+}
+
+// AttachWithSession connects a client to the router and to the requested
+// realm, the same as Attach, and returns the session created for the client.
+// This lets an application that embeds the router get the session of a
+// client it attached, such as a trusted in-process client.  The session is
+// returned after the WELCOME message is sent to the client.
+//
+// The returned session is a copy of the session's ID, details, and roles, as
+// they were when the client joined the realm.  It has no peer, since the
+// router's side of the session is owned by the router; the client sends its
+// messages over its own peer.
+func (r *router) AttachWithSession(client wamp.Peer) (*wamp.Session, error) {
+	sess, err := r.attachClient(context.Background(), client, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return copySession(sess), nil
 }
 
 // AttachClient connects a client to the router and to the requested realm.  If
@@ -136,24 +402,79 @@ func (r *router) Attach(client wamp.Peer) error {
 // See websocketpeer.WebSocketConfig for information provided by websocket
 // connections.
 func (r *router) AttachClient(client wamp.Peer, transportDetails wamp.Dict) error {
-	sendAbort := func(reason wamp.URI, abortErr error) {
-		abortMsg := wamp.Abort{Reason: reason}
-		abortMsg.Details = wamp.Dict{}
+	_, err := r.attachClient(context.Background(), client, transportDetails, "")
+	return err
+}
+
+// AttachLocal connects a client, embedded in the same application as the
+// router, to the router and to the requested realm, and returns the session
+// created for the client, copied as by AttachWithSession.  The client must be
+// connected over a local peer, such as one created by transport.LinkedPeers.
+//
+// The client is not authenticated, even if the realm requires local clients
+// to authenticate, and the session is given the specified authrole.  If
+// authrole is empty, then "trusted" is used.  Use this to connect built-in
+// services, such as server-side callees, to a realm.
+func (r *router) AttachLocal(client wamp.Peer, authrole string) (*wamp.Session, error) {
+	if !transport.IsLocal(client) {
+		return nil, errNotLocalPeer
+	}
+	if authrole == "" {
+		authrole = "trusted"
+	}
+	sess, err := r.attachClient(context.Background(), client, nil, authrole)
+	if err != nil {
+		return nil, err
+	}
+	return copySession(sess), nil
+}
+
+// copySession returns a copy of the session's ID, details, and roles, without
+// its peer, for giving to the application.  The details are copied so that the
+// application does not share them with the router.
+func copySession(sess *wamp.Session) *wamp.Session {
+	sess.Lock()
+	defer sess.Unlock()
+	safe := sess.SafeSession()
+	safe.Details = wamp.MergeDict(nil, sess.Details)
+	return safe
+}
+
+// attachClient attaches the client to the realm requested in its HELLO.  If
+// trustedRole is not empty, then the client is not authenticated and is given
+// that authrole.
+func (r *router) attachClient(ctx context.Context, client wamp.Peer, transportDetails wamp.Dict, trustedRole string) (*wamp.Session, error) {
+	var hello *wamp.Hello
+	var sid wamp.ID
+	addr, transportDetails := peerAddrDetails(client, transportDetails)
+	abort := func(reason wamp.URI, abortErr error) {
+		if hello != nil {
+			authid, _ := wamp.AsString(hello.Details["authid"])
+			r.events.emit(SessionAborted, sid, hello.Realm, authid)
+		} else {
+			r.events.emit(SessionAborted, sid, "", "")
+		}
 		if abortErr != nil {
-			abortMsg.Details["error"] = abortErr.Error()
-			r.log.Println("Aborting client connection:", abortErr)
+			if addr != "" {
+				r.log.Println("Aborting client connection from", addr+":", abortErr)
+			} else {
+				r.log.Println("Aborting client connection:", abortErr)
+			}
 		}
-		client.Send(&abortMsg) // Blocking OK; this is session goroutine.
-		client.Close()
+		sendAbort(client, reason, abortErr) // Blocking OK; this is session goroutine.
 	}
 
 	// Receive HELLO message from the client.
-	msg, err := wamp.RecvTimeout(client, helloTimeout)
+	msg, err := r.recvHello(ctx, client)
 	if err != nil {
-		return errors.New("did not receive HELLO: " + err.Error())
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			abort(wamp.ErrCanceled, ctxErr)
+			return nil, ctxErr
+		}
+		return nil, errors.New("did not receive HELLO: " + err.Error())
 	}
 	if r.debug {
-		r.log.Printf("New client sent: %s: %+v", msg.MessageType(), msg)
+		stdlog.Debugf(r.log, "New client sent: %s: %+v", msg.MessageType(), msg)
 	}
 
 	// A WAMP session is initiated by the Client sending a HELLO message to the
@@ -163,23 +484,43 @@ func (r *router) AttachClient(client wamp.Peer, transportDetails wamp.Dict) erro
 	if !ok {
 		// Received unexpected message - protocol violation.
 		err = fmt.Errorf("expected HELLO, received %s", msg.MessageType())
-		sendAbort(wamp.ErrProtocolViolation, err)
-		return err
+		abort(wamp.ErrProtocolViolation, err)
+		return nil, err
+	}
+
+	// Allow embedding application to reject client before realm lookup.
+	if r.helloInterceptor != nil {
+		if err = r.helloInterceptor(client, hello); err != nil {
+			abort(wamp.ErrAuthorizationFailed, err)
+			return nil, fmt.Errorf("HELLO rejected: %s", err)
+		}
 	}
 
 	// Client is required to provide a non-empty realm.
 	if string(hello.Realm) == "" {
 		err = errors.New("no realm requested")
-		sendAbort(wamp.ErrNoSuchRealm, err)
-		return err
+		abort(wamp.ErrNoSuchRealm, err)
+		return nil, err
 	}
-	// Lookup or create realm to attach to.
+	// Lookup or create realm to attach to.  If the client is refused, the
+	// reason for the ABORT is set, and the ABORT is sent after returning from
+	// the router goroutine, so that a client that is slow to take the ABORT,
+	// or a flood of clients, is not able to block the router.
 	var realm *realm
+	var abortReason wamp.URI
+	var abortErr error
 	sync := make(chan error)
-	r.actionChan <- func() {
+	submitted := r.submit(func() {
 		if r.closed {
-			sendAbort(wamp.ErrSystemShutdown, nil)
-			sync <- errors.New("router is closing, not accepting new clients")
+			abortReason = wamp.ErrSystemShutdown
+			sync <- errRouterClosed
+			return
+		}
+		// Check the session limit before looking up the realm, so that a
+		// client rejected for being over the limit does not create a realm.
+		if r.maxSessions > 0 && r.sessionCount >= r.maxSessions {
+			abortReason, abortErr = wamp.ErrSystemShutdown, errTooManySessions
+			sync <- errTooManySessions
 			return
 		}
 		// Realm is a string identifying the realm this session should attach
@@ -189,34 +530,88 @@ func (r *router) AttachClient(client wamp.Peer, transportDetails wamp.Dict) erro
 		if !found {
 			// If the router is not configured to automatically create the
 			// realm, then respond with an ABORT message.
-			if r.realmTemplate == nil {
-				sendAbort(wamp.ErrNoSuchRealm, nil)
+			if r.realmTemplate == nil && r.realmFactory == nil {
+				abortReason = wamp.ErrNoSuchRealm
 				sync <- fmt.Errorf("no realm \"%s\" exists on this router",
 					string(hello.Realm))
 				return
 			}
 
-			// Create the new realm based on template
-			config := *r.realmTemplate
+			// Check that the realm is allowed and would not exceed the
+			// limit on auto-created realms.
+			if r.autoRealmAllowed != nil && !r.autoRealmAllowed(hello.Realm) {
+				abortReason = wamp.ErrNoSuchRealm
+				sync <- fmt.Errorf("realm \"%s\" not allowed on this router",
+					string(hello.Realm))
+				return
+			}
+			if r.maxAutoRealms > 0 && len(r.autoRealms) >= r.maxAutoRealms {
+				abortReason = wamp.ErrNoSuchRealm
+				sync <- fmt.Errorf("cannot create realm \"%s\": limit of %d realms reached",
+					string(hello.Realm), r.maxAutoRealms)
+				return
+			}
+
+			// Create the new realm based on the factory or the template.
+			var config RealmConfig
+			if r.realmFactory != nil {
+				cfg, cfgErr := r.realmFactory(hello.Realm)
+				if cfgErr == nil && cfg == nil {
+					cfgErr = errors.New("no realm config")
+				}
+				if cfgErr != nil {
+					abortReason, abortErr = wamp.ErrNoSuchRealm, cfgErr
+					sync <- fmt.Errorf("cannot create realm \"%s\": %s",
+						string(hello.Realm), cfgErr)
+					return
+				}
+				config = *cfg
+			} else {
+				config = *r.realmTemplate
+			}
 			config.URI = hello.Realm
 			if realm, err = r.addRealm(&config); err != nil {
-				sendAbort(wamp.ErrNoSuchRealm, nil)
+				abortReason = wamp.ErrNoSuchRealm
 				sync <- fmt.Errorf("failed to create realm \"%s\"",
 					string(hello.Realm))
 				return
 
 			}
+			r.autoRealms[hello.Realm] = struct{}{}
 			r.log.Println("Auto-added realm:", hello.Realm)
 		}
+		// Reserve a slot for the session.  The slot is released if the
+		// session fails to attach, or when the session ends.
+		if r.maxSessions > 0 {
+			r.sessionCount++
+		}
 		sync <- nil
+	})
+	if !submitted {
+		abort(wamp.ErrSystemShutdown, nil)
+		return nil, errRouterClosed
 	}
-	err = <-sync
-	if err != nil {
-		return err
+	if err = <-sync; err != nil {
+		if abortReason != "" {
+			abort(abortReason, abortErr)
+		}
+		return nil, err
+	}
+	// Release the reserved session slot if the session fails to attach.  Once
+	// attached, the slot is released by the realm when the session ends.
+	var attached bool
+	if r.maxSessions > 0 {
+		defer func() {
+			if !attached {
+				r.releaseSession()
+			}
+		}()
 	}
 
 	hello.Details = wamp.NormalizeDict(hello.Details)
-	sid := wamp.GlobalID()
+	sid = r.idGenerator()
+	authid, _ := wamp.AsString(hello.Details["authid"])
+	r.events.emit(SessionAttached, sid, hello.Realm, authid)
 
 	// Create new session.
 	sess := wamp.NewSession(client, sid, nil, hello.Details)
@@ -233,8 +628,8 @@ func (r *router) AttachClient(client wamp.Peer, transportDetails wamp.Dict) erro
 	}
 	if !rolesOK {
 		err = errors.New("client did not announce any supported roles")
-		sendAbort(wamp.ErrNoSuchRole, err)
-		return err
+		abort(wamp.ErrNoSuchRole, err)
+		return nil, err
 	}
 
 	// Include any transport details with HELLO.Details.
@@ -245,11 +640,38 @@ func (r *router) AttachClient(client wamp.Peer, transportDetails wamp.Dict) erro
 	// Handle any necessary client auth.  This results in either a WELCOME
 	// message or an error.
 	//
-	// Authentication may take some time.
-	welcome, err := realm.authClient(sid, client, hello.Details)
+	// Authentication may take some time, so run it while watching for the
+	// context to be canceled.  If canceled, closing the client causes any
+	// authenticator waiting on the client to return.
+	type authResult struct {
+		welcome *wamp.Welcome
+		err     error
+	}
+	authChan := make(chan authResult, 1)
+	go func() {
+		welcome, err := realm.authClient(sid, client, hello.Details, trustedRole)
+		authChan <- authResult{welcome, err}
+	}()
+	var welcome *wamp.Welcome
+	select {
+	case result := <-authChan:
+		welcome, err = result.welcome, result.err
+	case <-ctx.Done():
+		abort(wamp.ErrCanceled, ctx.Err())
+		return nil, ctx.Err()
+	case <-realm.Context().Done():
+		abort(wamp.ErrSystemShutdown, nil)
+		return nil, errors.New("realm closed")
+	}
 	if err != nil {
-		sendAbort(wamp.ErrAuthenticationFailed, err)
-		return errors.New("authentication error: " + err.Error())
+		// A client that sends the wrong message during the authentication
+		// exchange violates the protocol, and did not fail to authenticate.
+		if _, ok := err.(*auth.UnexpectedMessageError); ok {
+			abort(wamp.ErrProtocolViolation, err)
+		} else {
+			abort(wamp.ErrAuthenticationFailed, err)
+		}
+		return nil, errors.New("authentication error: " + err.Error())
 	}
 
 	// Fill in the values of the welcome message and send to client.
@@ -273,24 +695,77 @@ func (r *router) AttachClient(client wamp.Peer, transportDetails wamp.Dict) erro
 	sessDetails["session"] = sid
 
 	sess.Details = sessDetails
+	// Read the details before the session is handed to the realm, which may
+	// modify them.
+	authid, _ = wamp.AsString(sessDetails["authid"])
+
+	// Tell the client how often it must send a message to stay attached, if
+	// it supports heartbeats.
+	if realm.heartbeatInterval > 0 && supportsHeartbeat(sess) {
+		welcome.Details["heartbeat_interval"] = int64(realm.heartbeatInterval / time.Millisecond)
+	}
+	// Decorate the WELCOME before the session is live, so that the decorator
+	// does not race with the realm using the session.
+	if realm.welcomeDecorator != nil {
+		if details := realm.welcomeDecorator(sess, welcome.Details); details != nil {
+			welcome.Details = details
+		}
+	}
 
 	if err := realm.handleSession(sess); err != nil {
-		// Any error returned here is a shutdown error.
-		sendAbort(wamp.ErrSystemShutdown, nil)
-		return err
+		// Other than exceeding a quota, any error returned here is a shutdown
+		// error.
+		if err == errSessionQuota {
+			abort(wamp.ErrNotAuthorized, err)
+		} else {
+			abort(wamp.ErrSystemShutdown, nil)
+		}
+		return nil, err
 	}
+	attached = true
 
 	client.Send(welcome) // Blocking OK; this is session goroutine.
+	r.events.emit(SessionAuthenticated, sid, hello.Realm, authid)
 	if r.debug {
-		r.log.Println("Created session:", sid)
+		if addr != "" {
+			stdlog.Debug(r.log, "Created session:", sid, "from", addr)
+		} else {
+			stdlog.Debug(r.log, "Created session:", sid)
+		}
 	}
-	return nil
+	return sess, nil
+}
+
+// peerAddrDetails returns the remote address of the client, and the transport
+// details with the address included as details["peer"].  If the transport
+// details already provide the address, then they are returned unchanged.
+// Otherwise the address is obtained from the peer, if the peer provides it.
+func peerAddrDetails(client wamp.Peer, transportDetails wamp.Dict) (string, wamp.Dict) {
+	if addr, ok := wamp.AsString(transportDetails["peer"]); ok {
+		return addr, transportDetails
+	}
+	addr, ok := wamp.PeerAddr(client)
+	if !ok {
+		return "", transportDetails
+	}
+	details := make(wamp.Dict, len(transportDetails)+1)
+	for k, v := range transportDetails {
+		details[k] = v
+	}
+	details["peer"] = addr
+	return addr, details
 }
 
 // Close stops the router and waits message processing to stop.
 func (r *router) Close() {
+	var alreadyClosed bool
 	sync := make(chan struct{})
-	r.actionChan <- func() {
+	if !r.submit(func() {
+		if r.closed {
+			alreadyClosed = true
+			close(sync)
+			return
+		}
 		// Prevent new or attachment to existing realms.
 		r.closed = true
 		// Close all existing realms.
@@ -301,50 +776,220 @@ func (r *router) Close() {
 			r.log.Println("Realm", uri, "completed shutdown")
 		}
 		close(sync)
+	}) {
+		return
 	}
 	<-sync
-	// Wait for all existing realms to close.
+	if alreadyClosed {
+		return
+	}
+	// Canceling the router's context stops any realm that was removed from
+	// the router by wamp.realm.drain and is still draining.  Then wait for all
+	// realms to close.
+	r.cancel()
 	r.waitRealms.Wait()
-	close(r.actionChan)
+	close(r.done)
 	r.log.Println("Router stopped")
 }
 
-// AddRealm allows the addition of a realm after construction
-func (r *router) AddRealm(config *RealmConfig) error {
+// Shutdown stops the router after giving attached sessions a chance to finish
+// their work and leave.  No new sessions are accepted, and a GOODBYE with
+// reason wamp.close.system_shutdown is sent to every session.  Sessions can
+// continue to send messages, so that in-flight RPC results are delivered,
+// until they reply with GOODBYE.  Once all sessions have left, or the context
+// is done, the realms are closed.  If the context expires before all sessions
+// have left, then the remaining sessions are forcibly closed and ctx.Err() is
+// returned.
+func (r *router) Shutdown(ctx context.Context) error {
+	var realms []*realm
+	var alreadyClosed bool
+	sync := make(chan struct{})
+	if !r.submit(func() {
+		if r.closed {
+			alreadyClosed = true
+			close(sync)
+			return
+		}
+		// Prevent new or attachment to existing realms.
+		r.closed = true
+		for uri, rlm := range r.realms {
+			realms = append(realms, rlm)
+			delete(r.realms, uri)
+		}
+		close(sync)
+	}) {
+		return nil
+	}
+	<-sync
+	if alreadyClosed {
+		return nil
+	}
+
+	// Drain all realms concurrently.
+	errChan := make(chan error, len(realms))
+	for _, rlm := range realms {
+		go func(rlm *realm) {
+			errChan <- rlm.drain(ctx)
+			r.log.Println("Realm", rlm.uri, "completed shutdown")
+		}(rlm)
+	}
+	var err error
+	for range realms {
+		if drainErr := <-errChan; drainErr != nil {
+			err = drainErr
+		}
+	}
+
+	// Canceling the router's context stops any realm that was removed from
+	// the router by wamp.realm.drain and is still draining.  Then wait for all
+	// realms to close.
+	r.cancel()
+	r.waitRealms.Wait()
+	close(r.done)
+	r.log.Println("Router stopped")
+	return err
+}
+
+// AddRealm allows the addition of a realm after construction.  The new realm
+// is returned so that the caller may inspect it.
+func (r *router) AddRealm(config *RealmConfig) (Realm, error) {
+	var newRealm *realm
 	var err error
 	sync := make(chan struct{})
-	r.actionChan <- func() {
-		_, err = r.addRealm(config)
+	if !r.submit(func() {
+		if r.closed {
+			err = errRouterClosed
+		} else {
+			newRealm, err = r.addRealm(config)
+		}
 		close(sync)
+	}) {
+		return nil, errRouterClosed
 	}
 	<-sync
+	if err != nil {
+		return nil, err
+	}
+	return newRealm, nil
+}
+
+// RemoveRealm will close and then remove a realm from this router, if the
+// realm exists.  Sessions attached to the realm are sent a GOODBYE message
+// with the reason wamp.close.system_shutdown.
+func (r *router) RemoveRealm(name wamp.URI) error {
+	realm, err := r.takeRealm(name)
+	if err != nil {
+		return err
+	}
+	// The realm was found within the router, so close it outside of the
+	// atomic func while still blocking the caller.
+	realm.close()
+	r.log.Println("Realm", name, "was removed and completed shutdown")
+	return nil
+}
+
+// DrainRealm removes the named realm from this router, and drains the realm
+// of its sessions before closing it.
+func (r *router) DrainRealm(ctx context.Context, name wamp.URI) error {
+	realm, err := r.takeRealm(name)
+	if err != nil {
+		return err
+	}
+	err = realm.drain(ctx)
+	r.log.Println("Realm", name, "was removed and completed shutdown")
 	return err
 }
 
-// RemoveRealm will close and then remove a realm from this router, if the realm exists.
-func (r *router) RemoveRealm(name wamp.URI) {
+// takeRealm removes the named realm from this router, so that no new clients
+// can join it, and returns the realm.
+func (r *router) takeRealm(name wamp.URI) (*realm, error) {
 	// Because we want to force atomicity as briefly as possible, the atomic
 	// func will be used purely to attempt to locate the realm
 	var realm *realm
-	var ok bool
+	var err error
 	sync := make(chan struct{})
-	r.actionChan <- func() {
+	if !r.submit(func() {
+		if r.closed {
+			err = errRouterClosed
+			close(sync)
+			return
+		}
+		var ok bool
 		if realm, ok = r.realms[name]; ok {
 			// if found, go ahead and remove the realm from the router to
 			// prevent new clients from joining it.
 			delete(r.realms, name)
+			delete(r.autoRealms, name)
 			r.log.Printf("Removed realm: %s", name)
+		} else {
+			err = fmt.Errorf("no realm \"%s\" exists on this router",
+				string(name))
 		}
 		close(sync)
+	}) {
+		return nil, errRouterClosed
 	}
 	// wait until the atomic func has completed
 	<-sync
-	// if the realm was found within the router, close it outside of the atomic
-	// func while still blocking the caller
-	if ok {
-		realm.close()
-		r.log.Println("Realm", name, "was removed and completed shutdown")
+	if err != nil {
+		return nil, err
+	}
+	return realm, nil
+}
+
+// ListRealms returns the URIs of all realms on this router.  The returned slice
+// is a copy that is safe to use after the router's realms change.  The order of
+// the URIs is not defined.  If the router is closed, then nil is returned.
+func (r *router) ListRealms() []wamp.URI {
+	var uris []wamp.URI
+	sync := make(chan struct{})
+	if !r.submit(func() {
+		uris = make([]wamp.URI, 0, len(r.realms))
+		for uri := range r.realms {
+			uris = append(uris, uri)
+		}
+		close(sync)
+	}) {
+		return nil
+	}
+	<-sync
+	return uris
+}
+
+// GetRealm returns the named realm if it exists on this router.  If the
+// router is closed, then false is returned.
+func (r *router) GetRealm(name wamp.URI) (Realm, bool) {
+	var realm *realm
+	sync := make(chan struct{})
+	if !r.submit(func() {
+		realm = r.realms[name]
+		close(sync)
+	}) {
+		return nil, false
+	}
+	<-sync
+	if realm == nil {
+		return nil, false
+	}
+	return realm, true
+}
+
+// RealmStats returns a snapshot of the statistics for the named realm.
+func (r *router) RealmStats(name wamp.URI) (RealmStats, error) {
+	var realm *realm
+	sync := make(chan struct{})
+	if !r.submit(func() {
+		realm = r.realms[name]
+		close(sync)
+	}) {
+		return RealmStats{}, errRouterClosed
+	}
+	<-sync
+	if realm == nil {
+		return RealmStats{}, fmt.Errorf("no realm \"%s\" exists on this router",
+			string(name))
 	}
+	return realm.Stats(), nil
 }
 
 // addRealm attempts to create and add a realm to this router.
@@ -355,14 +1000,49 @@ func (r *router) addRealm(config *RealmConfig) (*realm, error) {
 		return nil, errors.New("realm already exists: " + string(config.URI))
 	}
 
-	realm, err := newRealm(
-		config,
-		newBroker(r.log, config.StrictURI, config.AllowDisclose, r.debug, config.PublishFilterFactory),
-		newDealer(r.log, config.StrictURI, config.AllowDisclose, r.debug),
-		r.log, r.debug)
+	// Disclosure policies override AllowDisclose for the broker and dealer.
+	if err := checkDisclosePolicies(config); err != nil {
+		return nil, err
+	}
+	if err := checkOutQueuePolicy(config.OutQueuePolicy); err != nil {
+		return nil, err
+	}
+	allowPubDisclose, forcePubDisclose := disclosePolicy(config.AllowDisclose, config.DisclosePublisher)
+	allowCallerDisclose, forceCallerDisclose := disclosePolicy(config.AllowDisclose, config.DiscloseCaller)
+
+	// The realm's context is created here, so that the dealer and the
+	// broker's fan-out workers can watch it.
+	ctx, cancel := context.WithCancel(r.ctx)
+	broker := newBroker(r.log, config.StrictURI, allowPubDisclose, forcePubDisclose, r.debug, config.PublishFilterFactory, config.RetainEvents)
+	dealer := newDealer(ctx, r.log, config.StrictURI, allowCallerDisclose, forceCallerDisclose, r.debug, config.MaxCallTimeout)
+	realm, err := newRealm(ctx, cancel, config, broker, dealer, r.log, r.debug)
 	if err != nil {
+		cancel()
+		broker.close()
+		dealer.close()
 		return nil, err
 	}
+	realm.events = r.events
+	realm.handler = chainMiddleware(realm.routeMessage, r.middleware)
+	realm.deadLetters = newDeadLetters(config.DeadLetterHandler, r.log)
+	broker.deadLetters = realm.deadLetters
+	dealer.deadLetters = realm.deadLetters
+	broker.tracer = config.Tracer
+	dealer.tracer = config.Tracer
+	dealer.clock = r.clock
+	realm.clock = r.clock
+	broker.subQuota = newRoleQuota(config.AuthroleQuotas, func(q Quota) int {
+		return q.MaxSubscriptions
+	})
+	dealer.regQuota = newRoleQuota(config.AuthroleQuotas, func(q Quota) int {
+		return q.MaxRegistrations
+	})
+	broker.fanout = newFanout(ctx, config.PublishWorkers)
+	broker.pubIDGen = r.idGenerator
+	if r.maxSessions > 0 {
+		realm.sessionEnded = r.releaseSession
+	}
+	realm.removeFromRouter = func() { r.dropRealm(realm) }
 	r.realms[config.URI] = realm
 
 	r.waitRealms.Add(1)
@@ -372,13 +1052,62 @@ func (r *router) addRealm(config *RealmConfig) (*realm, error) {
 	}()
 
 	realm.waitReady()
+	if realm.metrics != nil {
+		realm.metrics.publish(realm.uri)
+	}
 	r.log.Println("Added realm:", config.URI)
 	return realm, nil
 }
 
+// dropRealm removes the realm from this router, if it has not already been
+// removed or replaced, so that no new clients can join it.  The realm is not
+// closed.
+func (r *router) dropRealm(realm *realm) {
+	sync := make(chan struct{})
+	if !r.submit(func() {
+		if r.realms[realm.uri] == realm {
+			delete(r.realms, realm.uri)
+			delete(r.autoRealms, realm.uri)
+			r.log.Printf("Removed realm: %s", realm.uri)
+		}
+		close(sync)
+	}) {
+		return
+	}
+	<-sync
+}
+
+// releaseSession frees the session slot held by a session that has ended or
+// that failed to attach.
+//
+// This is called by realms while the router goroutine may be waiting for the
+// realm to close, so the slot is released asynchronously.  If the router has
+// stopped, then there is no slot to release.
+func (r *router) releaseSession() {
+	go r.submit(func() {
+		r.sessionCount--
+	})
+}
+
+// submit sends an action to the router goroutine.  If the router has already
+// stopped, then the action is not run and false is returned.
+func (r *router) submit(action func()) bool {
+	select {
+	case r.actionChan <- action:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
 // Single goroutine used to safely access router data.
 func (r *router) run() {
-	for action := range r.actionChan {
-		action()
+	for {
+		select {
+		case action := <-r.actionChan:
+			action()
+		case <-r.done:
+			return
+		}
 	}
 }
@@ -1,15 +1,23 @@
 package router
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/fortytw2/leaktest"
+	"github.com/gammazero/nexus/router/auth"
 	"github.com/gammazero/nexus/stdlog"
 	"github.com/gammazero/nexus/transport"
+	"github.com/gammazero/nexus/transport/serialize"
 	"github.com/gammazero/nexus/wamp"
 )
 
@@ -124,279 +132,515 @@ func TestHandshake(t *testing.T) {
 	if err != nil {
 		t.Fatal("no goodbye message after sending goodbye:", err)
 	}
-	if _, ok := msg.(*wamp.Goodbye); !ok {
+	goodbye, ok := msg.(*wamp.Goodbye)
+	if !ok {
 		t.Fatal("expected GOODBYE, received:", msg.MessageType())
 	}
+	if goodbye.Reason != wamp.ErrGoodbyeAndOut {
+		t.Fatal("expected reason", wamp.ErrGoodbyeAndOut, "got", goodbye.Reason)
+	}
+
+	// Router closes the session after replying.
+	if msg, err = wamp.RecvTimeout(cli, time.Second); err == nil {
+		t.Fatal("expected session to be closed, received:", msg.MessageType())
+	}
 }
 
-func TestHandshakeBadRealm(t *testing.T) {
+func TestWelcomeDecorator(t *testing.T) {
 	defer leaktest.Check(t)()
-	r, err := newTestRouter()
+	var decoratedID wamp.ID
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				WelcomeDecorator: func(sess *wamp.Session, details wamp.Dict) wamp.Dict {
+					decoratedID = sess.ID
+					details["x_node"] = "node-1"
+					return details
+				},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	defer r.Close()
 
-	client, server := transport.LinkedPeers()
-	go client.Send(&wamp.Hello{Realm: "does.not.exist"})
-	err = r.Attach(server)
-	if err == nil {
-		t.Fatal("expected error")
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if node, _ := wamp.AsString(cli.Details["x_node"]); node != "node-1" {
+		t.Fatal("WELCOME missing custom details:", cli.Details)
+	}
+	if _, ok := cli.Details["roles"]; !ok {
+		t.Fatal("WELCOME missing roles")
+	}
+	if decoratedID != cli.ID {
+		t.Fatal("decorator called with wrong session")
 	}
 
-	msg, err := wamp.RecvTimeout(client, time.Second)
+	// Session details are not changed by the decorator.
+	sess, err := r.AttachWithSession(func() wamp.Peer {
+		client, server := transport.LinkedPeers()
+		go func() {
+			client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+			wamp.RecvTimeout(client, time.Second)
+			client.Close()
+		}()
+		return server
+	}())
 	if err != nil {
-		t.Fatal("timed out waiting for response to HELLO")
+		t.Fatal(err)
 	}
-	if _, ok := msg.(*wamp.Abort); !ok {
-		t.Error("Expected ABORT after bad handshake")
+	if _, ok := sess.Details["x_node"]; ok {
+		t.Fatal("decorator changed session details")
 	}
 }
 
-// Test sending a
-func TestProtocolViolation(t *testing.T) {
+func TestWelcomeFeatures(t *testing.T) {
 	defer leaktest.Check(t)()
-	r, err := newTestRouter()
+	const otherRealm = wamp.URI("nexus.test.other")
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+			},
+			{
+				URI:            otherRealm,
+				AnonymousAuth:  true,
+				AllowDisclose:  true,
+				RetainEvents:   5,
+				DisableMetaAPI: true,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer r.Close()
-	cli, err := testClient(r)
+
+	features := func(realm wamp.URI) (brokerFeatures, dealerFeatures wamp.Dict) {
+		cli, err := testClientInRealm(r, realm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		roles, _ := wamp.AsDict(cli.Details["roles"])
+		for role, dst := range map[string]*wamp.Dict{"broker": &brokerFeatures, "dealer": &dealerFeatures} {
+			roleDict, ok := wamp.AsDict(roles[role])
+			if !ok {
+				t.Fatal("WELCOME does not advertise role", role)
+			}
+			if *dst, ok = wamp.AsDict(roleDict["features"]); !ok {
+				t.Fatal("WELCOME does not advertise features for role", role)
+			}
+		}
+		return
+	}
+	check := func(features wamp.Dict, feature string, want bool) {
+		if _, ok := features[feature]; ok != want {
+			t.Errorf("feature %s advertised: %v, expected: %v", feature, ok, want)
+		}
+	}
+
+	brokerFeatures, dealerFeatures := features(testRealm)
+	check(brokerFeatures, featurePatternSub, true)
+	check(brokerFeatures, featurePubExclusion, true)
+	check(brokerFeatures, featurePubIdent, false)
+	check(brokerFeatures, featureEventRetention, false)
+	check(brokerFeatures, featureSubMetaAPI, true)
+	check(dealerFeatures, featureProgCallResults, true)
+	check(dealerFeatures, featureCallerIdent, false)
+	check(dealerFeatures, featureRegMetaAPI, true)
+	check(dealerFeatures, featureSessionMetaAPI, true)
+
+	brokerFeatures, dealerFeatures = features(otherRealm)
+	check(brokerFeatures, featurePatternSub, true)
+	check(brokerFeatures, featurePubIdent, true)
+	check(brokerFeatures, featureEventRetention, true)
+	check(brokerFeatures, featureSubMetaAPI, false)
+	check(brokerFeatures, featureSessionMetaAPI, false)
+	check(dealerFeatures, featureCallerIdent, true)
+	check(dealerFeatures, featureRegMetaAPI, false)
+	check(dealerFeatures, featureTestamentMetaAPI, false)
+}
+
+func TestAttachWithSession(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer r.Close()
 
-	// Send HELLO message after session established.
-	cli.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
-	msg, err := wamp.RecvTimeout(cli, time.Second)
+	client, server := transport.LinkedPeers()
+	defer client.Close()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	sess, err := r.AttachWithSession(server)
 	if err != nil {
-		t.Fatal("timed out waiting for ABORT")
+		t.Fatal(err)
 	}
-	abort, ok := msg.(*wamp.Abort)
+	msg, err := wamp.RecvTimeout(client, time.Second)
+	if err != nil {
+		t.Fatal("error waiting for welcome:", err)
+	}
+	welcome, ok := msg.(*wamp.Welcome)
 	if !ok {
-		t.Fatal("expected ABORT, received:", msg.MessageType())
+		t.Fatal("expected WELCOME, got", msg.MessageType())
 	}
-	if abort.Reason != wamp.ErrProtocolViolation {
-		t.Fatal("Expected reason to be", wamp.ErrProtocolViolation)
+	if sess.ID != welcome.ID {
+		t.Fatal("session ID", sess.ID, "does not match WELCOME ID", welcome.ID)
 	}
-
-	// Send SUBSCRIBE before session established.
-	client, server := transport.LinkedPeers()
-	// Run as goroutine since Send will block until message read by router, if
-	// client uses unbuffered channel.
-	go client.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: wamp.URI("some.uri")})
-	if err = r.Attach(server); err == nil {
-		t.Fatal("Expected error from Attach")
+	if sid, _ := wamp.AsID(sess.Details["session"]); sid != welcome.ID {
+		t.Fatal("wrong session ID in details:", sess.Details["session"])
 	}
 
-	msg, err = wamp.RecvTimeout(client, time.Second)
-	if err != nil {
-		t.Fatal("timed out waiting for ABORT")
+	rlm, _ := r.GetRealm(testRealm)
+	if _, _, ok = rlm.SessionResources(sess.ID); !ok {
+		t.Fatal("session not found in realm")
 	}
-	abort, ok = msg.(*wamp.Abort)
+
+	// The returned session is a copy, without the router's peer, so changing
+	// it does not change the router's session.
+	if sess.Peer != nil {
+		t.Fatal("returned session has the router's peer")
+	}
+	authrole := sess.Details["authrole"]
+	sess.Details["authrole"] = "changed"
+	rsp := rlm.(*realm).sessionGet(&wamp.Invocation{
+		Request:   1,
+		Arguments: wamp.List{sess.ID},
+	})
+	yield, ok := rsp.(*wamp.Yield)
 	if !ok {
-		t.Fatal("expected ABORT, received:", msg.MessageType())
+		t.Fatal("expected YIELD, got", rsp.MessageType())
 	}
-	if abort.Reason != wamp.ErrProtocolViolation {
-		t.Fatal("Expected reason to be", wamp.ErrProtocolViolation)
+	details, _ := wamp.AsDict(yield.Arguments[0])
+	if details["authrole"] != authrole {
+		t.Fatal("router's session details changed:", details["authrole"])
 	}
 }
 
-func TestRouterSubscribe(t *testing.T) {
+func TestAttachSessionRoles(t *testing.T) {
 	defer leaktest.Check(t)()
 	r, err := newTestRouter()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	defer r.Close()
 
-	sub, err := testClient(r)
+	cli, err := testClient(r)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer cli.Close()
 
-	subscribeID := wamp.GlobalID()
-	sub.Send(&wamp.Subscribe{Request: subscribeID, Topic: testTopic})
-	msg, err := wamp.RecvTimeout(sub, time.Second)
-	if err != nil {
-		t.Fatal("Timed out waiting for SUBSCRIBED")
-	}
-	subMsg, ok := msg.(*wamp.Subscribed)
+	// Get the router side of the attached session.
+	rlm, ok := r.GetRealm(testRealm)
 	if !ok {
-		t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+		t.Fatal("did not find realm", testRealm)
 	}
-	if subMsg.Request != subscribeID {
-		t.Fatal("wrong request ID")
+	var sess *wamp.Session
+	sync := make(chan struct{})
+	rlm.(*realm).actionChan <- func() {
+		sess = rlm.(*realm).clients[cli.ID]
+		close(sync)
 	}
-	subscriptionID := subMsg.Subscription
-
-	pub, err := testClient(r)
-	if err != nil {
-		t.Fatal(err)
+	<-sync
+	if sess == nil {
+		t.Fatal("session not found in realm")
 	}
-	pubID := wamp.GlobalID()
-	pub.Send(&wamp.Publish{Request: pubID, Topic: testTopic})
 
-	msg, err = wamp.RecvTimeout(sub, time.Second)
-	if err != nil {
-		t.Fatal("Timed out waiting for EVENT")
+	if !sess.HasRole("subscriber") {
+		t.Error("session does not have subscriber role")
 	}
-	event, ok := msg.(*wamp.Event)
-	if !ok {
-		t.Fatal("Expected EVENT, got:", msg.MessageType())
+	if !sess.HasFeature("subscriber", "publisher_identification") {
+		t.Error("session does not have publisher_identification feature")
 	}
-	if event.Subscription != subscriptionID {
-		t.Fatal("wrong subscription ID")
+	if !sess.HasFeature("caller", "call_timeout") {
+		t.Error("session does not have call_timeout feature")
+	}
+	if sess.HasRole("broker") {
+		t.Error("session should not have broker role")
 	}
 }
 
-func TestPublishAcknowledge(t *testing.T) {
+func TestAttachLocal(t *testing.T) {
 	defer leaktest.Check(t)()
-	r, err := newTestRouter()
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:              testRealm,
+				RequireLocalAuth: true,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	defer r.Close()
-	client, err := testClient(r)
+
+	// Local client is welcomed with the given authrole, even though the
+	// realm requires local clients to authenticate.
+	client, server := transport.LinkedPeers()
+	defer client.Close()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	sess, err := r.AttachLocal(server, "service")
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	id := wamp.GlobalID()
-	client.Send(&wamp.Publish{
-		Request: id,
-		Options: wamp.Dict{"acknowledge": true},
-		Topic:   "some.uri"})
-
 	msg, err := wamp.RecvTimeout(client, time.Second)
 	if err != nil {
-		t.Fatal("sent acknowledge=true, timed out waiting for PUBLISHED")
+		t.Fatal("error waiting for welcome:", err)
 	}
-	pub, ok := msg.(*wamp.Published)
+	welcome, ok := msg.(*wamp.Welcome)
 	if !ok {
-		t.Fatal("sent acknowledge=true, expected PUBLISHED, got:",
-			msg.MessageType())
+		t.Fatal("expected WELCOME, got", msg.MessageType())
 	}
-	if pub.Request != id {
-		t.Fatal("wrong request id")
+	if authrole, _ := wamp.AsString(welcome.Details["authrole"]); authrole != "service" {
+		t.Fatal("wrong authrole in WELCOME:", welcome.Details["authrole"])
+	}
+	if sess.ID != welcome.ID {
+		t.Fatal("wrong session ID")
+	}
+
+	// A peer that is not local cannot be attached this way.
+	client, server = transport.LinkedPeers()
+	defer client.Close()
+	if _, err = r.AttachLocal(&addrPeer{server, "10.0.0.1:1234"}, ""); err != errNotLocalPeer {
+		t.Fatal("expected error", errNotLocalPeer, "got", err)
 	}
 }
 
-func TestPublishFalseAcknowledge(t *testing.T) {
+// addrPeer is a peer that reports a remote address.
+type addrPeer struct {
+	wamp.Peer
+	addr string
+}
+
+func (p *addrPeer) RemoteAddr() string { return p.addr }
+
+func TestAttachRemoteAddr(t *testing.T) {
+	defer leaktest.Check(t)()
 	r, err := newTestRouter()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	defer r.Close()
-	client, err := testClient(r)
+
+	client, server := transport.LinkedPeers()
+	defer client.Close()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	if err = r.Attach(&addrPeer{server, "10.0.0.1:4321"}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := wamp.RecvTimeout(client, time.Second)
 	if err != nil {
 		t.Fatal(err)
 	}
+	welcome, ok := msg.(*wamp.Welcome)
+	if !ok {
+		t.Fatal("expected WELCOME, got", msg.MessageType())
+	}
 
-	id := wamp.GlobalID()
-	client.Send(&wamp.Publish{
-		Request: id,
-		Options: wamp.Dict{"acknowledge": false},
-		Topic:   "some.uri"})
+	rlm, _ := r.GetRealm(testRealm)
+	var sess *wamp.Session
+	sync := make(chan struct{})
+	rlm.(*realm).actionChan <- func() {
+		sess = rlm.(*realm).clients[welcome.ID]
+		close(sync)
+	}
+	<-sync
+	if sess == nil {
+		t.Fatal("session not found in realm")
+	}
+	transportDetails, _ := wamp.AsDict(sess.Details["transport"])
+	if addr, _ := wamp.AsString(transportDetails["peer"]); addr != "10.0.0.1:4321" {
+		t.Fatal("remote address not in transport details:", sess.Details["transport"])
+	}
+	if label := sessionLabel(sess); label != sess.String()+" (10.0.0.1:4321)" {
+		t.Fatal("wrong session label:", label)
+	}
+}
 
-	msg, err := wamp.RecvTimeout(client, 200*time.Millisecond)
-	if err == nil {
-		if _, ok := msg.(*wamp.Published); ok {
-			t.Fatal("Sent acknowledge=false, but received PUBLISHED:",
-				msg.MessageType())
+func TestRouterLoggers(t *testing.T) {
+	defer leaktest.Check(t)()
+	uris := []wamp.URI{"nexus.test.logger.alpha", "nexus.test.logger.beta"}
+	bufs := make([]*bytes.Buffer, len(uris))
+	for i, uri := range uris {
+		bufs[i] = &bytes.Buffer{}
+		config := &Config{
+			RealmConfigs: []*RealmConfig{{URI: uri}},
+			Debug:        debug,
+		}
+		r, err := NewRouter(config, log.New(bufs[i], "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Logger() == logger {
+			t.Fatal("router is not using its own logger")
+		}
+		r.Close()
+	}
+
+	for i, uri := range uris {
+		out := bufs[i].String()
+		if !strings.Contains(out, "Added realm: "+string(uri)) {
+			t.Errorf("router %d did not log to its logger: %q", i, out)
+		}
+		other := uris[(i+1)%len(uris)]
+		if strings.Contains(out, string(other)) {
+			t.Errorf("router %d logger received output from other router: %q", i, out)
 		}
 	}
 }
 
-func TestPublishNoAcknowledge(t *testing.T) {
-	r, err := newTestRouter()
+// leveledLogger records messages logged at each level.
+type leveledLogger struct {
+	sync.Mutex
+	levels map[string][]string
+}
+
+func (l *leveledLogger) log(level string, v ...interface{}) {
+	l.Lock()
+	l.levels[level] = append(l.levels[level], fmt.Sprint(v...))
+	l.Unlock()
+}
+
+func (l *leveledLogger) Print(v ...interface{})   { l.log("print", v...) }
+func (l *leveledLogger) Println(v ...interface{}) { l.log("print", v...) }
+func (l *leveledLogger) Printf(format string, v ...interface{}) {
+	l.log("print", fmt.Sprintf(format, v...))
+}
+func (l *leveledLogger) Debug(v ...interface{}) { l.log("debug", v...) }
+func (l *leveledLogger) Info(v ...interface{})  { l.log("info", v...) }
+func (l *leveledLogger) Warn(v ...interface{})  { l.log("warn", v...) }
+func (l *leveledLogger) Error(v ...interface{}) { l.log("error", v...) }
+
+func (l *leveledLogger) find(level, text string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, line := range l.levels[level] {
+		if strings.Contains(line, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLeveledLogger(t *testing.T) {
+	defer leaktest.Check(t)()
+	ll := &leveledLogger{levels: map[string][]string{}}
+	config := &Config{
+		RealmConfigs: []*RealmConfig{{URI: testRealm}},
+		Debug:        true,
+	}
+	r, err := NewRouter(config, ll)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	defer r.Close()
-	client, err := testClient(r)
+	cli, err := testClient(r)
 	if err != nil {
 		t.Fatal(err)
 	}
+	cli.Close()
+	r.Close()
 
-	id := wamp.GlobalID()
-	client.Send(&wamp.Publish{Request: id, Topic: "some.uri"})
-	msg, err := wamp.RecvTimeout(client, 200*time.Millisecond)
-	if err == nil {
-		if _, ok := msg.(*wamp.Published); ok {
-			t.Fatal("Sent acknowledge=false, but received PUBLISHED:",
-				msg.MessageType())
-		}
+	created := fmt.Sprint("Created session: ", cli.ID)
+	if !ll.find("debug", created) {
+		t.Error("debug output not logged at debug level")
+	}
+	if ll.find("print", created) {
+		t.Error("debug output logged with Print")
+	}
+	if !ll.find("print", "Starting router") {
+		t.Error("non-debug output not logged with Print")
 	}
 }
 
-func TestRouterCall(t *testing.T) {
+func TestAttachTransportDetails(t *testing.T) {
 	defer leaktest.Check(t)()
 	r, err := newTestRouter()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	defer r.Close()
-	callee, err := testClient(r)
+
+	const peerAddr = "203.0.113.5:4321"
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: wamp.Dict{"roles": clientRoles["roles"]}})
+	err = r.AttachClient(server, wamp.Dict{
+		"type":                  "test",
+		"peer":                  peerAddr,
+		"http_headers_received": wamp.Dict{"authorization": "secret"},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	registerID := wamp.GlobalID()
-	// Register remote procedure
-	callee.Send(&wamp.Register{Request: registerID, Procedure: testProcedure})
-
-	msg, err := wamp.RecvTimeout(callee, time.Second)
+	msg, err := wamp.RecvTimeout(client, time.Second)
 	if err != nil {
-		t.Fatal("Timed out waiting for REGISTERED")
+		t.Fatal(err)
 	}
-	registered, ok := msg.(*wamp.Registered)
+	welcome, ok := msg.(*wamp.Welcome)
 	if !ok {
-		t.Fatal("expected REGISTERED,got:", msg.MessageType())
+		t.Fatal("expected WELCOME, got", msg.MessageType())
 	}
-	if registered.Request != registerID {
-		t.Fatal("wrong request ID")
-	}
-	registrationID := registered.Registration
+	defer client.Close()
 
-	caller, err := testClient(r)
-	if err != nil {
-		t.Fatal("Error connecting caller:", err)
+	// Check the transport details in the router side of the session.
+	rlm, _ := r.GetRealm(testRealm)
+	var sess *wamp.Session
+	sync := make(chan struct{})
+	rlm.(*realm).actionChan <- func() {
+		sess = rlm.(*realm).clients[welcome.ID]
+		close(sync)
 	}
-	callID := wamp.GlobalID()
-	// Call remote procedure
-	caller.Send(&wamp.Call{Request: callID, Procedure: testProcedure})
-
-	msg, err = wamp.RecvTimeout(callee, time.Second)
-	if err != nil {
-		t.Fatal("Timed out waiting for INVOCATION")
+	<-sync
+	if sess == nil {
+		t.Fatal("session not found in realm")
 	}
-	invocation, ok := msg.(*wamp.Invocation)
-	if !ok {
-		t.Fatal("expected INVOCATION, got:", msg.MessageType())
+	transDict := wamp.DictChild(sess.Details, "transport")
+	if peer, _ := wamp.AsString(transDict["peer"]); peer != peerAddr {
+		t.Fatal("wrong transport peer:", transDict["peer"])
 	}
-	if invocation.Registration != registrationID {
-		t.Fatal("wrong registration id")
+	if wamp.DictChild(transDict, "http_headers_received") == nil {
+		t.Fatal("missing HTTP headers from transport details")
 	}
-	invocationID := invocation.Request
 
-	// Returns result of remove procedure
-	callee.Send(&wamp.Yield{Request: invocationID})
-
-	msg, err = wamp.RecvTimeout(caller, time.Second)
-	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
+	// Check that HTTP headers are not exposed through session meta API.
+	client.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSessionGet,
+		Arguments: wamp.List{welcome.ID},
+	})
+	if msg, err = wamp.RecvTimeout(client, time.Second); err != nil {
+		t.Fatal(err)
 	}
 	result, ok := msg.(*wamp.Result)
 	if !ok {
 		t.Fatal("expected RESULT, got", msg.MessageType())
 	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+	details, _ := wamp.AsDict(result.Arguments[0])
+	transDict = wamp.DictChild(details, "transport")
+	if peer, _ := wamp.AsString(transDict["peer"]); peer != peerAddr {
+		t.Fatal("wrong transport peer in session meta:", transDict["peer"])
+	}
+	if _, ok = transDict["http_headers_received"]; ok {
+		t.Fatal("session meta exposed HTTP headers")
 	}
 }
 
-func TestSessionCountMetaProcedure(t *testing.T) {
+func TestHandshakeBadRealm(t *testing.T) {
 	defer leaktest.Check(t)()
 	r, err := newTestRouter()
 	if err != nil {
@@ -404,535 +648,797 @@ func TestSessionCountMetaProcedure(t *testing.T) {
 	}
 	defer r.Close()
 
-	caller, err := testClient(r)
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: "does.not.exist"})
+	err = r.Attach(server)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	msg, err := wamp.RecvTimeout(client, time.Second)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatal("timed out waiting for response to HELLO")
+	}
+	if _, ok := msg.(*wamp.Abort); !ok {
+		t.Error("Expected ABORT after bad handshake")
 	}
+}
 
-	// Call wamp.MetaProcSessionCount
-	req := &wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionCount}
-	caller.Send(req)
-	msg, err := wamp.RecvTimeout(caller, time.Second)
+func TestAnonymousAuth(t *testing.T) {
+	defer leaktest.Check(t)()
+	// Local clients must authenticate so that anonymous auth is checked.
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:              testRealm,
+				RequireLocalAuth: true,
+			},
+			{
+				URI:              testRealm2,
+				RequireLocalAuth: true,
+				AnonymousAuth:    true,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
-	result, ok := msg.(*wamp.Result)
-	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
-	}
-	if result.Request != req.Request {
-		t.Fatal("wrong result ID")
+	defer r.Close()
+
+	roles := wamp.Dict{"roles": clientRoles["roles"]}
+
+	// Anonymous rejected when not allowed.
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: roles})
+	if err = r.Attach(server); err == nil {
+		t.Fatal("expected error")
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	msg, err := wamp.RecvTimeout(client, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for response to HELLO")
 	}
-	count, ok := result.Arguments[0].(int)
+	abort, ok := msg.(*wamp.Abort)
 	if !ok {
-		t.Fatal("expected int arguemnt")
+		t.Fatal("expected ABORT, got", msg.MessageType())
 	}
-	if count != 1 {
-		t.Fatal("wrong session count")
+	if abort.Reason != wamp.ErrAuthenticationFailed {
+		t.Fatal("wrong ABORT reason:", abort.Reason)
 	}
 
-	// Call wamp.MetaProcSessionCount with invalid argument
-	req = &wamp.Call{
-		Request:   wamp.GlobalID(),
-		Procedure: wamp.MetaProcSessionCount,
-		Arguments: wamp.List{"should-be-a-list"},
-	}
-	caller.Send(req)
-	msg, err = wamp.RecvTimeout(caller, time.Second)
-	if err != nil {
+	// Anonymous accepted when allowed.
+	client, server = transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: testRealm2, Details: roles})
+	if err = r.Attach(server); err != nil {
 		t.Fatal(err)
 	}
-	errResult, ok := msg.(*wamp.Error)
+	if msg, err = wamp.RecvTimeout(client, time.Second); err != nil {
+		t.Fatal("timed out waiting for response to HELLO")
+	}
+	welcome, ok := msg.(*wamp.Welcome)
 	if !ok {
-		t.Fatal("expected ERROR, got", msg.MessageType())
+		t.Fatal("expected WELCOME, got", msg.MessageType())
 	}
-	if errResult.Request != req.Request {
-		t.Fatal("wrong result ID")
+	if authrole, _ := wamp.AsString(welcome.Details["authrole"]); authrole != "anonymous" {
+		t.Fatal("expected anonymous authrole, got", authrole)
 	}
+	client.Close()
+}
 
-	// Call wamp.MetaProcSessionCount with non-matching filter
-	filter := wamp.List{"user", "def"}
-	req = &wamp.Call{
-		Request:   wamp.GlobalID(),
-		Procedure: wamp.MetaProcSessionCount,
-		Arguments: wamp.List{filter},
+func TestHelloTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+	helloTimeout := 50 * time.Millisecond
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+			},
+		},
+		HelloTimeout: &helloTimeout,
+		Debug:        debug,
 	}
-	caller.Send(req)
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+	r, err := NewRouter(config, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
-	result, ok = msg.(*wamp.Result)
-	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
-	}
-	if result.Request != req.Request {
-		t.Fatal("wrong result ID")
-	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	defer r.Close()
+
+	// Client never sends HELLO, so Attach must give up after the timeout.
+	_, server := transport.LinkedPeers()
+	start := time.Now()
+	if err = r.Attach(server); err == nil {
+		t.Fatal("expected error when no HELLO sent")
 	}
-	count = result.Arguments[0].(int)
-	if count != 0 {
-		t.Fatal("wrong session count")
+	if time.Since(start) > time.Second {
+		t.Fatal("Attach did not use configured hello timeout")
 	}
 
-	// Call wamp.MetaProcSessionCount with matching filter
-	filter = wamp.List{"trusted", "user", "def"}
-	req = &wamp.Call{
-		Request:   wamp.GlobalID(),
-		Procedure: wamp.MetaProcSessionCount,
-		Arguments: wamp.List{filter},
+	// Zero or negative timeout waits indefinitely for HELLO.
+	for _, helloTimeout = range []time.Duration{0, -1} {
+		r2, err := NewRouter(config, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r2.Close()
+
+		client, server := transport.LinkedPeers()
+		errChan := make(chan error)
+		go func() { errChan <- r2.Attach(server) }()
+		select {
+		case err = <-errChan:
+			t.Fatal("Attach returned before HELLO sent:", err)
+		case <-time.After(200 * time.Millisecond):
+		}
+		client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+		if err = <-errChan; err != nil {
+			t.Fatal(err)
+		}
+		msg, err := wamp.RecvTimeout(client, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := msg.(*wamp.Welcome); !ok {
+			t.Fatal("expected WELCOME, received:", msg.MessageType())
+		}
 	}
-	caller.Send(req)
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+
+	// Without a configured timeout, the default is used.
+	config.HelloTimeout = nil
+	r3, err := NewRouter(config, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
-	result, ok = msg.(*wamp.Result)
-	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
-	}
-	if result.Request != req.Request {
-		t.Fatal("wrong result ID")
-	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
-	}
-	count = result.Arguments[0].(int)
-	if count != 1 {
-		t.Fatal("wrong session count")
+	defer r3.Close()
+	if timeout := r3.(*router).helloTimeout; timeout != defaultHelloTimeout {
+		t.Fatal("expected default hello timeout, got", timeout)
 	}
 }
 
-func TestListSessionMetaProcedures(t *testing.T) {
+func TestAttachContext(t *testing.T) {
 	defer leaktest.Check(t)()
 	r, err := newTestRouter()
-	if err != nil {
-		t.Error(err)
-	}
-	defer r.Close()
-
-	caller, err := testClient(r)
 	if err != nil {
 		t.Fatal(err)
 	}
-	sessID := caller.ID
+	defer r.Close()
 
-	// Call wamp.MetaProcSessionList to get session list.
-	req := &wamp.Call{
-		Request:   wamp.GlobalID(),
-		Procedure: wamp.MetaProcSessionList,
+	// Cancel the context while the router is waiting for HELLO.
+	client, server := transport.LinkedPeers()
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error)
+	go func() { errChan <- r.AttachContext(ctx, server) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err = <-errChan:
+		if err != context.Canceled {
+			t.Fatal("expected context.Canceled, got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("AttachContext did not return after cancel")
 	}
-	caller.Send(req)
-	msg, err := wamp.RecvTimeout(caller, time.Second)
+	msg, err := wamp.RecvTimeout(client, time.Second)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatal("timed out waiting for ABORT")
 	}
-	result, ok := msg.(*wamp.Result)
+	abort, ok := msg.(*wamp.Abort)
 	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
-	}
-	if result.Request != req.Request {
-		t.Fatal("wrong result ID")
+		t.Fatal("expected ABORT, received:", msg.MessageType())
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	if abort.Reason != wamp.ErrCanceled {
+		t.Fatal("wrong ABORT reason:", abort.Reason)
 	}
-	ids, ok := result.Arguments[0].([]wamp.ID)
-	if !ok {
-		t.Fatal("wrong arg type")
+
+	// Uncanceled context attaches normally.
+	client, server = transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	if err = r.AttachContext(context.Background(), server); err != nil {
+		t.Fatal(err)
 	}
-	if len(ids) != 1 {
-		t.Fatal("wrong number of session IDs")
+	msg, err = wamp.RecvTimeout(client, time.Second)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if sessID != ids[0] {
-		t.Fatal("wrong session ID")
+	if _, ok = msg.(*wamp.Welcome); !ok {
+		t.Fatal("expected WELCOME, received:", msg.MessageType())
 	}
+}
 
-	// Call wamp.MetaProcSessionList with matching filter
-	filter := wamp.List{"trusted"}
-	req = &wamp.Call{
-		Request:   wamp.GlobalID(),
-		Procedure: wamp.MetaProcSessionList,
-		Arguments: wamp.List{filter},
+func TestHelloInterceptor(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+			},
+		},
+		HelloInterceptor: func(peer wamp.Peer, hello *wamp.Hello) error {
+			if authid, _ := wamp.AsString(hello.Details["authid"]); authid == "banned" {
+				return fmt.Errorf("client %s not allowed", authid)
+			}
+			return nil
+		},
+		Debug: debug,
 	}
-	caller.Send(req)
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+	r, err := NewRouter(config, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
-	result, ok = msg.(*wamp.Result)
-	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
-	}
-	if result.Request != req.Request {
-		t.Fatal("wrong result ID")
+	defer r.Close()
+
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{
+		Realm: testRealm,
+		Details: wamp.Dict{
+			"authid": "banned",
+			"roles":  wamp.Dict{"subscriber": wamp.Dict{}},
+		},
+	})
+	if err = r.Attach(server); err == nil {
+		t.Fatal("expected error from rejected HELLO")
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	msg, err := wamp.RecvTimeout(client, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for ABORT")
 	}
-	ids, ok = result.Arguments[0].([]wamp.ID)
+	abort, ok := msg.(*wamp.Abort)
 	if !ok {
-		t.Fatal("wrong arg type")
+		t.Fatal("expected ABORT, received:", msg.MessageType())
 	}
-	if len(ids) != 1 {
-		t.Fatal("wrong number of session IDs")
+	if abort.Reason != wamp.ErrAuthorizationFailed {
+		t.Fatal("wrong ABORT reason:", abort.Reason)
 	}
-	if sessID != ids[0] {
-		t.Fatal("wrong session ID")
+	if errStr, _ := wamp.AsString(abort.Details["error"]); errStr != "client banned not allowed" {
+		t.Fatal("wrong error in ABORT details:", errStr)
+	}
+
+	// Client not rejected by interceptor is attached.
+	if _, err = testClient(r); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestGetSessionMetaProcedures(t *testing.T) {
+func TestMaxSessions(t *testing.T) {
 	defer leaktest.Check(t)()
-	r, err := newTestRouter()
+	const maxSessions = 2
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+			},
+		},
+		MaxSessions: maxSessions,
+		Debug:       debug,
+	}
+	r, err := NewRouter(config, logger)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	defer r.Close()
 
-	caller, err := testClient(r)
-	if err != nil {
-		t.Fatal(err)
+	// attach returns the client if it gets a WELCOME, or nil if it gets an
+	// ABORT with reason system_shutdown.
+	type result struct {
+		client wamp.Peer
+		err    error
+	}
+	attach := func() result {
+		client, server := transport.LinkedPeers()
+		go client.Send(&wamp.Hello{
+			Realm:   testRealm,
+			Details: wamp.Dict{"roles": wamp.Dict{"subscriber": wamp.Dict{}}},
+		})
+		attachErr := r.Attach(server)
+		msg, err := wamp.RecvTimeout(client, time.Second)
+		if err != nil {
+			return result{nil, err}
+		}
+		switch msg := msg.(type) {
+		case *wamp.Welcome:
+			if attachErr != nil {
+				return result{nil, attachErr}
+			}
+			return result{client, nil}
+		case *wamp.Abort:
+			if msg.Reason != wamp.ErrSystemShutdown {
+				return result{nil, fmt.Errorf("wrong ABORT reason: %s", msg.Reason)}
+			}
+			if attachErr == nil {
+				return result{nil, errors.New("expected error from Attach")}
+			}
+			return result{nil, nil}
+		}
+		return result{nil, fmt.Errorf("unexpected %s", msg.MessageType())}
 	}
-	sessID := caller.ID
 
-	// Call session meta-procedure with bad session ID
-	callID := wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcSessionGet,
-		Arguments: wamp.List{wamp.ID(123456789)},
-	})
-	msg, err := wamp.RecvTimeout(caller, time.Second)
-	if err != nil {
-		t.Fatal(err)
-	}
-	errRsp, ok := msg.(*wamp.Error)
-	if !ok {
-		t.Fatal("expected ERROR, got", msg.MessageType())
+	// Attach one more client than the limit allows, concurrently.
+	results := make(chan result, maxSessions+1)
+	for i := 0; i < maxSessions+1; i++ {
+		go func() { results <- attach() }()
+	}
+	var clients []wamp.Peer
+	for i := 0; i < maxSessions+1; i++ {
+		res := <-results
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if res.client != nil {
+			clients = append(clients, res.client)
+		}
 	}
-	if errRsp.Error != wamp.ErrNoSuchSession {
-		t.Fatal("wrong error value")
+	if len(clients) != maxSessions {
+		t.Fatal("expected", maxSessions, "sessions attached, got", len(clients))
 	}
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
 
-	// Call session meta-procedure to get session information.
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcSessionGet,
-		Arguments: wamp.List{sessID},
-	})
-	msg, err = wamp.RecvTimeout(caller, time.Second)
-	if err != nil {
-		t.Fatal(err)
+	// Check that the limit is still enforced.
+	if res := attach(); res.err != nil || res.client != nil {
+		t.Fatal("expected attach to be rejected", res.err)
 	}
-	result, ok := msg.(*wamp.Result)
-	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
-	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
-	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+
+	// Ending a session frees a slot.
+	clients[0].Send(&wamp.Goodbye{Reason: wamp.CloseRealm, Details: wamp.Dict{}})
+	if _, err = wamp.RecvTimeout(clients[0], time.Second); err != nil {
+		t.Fatal("no GOODBYE reply:", err)
+	}
+	var res result
+	for i := 0; i < 50; i++ {
+		if res = attach(); res.client != nil || res.err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	details, ok := result.Arguments[0].(wamp.Dict)
-	if !ok {
-		t.Fatal("expected dict type arg")
+	if res.err != nil {
+		t.Fatal(res.err)
 	}
-	sid, _ := wamp.AsID(details["session"])
-	if sid != sessID {
-		t.Fatal("wrong session ID")
+	if res.client == nil {
+		t.Fatal("session slot not released when session ended")
 	}
+	clients[0] = res.client
 }
 
-func TestRegistrationMetaProcedures(t *testing.T) {
+func TestHeartbeat(t *testing.T) {
 	defer leaktest.Check(t)()
-	r, err := newTestRouter()
+	const interval = 50 * time.Millisecond
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				AnonymousAuth:     true,
+				HeartbeatInterval: interval,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	defer r.Close()
 
-	caller, err := testClient(r)
-	if err != nil {
-		t.Fatal(err)
+	// attach attaches a client that may announce heartbeat support.
+	attach := func(heartbeat bool) *wamp.Session {
+		client, server := transport.LinkedPeers()
+		details := wamp.Dict{"roles": clientRoles["roles"]}
+		if heartbeat {
+			details[wamp.OptHeartbeat] = true
+		}
+		go client.Send(&wamp.Hello{Realm: testRealm, Details: details})
+		if err := r.Attach(server); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := wamp.RecvTimeout(client, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		welcome, ok := msg.(*wamp.Welcome)
+		if !ok {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+		return &wamp.Session{Peer: client, ID: welcome.ID, Details: welcome.Details}
 	}
-	sessID := caller.ID
 
-	// ----- Test wamp.registration.list meta procedure -----
-	callID := wamp.GlobalID()
-	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcRegList})
-	msg, err := wamp.RecvTimeout(caller, time.Second)
-	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
+	live := attach(true)
+	defer live.Close()
+	ms, _ := wamp.AsInt64(live.Details["heartbeat_interval"])
+	if time.Duration(ms)*time.Millisecond != interval {
+		t.Fatal("WELCOME has wrong heartbeat_interval:", live.Details["heartbeat_interval"])
 	}
-	result, ok := msg.(*wamp.Result)
-	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
+
+	idle := attach(true)
+	defer idle.Close()
+
+	// A session that does not support heartbeats is not asked for them, and
+	// is not ended when idle.
+	other := attach(false)
+	defer other.Close()
+	if _, ok := other.Details["heartbeat_interval"]; ok {
+		t.Fatal("WELCOME has heartbeat_interval for session without heartbeat support")
 	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+
+	// The live session calls the heartbeat procedure while the idle session
+	// sends nothing, until the idle session is ended.
+	var goodbye wamp.Message
+	deadline := time.Now().Add(10 * interval)
+	for req := wamp.ID(1); goodbye == nil && time.Now().Before(deadline); req++ {
+		live.Send(&wamp.Call{Request: req, Procedure: wamp.MetaProcSessionHeartbeat})
+		msg, err := wamp.RecvTimeout(live, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := msg.(*wamp.Result); !ok {
+			t.Fatal("expected RESULT from heartbeat, got", msg.MessageType())
+		}
+		select {
+		case goodbye = <-idle.Recv():
+		case <-time.After(interval / 2):
+		}
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	if goodbye == nil {
+		t.Fatal("idle session was not ended")
 	}
-	dict, ok := result.Arguments[0].(wamp.Dict)
-	if !ok {
-		t.Fatal("expected wamp.Dict")
+	if g, ok := goodbye.(*wamp.Goodbye); !ok || g.Reason != wamp.CloseTimeout {
+		t.Fatal("expected GOODBYE", wamp.CloseTimeout, "got", goodbye)
 	}
-	exactPrev, ok := dict["exact"].([]wamp.ID)
-	if !ok {
-		t.Fatal("expected []wamp.ID")
+
+	// Live session is still attached.
+	live.Send(&wamp.Call{Request: 1000, Procedure: wamp.MetaProcSessionHeartbeat})
+	if _, err = wamp.RecvTimeout(live, time.Second); err != nil {
+		t.Fatal("live session ended:", err)
 	}
-	prefixPrev, ok := dict["prefix"].([]wamp.ID)
-	if !ok {
-		t.Fatal("expected []wamp.ID")
+
+	// The session without heartbeat support was idle for as long as the idle
+	// session, and is still attached.
+	other.Send(&wamp.Call{Request: 1, Procedure: wamp.MetaProcSessionHeartbeat})
+	msg, err := wamp.RecvTimeout(other, time.Second)
+	if err != nil {
+		t.Fatal("session without heartbeat support ended:", err)
 	}
-	wildcardPrev, ok := dict["wildcard"].([]wamp.ID)
-	if !ok {
-		t.Fatal("expected []wamp.ID")
+	if _, ok := msg.(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
 	}
+}
 
-	callee, err := testClient(r)
-	if err != nil {
-		t.Fatal("Error connecting client:", err)
+// Test sending a
+type testTicketKeyStore struct{}
+
+func (ks testTicketKeyStore) AuthKey(authid, authmethod string) ([]byte, error) {
+	if authid != "jdoe" || authmethod != "ticket" {
+		return nil, errors.New("no such user")
 	}
-	sessID = callee.ID
-	// Register remote procedure
-	registerID := wamp.GlobalID()
-	callee.Send(&wamp.Register{Request: registerID, Procedure: testProcedure})
+	return []byte("good-ticket"), nil
+}
 
-	msg, err = wamp.RecvTimeout(callee, time.Second)
-	if err != nil {
-		t.Fatal("Timed out waiting for REGISTERED")
+func (ks testTicketKeyStore) PasswordInfo(authid string) (string, int, int) {
+	return "", 0, 0
+}
+
+func (ks testTicketKeyStore) AuthRole(authid string) (string, error) {
+	if authid != "jdoe" {
+		return "", errors.New("no such user")
 	}
-	registered, ok := msg.(*wamp.Registered)
-	if !ok {
-		t.Fatal("expected REGISTERED, got:", msg.MessageType())
+	return "user", nil
+}
+
+func (ks testTicketKeyStore) Provider() string { return "test" }
+
+func TestTicketAuthAttach(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:              testRealm,
+				RequireLocalAuth: true,
+				Authenticators: []auth.Authenticator{
+					auth.NewTicketAuthenticator(testTicketKeyStore{}, time.Second),
+				},
+			},
+		},
+		Debug: debug,
 	}
-	if registered.Request != registerID {
-		t.Fatal("wrong request ID")
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
 	}
-	registrationID := registered.Registration
+	defer r.Close()
 
-	// Register remote procedure
-	callee.Send(&wamp.Register{
-		Request:   wamp.GlobalID(),
-		Procedure: testProcedureWC,
-		Options:   wamp.Dict{"match": "wildcard"},
-	})
-	msg = <-callee.Recv()
-	if _, ok = msg.(*wamp.Registered); !ok {
-		t.Fatal("expected REGISTERED, got:", msg.MessageType())
+	attach := func(ticket string) (wamp.Message, error) {
+		client, server := transport.LinkedPeers()
+		errChan := make(chan error, 1)
+		go func() { errChan <- r.Attach(server) }()
+		client.Send(&wamp.Hello{
+			Realm: testRealm,
+			Details: wamp.Dict{
+				"authid":      "jdoe",
+				"authmethods": wamp.List{"ticket"},
+				"roles":       wamp.Dict{"caller": wamp.Dict{}},
+			},
+		})
+		msg, err := wamp.RecvTimeout(client, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for CHALLENGE")
+		}
+		ch, ok := msg.(*wamp.Challenge)
+		if !ok {
+			t.Fatal("expected CHALLENGE, got", msg.MessageType())
+		}
+		if ch.AuthMethod != "ticket" {
+			t.Fatal("wrong challenge authmethod:", ch.AuthMethod)
+		}
+		client.Send(&wamp.Authenticate{Signature: ticket})
+		if msg, err = wamp.RecvTimeout(client, time.Second); err != nil {
+			t.Fatal("timed out waiting for response to AUTHENTICATE")
+		}
+		err = <-errChan
+		client.Close()
+		return msg, err
 	}
 
-	// Call session meta-procedure to get session count.
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcRegList})
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+	// Good ticket gets WELCOME with authrole from keystore.
+	msg, err := attach("good-ticket")
 	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
+		t.Fatal(err)
 	}
-	result, ok = msg.(*wamp.Result)
+	welcome, ok := msg.(*wamp.Welcome)
 	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
+		t.Fatal("expected WELCOME, got", msg.MessageType())
 	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+	if s, _ := wamp.AsString(welcome.Details["authrole"]); s != "user" {
+		t.Fatal("wrong authrole in WELCOME:", s)
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	if s, _ := wamp.AsString(welcome.Details["authmethod"]); s != "ticket" {
+		t.Fatal("wrong authmethod in WELCOME:", s)
 	}
-	dict, ok = result.Arguments[0].(wamp.Dict)
+
+	// Bad ticket gets ABORT.
+	msg, err = attach("bad-ticket")
+	if err == nil {
+		t.Fatal("expected error from Attach with bad ticket")
+	}
+	abort, ok := msg.(*wamp.Abort)
 	if !ok {
-		t.Fatal("expected wamp.Dict")
+		t.Fatal("expected ABORT, got", msg.MessageType())
 	}
-	exact := dict["exact"].([]wamp.ID)
-	prefix := dict["prefix"].([]wamp.ID)
-	wildcard := dict["wildcard"].([]wamp.ID)
-
-	if len(exact) != len(exactPrev)+1 {
-		t.Fatal("expected additional exact match")
+	if abort.Reason != wamp.ErrAuthenticationFailed {
+		t.Fatal("wrong ABORT reason:", abort.Reason)
 	}
-	if len(prefix) != len(prefixPrev) {
-		t.Fatal("prefix matches should not have changed")
+}
+
+func TestAuthUnexpectedMessage(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:              testRealm,
+				RequireLocalAuth: true,
+				Authenticators: []auth.Authenticator{
+					auth.NewTicketAuthenticator(testTicketKeyStore{}, time.Second),
+				},
+			},
+		},
+		Debug: debug,
 	}
-	if len(wildcard) != len(wildcardPrev)+1 {
-		t.Fatal("expected additional wildcard match")
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer r.Close()
 
-	var found bool
-	for i := range exact {
-		if exact[i] == registrationID {
-			found = true
-			break
+	checkAbort := func(client wamp.Peer, errChan chan error) {
+		msg, err := wamp.RecvTimeout(client, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for ABORT")
+		}
+		abort, ok := msg.(*wamp.Abort)
+		if !ok {
+			t.Fatal("expected ABORT, got", msg.MessageType())
+		}
+		if abort.Reason != wamp.ErrProtocolViolation {
+			t.Fatal("wrong ABORT reason:", abort.Reason)
+		}
+		if err = <-errChan; err == nil {
+			t.Fatal("expected error from Attach")
 		}
-	}
-	if !found {
-		t.Fatal("missing expected registration ID")
 	}
 
-	// ----- Test wamp.registration.lookup meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcRegLookup,
-		Arguments: wamp.List{testProcedure},
+	// AUTHENTICATE sent before HELLO and CHALLENGE.
+	client, server := transport.LinkedPeers()
+	errChan := make(chan error, 1)
+	go func() { errChan <- r.Attach(server) }()
+	client.Send(&wamp.Authenticate{Signature: "good-ticket"})
+	checkAbort(client, errChan)
+	client.Close()
+
+	// Unexpected message sent in response to CHALLENGE.
+	client, server = transport.LinkedPeers()
+	go func() { errChan <- r.Attach(server) }()
+	client.Send(&wamp.Hello{
+		Realm: testRealm,
+		Details: wamp.Dict{
+			"authid":      "jdoe",
+			"authmethods": wamp.List{"ticket"},
+			"roles":       wamp.Dict{"caller": wamp.Dict{}},
+		},
 	})
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+	msg, err := wamp.RecvTimeout(client, time.Second)
 	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
-	}
-	result, ok = msg.(*wamp.Result)
-	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
-	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+		t.Fatal("timed out waiting for CHALLENGE")
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	if _, ok := msg.(*wamp.Challenge); !ok {
+		t.Fatal("expected CHALLENGE, got", msg.MessageType())
 	}
-	regID, ok := result.Arguments[0].(wamp.ID)
-	if !ok {
-		t.Fatal("expected wamp.ID")
+	client.Send(&wamp.Call{Request: 1, Procedure: testProcedure})
+	checkAbort(client, errChan)
+	client.Close()
+}
+
+func TestProtocolViolation(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if regID != registrationID {
-		t.Fatal("received wrong registration ID")
+	defer r.Close()
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// ----- Test wamp.registration.match meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcRegMatch,
-		Arguments: wamp.List{testProcedure},
-	})
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+	// Send HELLO message after session established.
+	cli.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	msg, err := wamp.RecvTimeout(cli, time.Second)
 	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
+		t.Fatal("timed out waiting for ABORT")
 	}
-	result, ok = msg.(*wamp.Result)
+	abort, ok := msg.(*wamp.Abort)
 	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
-	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+		t.Fatal("expected ABORT, received:", msg.MessageType())
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
-	}
-	regID, ok = wamp.AsID(result.Arguments[0])
-	if !ok {
-		t.Fatal("expected wamp.ID")
+	if abort.Reason != wamp.ErrProtocolViolation {
+		t.Fatal("Expected reason to be", wamp.ErrProtocolViolation)
 	}
-	if regID != registrationID {
-		t.Fatal("received wrong registration ID")
+
+	// Send SUBSCRIBE before session established.
+	client, server := transport.LinkedPeers()
+	// Run as goroutine since Send will block until message read by router, if
+	// client uses unbuffered channel.
+	go client.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: wamp.URI("some.uri")})
+	if err = r.Attach(server); err == nil {
+		t.Fatal("Expected error from Attach")
 	}
 
-	// ----- Test wamp.registration.get meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcRegGet,
-		Arguments: wamp.List{registrationID},
-	})
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+	msg, err = wamp.RecvTimeout(client, time.Second)
 	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
-	}
-	result, ok = msg.(*wamp.Result)
-	if !ok {
-		t.Fatalf("expected RESULT, got %s %+v", msg.MessageType(), msg)
-	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
-	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+		t.Fatal("timed out waiting for ABORT")
 	}
-	dict, ok = result.Arguments[0].(wamp.Dict)
+	abort, ok = msg.(*wamp.Abort)
 	if !ok {
-		t.Fatal("expected wamp.Dict")
-	}
-	regID, _ = wamp.AsID(dict["id"])
-	if regID != registrationID {
-		t.Fatal("received wrong registration")
+		t.Fatal("expected ABORT, received:", msg.MessageType())
 	}
-	uri, _ := wamp.AsURI(dict["uri"])
-	if uri != testProcedure {
-		t.Fatal("registration has wrong uri:", uri)
+	if abort.Reason != wamp.ErrProtocolViolation {
+		t.Fatal("Expected reason to be", wamp.ErrProtocolViolation)
 	}
+}
 
-	// ----- Test wamp.registration.list_callees meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcRegListCallees,
-		Arguments: wamp.List{registrationID},
-	})
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+func TestSendAbort(t *testing.T) {
+	client, server := transport.LinkedPeers()
+	go sendAbort(server, wamp.ErrProtocolViolation, errors.New("bad message"))
+
+	msg, err := wamp.RecvTimeout(client, time.Second)
 	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
+		t.Fatal("timed out waiting for ABORT")
 	}
-	result, ok = msg.(*wamp.Result)
+	abort, ok := msg.(*wamp.Abort)
 	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
+		t.Fatal("expected ABORT, received:", msg.MessageType())
 	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+	if abort.Reason != wamp.ErrProtocolViolation {
+		t.Fatal("wrong reason:", abort.Reason)
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	if wamp.ErrProtocolViolation != "wamp.error.protocol_violation" {
+		t.Fatal("wrong URI for protocol violation:", wamp.ErrProtocolViolation)
 	}
-	idList, ok := result.Arguments[0].([]wamp.ID)
-	if !ok {
-		t.Fatal("Expected []wamp.ID")
+	if abort.Details["error"] != "bad message" {
+		t.Fatal("wrong error detail:", abort.Details["error"])
 	}
-	if len(idList) != 1 {
-		t.Fatal("Expected 1 callee in list")
+	// The peer is closed after sending the ABORT.
+	select {
+	case msg, open := <-client.Recv():
+		if open {
+			t.Fatal("unexpected message:", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("peer not closed after ABORT")
 	}
-	if idList[0] != sessID {
-		t.Fatal("Wrong callee session ID")
+
+	abort = newAbort(wamp.ErrNoSuchRealm, nil)
+	if abort.Details == nil || len(abort.Details) != 0 {
+		t.Fatal("expected empty details for ABORT without error")
 	}
+}
 
-	// ----- Test wamp.registration.count_callees meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcRegCountCallees,
-		Arguments: wamp.List{registrationID},
-	})
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+// blockedPeer is a peer whose Send blocks until released.  The sending
+// channel is closed when Send is first called.
+type blockedPeer struct {
+	wamp.Peer
+	sending chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (p *blockedPeer) Send(msg wamp.Message) error {
+	p.once.Do(func() { close(p.sending) })
+	<-p.release
+	return p.Peer.Send(msg)
+}
+
+func TestAbortDoesNotBlockRouter(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
 	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
+		t.Fatal(err)
 	}
-	result, ok = msg.(*wamp.Result)
-	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
+	defer r.Close()
+
+	// A client that requests a realm that does not exist, and is slow to
+	// take the ABORT.
+	client, server := transport.LinkedPeers()
+	defer client.Close()
+	blocked := &blockedPeer{
+		Peer:    server,
+		sending: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	var releaseOnce sync.Once
+	release := func() { releaseOnce.Do(func() { close(blocked.release) }) }
+	// Release the peer before closing the router, even if the test fails.
+	defer release()
+	go client.Send(&wamp.Hello{Realm: "nexus.no.realm", Details: clientRoles})
+	errChan := make(chan error, 1)
+	go func() { errChan <- r.Attach(blocked) }()
+	select {
+	case <-blocked.sending:
+	case <-time.After(time.Second):
+		t.Fatal("ABORT not sent")
 	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+
+	// Other clients can still attach while the ABORT is waiting to be sent.
+	done := make(chan error, 1)
+	go func() {
+		_, err := testClient(r)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("router blocked by client being sent ABORT")
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+
+	release()
+	if err = <-errChan; err == nil {
+		t.Fatal("expected error attaching to nonexistent realm")
 	}
-	count, ok := wamp.AsInt64(result.Arguments[0])
-	if !ok {
-		t.Fatal("Argument is not an int")
+	msg, err := wamp.RecvTimeout(client, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for ABORT")
 	}
-	if count != 1 {
-		t.Fatal("Wring number of callees")
+	if abort, ok := msg.(*wamp.Abort); !ok || abort.Reason != wamp.ErrNoSuchRealm {
+		t.Fatal("expected ABORT", wamp.ErrNoSuchRealm, "got", msg)
 	}
 }
 
-func TestSubscriptionMetaProcedures(t *testing.T) {
+func TestRouterSubscribe(t *testing.T) {
 	defer leaktest.Check(t)()
 	r, err := newTestRouter()
 	if err != nil {
@@ -940,329 +1446,3144 @@ func TestSubscriptionMetaProcedures(t *testing.T) {
 	}
 	defer r.Close()
 
-	caller, err := testClient(r)
+	sub, err := testClient(r)
 	if err != nil {
 		t.Fatal(err)
 	}
-	sessID := caller.ID
 
-	// ----- Test wamp.subscription.list meta procedure -----
-	callID := wamp.GlobalID()
-	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcSubList})
-	msg, err := wamp.RecvTimeout(caller, time.Second)
+	subscribeID := wamp.GlobalID()
+	sub.Send(&wamp.Subscribe{Request: subscribeID, Topic: testTopic})
+	msg, err := wamp.RecvTimeout(sub, time.Second)
 	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
+		t.Fatal("Timed out waiting for SUBSCRIBED")
 	}
-	result, ok := msg.(*wamp.Result)
+	subMsg, ok := msg.(*wamp.Subscribed)
 	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
-	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+		t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	if subMsg.Request != subscribeID {
+		t.Fatal("wrong request ID")
 	}
-	dict, ok := result.Arguments[0].(wamp.Dict)
-	if !ok {
-		t.Fatal("expected wamp.Dict")
+	subscriptionID := subMsg.Subscription
+
+	pub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
 	}
-	exactPrev, ok := dict["exact"].([]wamp.ID)
-	if !ok {
-		t.Fatal("expected []wamp.ID")
+	pubID := wamp.GlobalID()
+	pub.Send(&wamp.Publish{Request: pubID, Topic: testTopic})
+
+	msg, err = wamp.RecvTimeout(sub, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for EVENT")
 	}
-	prefixPrev, ok := dict["prefix"].([]wamp.ID)
+	event, ok := msg.(*wamp.Event)
 	if !ok {
-		t.Fatal("expected []wamp.ID")
+		t.Fatal("Expected EVENT, got:", msg.MessageType())
 	}
-	wildcardPrev, ok := dict["wildcard"].([]wamp.ID)
-	if !ok {
-		t.Fatal("expected []wamp.ID")
+	if event.Subscription != subscriptionID {
+		t.Fatal("wrong subscription ID")
 	}
+}
 
-	subscriber, err := testClient(r)
+func TestPublishAcknowledge(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
 	if err != nil {
-		t.Fatal("Error connecting client:", err)
+		t.Error(err)
 	}
-	sessID = subscriber.ID
-	// Subscribe to topic
-	reqID := wamp.GlobalID()
-	subscriber.Send(&wamp.Subscribe{Request: reqID, Topic: testTopic})
-	msg, err = wamp.RecvTimeout(subscriber, time.Second)
+	defer r.Close()
+	client, err := testClient(r)
 	if err != nil {
-		t.Fatal("Timed out waiting for SUBSCRIBED")
-	}
-	subscribed, ok := msg.(*wamp.Subscribed)
-	if !ok {
-		t.Fatal("expected SUBSCRIBED, got:", msg.MessageType())
-	}
-	if subscribed.Request != reqID {
-		t.Fatal("wrong request ID")
+		t.Fatal(err)
 	}
-	subscriptionID := subscribed.Subscription
 
-	// Subscriber to wildcard topic
-	subscriber.Send(&wamp.Subscribe{
-		Request: wamp.GlobalID(),
-		Topic:   testTopicWC,
-		Options: wamp.Dict{"match": "wildcard"},
-	})
-	msg = <-subscriber.Recv()
-	if _, ok = msg.(*wamp.Subscribed); !ok {
-		t.Fatal("expected SUBSCRIBED, got:", msg.MessageType())
-	}
+	id := wamp.GlobalID()
+	client.Send(&wamp.Publish{
+		Request: id,
+		Options: wamp.Dict{"acknowledge": true},
+		Topic:   "some.uri"})
 
-	// Call subscription meta-procedure to get subscriptions.
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcSubList})
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+	msg, err := wamp.RecvTimeout(client, time.Second)
 	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
+		t.Fatal("sent acknowledge=true, timed out waiting for PUBLISHED")
 	}
-	result, ok = msg.(*wamp.Result)
+	pub, ok := msg.(*wamp.Published)
 	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
+		t.Fatal("sent acknowledge=true, expected PUBLISHED, got:",
+			msg.MessageType())
 	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+	if pub.Request != id {
+		t.Fatal("wrong request id")
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+}
+
+func TestPublishFalseAcknowledge(t *testing.T) {
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
 	}
-	dict, ok = result.Arguments[0].(wamp.Dict)
-	if !ok {
-		t.Fatal("expected wamp.Dict")
+	defer r.Close()
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := wamp.GlobalID()
+	client.Send(&wamp.Publish{
+		Request: id,
+		Options: wamp.Dict{"acknowledge": false},
+		Topic:   "some.uri"})
+
+	msg, err := wamp.RecvTimeout(client, 200*time.Millisecond)
+	if err == nil {
+		if _, ok := msg.(*wamp.Published); ok {
+			t.Fatal("Sent acknowledge=false, but received PUBLISHED:",
+				msg.MessageType())
+		}
+	}
+}
+
+func TestPublishNoAcknowledge(t *testing.T) {
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := wamp.GlobalID()
+	client.Send(&wamp.Publish{Request: id, Topic: "some.uri"})
+	msg, err := wamp.RecvTimeout(client, 200*time.Millisecond)
+	if err == nil {
+		if _, ok := msg.(*wamp.Published); ok {
+			t.Fatal("Sent acknowledge=false, but received PUBLISHED:",
+				msg.MessageType())
+		}
+	}
+}
+
+func TestRouterCall(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registerID := wamp.GlobalID()
+	// Register remote procedure
+	callee.Send(&wamp.Register{Request: registerID, Procedure: testProcedure})
+
+	msg, err := wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for REGISTERED")
+	}
+	registered, ok := msg.(*wamp.Registered)
+	if !ok {
+		t.Fatal("expected REGISTERED,got:", msg.MessageType())
+	}
+	if registered.Request != registerID {
+		t.Fatal("wrong request ID")
+	}
+	registrationID := registered.Registration
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal("Error connecting caller:", err)
+	}
+	callID := wamp.GlobalID()
+	// Call remote procedure
+	caller.Send(&wamp.Call{Request: callID, Procedure: testProcedure})
+
+	msg, err = wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for INVOCATION")
+	}
+	invocation, ok := msg.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", msg.MessageType())
+	}
+	if invocation.Registration != registrationID {
+		t.Fatal("wrong registration id")
+	}
+	invocationID := invocation.Request
+
+	// Returns result of remove procedure
+	callee.Send(&wamp.Yield{Request: invocationID})
+
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+}
+
+func TestCloseCancelsPendingCalls(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	if msg, err := wamp.RecvTimeout(callee, time.Second); err != nil {
+		t.Fatal("Timed out waiting for REGISTERED")
+	} else if _, ok := msg.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got:", msg.MessageType())
+	}
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal("Error connecting caller:", err)
+	}
+	callID := wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: callID, Procedure: testProcedure})
+	if msg, err := wamp.RecvTimeout(callee, time.Second); err != nil {
+		t.Fatal("Timed out waiting for INVOCATION")
+	} else if _, ok := msg.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got:", msg.MessageType())
+	}
+
+	// Close the router while the call is in flight.  The callee never yields.
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+
+	msg, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for ERROR")
+	}
+	errMsg, ok := msg.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", msg.MessageType())
+	}
+	if errMsg.Type != wamp.CALL || errMsg.Request != callID {
+		t.Fatal("wrong ERROR for call:", errMsg)
+	}
+	if errMsg.Error != wamp.ErrSystemShutdown {
+		t.Fatal("expected", wamp.ErrSystemShutdown, "got", errMsg.Error)
+	}
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for GOODBYE")
+	}
+	if _, ok = msg.(*wamp.Goodbye); !ok {
+		t.Fatal("expected GOODBYE, got:", msg.MessageType())
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("router did not close")
+	}
+	caller.Close()
+	callee.Close()
+}
+
+func TestMetaAPIConfig(t *testing.T) {
+	defer leaktest.Check(t)()
+	for _, disable := range []bool{false, true} {
+		config := &Config{
+			RealmConfigs: []*RealmConfig{
+				{
+					URI:            testRealm,
+					AnonymousAuth:  true,
+					DisableMetaAPI: disable,
+					MetaStrictURI:  disable,
+				},
+			},
+			Debug: debug,
+		}
+		r, err := NewRouter(config, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caller, err := testClient(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := &wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionCount}
+		caller.Send(req)
+		msg, err := wamp.RecvTimeout(caller, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !disable {
+			if _, ok := msg.(*wamp.Result); !ok {
+				t.Fatal("expected RESULT, got", msg.MessageType())
+			}
+			caller.Close()
+			r.Close()
+			continue
+		}
+
+		// Meta API disabled.
+		errMsg, ok := msg.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got", msg.MessageType())
+		}
+		if errMsg.Error != wamp.ErrNoSuchProcedure {
+			t.Fatal("wrong error:", errMsg.Error)
+		}
+
+		// Publishing to a reserved topic is not allowed.
+		caller.Send(&wamp.Publish{
+			Request: wamp.GlobalID(),
+			Topic:   wamp.MetaEventSessionOnJoin,
+			Options: wamp.Dict{wamp.OptAcknowledge: true},
+		})
+		if msg, err = wamp.RecvTimeout(caller, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if errMsg, ok = msg.(*wamp.Error); !ok {
+			t.Fatal("expected ERROR, got", msg.MessageType())
+		}
+		if errMsg.Error != wamp.ErrInvalidURI {
+			t.Fatal("wrong error:", errMsg.Error)
+		}
+
+		// Other topics are allowed.
+		caller.Send(&wamp.Publish{
+			Request: wamp.GlobalID(),
+			Topic:   testTopic,
+			Options: wamp.Dict{wamp.OptAcknowledge: true},
+		})
+		if msg, err = wamp.RecvTimeout(caller, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok = msg.(*wamp.Published); !ok {
+			t.Fatal("expected PUBLISHED, got", msg.MessageType())
+		}
+		caller.Close()
+		r.Close()
+	}
+}
+
+func TestSessionCountMetaProcedure(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Call wamp.MetaProcSessionCount
+	req := &wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionCount}
+	caller.Send(req)
+	msg, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != req.Request {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	count, ok := result.Arguments[0].(int)
+	if !ok {
+		t.Fatal("expected int arguemnt")
+	}
+	if count != 1 {
+		t.Fatal("wrong session count")
+	}
+
+	// Call wamp.MetaProcSessionCount with invalid argument
+	req = &wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSessionCount,
+		Arguments: wamp.List{"should-be-a-list"},
+	}
+	caller.Send(req)
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errResult, ok := msg.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got", msg.MessageType())
+	}
+	if errResult.Request != req.Request {
+		t.Fatal("wrong result ID")
+	}
+
+	// Call wamp.MetaProcSessionCount with non-matching filter
+	filter := wamp.List{"user", "def"}
+	req = &wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSessionCount,
+		Arguments: wamp.List{filter},
+	}
+	caller.Send(req)
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != req.Request {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	count = result.Arguments[0].(int)
+	if count != 0 {
+		t.Fatal("wrong session count")
+	}
+
+	// Call wamp.MetaProcSessionCount with matching filter
+	filter = wamp.List{"trusted", "user", "def"}
+	req = &wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSessionCount,
+		Arguments: wamp.List{filter},
+	}
+	caller.Send(req)
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != req.Request {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	count = result.Arguments[0].(int)
+	if count != 1 {
+		t.Fatal("wrong session count")
+	}
+}
+
+func TestListSessionMetaProcedures(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessID := caller.ID
+
+	// Call wamp.MetaProcSessionList to get session list.
+	req := &wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSessionList,
+	}
+	caller.Send(req)
+	msg, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != req.Request {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	ids, ok := result.Arguments[0].([]wamp.ID)
+	if !ok {
+		t.Fatal("wrong arg type")
+	}
+	if len(ids) != 1 {
+		t.Fatal("wrong number of session IDs")
+	}
+	if sessID != ids[0] {
+		t.Fatal("wrong session ID")
+	}
+
+	// Call wamp.MetaProcSessionList with matching filter
+	filter := wamp.List{"trusted"}
+	req = &wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSessionList,
+		Arguments: wamp.List{filter},
+	}
+	caller.Send(req)
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != req.Request {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	ids, ok = result.Arguments[0].([]wamp.ID)
+	if !ok {
+		t.Fatal("wrong arg type")
+	}
+	if len(ids) != 1 {
+		t.Fatal("wrong number of session IDs")
+	}
+	if sessID != ids[0] {
+		t.Fatal("wrong session ID")
+	}
+}
+
+func TestGetSessionMetaProcedures(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessID := caller.ID
+
+	// Call session meta-procedure with bad session ID
+	callID := wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcSessionGet,
+		Arguments: wamp.List{wamp.ID(123456789)},
+	})
+	msg, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errRsp, ok := msg.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got", msg.MessageType())
+	}
+	if errRsp.Error != wamp.ErrNoSuchSession {
+		t.Fatal("wrong error value")
+	}
+
+	// Call session meta-procedure to get session information.
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcSessionGet,
+		Arguments: wamp.List{sessID},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	details, ok := result.Arguments[0].(wamp.Dict)
+	if !ok {
+		t.Fatal("expected dict type arg")
+	}
+	sid, _ := wamp.AsID(details["session"])
+	if sid != sessID {
+		t.Fatal("wrong session ID")
+	}
+	roles, ok := wamp.AsDict(details["roles"])
+	if !ok {
+		t.Fatal("missing roles in session details")
+	}
+	if ok, _ = wamp.DictFlag(roles, []string{"caller", "features", "call_timeout"}); !ok {
+		t.Fatal("missing caller call_timeout feature in roles:", roles)
+	}
+	if _, ok = roles["callee"]; !ok {
+		t.Fatal("missing callee role in roles:", roles)
+	}
+}
+
+func TestSessionResources(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	cli.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	msg, err := wamp.RecvTimeout(cli, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribed, ok := msg.(*wamp.Subscribed)
+	if !ok {
+		t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+	}
+	cli.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	if msg, err = wamp.RecvTimeout(cli, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	registered, ok := msg.(*wamp.Registered)
+	if !ok {
+		t.Fatal("expected REGISTERED, got", msg.MessageType())
+	}
+
+	rlm, _ := r.GetRealm(testRealm)
+	subIDs, regIDs, ok := rlm.SessionResources(cli.ID)
+	if !ok {
+		t.Fatal("session not found")
+	}
+	if len(subIDs) != 1 || subIDs[0] != subscribed.Subscription {
+		t.Fatal("wrong subscriptions for session:", subIDs)
+	}
+	if len(regIDs) != 1 || regIDs[0] != registered.Registration {
+		t.Fatal("wrong registrations for session:", regIDs)
+	}
+	if _, _, ok = rlm.SessionResources(wamp.GlobalID()); ok {
+		t.Fatal("expected no resources for unknown session")
+	}
+
+	// The session's resources are also returned by wamp.session.get.
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+	caller.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSessionGet,
+		Arguments: wamp.List{cli.ID},
+	})
+	if msg, err = wamp.RecvTimeout(caller, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	details, _ := wamp.AsDict(result.Arguments[0])
+	subList, _ := wamp.AsList(details["subscriptions"])
+	if len(subList) != 1 || subList[0] != subscribed.Subscription {
+		t.Fatal("wrong subscriptions in session details:", details["subscriptions"])
+	}
+	regList, _ := wamp.AsList(details["registrations"])
+	if len(regList) != 1 || regList[0] != registered.Registration {
+		t.Fatal("wrong registrations in session details:", details["registrations"])
+	}
+
+	// Unsubscribing removes the subscription from the session's resources.
+	cli.Send(&wamp.Unsubscribe{
+		Request:      wamp.GlobalID(),
+		Subscription: subscribed.Subscription,
+	})
+	if _, err = wamp.RecvTimeout(cli, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if subIDs, _, _ = rlm.SessionResources(cli.ID); len(subIDs) != 0 {
+		t.Fatal("expected no subscriptions after unsubscribe:", subIDs)
+	}
+}
+
+func TestSessionMetaEvents(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	sub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Call a meta procedure so that the meta session has published on_join
+	// for the subscriber before subscribing.
+	sub.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionCount})
+	if _, err = wamp.RecvTimeout(sub, time.Second); err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+
+	subIDs := map[wamp.URI]wamp.ID{}
+	for _, topic := range []wamp.URI{wamp.MetaEventSessionOnJoin, wamp.MetaEventSessionOnLeave} {
+		sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: topic})
+		msg, err := wamp.RecvTimeout(sub, time.Second)
+		if err != nil {
+			t.Fatal("Timed out waiting for SUBSCRIBED")
+		}
+		subMsg, ok := msg.(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+		}
+		subIDs[topic] = subMsg.Subscription
+	}
+
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check on_join event has session details.
+	msg, err := wamp.RecvTimeout(sub, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for on_join EVENT")
+	}
+	event, ok := msg.(*wamp.Event)
+	if !ok {
+		t.Fatal("Expected EVENT, got:", msg.MessageType())
+	}
+	if event.Subscription != subIDs[wamp.MetaEventSessionOnJoin] {
+		t.Fatal("expected on_join event")
+	}
+	if len(event.Arguments) == 0 {
+		t.Fatal("missing on_join event argument")
+	}
+	details, ok := wamp.AsDict(event.Arguments[0])
+	if !ok {
+		t.Fatal("expected dict on_join argument")
+	}
+	if sid, _ := wamp.AsID(details["session"]); sid != cli.ID {
+		t.Fatal("wrong session ID in on_join event")
+	}
+	if authid, _ := wamp.AsString(details["authid"]); authid != "user1" {
+		t.Fatal("wrong authid in on_join event:", authid)
+	}
+	if authrole, _ := wamp.AsString(details["authrole"]); authrole != "trusted" {
+		t.Fatal("wrong authrole in on_join event:", authrole)
+	}
+
+	// Check on_leave event has session ID, authid, and authrole.
+	cli.Send(&wamp.Goodbye{})
+	if _, err = wamp.RecvTimeout(cli, time.Second); err != nil {
+		t.Fatal("no goodbye message after sending goodbye:", err)
+	}
+	msg, err = wamp.RecvTimeout(sub, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for on_leave EVENT")
+	}
+	if event, ok = msg.(*wamp.Event); !ok {
+		t.Fatal("Expected EVENT, got:", msg.MessageType())
+	}
+	if event.Subscription != subIDs[wamp.MetaEventSessionOnLeave] {
+		t.Fatal("expected on_leave event")
+	}
+	if len(event.Arguments) != 3 {
+		t.Fatal("expected 3 on_leave event arguments, got", len(event.Arguments))
+	}
+	if sid, _ := wamp.AsID(event.Arguments[0]); sid != cli.ID {
+		t.Fatal("wrong session ID in on_leave event")
+	}
+	if authid, _ := wamp.AsString(event.Arguments[1]); authid != "user1" {
+		t.Fatal("wrong authid in on_leave event:", authid)
+	}
+	if authrole, _ := wamp.AsString(event.Arguments[2]); authrole != "trusted" {
+		t.Fatal("wrong authrole in on_leave event:", authrole)
+	}
+
+	// Subscriber does not get any other meta events.
+	if msg, err = wamp.RecvTimeout(sub, 10*time.Millisecond); err == nil {
+		t.Fatal("unexpected message:", msg.MessageType())
+	}
+}
+
+func TestRegistrationMetaProcedures(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessID := caller.ID
+
+	// ----- Test wamp.registration.list meta procedure -----
+	callID := wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcRegList})
+	msg, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	dict, ok := result.Arguments[0].(wamp.Dict)
+	if !ok {
+		t.Fatal("expected wamp.Dict")
+	}
+	exactPrev, ok := dict["exact"].([]wamp.ID)
+	if !ok {
+		t.Fatal("expected []wamp.ID")
+	}
+	prefixPrev, ok := dict["prefix"].([]wamp.ID)
+	if !ok {
+		t.Fatal("expected []wamp.ID")
+	}
+	wildcardPrev, ok := dict["wildcard"].([]wamp.ID)
+	if !ok {
+		t.Fatal("expected []wamp.ID")
+	}
+
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal("Error connecting client:", err)
+	}
+	sessID = callee.ID
+	// Register remote procedure
+	registerID := wamp.GlobalID()
+	callee.Send(&wamp.Register{Request: registerID, Procedure: testProcedure})
+
+	msg, err = wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for REGISTERED")
+	}
+	registered, ok := msg.(*wamp.Registered)
+	if !ok {
+		t.Fatal("expected REGISTERED, got:", msg.MessageType())
+	}
+	if registered.Request != registerID {
+		t.Fatal("wrong request ID")
+	}
+	registrationID := registered.Registration
+
+	// Register remote procedure
+	callee.Send(&wamp.Register{
+		Request:   wamp.GlobalID(),
+		Procedure: testProcedureWC,
+		Options:   wamp.Dict{"match": "wildcard"},
+	})
+	msg = <-callee.Recv()
+	if _, ok = msg.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got:", msg.MessageType())
+	}
+
+	// Call session meta-procedure to get session count.
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcRegList})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	dict, ok = result.Arguments[0].(wamp.Dict)
+	if !ok {
+		t.Fatal("expected wamp.Dict")
+	}
+	exact := dict["exact"].([]wamp.ID)
+	prefix := dict["prefix"].([]wamp.ID)
+	wildcard := dict["wildcard"].([]wamp.ID)
+
+	if len(exact) != len(exactPrev)+1 {
+		t.Fatal("expected additional exact match")
+	}
+	if len(prefix) != len(prefixPrev) {
+		t.Fatal("prefix matches should not have changed")
+	}
+	if len(wildcard) != len(wildcardPrev)+1 {
+		t.Fatal("expected additional wildcard match")
+	}
+
+	var found bool
+	for i := range exact {
+		if exact[i] == registrationID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatal("missing expected registration ID")
+	}
+
+	// ----- Test wamp.registration.lookup meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcRegLookup,
+		Arguments: wamp.List{testProcedure},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	regID, ok := result.Arguments[0].(wamp.ID)
+	if !ok {
+		t.Fatal("expected wamp.ID")
+	}
+	if regID != registrationID {
+		t.Fatal("received wrong registration ID")
+	}
+
+	// ----- Test wamp.registration.match meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcRegMatch,
+		Arguments: wamp.List{testProcedure},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	regID, ok = wamp.AsID(result.Arguments[0])
+	if !ok {
+		t.Fatal("expected wamp.ID")
+	}
+	if regID != registrationID {
+		t.Fatal("received wrong registration ID")
+	}
+
+	// ----- Test wamp.registration.get meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcRegGet,
+		Arguments: wamp.List{registrationID},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatalf("expected RESULT, got %s %+v", msg.MessageType(), msg)
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	dict, ok = result.Arguments[0].(wamp.Dict)
+	if !ok {
+		t.Fatal("expected wamp.Dict")
+	}
+	regID, _ = wamp.AsID(dict["id"])
+	if regID != registrationID {
+		t.Fatal("received wrong registration")
+	}
+	uri, _ := wamp.AsURI(dict["uri"])
+	if uri != testProcedure {
+		t.Fatal("registration has wrong uri:", uri)
+	}
+
+	// ----- Test wamp.registration.list_callees meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcRegListCallees,
+		Arguments: wamp.List{registrationID},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	idList, ok := result.Arguments[0].([]wamp.ID)
+	if !ok {
+		t.Fatal("Expected []wamp.ID")
+	}
+	if len(idList) != 1 {
+		t.Fatal("Expected 1 callee in list")
+	}
+	if idList[0] != sessID {
+		t.Fatal("Wrong callee session ID")
+	}
+
+	// ----- Test wamp.registration.count_callees meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcRegCountCallees,
+		Arguments: wamp.List{registrationID},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	count, ok := wamp.AsInt64(result.Arguments[0])
+	if !ok {
+		t.Fatal("Argument is not an int")
+	}
+	if count != 1 {
+		t.Fatal("Wring number of callees")
+	}
+}
+
+func TestSubscriptionMetaProcedures(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessID := caller.ID
+
+	// ----- Test wamp.subscription.list meta procedure -----
+	callID := wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcSubList})
+	msg, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	dict, ok := result.Arguments[0].(wamp.Dict)
+	if !ok {
+		t.Fatal("expected wamp.Dict")
+	}
+	exactPrev, ok := dict["exact"].([]wamp.ID)
+	if !ok {
+		t.Fatal("expected []wamp.ID")
+	}
+	prefixPrev, ok := dict["prefix"].([]wamp.ID)
+	if !ok {
+		t.Fatal("expected []wamp.ID")
+	}
+	wildcardPrev, ok := dict["wildcard"].([]wamp.ID)
+	if !ok {
+		t.Fatal("expected []wamp.ID")
+	}
+
+	subscriber, err := testClient(r)
+	if err != nil {
+		t.Fatal("Error connecting client:", err)
+	}
+	sessID = subscriber.ID
+	// Subscribe to topic
+	reqID := wamp.GlobalID()
+	subscriber.Send(&wamp.Subscribe{Request: reqID, Topic: testTopic})
+	msg, err = wamp.RecvTimeout(subscriber, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for SUBSCRIBED")
+	}
+	subscribed, ok := msg.(*wamp.Subscribed)
+	if !ok {
+		t.Fatal("expected SUBSCRIBED, got:", msg.MessageType())
+	}
+	if subscribed.Request != reqID {
+		t.Fatal("wrong request ID")
+	}
+	subscriptionID := subscribed.Subscription
+
+	// Subscriber to wildcard topic
+	subscriber.Send(&wamp.Subscribe{
+		Request: wamp.GlobalID(),
+		Topic:   testTopicWC,
+		Options: wamp.Dict{"match": "wildcard"},
+	})
+	msg = <-subscriber.Recv()
+	if _, ok = msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED, got:", msg.MessageType())
+	}
+
+	// Call subscription meta-procedure to get subscriptions.
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcSubList})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	dict, ok = result.Arguments[0].(wamp.Dict)
+	if !ok {
+		t.Fatal("expected wamp.Dict")
+	}
+	exact := dict["exact"].([]wamp.ID)
+	prefix := dict["prefix"].([]wamp.ID)
+	wildcard := dict["wildcard"].([]wamp.ID)
+
+	if len(exact) != len(exactPrev)+1 {
+		t.Error("expected additional exact match")
+	}
+	if len(prefix) != len(prefixPrev) {
+		t.Error("prefix matches should not have changed")
+	}
+	if len(wildcard) != len(wildcardPrev)+1 {
+		t.Error("expected additional wildcard match")
+	}
+
+	var found bool
+	for i := range exact {
+		if exact[i] == subscriptionID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("missing expected subscription ID")
+	}
+
+	// ----- Test wamp.subscription.lookup meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcSubLookup,
+		Arguments: wamp.List{testTopic},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	subID, ok := result.Arguments[0].(wamp.ID)
+	if !ok {
+		t.Fatal("expected wamp.ID")
+	}
+	if subID != subscriptionID {
+		t.Fatal("received wrong subscription ID")
+	}
+
+	// ----- Test wamp.subscription.match meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcSubMatch,
+		Arguments: wamp.List{testTopic},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	subIDs, ok := wamp.AsList(result.Arguments[0])
+	if !ok {
+		t.Fatal("expected wamp.List")
+	}
+	if len(subIDs) != 2 {
+		t.Error("expected 2 subscriptions for wamp.subscription.match, got", len(subIDs))
+	}
+	found = false
+	for i := range subIDs {
+		if id, _ := wamp.AsID(subIDs[i]); id == subscriptionID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("wamp.subscription.match missing expected subscription ID")
+	}
+
+	// ----- Test wamp.subscription.get meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcSubGet,
+		Arguments: wamp.List{subscriptionID},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatalf("expected RESULT, got %s %+v", msg.MessageType(), msg)
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	dict, ok = result.Arguments[0].(wamp.Dict)
+	if !ok {
+		t.Fatal("expected wamp.Dict")
+	}
+	subID, _ = wamp.AsID(dict["id"])
+	if subID != subscriptionID {
+		t.Fatal("received wrong subscription")
+	}
+	uri, _ := wamp.AsURI(dict["uri"])
+	if uri != testTopic {
+		t.Fatal("subscription has wrong uri:", uri)
+	}
+
+	// ----- Test wamp.subscription.list_subscribers meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcSubListSubscribers,
+		Arguments: wamp.List{subscriptionID},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	idList, ok := result.Arguments[0].([]wamp.ID)
+	if !ok {
+		t.Fatal("Expected []wamp.ID")
+	}
+	if len(idList) != 1 {
+		t.Fatal("Expected 1 subscriber in list")
+	}
+	if idList[0] != sessID {
+		t.Fatal("Wrong subscriber session ID")
+	}
+
+	// ----- Test wamp.subscription.count_subscribers meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcSubCountSubscribers,
+		Arguments: wamp.List{subscriptionID},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok = msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	count, ok := wamp.AsInt64(result.Arguments[0])
+	if !ok {
+		t.Fatal("Argument is not an int")
+	}
+	if count != 1 {
+		t.Fatal("Wring number of subscribers")
+	}
+
+	countSubscribers := func() (int64, error) {
+		caller.Send(&wamp.Call{
+			Request:   wamp.GlobalID(),
+			Procedure: wamp.MetaProcSubCountSubscribers,
+			Arguments: wamp.List{subscriptionID},
+		})
+		msg, err := wamp.RecvTimeout(caller, time.Second)
+		if err != nil {
+			t.Fatal("Timed out waiting for RESULT")
+		}
+		switch msg := msg.(type) {
+		case *wamp.Result:
+			count, _ := wamp.AsInt64(msg.Arguments[0])
+			return count, nil
+		case *wamp.Error:
+			return 0, fmt.Errorf("%s", msg.Error)
+		}
+		t.Fatal("expected RESULT or ERROR, got", msg.MessageType())
+		return 0, nil
+	}
+
+	// Subscribe another session and check count increases.
+	subscriber2, err := testClient(r)
+	if err != nil {
+		t.Fatal("Error connecting client:", err)
+	}
+	subscriber2.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	msg, err = wamp.RecvTimeout(subscriber2, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for SUBSCRIBED")
+	}
+	if _, ok = msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED, got:", msg.MessageType())
+	}
+	if count, err = countSubscribers(); err != nil || count != 2 {
+		t.Fatal("expected 2 subscribers, got", count, err)
+	}
+
+	// Unsubscribe and check count decreases.
+	subscriber2.Send(&wamp.Unsubscribe{Request: wamp.GlobalID(), Subscription: subscriptionID})
+	msg, err = wamp.RecvTimeout(subscriber2, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for UNSUBSCRIBED")
+	}
+	if _, ok = msg.(*wamp.Unsubscribed); !ok {
+		t.Fatal("expected UNSUBSCRIBED, got:", msg.MessageType())
+	}
+	if count, err = countSubscribers(); err != nil || count != 1 {
+		t.Fatal("expected 1 subscriber, got", count, err)
+	}
+
+	// End the last subscriber's session and check subscription is gone.
+	subscriber.Send(&wamp.Goodbye{})
+	if _, err = wamp.RecvTimeout(subscriber, time.Second); err != nil {
+		t.Fatal("no goodbye message after sending goodbye:", err)
+	}
+	// Wait for session removal to be processed by broker.
+	for i := 0; i < 100; i++ {
+		if _, err = countSubscribers(); err != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err == nil || err.Error() != string(wamp.ErrNoSuchSubscription) {
+		t.Fatal("expected", wamp.ErrNoSuchSubscription, "got", err)
+	}
+}
+
+func TestAutoRealmConcurrent(t *testing.T) {
+	defer leaktest.Check(t)()
+	template := &RealmConfig{AnonymousAuth: true}
+	r, err := NewRouter(&Config{RealmTemplate: template, Debug: debug}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	const realmCount = 32
+	errChan := make(chan error, realmCount)
+	for i := 0; i < realmCount; i++ {
+		uri := wamp.URI(fmt.Sprintf("nexus.test.auto%d", i))
+		go func() {
+			client, server := transport.LinkedPeers()
+			go client.Send(&wamp.Hello{
+				Realm:   uri,
+				Details: wamp.Dict{"roles": clientRoles["roles"]},
+			})
+			if err := r.Attach(server); err != nil {
+				errChan <- err
+				return
+			}
+			msg, err := wamp.RecvTimeout(client, time.Second)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			if _, ok := msg.(*wamp.Welcome); !ok {
+				errChan <- fmt.Errorf("expected WELCOME, got %v", msg.MessageType())
+				return
+			}
+			client.Close()
+			errChan <- nil
+		}()
+	}
+	for i := 0; i < realmCount; i++ {
+		if err = <-errChan; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < realmCount; i++ {
+		uri := wamp.URI(fmt.Sprintf("nexus.test.auto%d", i))
+		realm, ok := r.GetRealm(uri)
+		if !ok {
+			t.Fatal("realm was not created:", uri)
+		}
+		if realm.URI() != uri {
+			t.Fatal("wrong realm URI:", realm.URI(), "expected", uri)
+		}
+	}
+	if template.URI != "" {
+		t.Fatal("realm template was modified")
+	}
+}
+
+func TestDynamicRealmChange(t *testing.T) {
+	defer leaktest.Check(t)
+
+	dr, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dr.Close()
+
+	realm2, err := dr.AddRealm(&RealmConfig{
+		URI:           testRealm2,
+		StrictURI:     false,
+		AnonymousAuth: true,
+		AllowDisclose: false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if realm2.URI() != testRealm2 {
+		t.Fatal("wrong realm URI:", realm2.URI())
+	}
+
+	cli, err := testClientInRealm(dr, testRealm2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli.Send(&wamp.Goodbye{})
+	msg, err := wamp.RecvTimeout(cli, time.Second)
+	if err != nil {
+		t.Fatal("no goodbye message after sending goodbye")
+	}
+	if _, ok := msg.(*wamp.Goodbye); !ok {
+		t.Fatalf("expected GOODBYE, received %s", msg.MessageType())
+	}
+
+	cli, err = testClientInRealm(dr, testRealm2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sync := make(chan wamp.Message)
+	go func() {
+		sync <- <-cli.Recv()
+	}()
+
+	if n := realm2.CountSessions(); n != 1 {
+		t.Fatal("expected 1 session in realm, got", n)
+	}
+
+	if err = dr.RemoveRealm(testRealm2); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("expected client to be booted when removing realm")
+	case msg := <-sync:
+		g, ok := msg.(*wamp.Goodbye)
+		if !ok {
+			t.Fatalf("expected GOODBYE, received %s", msg.MessageType())
+		}
+		if g.Reason != wamp.ErrSystemShutdown {
+			t.Fatal("wrong GOODBYE reason:", g.Reason)
+		}
+	}
+
+	if err = dr.RemoveRealm(testRealm2); err == nil {
+		t.Fatal("expected error removing realm that does not exist")
+	}
+}
+
+func TestRealmStats(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err = r.RealmStats("no.such.realm"); err == nil {
+		t.Fatal("expected error for nonexistent realm")
+	}
+	before, err := r.RealmStats(testRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	if msg, err := wamp.RecvTimeout(cli, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+	}
+	cli.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	if msg, err := wamp.RecvTimeout(cli, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got", msg.MessageType())
+	}
+	for i := 0; i < 3; i++ {
+		cli.Send(&wamp.Publish{
+			Request: wamp.GlobalID(),
+			Topic:   testTopic,
+			Options: wamp.Dict{wamp.OptAcknowledge: true},
+		})
+		if _, err = wamp.RecvTimeout(cli, time.Second); err != nil {
+			t.Fatal("timed out waiting for PUBLISHED")
+		}
+	}
+
+	stats, err := r.RealmStats(testRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Sessions != before.Sessions+1 {
+		t.Error("expected 1 more session, got", stats.Sessions-before.Sessions)
+	}
+	if stats.Subscriptions != before.Subscriptions+1 {
+		t.Error("expected 1 more subscription, got",
+			stats.Subscriptions-before.Subscriptions)
+	}
+	if stats.Registrations != before.Registrations+1 {
+		t.Error("expected 1 more registration, got",
+			stats.Registrations-before.Registrations)
+	}
+	if n := stats.Messages[wamp.SUBSCRIBE] - before.Messages[wamp.SUBSCRIBE]; n != 1 {
+		t.Error("expected 1 more SUBSCRIBE, got", n)
+	}
+	if n := stats.Messages[wamp.REGISTER] - before.Messages[wamp.REGISTER]; n != 1 {
+		t.Error("expected 1 more REGISTER, got", n)
+	}
+	if n := stats.Messages[wamp.PUBLISH] - before.Messages[wamp.PUBLISH]; n < 3 {
+		t.Error("expected at least 3 more PUBLISH, got", n)
+	}
+	if stats.Uptime < before.Uptime {
+		t.Error("uptime decreased")
+	}
+
+	// Changing the returned snapshot does not affect the realm.
+	stats.Messages[wamp.PUBLISH] = 0
+	if stats, _ = r.RealmStats(testRealm); stats.Messages[wamp.PUBLISH] == 0 {
+		t.Error("snapshot shares message counts with realm")
+	}
+	cli.Close()
+}
+
+func TestListRealms(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	realms := r.ListRealms()
+	if len(realms) != 1 || realms[0] != testRealm {
+		t.Fatal("expected only", testRealm, "got", realms)
+	}
+
+	if _, err = r.AddRealm(&RealmConfig{URI: testRealm2}); err != nil {
+		t.Fatal(err)
+	}
+	realms = r.ListRealms()
+	if len(realms) != 2 {
+		t.Fatal("expected 2 realms, got", len(realms))
+	}
+	found := map[wamp.URI]bool{}
+	for _, uri := range realms {
+		found[uri] = true
+	}
+	if !found[testRealm] || !found[testRealm2] {
+		t.Fatal("missing realm from list:", realms)
+	}
+
+	// Check that the previously returned slice is a snapshot.
+	if err = r.RemoveRealm(testRealm2); err != nil {
+		t.Fatal(err)
+	}
+	if len(realms) != 2 {
+		t.Fatal("realm list changed after removing realm")
+	}
+	if realms = r.ListRealms(); len(realms) != 1 {
+		t.Fatal("expected 1 realm, got", len(realms))
+	}
+}
+
+func TestGetRealm(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	realm, ok := r.GetRealm(testRealm)
+	if !ok {
+		t.Fatal("did not find realm", testRealm)
+	}
+	if realm.URI() != testRealm {
+		t.Fatal("wrong realm URI:", realm.URI())
+	}
+	if stats := realm.Stats(); stats.Sessions != 0 {
+		t.Fatal("expected 0 sessions, got", stats.Sessions)
+	}
+
+	if _, ok = r.GetRealm(testRealm2); ok {
+		t.Fatal("found realm that does not exist")
+	}
+	// Looking up a realm must not create it.
+	if realms := r.ListRealms(); len(realms) != 1 {
+		t.Fatal("expected 1 realm, got", len(realms))
+	}
+
+	r.Close()
+	if _, ok = r.GetRealm(testRealm); ok {
+		t.Fatal("found realm on closed router")
+	}
+}
+
+func TestRemoveRealmClosedRouter(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	if err = r.RemoveRealm(testRealm); err == nil {
+		t.Fatal("expected error removing realm from closed router")
+	}
+	if _, err = r.AddRealm(&RealmConfig{URI: testRealm2}); err == nil {
+		t.Fatal("expected error adding realm to closed router")
+	}
+	// Closing again must not panic or block.
+	r.Close()
+}
+
+func TestShutdown(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	msg, err := wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for REGISTERED")
+	}
+	if _, ok := msg.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED,got:", msg.MessageType())
+	}
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callID := wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: callID, Procedure: testProcedure})
+	msg, err = wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for INVOCATION")
+	}
+	invocation, ok := msg.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", msg.MessageType())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	errChan := make(chan error)
+	go func() { errChan <- r.Shutdown(ctx) }()
+
+	// Callee gets GOODBYE, but can still return the in-flight result.
+	msg, err = wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for GOODBYE")
+	}
+	goodbye, ok := msg.(*wamp.Goodbye)
+	if !ok {
+		t.Fatal("expected GOODBYE, got:", msg.MessageType())
+	}
+	if goodbye.Reason != wamp.CloseSystemShutdown {
+		t.Fatal("wrong GOODBYE reason:", goodbye.Reason)
+	}
+	callee.Send(&wamp.Yield{Request: invocation.Request})
+	callee.Send(&wamp.Goodbye{Reason: wamp.ErrGoodbyeAndOut, Details: wamp.Dict{}})
+
+	// Caller gets GOODBYE and the RESULT, in either order.
+	var gotResult, gotGoodbye bool
+	for i := 0; i < 2; i++ {
+		msg, err = wamp.RecvTimeout(caller, time.Second)
+		if err != nil {
+			t.Fatal("Timed out waiting for RESULT and GOODBYE")
+		}
+		switch msg := msg.(type) {
+		case *wamp.Result:
+			if msg.Request != callID {
+				t.Fatal("wrong result ID")
+			}
+			gotResult = true
+		case *wamp.Goodbye:
+			gotGoodbye = true
+		default:
+			t.Fatal("unexpected message:", msg.MessageType())
+		}
+	}
+	if !gotResult || !gotGoodbye {
+		t.Fatal("expected RESULT and GOODBYE")
+	}
+	caller.Send(&wamp.Goodbye{Reason: wamp.ErrGoodbyeAndOut, Details: wamp.Dict{}})
+
+	if err = <-errChan; err != nil {
+		t.Fatal("unexpected error from Shutdown:", err)
+	}
+
+	// Router must not reply to the GOODBYE acknowledgement.
+	for msg = range callee.Recv() {
+		t.Fatal("unexpected message after GOODBYE:", msg.MessageType())
+	}
+
+	// Router is closed after shutdown.
+	if _, err = testClient(r); err == nil {
+		t.Fatal("expected error attaching to shut down router")
+	}
+	r.Close()
+}
+
+func TestDrainRealm(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	msg, err := wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for REGISTERED")
+	}
+	if _, ok := msg.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED,got:", msg.MessageType())
+	}
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callID := wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: callID, Procedure: testProcedure})
+	msg, err = wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for INVOCATION")
+	}
+	invocation, ok := msg.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", msg.MessageType())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	errChan := make(chan error)
+	go func() { errChan <- r.DrainRealm(ctx, testRealm) }()
+
+	// Callee gets GOODBYE, and completes the in-flight call during the drain.
+	msg, err = wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for GOODBYE")
+	}
+	if _, ok = msg.(*wamp.Goodbye); !ok {
+		t.Fatal("expected GOODBYE, got:", msg.MessageType())
+	}
+	callee.Send(&wamp.Yield{Request: invocation.Request})
+	callee.Send(&wamp.Goodbye{Reason: wamp.ErrGoodbyeAndOut, Details: wamp.Dict{}})
+
+	// Caller gets GOODBYE and the RESULT, in either order.
+	var gotResult, gotGoodbye bool
+	for i := 0; i < 2; i++ {
+		msg, err = wamp.RecvTimeout(caller, time.Second)
+		if err != nil {
+			t.Fatal("Timed out waiting for RESULT and GOODBYE")
+		}
+		switch msg := msg.(type) {
+		case *wamp.Result:
+			if msg.Request != callID {
+				t.Fatal("wrong result ID")
+			}
+			gotResult = true
+		case *wamp.Goodbye:
+			gotGoodbye = true
+		default:
+			t.Fatal("unexpected message:", msg.MessageType())
+		}
+	}
+	if !gotResult || !gotGoodbye {
+		t.Fatal("expected RESULT and GOODBYE")
+	}
+	caller.Send(&wamp.Goodbye{Reason: wamp.ErrGoodbyeAndOut, Details: wamp.Dict{}})
+
+	if err = <-errChan; err != nil {
+		t.Fatal("unexpected error from DrainRealm:", err)
+	}
+
+	// The realm is removed, but the router is still running.
+	if _, ok = r.GetRealm(testRealm); ok {
+		t.Fatal("realm still exists after drain")
+	}
+	if err = r.DrainRealm(ctx, testRealm); err == nil {
+		t.Fatal("expected error draining nonexistent realm")
+	}
+	if _, err = r.AddRealm(&RealmConfig{URI: testRealm2}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRealmDrainMetaProcedure(t *testing.T) {
+	defer leaktest.Check(t)()
+	const adminRealm = wamp.URI("nexus.test.drain.admin")
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:            testRealm,
+				AnonymousAuth:  true,
+				MetaDrainRoles: []string{"trusted"},
+			},
+			{
+				URI:            adminRealm,
+				AnonymousAuth:  true,
+				MetaDrainRoles: []string{"admin"},
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Local client has authrole "trusted", which may not drain adminRealm.
+	cli, err := testClientInRealm(r, adminRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcRealmDrain})
+	msg, err := wamp.RecvTimeout(cli, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := msg.(*wamp.Error); !ok || e.Error != wamp.ErrNotAuthorized {
+		t.Fatal("Expected not authorized ERROR, got", msg)
+	}
+	cli.Close()
+
+	cli1, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli2, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli1.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcRealmDrain,
+		Arguments: wamp.List{200},
+	})
+	msg, err = wamp.RecvTimeout(cli1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("Expected RESULT, got", msg.MessageType())
+	}
+	if n, _ := wamp.AsInt64(result.Arguments[0]); n != 2 {
+		t.Fatal("Expected 2 sessions drained, got", n)
+	}
+
+	// During the grace period, new subscriptions and sessions are rejected.
+	cli2.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	msg, err = wamp.RecvTimeout(cli2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := msg.(*wamp.Error); !ok || e.Error != wamp.ErrSystemShutdown {
+		t.Fatal("Expected system shutdown ERROR, got", msg)
+	}
+	if _, err = testClient(r); err == nil {
+		t.Fatal("Expected attach to draining realm to fail")
+	}
+
+	// After the grace period, every session is sent GOODBYE.
+	for _, c := range []*wamp.Session{cli1, cli2} {
+		msg, err = wamp.RecvTimeout(c, time.Second)
+		if err != nil {
+			t.Fatal("Timed out waiting for GOODBYE")
+		}
+		if _, ok = msg.(*wamp.Goodbye); !ok {
+			t.Fatal("Expected GOODBYE, got", msg.MessageType())
+		}
+		c.Send(&wamp.Goodbye{Reason: wamp.ErrGoodbyeAndOut, Details: wamp.Dict{}})
+	}
+
+	// The drained realm is removed from the router.
+	if _, ok = r.GetRealm(testRealm); ok {
+		t.Fatal("Drained realm was not removed")
+	}
+	if _, err = testClient(r); err == nil {
+		t.Fatal("Expected attach to drained realm to fail")
+	}
+
+	cli1.Close()
+	cli2.Close()
+}
+
+func TestRealmDrainDuringClose(t *testing.T) {
+	defer leaktest.Check(t)()
+	for i := 0; i < 20; i++ {
+		r, err := NewRouter(&Config{
+			RealmConfigs: []*RealmConfig{
+				{
+					URI:            testRealm,
+					AnonymousAuth:  true,
+					MetaDrainRoles: []string{"trusted"},
+				},
+			},
+			Debug: debug,
+		}, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli, err := testClient(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Call drain and close the router at the same time.  Neither may
+		// block the other.
+		cli.Send(&wamp.Call{
+			Request:   wamp.GlobalID(),
+			Procedure: wamp.MetaProcRealmDrain,
+			Arguments: wamp.List{0},
+		})
+		closed := make(chan struct{})
+		go func() {
+			r.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("router close deadlocked with realm drain")
+		}
+		cli.Close()
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Client never replies to GOODBYE, so shutdown must give up.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = r.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expected deadline exceeded error, got:", err)
+	}
+	msg, err := wamp.RecvTimeout(cli, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for GOODBYE")
+	}
+	if _, ok := msg.(*wamp.Goodbye); !ok {
+		t.Fatal("expected GOODBYE, got:", msg.MessageType())
+	}
+}
+
+func TestInvalidDisclosePolicy(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				DisclosePublisher: "sometimes",
+			},
+		},
+		Debug: debug,
+	}
+	if _, err := NewRouter(config, logger); err == nil {
+		t.Fatal("expected error for invalid disclose_publisher policy")
+	}
+
+	config.RealmConfigs[0].DisclosePublisher = ""
+	config.RealmConfigs[0].DiscloseCaller = "sometimes"
+	if _, err := NewRouter(config, logger); err == nil {
+		t.Fatal("expected error for invalid disclose_caller policy")
+	}
+}
+
+func TestSlowConsumerDropped(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				OutQueueSize:  4,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	slow, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	if msg, err := wamp.RecvTimeout(slow, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+	}
+
+	// The slow subscriber stops reading while many publishers publish.
+	const publishers = 8
+	const pubCount = 100
+	errChan := make(chan error, publishers)
+	for i := 0; i < publishers; i++ {
+		pub, err := testClient(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for j := 0; j < pubCount; j++ {
+				pub.Send(&wamp.Publish{
+					Request:   wamp.GlobalID(),
+					Topic:     testTopic,
+					Options:   wamp.Dict{wamp.OptAcknowledge: true},
+					Arguments: wamp.List{j},
+				})
+				if _, err := wamp.RecvTimeout(pub, time.Second); err != nil {
+					errChan <- errors.New("timed out waiting for PUBLISHED")
+					return
+				}
+			}
+			errChan <- nil
+		}()
+	}
+	for i := 0; i < publishers; i++ {
+		if err = <-errChan; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The slow subscriber must have been removed from the realm.  Once it has
+	// read what was already delivered, it gets a GOODBYE and its connection is
+	// closed.
+	var last wamp.Message
+	timeout := time.After(time.Second)
+	for open := true; open; {
+		var msg wamp.Message
+		select {
+		case msg, open = <-slow.Recv():
+			if open {
+				last = msg
+			}
+		case <-timeout:
+			t.Fatal("slow subscriber was not dropped")
+		}
+	}
+	goodbye, ok := last.(*wamp.Goodbye)
+	if !ok {
+		t.Fatal("expected GOODBYE as last message, got", last)
+	}
+	if goodbye.Reason != wamp.ErrSystemShutdown {
+		t.Fatal("wrong GOODBYE reason:", goodbye.Reason)
+	}
+	stats, err := r.RealmStats(testRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Sessions != publishers {
+		t.Fatal("expected", publishers, "sessions, got", stats.Sessions)
+	}
+}
+
+func TestOutQueueAbort(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				OutQueueSize:  4,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A client must not send WELCOME, so the session is aborted.
+	client.Send(&wamp.Welcome{ID: wamp.GlobalID()})
+	msg, err := wamp.RecvTimeout(client, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for ABORT")
+	}
+	abort, ok := msg.(*wamp.Abort)
+	if !ok {
+		t.Fatal("expected ABORT, got", msg.MessageType())
+	}
+	if abort.Reason != wamp.ErrProtocolViolation {
+		t.Fatal("wrong ABORT reason:", abort.Reason)
+	}
+}
+
+func TestOutQueueFlushOnClose(t *testing.T) {
+	defer leaktest.Check(t)()
+	client, server := transport.LinkedPeers()
+	qp := newQueuedPeer(server, 4, true, nil)
+
+	for i := 0; i < 4; i++ {
+		if err := qp.TrySend(&wamp.Event{Publication: wamp.ID(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	qp.TrySend(makeGoodbye(wamp.CloseNormal, ""))
+	qp.Close()
+
+	for i := 0; i < 4; i++ {
+		msg, err := wamp.RecvTimeout(client, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		event, ok := msg.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected EVENT, got", msg.MessageType())
+		}
+		if event.Publication != wamp.ID(i) {
+			t.Fatal("wrong publication ID:", event.Publication)
+		}
+	}
+	msg, err := wamp.RecvTimeout(client, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*wamp.Goodbye); !ok {
+		t.Fatal("expected GOODBYE, got", msg.MessageType())
+	}
+	if err = qp.TrySend(&wamp.Event{}); err == nil {
+		t.Fatal("expected error sending to closed queue")
+	}
+}
+
+func TestInvalidOutQueuePolicy(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:            testRealm,
+				OutQueuePolicy: "sometimes",
+			},
+		},
+		Debug: debug,
+	}
+	if _, err := NewRouter(config, logger); err == nil {
+		t.Fatal("expected error for invalid out_queue_policy")
+	}
+}
+
+func TestMessageRateLimit(t *testing.T) {
+	defer leaktest.Check(t)()
+	const burst = 5
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:          testRealm,
+				MessageRate:  1,
+				MessageBurst: burst,
+			},
+			{
+				URI:             testRealm2,
+				MessageRate:     1,
+				MessageBurst:    burst,
+				RateLimitReason: "nexus.test.rate_limited",
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	publish := func(cli *wamp.Session, count int) {
+		for i := 0; i < count; i++ {
+			cli.Send(&wamp.Publish{
+				Request: wamp.GlobalID(),
+				Topic:   testTopic,
+				Options: wamp.Dict{wamp.OptAcknowledge: true},
+			})
+		}
+	}
+
+	// A burst above the limit is throttled.
+	cli, err := testClientInRealm(r, testRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(cli, 4*burst)
+	var published int
+	for {
+		msg, err := wamp.RecvTimeout(cli, 200*time.Millisecond)
+		if err != nil {
+			break
+		}
+		if _, ok := msg.(*wamp.Published); !ok {
+			t.Fatal("expected PUBLISHED, got", msg.MessageType())
+		}
+		published++
+	}
+	if published < burst || published > burst+1 {
+		t.Fatal("expected", burst, "messages to be accepted, got", published)
+	}
+	cli.Close()
+
+	// Sustained violation ends the session.  The session is ended when more
+	// than a burst of messages is dropped, so send no more than that, since
+	// the session stops reading once ended.
+	cli, err = testClientInRealm(r, testRealm2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(cli, 2*burst+1)
+	for {
+		msg, err := wamp.RecvTimeout(cli, time.Second)
+		if err != nil {
+			t.Fatal("session was not ended for exceeding message rate")
+		}
+		if g, ok := msg.(*wamp.Goodbye); ok {
+			if g.Reason != "nexus.test.rate_limited" {
+				t.Fatal("wrong GOODBYE reason:", g.Reason)
+			}
+			break
+		}
+	}
+	cli.Close()
+}
+
+func TestMaxPayloadSize(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:            testRealm,
+				MaxPayloadSize: 64,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	big := strings.Repeat("x", 100)
+	expectSizeErr := func(cli *wamp.Session, msgType wamp.MessageType) {
+		msg, err := wamp.RecvTimeout(cli, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, ok := msg.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got", msg.MessageType())
+		}
+		if e.Type != msgType || e.Error != wamp.ErrPayloadSizeExceeded {
+			t.Fatal("wrong error:", e.Type, e.Error)
+		}
+	}
+
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// Oversize publish.
+	cli.Send(&wamp.Publish{
+		Request:   wamp.GlobalID(),
+		Topic:     testTopic,
+		Options:   wamp.Dict{wamp.OptAcknowledge: true},
+		Arguments: wamp.List{big},
+	})
+	expectSizeErr(cli, wamp.PUBLISH)
+	cli.Send(&wamp.Publish{
+		Request:     wamp.GlobalID(),
+		Topic:       testTopic,
+		Options:     wamp.Dict{wamp.OptAcknowledge: true},
+		ArgumentsKw: wamp.Dict{"small": "payload"},
+	})
+	if msg, err := wamp.RecvTimeout(cli, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Published); !ok {
+		t.Fatal("expected PUBLISHED, got", msg.MessageType())
+	}
+
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer callee.Close()
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	if msg, err := wamp.RecvTimeout(callee, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got", msg.MessageType())
+	}
+
+	// Oversize call is not sent to the callee.
+	cli.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: testProcedure,
+		Arguments: wamp.List{big},
+	})
+	expectSizeErr(cli, wamp.CALL)
+	if _, err = wamp.RecvTimeout(callee, time.Millisecond); err == nil {
+		t.Fatal("callee should not have received INVOCATION")
+	}
+
+	// Oversize yield results in an error to the caller.
+	cli.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: testProcedure})
+	msg, err := wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, ok := msg.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got", msg.MessageType())
+	}
+	callee.Send(&wamp.Yield{Request: inv.Request, Arguments: wamp.List{big}})
+	expectSizeErr(cli, wamp.CALL)
+}
+
+func TestAutoRealmLimits(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &Config{
+		RealmTemplate: &RealmConfig{AnonymousAuth: true},
+		MaxAutoRealms: 2,
+		AutoRealmAllowed: func(uri wamp.URI) bool {
+			return strings.HasPrefix(string(uri), "nexus.auto.")
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// attach returns the reply to a HELLO for the realm.
+	attach := func(uri wamp.URI) wamp.Message {
+		client, server := transport.LinkedPeers()
+		defer client.Close()
+		go client.Send(&wamp.Hello{
+			Realm:   uri,
+			Details: wamp.Dict{"roles": wamp.Dict{"caller": wamp.Dict{}}},
+		})
+		r.Attach(server)
+		msg, err := wamp.RecvTimeout(client, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	checkAbort := func(msg wamp.Message) {
+		abort, ok := msg.(*wamp.Abort)
+		if !ok {
+			t.Fatal("expected ABORT, got", msg.MessageType())
+		}
+		if abort.Reason != wamp.ErrNoSuchRealm {
+			t.Fatal("wrong ABORT reason:", abort.Reason)
+		}
+	}
+
+	// Realm not allowed.
+	checkAbort(attach("nexus.other.realm"))
+	if _, ok := r.GetRealm("nexus.other.realm"); ok {
+		t.Fatal("disallowed realm was created")
+	}
+
+	for _, uri := range []wamp.URI{"nexus.auto.one", "nexus.auto.two"} {
+		if msg := attach(uri); msg.MessageType() != wamp.WELCOME {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+	}
+	// Joining an existing realm does not count against the limit.
+	if msg := attach("nexus.auto.one"); msg.MessageType() != wamp.WELCOME {
+		t.Fatal("expected WELCOME, got", msg.MessageType())
+	}
+
+	// Limit reached.
+	checkAbort(attach("nexus.auto.three"))
+
+	// Removing an auto-created realm makes room for another.
+	if err = r.RemoveRealm("nexus.auto.one"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := attach("nexus.auto.three"); msg.MessageType() != wamp.WELCOME {
+		t.Fatal("expected WELCOME, got", msg.MessageType())
+	}
+}
+
+// TestSessionDetailsRace exercises session details from many goroutines at
+// once.  Run with -race to detect unsynchronized access.
+func TestSessionDetailsRace(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:              testRealm,
+				AnonymousAuth:    true,
+				AllowDisclose:    true,
+				EnableMetaModify: true,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Read the details published in session on_join events, while the joining
+	// sessions modify their details.
+	watcher, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	watcher.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: wamp.MetaEventSessionOnJoin})
+	msg, err := wamp.RecvTimeout(watcher, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for SUBSCRIBED")
+	}
+	if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+	}
+	stopWatch := make(chan struct{})
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		for {
+			select {
+			case msg := <-watcher.Recv():
+				if event, ok := msg.(*wamp.Event); ok {
+					_ = fmt.Sprint(event.Arguments)
+				}
+			case <-stopWatch:
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stopWatch)
+		<-watchDone
+	}()
+
+	const numClients = 8
+	var wg sync.WaitGroup
+	errChan := make(chan error, numClients)
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errChan <- sessionDetailsWorkload(r, i)
+		}(i)
+	}
+	wg.Wait()
+	close(errChan)
+	for err := range errChan {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sessionDetailsWorkload attaches a client that subscribes, publishes with
+// disclosure, and reads and modifies session details through the meta API,
+// and then leaves.
+func sessionDetailsWorkload(r Router, n int) error {
+	client, server := transport.LinkedPeers()
+	defer client.Close()
+	go client.Send(&wamp.Hello{
+		Realm: testRealm,
+		Details: wamp.Dict{
+			"authid": fmt.Sprintf("user%d", n),
+			"roles": wamp.Dict{
+				"publisher":  wamp.Dict{},
+				"subscriber": wamp.Dict{"features": wamp.Dict{featurePubIdent: true}},
+				"caller":     wamp.Dict{},
+			},
+		},
+	})
+	if err := r.Attach(server); err != nil {
+		return err
+	}
+	msg, err := wamp.RecvTimeout(client, time.Second)
+	if err != nil {
+		return err
+	}
+	welcome, ok := msg.(*wamp.Welcome)
+	if !ok {
+		return fmt.Errorf("expected WELCOME, got %s", msg.MessageType())
+	}
+
+	// Read until the router ends the session.
+	done := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := wamp.RecvTimeout(client, 5*time.Second)
+			if err != nil {
+				done <- fmt.Errorf("session %d not ended: %s", welcome.ID, err)
+				return
+			}
+			if _, ok := msg.(*wamp.Goodbye); ok {
+				done <- nil
+				return
+			}
+		}
+	}()
+
+	// Send requests without waiting for replies, so that they are processed
+	// concurrently with the other clients' requests.
+	client.Send(&wamp.Subscribe{Request: 1, Topic: testTopic, Options: wamp.Dict{}})
+	const rounds = 20
+	for i := 0; i < rounds; i++ {
+		client.Send(&wamp.Publish{
+			Request: wamp.ID(100 + i),
+			Topic:   testTopic,
+			Options: wamp.Dict{wamp.OptDiscloseMe: true, wamp.OptExcludeMe: false},
+		})
+		client.Send(&wamp.Call{
+			Request:   wamp.ID(200 + i),
+			Procedure: wamp.MetaProcSessionModifyDetails,
+			Arguments: wamp.List{welcome.ID, wamp.Dict{"xyzzy": i}},
+		})
+		client.Send(&wamp.Call{
+			Request:   wamp.ID(300 + i),
+			Procedure: wamp.MetaProcSessionGet,
+			Arguments: wamp.List{welcome.ID},
+		})
+		client.Send(&wamp.Call{
+			Request:   wamp.ID(400 + i),
+			Procedure: wamp.MetaProcSessionList,
+			Arguments: wamp.List{wamp.List{"anonymous"}},
+		})
+	}
+	client.Send(&wamp.Goodbye{Reason: wamp.CloseRealm, Details: wamp.Dict{}})
+	return <-done
+}
+
+func TestIDGenerator(t *testing.T) {
+	defer leaktest.Check(t)()
+	// Generate sequential IDs prefixed with a node number, as a clustered
+	// router might.
+	const nodePrefix = wamp.ID(7 << 40)
+	var seq wamp.SyncIDGen
+	var generated int64
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{URI: testRealm},
+		},
+		IDGenerator: func() wamp.ID {
+			atomic.AddInt64(&generated, 1)
+			return nodePrefix | seq.Next()
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	join := func() (wamp.Peer, wamp.ID) {
+		client, server := transport.LinkedPeers()
+		go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+		if err := r.Attach(server); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := wamp.RecvTimeout(client, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		welcome, ok := msg.(*wamp.Welcome)
+		if !ok {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+		return client, welcome.ID
+	}
+
+	subscriber, sid := join()
+	defer subscriber.Close()
+	if sid != nodePrefix|1 {
+		t.Fatal("expected first session ID", nodePrefix|1, "got", sid)
+	}
+	subscriber.Send(&wamp.Subscribe{Request: 1, Topic: testTopic})
+	if msg, err := wamp.RecvTimeout(subscriber, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+	}
+
+	publisher, pid := join()
+	defer publisher.Close()
+	publisher.Send(&wamp.Publish{Request: 2, Topic: testTopic})
+	msg, err := wamp.RecvTimeout(subscriber, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, ok := msg.(*wamp.Event)
+	if !ok {
+		t.Fatal("expected EVENT, got", msg.MessageType())
+	}
+
+	// Session meta events also get publication IDs, so the exact sequence
+	// numbers after the first session depend on timing.
+	n := wamp.ID(atomic.LoadInt64(&generated))
+	for _, id := range []wamp.ID{pid, event.Publication} {
+		if id&^nodePrefix > n || id&nodePrefix != nodePrefix {
+			t.Fatal("ID", id, "not from generator")
+		}
+	}
+	if event.Publication <= pid {
+		t.Fatal("publication ID", event.Publication, "not after session ID", pid)
+	}
+}
+
+func TestTransportClosedCleanup(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Watch for the on_leave meta event.
+	watcher, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher.Send(&wamp.Subscribe{Request: 1, Topic: wamp.MetaEventSessionOnLeave})
+	if msg, err := wamp.RecvTimeout(watcher, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
 	}
-	exact := dict["exact"].([]wamp.ID)
-	prefix := dict["prefix"].([]wamp.ID)
-	wildcard := dict["wildcard"].([]wamp.ID)
 
-	if len(exact) != len(exactPrev)+1 {
-		t.Error("expected additional exact match")
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	// Get the router's side of the session, to check its resources.
+	sess, err := r.(*router).attachClient(context.Background(), server, nil, "")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if len(prefix) != len(prefixPrev) {
-		t.Error("prefix matches should not have changed")
+	if _, err = wamp.RecvTimeout(client, time.Second); err != nil {
+		t.Fatal(err)
 	}
-	if len(wildcard) != len(wildcardPrev)+1 {
-		t.Error("expected additional wildcard match")
+	client.Send(&wamp.Subscribe{Request: 2, Topic: testTopic})
+	client.Send(&wamp.Register{Request: 3, Procedure: testProcedure})
+	for i := 0; i < 2; i++ {
+		if _, err = wamp.RecvTimeout(client, time.Second); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	var found bool
-	for i := range exact {
-		if exact[i] == subscriptionID {
-			found = true
-			break
-		}
+	rlm, _ := r.GetRealm(testRealm)
+	realm := rlm.(*realm)
+	if len(realm.broker.sessionSubscriptions(sess)) != 1 {
+		t.Fatal("expected subscription for session")
 	}
-	if !found {
-		t.Error("missing expected subscription ID")
+	if len(realm.dealer.sessionRegistrations(sess)) != 1 {
+		t.Fatal("expected registration for session")
 	}
 
-	// ----- Test wamp.subscription.lookup meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcSubLookup,
-		Arguments: wamp.List{testTopic},
-	})
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+	// Close the client's transport without sending GOODBYE.
+	client.Close()
+
+	msg, err := wamp.RecvTimeout(watcher, time.Second)
 	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
+		t.Fatal("did not get on_leave event:", err)
 	}
-	result, ok = msg.(*wamp.Result)
+	event, ok := msg.(*wamp.Event)
 	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
+		t.Fatal("expected EVENT, got", msg.MessageType())
 	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+	if sid, _ := wamp.AsID(event.Arguments[0]); sid != sess.ID {
+		t.Fatal("on_leave for wrong session:", sid)
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+
+	if sess.Goodbye() != wamp.NoGoodbye {
+		t.Fatal("session was not ended")
 	}
-	subID, ok := result.Arguments[0].(wamp.ID)
-	if !ok {
-		t.Fatal("expected wamp.ID")
+	if len(realm.broker.sessionSubscriptions(sess)) != 0 {
+		t.Fatal("subscription not removed after transport closed")
 	}
-	if subID != subscriptionID {
-		t.Fatal("received wrong subscription ID")
+	if len(realm.dealer.sessionRegistrations(sess)) != 0 {
+		t.Fatal("registration not removed after transport closed")
 	}
+	if _, _, ok = rlm.SessionResources(sess.ID); ok {
+		t.Fatal("session still in realm after transport closed")
+	}
+}
 
-	// ----- Test wamp.subscription.match meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcSubMatch,
-		Arguments: wamp.List{testTopic},
-	})
-	msg, err = wamp.RecvTimeout(caller, time.Second)
-	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
+func TestRealmFactory(t *testing.T) {
+	defer leaktest.Check(t)()
+	// Each tenant realm gets its own authrole for anonymous clients.
+	tenantRoles := map[wamp.URI]string{
+		"nexus.tenant.a": "tenant-a",
+		"nexus.tenant.b": "tenant-b",
 	}
-	result, ok = msg.(*wamp.Result)
-	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
+	config := &Config{
+		RealmFactory: func(uri wamp.URI) (*RealmConfig, error) {
+			role, ok := tenantRoles[uri]
+			if !ok {
+				return nil, errors.New("unknown tenant")
+			}
+			return &RealmConfig{
+				Authenticators: []auth.Authenticator{
+					&auth.AnonymousAuth{AuthRole: role},
+				},
+			}, nil
+		},
+		Debug: debug,
 	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	defer r.Close()
+
+	// attach returns the reply to a HELLO, from a non-local client, for the
+	// realm.
+	attach := func(uri wamp.URI) wamp.Message {
+		client, server := transport.LinkedPeers()
+		defer client.Close()
+		go client.Send(&wamp.Hello{Realm: uri, Details: clientRoles})
+		r.Attach(&addrPeer{Peer: server, addr: "10.0.0.1:4321"})
+		msg, err := wamp.RecvTimeout(client, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
 	}
-	subIDs, ok := wamp.AsList(result.Arguments[0])
+
+	for uri, role := range tenantRoles {
+		msg := attach(uri)
+		welcome, ok := msg.(*wamp.Welcome)
+		if !ok {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+		if authrole, _ := wamp.AsString(welcome.Details["authrole"]); authrole != role {
+			t.Fatal("wrong authrole for", uri, ":", authrole)
+		}
+	}
+
+	msg := attach("nexus.tenant.c")
+	abort, ok := msg.(*wamp.Abort)
 	if !ok {
-		t.Fatal("expected wamp.List")
+		t.Fatal("expected ABORT, got", msg.MessageType())
 	}
-	if len(subIDs) != 2 {
-		t.Error("expected 2 subscriptions for wamp.subscription.match, got", len(subIDs))
+	if abort.Reason != wamp.ErrNoSuchRealm {
+		t.Fatal("wrong ABORT reason:", abort.Reason)
+	}
+	if errMsg, _ := wamp.AsString(abort.Details["error"]); errMsg != "unknown tenant" {
+		t.Fatal("wrong ABORT error:", errMsg)
+	}
+	if _, ok = r.GetRealm("nexus.tenant.c"); ok {
+		t.Fatal("rejected realm was created")
 	}
+}
 
-	// ----- Test wamp.subscription.get meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcSubGet,
-		Arguments: wamp.List{subscriptionID},
-	})
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+func TestCalleeGoneErrorsCaller(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
 	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
-	}
-	result, ok = msg.(*wamp.Result)
-	if !ok {
-		t.Fatalf("expected RESULT, got %s %+v", msg.MessageType(), msg)
+		t.Fatal(err)
 	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+	defer r.Close()
+
+	callee, server := transport.LinkedPeers()
+	go callee.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	if err = r.Attach(server); err != nil {
+		t.Fatal(err)
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	if _, err = wamp.RecvTimeout(callee, time.Second); err != nil {
+		t.Fatal(err)
 	}
-	dict, ok = result.Arguments[0].(wamp.Dict)
-	if !ok {
-		t.Fatal("expected wamp.Dict")
+	callee.Send(&wamp.Register{Request: 1, Procedure: testProcedure})
+	if msg, err := wamp.RecvTimeout(callee, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got", msg.MessageType())
 	}
-	subID, _ = wamp.AsID(dict["id"])
-	if subID != subscriptionID {
-		t.Fatal("received wrong subscription")
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
 	}
-	uri, _ := wamp.AsURI(dict["uri"])
-	if uri != testTopic {
-		t.Fatal("subscription has wrong uri:", uri)
+	caller.Send(&wamp.Call{Request: 2, Procedure: testProcedure})
+	if msg, err := wamp.RecvTimeout(callee, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got", msg.MessageType())
 	}
 
-	// ----- Test wamp.subscription.list_subscribers meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcSubListSubscribers,
-		Arguments: wamp.List{subscriptionID},
-	})
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+	// Callee disconnects without yielding.
+	callee.Close()
+
+	msg, err := wamp.RecvTimeout(caller, time.Second)
 	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
+		t.Fatal("caller did not get error when callee left:", err)
 	}
-	result, ok = msg.(*wamp.Result)
+	errMsg, ok := msg.(*wamp.Error)
 	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
-	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+		t.Fatal("expected ERROR, got", msg.MessageType())
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	if errMsg.Type != wamp.CALL || errMsg.Request != 2 {
+		t.Fatal("wrong ERROR for call:", errMsg.Type, errMsg.Request)
 	}
-	idList, ok := result.Arguments[0].([]wamp.ID)
-	if !ok {
-		t.Fatal("Expected []wamp.ID")
+	if errMsg.Error != wamp.ErrCanceled {
+		t.Fatal("wrong error URI:", errMsg.Error)
 	}
-	if len(idList) != 1 {
-		t.Fatal("Expected 1 subscriber in list")
+}
+
+func TestRealmContextCanceledOnClose(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:            testRealm,
+				AnonymousAuth:  true,
+				PublishWorkers: 4,
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if idList[0] != sessID {
-		t.Fatal("Wrong subscriber session ID")
+
+	rlm, _ := r.GetRealm(testRealm)
+	realmCtx := rlm.(*realm).Context()
+	if realmCtx.Err() != nil {
+		t.Fatal("realm context canceled before close")
 	}
 
-	// ----- Test wamp.subscription.count_subscribers meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcSubCountSubscribers,
-		Arguments: wamp.List{subscriptionID},
-	})
-	msg, err = wamp.RecvTimeout(caller, time.Second)
+	// Leave work in progress: a subscription, and a call with a timeout that
+	// is still pending with its callee.
+	callee, err := testClient(r)
 	if err != nil {
-		t.Fatal("Timed out waiting for RESULT")
-	}
-	result, ok = msg.(*wamp.Result)
-	if !ok {
-		t.Fatal("expected RESULT, got", msg.MessageType())
+		t.Fatal(err)
 	}
-	if result.Request != callID {
-		t.Fatal("wrong result ID")
+	callee.Send(&wamp.Subscribe{Request: 1, Topic: testTopic})
+	callee.Send(&wamp.Register{Request: 2, Procedure: testProcedure})
+	for i := 0; i < 2; i++ {
+		if _, err = wamp.RecvTimeout(callee, time.Second); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
 	}
-	count, ok := wamp.AsInt64(result.Arguments[0])
-	if !ok {
-		t.Fatal("Argument is not an int")
+	caller.Send(&wamp.Call{
+		Request:   3,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: 60000},
+	})
+	if msg, err := wamp.RecvTimeout(callee, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got", msg.MessageType())
 	}
-	if count != 1 {
-		t.Fatal("Wring number of subscribers")
+
+	r.Close()
+
+	select {
+	case <-realmCtx.Done():
+	default:
+		t.Fatal("realm context not canceled by router close")
 	}
+	// The deferred leak check verifies that no realm, broker, dealer, worker,
+	// or timer goroutines remain.
 }
 
-func TestDynamicRealmChange(t *testing.T) {
-	defer leaktest.Check(t)
+func TestAuthroleQuotas(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				AuthroleQuotas: map[string]Quota{
+					"trusted": {MaxSessions: 1, MaxRegistrations: 1},
+				},
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
 
-	dr, err := newTestRouter()
+	cli, err := testClient(r)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer dr.Close()
+	if _, err = testClient(r); err == nil {
+		t.Fatal("expected session quota to reject second session")
+	}
 
-	err = dr.AddRealm(&RealmConfig{
-		URI:           testRealm2,
-		StrictURI:     false,
-		AnonymousAuth: true,
-		AllowDisclose: false,
-	})
+	register := func(procedure wamp.URI) wamp.Message {
+		cli.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: procedure})
+		msg, err := wamp.RecvTimeout(cli, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	if msg := register("nexus.test.quota.one"); msg.MessageType() != wamp.REGISTERED {
+		t.Fatal("expected REGISTERED, got", msg.MessageType())
+	}
+	msg := register("nexus.test.quota.two")
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("expected ERROR", wamp.ErrNotAuthorized, "got", msg)
+	}
+
+	// The session quota is released when the session leaves.
+	cli.Send(&wamp.Goodbye{Reason: wamp.CloseRealm, Details: wamp.Dict{}})
+	if _, err = wamp.RecvTimeout(cli, time.Second); err != nil {
+		t.Fatal("timed out waiting for GOODBYE")
+	}
+	realm, _ := r.GetRealm(testRealm)
+	for i := 0; realm.CountSessions() != 0; i++ {
+		if i == 100 {
+			t.Fatal("session did not leave realm")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cli, err = testClient(r)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if msg = register("nexus.test.quota.two"); msg.MessageType() != wamp.REGISTERED {
+		t.Fatal("expected REGISTERED, got", msg.MessageType())
+	}
+	cli.Close()
+}
 
-	cli, err := testClientInRealm(dr, testRealm2)
+func TestNullVsEmptyArgs(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer r.Close()
 
-	cli.Send(&wamp.Goodbye{})
-	msg, err := wamp.RecvTimeout(cli, time.Second)
+	sub, err := testClient(r)
 	if err != nil {
-		t.Fatal("no goodbye message after sending goodbye")
+		t.Fatal(err)
 	}
-	if _, ok := msg.(*wamp.Goodbye); !ok {
-		t.Fatalf("expected GOODBYE, received %s", msg.MessageType())
+	sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	if msg, err := wamp.RecvTimeout(sub, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
 	}
-
-	cli, err = testClientInRealm(dr, testRealm2)
+	pub, err := testClient(r)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	sync := make(chan wamp.Message)
-	go func() {
-		sync <- <-cli.Recv()
-	}()
-
-	dr.RemoveRealm(testRealm2)
-
-	select {
-	case <-time.After(time.Second):
-		t.Fatal("expected client to be booted when removing realm")
-	case msg := <-sync:
-		if _, ok := msg.(*wamp.Goodbye); !ok {
-			t.Fatalf("expected GOODBYE, received %s", msg.MessageType())
+	// Publish events that differ only in having null or empty args, as they
+	// are decoded from "args: null" and "args: []".  The subscriber must get
+	// the same event for each.
+	var s serialize.JSONSerializer
+	var expect []byte
+	for _, args := range []wamp.List{nil, {}} {
+		pub.Send(&wamp.Publish{
+			Request:     wamp.GlobalID(),
+			Options:     wamp.Dict{},
+			Topic:       testTopic,
+			Arguments:   args,
+			ArgumentsKw: wamp.Dict{"a": 1},
+		})
+		msg, err := wamp.RecvTimeout(sub, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for EVENT")
+		}
+		event, ok := msg.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected EVENT, got", msg.MessageType())
+		}
+		event.Publication = 1
+		b, err := s.Serialize(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect == nil {
+			expect = b
+		} else if !bytes.Equal(b, expect) {
+			t.Fatalf("got event %s, expected %s", b, expect)
 		}
 	}
+	if !bytes.Contains(expect, []byte(`{},[],{"a":1}]`)) {
+		t.Fatal("event does not have empty args:", string(expect))
+	}
+
+	pub.Close()
+	sub.Close()
 }
@@ -0,0 +1,92 @@
+package router
+
+import (
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// sessionEventQueueSize is the number of session events buffered for the
+// consumer of Router.SessionEvents.  When the buffer is full, the oldest event
+// is dropped to make room for the newest.
+const sessionEventQueueSize = 256
+
+// SessionEventKind identifies what happened in a session's lifecycle.
+type SessionEventKind int
+
+const (
+	// SessionAttached is emitted when a client's HELLO is accepted for a realm
+	// and a session ID is assigned, before authentication.
+	SessionAttached SessionEventKind = iota
+	// SessionAuthenticated is emitted when a session has been authenticated
+	// and welcomed into a realm.
+	SessionAuthenticated
+	// SessionEnded is emitted when a session leaves its realm.
+	SessionEnded
+	// SessionAborted is emitted when the router aborts a client's attempt to
+	// attach.
+	SessionAborted
+)
+
+// String returns the name of the session event kind.
+func (k SessionEventKind) String() string {
+	switch k {
+	case SessionAttached:
+		return "attached"
+	case SessionAuthenticated:
+		return "authenticated"
+	case SessionEnded:
+		return "ended"
+	case SessionAborted:
+		return "aborted"
+	}
+	return "unknown"
+}
+
+// SessionEvent describes a change in the lifecycle of a session.
+type SessionEvent struct {
+	Kind      SessionEventKind
+	SessionID wamp.ID
+	Realm     wamp.URI
+	AuthID    string
+	Time      time.Time
+}
+
+// sessionEvents is a bounded queue of session events.  Emitting an event never
+// blocks; if there is no room for the event, then the oldest event is dropped.
+type sessionEvents struct {
+	ch chan SessionEvent
+}
+
+func newSessionEvents() *sessionEvents {
+	return &sessionEvents{
+		ch: make(chan SessionEvent, sessionEventQueueSize),
+	}
+}
+
+// emit queues an event with the current time.  It is safe to call on a nil
+// sessionEvents, in which case nothing is done.
+func (e *sessionEvents) emit(kind SessionEventKind, sid wamp.ID, realm wamp.URI, authid string) {
+	if e == nil {
+		return
+	}
+	ev := SessionEvent{
+		Kind:      kind,
+		SessionID: sid,
+		Realm:     realm,
+		AuthID:    authid,
+		Time:      time.Now(),
+	}
+	for {
+		select {
+		case e.ch <- ev:
+			return
+		default:
+		}
+		// Queue is full, so drop the oldest event and try again.
+		select {
+		case <-e.ch:
+		default:
+		}
+	}
+}
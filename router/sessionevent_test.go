@@ -0,0 +1,87 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/gammazero/nexus/transport"
+	"github.com/gammazero/nexus/wamp"
+)
+
+func recvSessionEvent(t *testing.T, events <-chan SessionEvent) SessionEvent {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for session event")
+	}
+	return SessionEvent{}
+}
+
+func TestSessionEvents(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	events := r.SessionEvents()
+
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := recvSessionEvent(t, events)
+	if ev.Kind != SessionAttached {
+		t.Fatal("expected attached event, got", ev.Kind)
+	}
+	if ev.SessionID != cli.ID || ev.Realm != testRealm || ev.AuthID != "user1" {
+		t.Fatalf("wrong attached event: %+v", ev)
+	}
+	if ev.Time.IsZero() {
+		t.Fatal("event missing timestamp")
+	}
+	ev = recvSessionEvent(t, events)
+	if ev.Kind != SessionAuthenticated || ev.SessionID != cli.ID {
+		t.Fatalf("expected authenticated event, got: %+v", ev)
+	}
+
+	cli.Send(&wamp.Goodbye{})
+	if _, err = wamp.RecvTimeout(cli, time.Second); err != nil {
+		t.Fatal("no goodbye message after sending goodbye:", err)
+	}
+	ev = recvSessionEvent(t, events)
+	if ev.Kind != SessionEnded || ev.SessionID != cli.ID || ev.Realm != testRealm {
+		t.Fatalf("expected ended event, got: %+v", ev)
+	}
+
+	// Client requesting a realm that does not exist is aborted.
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: "does.not.exist"})
+	if err = r.Attach(server); err == nil {
+		t.Fatal("expected error")
+	}
+	ev = recvSessionEvent(t, events)
+	if ev.Kind != SessionAborted || ev.Realm != "does.not.exist" {
+		t.Fatalf("expected aborted event, got: %+v", ev)
+	}
+}
+
+func TestSessionEventsDropOldest(t *testing.T) {
+	events := newSessionEvents()
+	for i := 1; i <= sessionEventQueueSize+10; i++ {
+		events.emit(SessionAttached, wamp.ID(i), testRealm, "")
+	}
+	if len(events.ch) != sessionEventQueueSize {
+		t.Fatal("expected full event queue, got", len(events.ch))
+	}
+	ev := <-events.ch
+	if ev.SessionID != 11 {
+		t.Fatal("expected oldest events to be dropped, first is", ev.SessionID)
+	}
+
+	// Emitting on nil sessionEvents does nothing.
+	var nilEvents *sessionEvents
+	nilEvents.emit(SessionEnded, 1, testRealm, "")
+}
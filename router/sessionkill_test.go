@@ -243,6 +243,100 @@ func TestSessionKillByAuthid(t *testing.T) {
 	}
 }
 
+func TestSessionKillByAuthrole(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+
+	cli1, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli1.Close()
+
+	cli2, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli2.Close()
+
+	cli3, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli3.Close()
+
+	// Give client 3 a different authrole.
+	cli1.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionModifyDetails, Arguments: wamp.List{cli3.ID, wamp.Dict{"authrole": "guest"}}})
+	msg, err := wamp.RecvTimeout(cli1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*wamp.Result); !ok {
+		t.Fatal("Expected RESULT, got", msg.MessageType())
+	}
+
+	reason := wamp.URI("foo.bar.baz")
+
+	// Killing by authrole "guest" should kill only client 3.
+	cli1.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionKillByAuthrole, Arguments: wamp.List{"guest"}, ArgumentsKw: wamp.Dict{"reason": reason}})
+	msg, err = wamp.RecvTimeout(cli1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("Expected RESULT, got", msg.MessageType())
+	}
+	if count, _ := wamp.AsInt64(result.Arguments[0]); count != 1 {
+		t.Fatal("Expected 1 session killed, got", count)
+	}
+
+	msg, err = wamp.RecvTimeout(cli3, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, ok := msg.(*wamp.Goodbye)
+	if !ok {
+		t.Fatal("expected GOODBYE, got", msg.MessageType())
+	}
+	if g.Reason != reason {
+		t.Error("Wrong GOODBYE.Reason, got", g.Reason, "expected", reason)
+	}
+	if _, err = wamp.RecvTimeout(cli2, time.Millisecond); err == nil {
+		t.Fatal("Expected timeout")
+	}
+
+	// Killing by the caller's own authrole should not kill the caller.
+	cli1.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionKillByAuthrole, Arguments: wamp.List{cli1.Details["authrole"]}})
+	msg, err = wamp.RecvTimeout(cli1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, ok = msg.(*wamp.Result); !ok {
+		t.Fatal("Expected RESULT, got", msg.MessageType())
+	}
+	if count, _ := wamp.AsInt64(result.Arguments[0]); count != 1 {
+		t.Fatal("Expected 1 session killed, got", count)
+	}
+	msg, err = wamp.RecvTimeout(cli2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, ok = msg.(*wamp.Goodbye); !ok {
+		t.Fatal("expected GOODBYE, got", msg.MessageType())
+	}
+	if g.Reason != wamp.CloseNormal {
+		t.Error("Wrong GOODBYE.Reason, got", g.Reason, "expected", wamp.CloseNormal)
+	}
+	if _, err = wamp.RecvTimeout(cli1, time.Millisecond); err == nil {
+		t.Fatal("Expected timeout")
+	}
+}
+
 func TestSessionModifyDetails(t *testing.T) {
 	defer leaktest.Check(t)()
 	r, err := newTestRouter()
@@ -314,3 +408,136 @@ func TestSessionModifyDetails(t *testing.T) {
 		t.Error("Did not get correct value for pi")
 	}
 }
+
+func TestSessionKillRestricted(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:            testRealm,
+				AnonymousAuth:  true,
+				EnableMetaKill: true,
+				MetaKillRoles:  []string{"admin"},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cli1, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli2, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Local client has authrole "trusted", which may not kill sessions.
+	cli1.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionKill, Arguments: wamp.List{cli2.ID}})
+	msg, err := wamp.RecvTimeout(cli1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := msg.(*wamp.Error)
+	if !ok {
+		t.Fatal("Expected ERROR, got", msg.MessageType())
+	}
+	if e.Error != wamp.ErrNotAuthorized {
+		t.Error("Wrong error, got", e.Error, "expected", wamp.ErrNotAuthorized)
+	}
+
+	cli1.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionKillAll})
+	msg, err = wamp.RecvTimeout(cli1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok = msg.(*wamp.Error); !ok || e.Error != wamp.ErrNotAuthorized {
+		t.Fatal("Expected not authorized ERROR, got", msg)
+	}
+
+	// Check that client-2 was not killed.
+	if _, err = wamp.RecvTimeout(cli2, time.Millisecond); err == nil {
+		t.Fatal("Expected timeout")
+	}
+
+	cli1.Close()
+	cli2.Close()
+}
+
+func TestSessionListAndKill(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:            testRealm,
+				AnonymousAuth:  true,
+				EnableMetaKill: true,
+				MetaKillRoles:  []string{"trusted"},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cli1, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli2, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// List sessions and find client-2.
+	cli1.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionList})
+	msg, err := wamp.RecvTimeout(cli1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("Expected RESULT, got", msg.MessageType())
+	}
+	ids, ok := wamp.AsList(result.Arguments[0])
+	if !ok {
+		t.Fatal("Expected list of session IDs")
+	}
+	var found bool
+	for i := range ids {
+		if id, _ := wamp.AsID(ids[i]); id == cli2.ID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatal("Did not find client-2 in session list")
+	}
+
+	// Kill client-2.
+	cli1.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionKill, Arguments: wamp.List{cli2.ID}})
+	msg, err = wamp.RecvTimeout(cli1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = msg.(*wamp.Result); !ok {
+		t.Fatal("Expected RESULT, got", msg.MessageType())
+	}
+	msg, err = wamp.RecvTimeout(cli2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = msg.(*wamp.Goodbye); !ok {
+		t.Fatal("expected GOODBYE, got", msg.MessageType())
+	}
+
+	cli1.Close()
+}
@@ -0,0 +1,53 @@
+package router
+
+import (
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// Tracer is called as publications and calls are routed in a realm, to trace
+// them for debugging or to export them to a tracing system.  Tracer methods
+// are called concurrently, from the goroutines that route messages, so they
+// must be safe for concurrent use, return quickly, and not call back into the
+// router.
+type Tracer interface {
+	// OnPublish is called when a PUBLISH is received from a publisher.
+	// Request is the PUBLISH request ID and URI is the topic.
+	OnPublish(TraceInfo)
+	// OnEvent is called when an EVENT is sent to a subscriber.  Request is
+	// the publication ID and URI is the topic.
+	OnEvent(TraceInfo)
+	// OnCall is called when a CALL is received from a caller.  Request is
+	// the CALL request ID and URI is the procedure.
+	OnCall(TraceInfo)
+	// OnResult is called when a RESULT is sent to a caller, including each
+	// progressive result.  Request is the CALL request ID and URI is the
+	// procedure.
+	OnResult(TraceInfo)
+	// OnError is called when an ERROR is sent to a caller.  Request is the
+	// CALL request ID and URI is the error URI.
+	OnError(TraceInfo)
+}
+
+// TraceInfo describes a message traced by a Tracer.
+type TraceInfo struct {
+	// Session is the ID of the session that sent, or is sent, the message.
+	Session wamp.ID
+	// Request is the request ID of the message.
+	Request wamp.ID
+	// URI is the topic, procedure, or error URI of the message.
+	URI wamp.URI
+	// Time is when the message was routed.
+	Time time.Time
+}
+
+// traceInfo returns the TraceInfo for a message routed now.
+func traceInfo(sess *wamp.Session, request wamp.ID, uri wamp.URI) TraceInfo {
+	return TraceInfo{
+		Session: sess.ID,
+		Request: request,
+		URI:     uri,
+		Time:    time.Now(),
+	}
+}
@@ -0,0 +1,143 @@
+package router
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+type traceRecord struct {
+	kind string
+	info TraceInfo
+}
+
+// recordingTracer is a Tracer that records each trace.
+type recordingTracer struct {
+	mu      sync.Mutex
+	records []traceRecord
+}
+
+func (t *recordingTracer) add(kind string, info TraceInfo) {
+	t.mu.Lock()
+	t.records = append(t.records, traceRecord{kind, info})
+	t.mu.Unlock()
+}
+
+func (t *recordingTracer) OnPublish(info TraceInfo) { t.add("publish", info) }
+func (t *recordingTracer) OnEvent(info TraceInfo)   { t.add("event", info) }
+func (t *recordingTracer) OnCall(info TraceInfo)    { t.add("call", info) }
+func (t *recordingTracer) OnResult(info TraceInfo)  { t.add("result", info) }
+func (t *recordingTracer) OnError(info TraceInfo)   { t.add("error", info) }
+
+// take returns the records traced so far, and clears them.
+func (t *recordingTracer) take() []traceRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	records := t.records
+	t.records = nil
+	return records
+}
+
+// check waits for the expected traces, since a trace may be recorded after
+// the traced message is sent, and checks their kinds.
+func (t *recordingTracer) check(tb testing.TB, kinds ...string) []traceRecord {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		t.mu.Lock()
+		n := len(t.records)
+		t.mu.Unlock()
+		if n >= len(kinds) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	records := t.take()
+	if len(records) != len(kinds) {
+		tb.Fatalf("expected %d traces %v, got %d: %v", len(kinds), kinds, len(records), records)
+	}
+	for i := range kinds {
+		if records[i].kind != kinds[i] {
+			tb.Fatal("expected trace", kinds[i], "got", records[i].kind)
+		}
+		if records[i].info.Time.IsZero() {
+			tb.Fatal("trace", kinds[i], "has no time")
+		}
+	}
+	return records
+}
+
+func TestTraceCall(t *testing.T) {
+	dealer, _ := newTestDealer()
+	defer dealer.close()
+	tracer := &recordingTracer{}
+	dealer.tracer = tracer
+
+	calleeSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	dealer.register(calleeSess, &wamp.Register{Request: 123, Procedure: testProcedure})
+	if _, err := wamp.RecvTimeout(calleeSess, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	callerSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	dealer.call(callerSess, &wamp.Call{Request: 124, Procedure: testProcedure})
+	rsp, err := wamp.RecvTimeout(calleeSess, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := rsp.(*wamp.Invocation)
+	dealer.yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	if rsp, err = wamp.RecvTimeout(callerSess, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rsp.(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+
+	records := tracer.check(t, "call", "result")
+	for _, rec := range records {
+		if rec.info.Session != callerSess.ID || rec.info.Request != 124 || rec.info.URI != testProcedure {
+			t.Fatal("wrong", rec.kind, "trace:", rec.info)
+		}
+	}
+
+	// Call to unregistered procedure traces error.
+	dealer.call(callerSess, &wamp.Call{Request: 125, Procedure: "nexus.test.bad"})
+	if _, err = wamp.RecvTimeout(callerSess, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	records = tracer.check(t, "call", "error")
+	if records[1].info.Request != 125 || records[1].info.URI != wamp.ErrNoSuchProcedure {
+		t.Fatal("wrong error trace:", records[1].info)
+	}
+}
+
+func TestTracePublish(t *testing.T) {
+	broker := newBroker(logger, false, true, false, debug, nil, 0)
+	defer broker.close()
+	tracer := &recordingTracer{}
+	broker.tracer = tracer
+
+	subSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.subscribe(subSess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+	if _, err := wamp.RecvTimeout(subSess, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	pubSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), nil, nil)
+	broker.publish(pubSess, &wamp.Publish{Request: 124, Topic: testTopic})
+	rsp, err := wamp.RecvTimeout(subSess, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := rsp.(*wamp.Event)
+
+	records := tracer.check(t, "publish", "event")
+	if records[0].info.Session != pubSess.ID || records[0].info.Request != 124 {
+		t.Fatal("wrong publish trace:", records[0].info)
+	}
+	if records[1].info.Session != subSess.ID || records[1].info.Request != event.Publication {
+		t.Fatal("wrong event trace:", records[1].info)
+	}
+}
@@ -26,6 +26,8 @@ const (
 	cborWebsocketProtocol    = "wamp.2.cbor"
 
 	defaultOutQueueSize = 16
+
+	defaultTrackingCookieName = "nexus-wamp-cookie"
 )
 
 type protocol struct {
@@ -80,6 +82,9 @@ type WebsocketServer struct {
 	//
 	// The "cookie" and "nextcookie" values are retrieved similarly.
 	EnableTrackingCookie bool
+	// TrackingCookieName is the name of the tracking cookie.  The default is
+	// "nexus-wamp-cookie".
+	TrackingCookieName string
 	// EnableRequestCapture tells the server to include the upgrade HTTP
 	// request in the HELLO and session details.  It is stored in
 	// Details.transport.auth.request|*http.Request making it available to
@@ -96,6 +101,15 @@ type WebsocketServer struct {
 	// client.  The default is defaultOutQueueSize.
 	OutQueueSize int
 
+	// SerializerPreference lists serializers, by name ("json", "msgpack",
+	// "cbor"), in the order the server prefers them.  When set, the server
+	// selects the most preferred serializer offered by the client, regardless
+	// of the order in which the client offers them, and rejects the upgrade
+	// request with 400 Bad Request if the client offers none of them.  When
+	// not set, the first registered subprotocol offered by the client is
+	// selected.
+	SerializerPreference []string
+
 	router    Router
 	protocols map[string]protocol
 }
@@ -253,6 +267,11 @@ func (s *WebsocketServer) ListenAndServe(address string) (io.Closer, error) {
 // io.closer is closed.  If tls.Config does not already contain a certificate,
 // then certFile and keyFile, if specified, are used to load an X509
 // certificate.
+//
+// Client certificates are requested and verified according to the ClientAuth,
+// ClientCAs, and VerifyPeerCertificate settings in tls.Config.  The subject of
+// a client certificate is available to authenticators and authorizers as
+// details.transport.auth.client_cert_subject.
 func (s *WebsocketServer) ListenAndServeTLS(address string, tlscfg *tls.Config, certFile, keyFile string) (io.Closer, error) {
 	// With Go 1.9, code below, until tls.Listen, can be removed when using:
 	//go server.ServeTLS(l, certFile, keyFile)
@@ -302,7 +321,10 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if authDict == nil {
 			authDict = wamp.Dict{}
 		}
-		const cookieName = "nexus-wamp-cookie"
+		cookieName := s.TrackingCookieName
+		if cookieName == "" {
+			cookieName = defaultTrackingCookieName
+		}
 		if reqCk, err := r.Cookie(cookieName); err == nil {
 			authDict["cookie"] = reqCk
 			//fmt.Println("===> Received tracking cookie: ", reqCk)
@@ -322,6 +344,16 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// If the client presented a TLS certificate, then save the certificate
+	// subject in the HELLO and session details as transport.auth details, so
+	// that it is available to authenticators and authorizers.
+	if r.TLS != nil && len(r.TLS.PeerCertificates) != 0 {
+		if authDict == nil {
+			authDict = wamp.Dict{}
+		}
+		authDict["client_cert_subject"] = r.TLS.PeerCertificates[0].Subject.String()
+	}
+
 	// If request capture is enabled, then save the HTTP upgrade http.Request
 	// in the HELLO and session details as transport.auth details.request.
 	if s.EnableRequestCapture {
@@ -331,14 +363,82 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		authDict["request"] = r
 	}
 
-	conn, err := s.Upgrader.Upgrade(w, r, w.Header())
+	upgrader := s.Upgrader
+	if len(s.SerializerPreference) != 0 {
+		proto, ok := s.preferredProtocol(websocket.Subprotocols(r))
+		if !ok {
+			s.router.Logger().Println("Error upgrading to websocket connection:",
+				"no preferred serializer in subprotocols", websocket.Subprotocols(r))
+			http.Error(w, "no acceptable WAMP subprotocol", http.StatusBadRequest)
+			return
+		}
+		// Copy the upgrader so that it only selects the preferred protocol.
+		u := *s.Upgrader
+		u.Subprotocols = []string{proto}
+		upgrader = &u
+	}
+
+	conn, err := upgrader.Upgrade(w, r, w.Header())
 	if err != nil {
 		s.router.Logger().Println("Error upgrading to websocket connection:", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	s.handleWebsocket(conn, wamp.Dict{"auth": authDict})
+	transportDetails := wamp.Dict{
+		"type":                  "websocket",
+		"peer":                  r.RemoteAddr,
+		"http_headers_received": headerDetails(r.Header),
+		"auth":                  authDict,
+	}
+	if r.TLS != nil {
+		if certDetails := peerCertDetails(r.TLS); certDetails != nil {
+			transportDetails["peer_cert"] = certDetails
+		}
+	}
+	s.handleWebsocket(conn, transportDetails)
+}
+
+// headerDetails returns the HTTP request headers as transport details.  Header
+// names are lower case, and multiple values for a header are comma-separated.
+func headerDetails(header http.Header) wamp.Dict {
+	details := make(wamp.Dict, len(header))
+	for name, vals := range header {
+		details[strings.ToLower(name)] = strings.Join(vals, ", ")
+	}
+	return details
+}
+
+// peerCertDetails returns the subject and issuer of the peer's TLS
+// certificate as transport details, or nil if the peer did not present a
+// certificate.
+func peerCertDetails(state *tls.ConnectionState) wamp.Dict {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	return wamp.Dict{
+		"subject": cert.Subject.String(),
+		"issuer":  cert.Issuer.String(),
+		"serial":  cert.SerialNumber.String(),
+	}
+}
+
+// preferredProtocol returns the subprotocol of the most preferred serializer
+// that is offered by the client and registered with the server.
+func (s *WebsocketServer) preferredProtocol(offered []string) (string, bool) {
+	for _, name := range s.SerializerPreference {
+		proto := "wamp.2." + name
+		if _, ok := s.protocols[proto]; !ok {
+			continue
+		}
+		for i := range offered {
+			if offered[i] == proto {
+				return proto, true
+			}
+		}
+	}
+	return "", false
 }
 
 // addProtocol registers a serializer for protocol and payload type.
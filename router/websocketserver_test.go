@@ -1,11 +1,23 @@
 package router
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"math/big"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/fortytw2/leaktest"
+	"github.com/gammazero/nexus/router/auth"
 	"github.com/gammazero/nexus/transport"
 	"github.com/gammazero/nexus/transport/serialize"
 	"github.com/gammazero/nexus/wamp"
@@ -99,6 +111,206 @@ func TestWSHandshakeMsgpack(t *testing.T) {
 	client.Close()
 }
 
+func TestWSPubSub(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(routerConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	s := NewWebsocketServer(r)
+	s.KeepAlive = time.Second
+	closer, err := s.ListenAndServe(wsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	connect := func(serialization serialize.Serialization) wamp.Peer {
+		client, err := transport.ConnectWebsocketPeer(
+			fmt.Sprintf("ws://%s/", wsAddr), serialization, nil, nil, r.Logger(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+		msg, err := wamp.RecvTimeout(client, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := msg.(*wamp.Welcome); !ok {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+		return client
+	}
+
+	// Subscriber and publisher use different serializers.
+	sub := connect(serialize.JSON)
+	pub := connect(serialize.MSGPACK)
+
+	sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	msg, err := wamp.RecvTimeout(sub, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribed, ok := msg.(*wamp.Subscribed)
+	if !ok {
+		t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+	}
+
+	pub.Send(&wamp.Publish{
+		Request:   wamp.GlobalID(),
+		Topic:     testTopic,
+		Arguments: wamp.List{"hello"},
+	})
+	if msg, err = wamp.RecvTimeout(sub, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	event, ok := msg.(*wamp.Event)
+	if !ok {
+		t.Fatal("expected EVENT, got", msg.MessageType())
+	}
+	if event.Subscription != subscribed.Subscription {
+		t.Fatal("wrong subscription ID in EVENT")
+	}
+	if arg, _ := wamp.AsString(event.Arguments[0]); arg != "hello" {
+		t.Fatal("wrong EVENT argument:", event.Arguments)
+	}
+
+	// Closing the websocket connections removes the sessions from the realm.
+	sub.Close()
+	pub.Close()
+	for i := 0; i < 100; i++ {
+		stats, err := r.RealmStats(testRealm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Sessions == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("sessions not removed after websocket close")
+}
+
+// selfSignedCert creates a self-signed certificate for the common name.
+func selfSignedCert(cn string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// certAuth is an anonymous authenticator that records the client certificate
+// subject and the transport details.
+type certAuth struct {
+	sync.Mutex
+	subject   string
+	transport wamp.Dict
+}
+
+func (a *certAuth) AuthMethod() string { return "anonymous" }
+
+func (a *certAuth) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	subject, _ := wamp.DictValue(details, []string{"transport", "auth", "client_cert_subject"})
+	a.Lock()
+	a.subject, _ = wamp.AsString(subject)
+	a.transport = wamp.DictChild(details, "transport")
+	a.Unlock()
+	return &wamp.Welcome{Details: wamp.Dict{"authrole": "anonymous"}}, nil
+}
+
+func TestWSTLSClientCert(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ca := &certAuth{}
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:            testRealm,
+				Authenticators: []auth.Authenticator{ca},
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	serverCert, err := selfSignedCert("nexus.test.server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := selfSignedCert("nexus.test.client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewWebsocketServer(r)
+	closer, err := s.ListenAndServeTLS(wsAddr, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	client, err := transport.ConnectWebsocketPeer(
+		fmt.Sprintf("wss://%s/", wsAddr), serialize.JSON, &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{clientCert},
+		}, nil, r.Logger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	msg, err := wamp.RecvTimeout(client, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*wamp.Welcome); !ok {
+		t.Fatal("expected WELCOME, got", msg.MessageType())
+	}
+	client.Close()
+
+	ca.Lock()
+	subject := ca.subject
+	transDict := ca.transport
+	ca.Unlock()
+	if subject != "CN=nexus.test.client" {
+		t.Fatal("wrong client certificate subject in transport details:", subject)
+	}
+	if typ, _ := wamp.AsString(transDict["type"]); typ != "websocket" {
+		t.Error("wrong transport type:", transDict["type"])
+	}
+	if peer, _ := wamp.AsString(transDict["peer"]); peer == "" {
+		t.Error("missing transport peer")
+	}
+	if wamp.DictChild(transDict, "http_headers_received") == nil {
+		t.Error("missing HTTP headers from transport details")
+	}
+	certSubject, _ := wamp.AsString(wamp.DictChild(transDict, "peer_cert")["subject"])
+	if certSubject != subject {
+		t.Error("wrong peer_cert subject:", certSubject)
+	}
+}
+
 func TestAllowOrigins(t *testing.T) {
 	s := &WebsocketServer{
 		Upgrader: &websocket.Upgrader{},
@@ -226,3 +438,163 @@ func TestAllowOriginsWithPorts(t *testing.T) {
 		t.Error("Should have allowed:", allowed)
 	}
 }
+
+// testCookieStore recognizes one cookie value, and records what is stored.
+type testCookieStore struct {
+	sync.Mutex
+	stored map[string]string
+}
+
+const testCookieValue = "returning-client"
+
+func (s *testCookieStore) Lookup(cookie string) (string, string, bool) {
+	if cookie != testCookieValue {
+		return "", "", false
+	}
+	return "jdoe", "user", true
+}
+
+func (s *testCookieStore) Store(cookie, authid, authrole string) {
+	s.Lock()
+	s.stored[cookie] = authid + "/" + authrole
+	s.Unlock()
+}
+
+func TestWSCookieAuth(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	store := &testCookieStore{stored: map[string]string{}}
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				CookieStore:   store,
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	s := NewWebsocketServer(r)
+	s.EnableTrackingCookie = true
+	s.TrackingCookieName = "test-cookie"
+	closer, err := s.ListenAndServe(wsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	join := func(cookieValue string) *wamp.Welcome {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wsURL := fmt.Sprintf("ws://%s/", wsAddr)
+		if cookieValue != "" {
+			u, _ := url.Parse(fmt.Sprintf("http://%s/", wsAddr))
+			jar.SetCookies(u, []*http.Cookie{
+				{Name: "test-cookie", Value: cookieValue},
+			})
+		}
+		client, err := transport.ConnectWebsocketPeer(wsURL, serialize.JSON,
+			nil, nil, r.Logger(), &transport.WebsocketConfig{Jar: jar})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Send(&wamp.Hello{
+			Realm: testRealm,
+			Details: wamp.Dict{
+				"authmethods": wamp.List{"cookie", "anonymous"},
+				"roles":       clientRoles["roles"],
+			},
+		})
+		msg, err := wamp.RecvTimeout(client, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		welcome, ok := msg.(*wamp.Welcome)
+		if !ok {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+		return welcome
+	}
+
+	// Client with recognized cookie is authenticated by cookie.
+	welcome := join(testCookieValue)
+	if authid, _ := wamp.AsString(welcome.Details["authid"]); authid != "jdoe" {
+		t.Fatal("wrong authid:", welcome.Details["authid"])
+	}
+	if authrole, _ := wamp.AsString(welcome.Details["authrole"]); authrole != "user" {
+		t.Fatal("wrong authrole:", welcome.Details["authrole"])
+	}
+	if method, _ := wamp.AsString(welcome.Details["authmethod"]); method != "cookie" {
+		t.Fatal("wrong authmethod:", welcome.Details["authmethod"])
+	}
+
+	// Client with unknown cookie falls back to the next authmethod.
+	welcome = join("unknown")
+	if method, _ := wamp.AsString(welcome.Details["authmethod"]); method != "anonymous" {
+		t.Fatal("wrong authmethod:", welcome.Details["authmethod"])
+	}
+
+	// The next cookie issued to each client is stored.
+	store.Lock()
+	defer store.Unlock()
+	if len(store.stored) != 2 {
+		t.Fatal("expected 2 stored cookies, got", len(store.stored))
+	}
+	var found bool
+	for _, v := range store.stored {
+		if v == "jdoe/user" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("cookie for jdoe not stored")
+	}
+}
+
+func TestWSSerializerPreference(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(routerConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	s := NewWebsocketServer(r)
+	s.SerializerPreference = []string{"msgpack", "json"}
+	closer, err := s.ListenAndServe(wsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	// Client prefers json, but server prefers msgpack.
+	dialer := websocket.Dialer{
+		Subprotocols: []string{jsonWebsocketProtocol, msgpackWebsocketProtocol},
+	}
+	conn, _, err := dialer.Dial(fmt.Sprintf("ws://%s/", wsAddr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Subprotocol() != msgpackWebsocketProtocol {
+		t.Error("expected msgpack subprotocol, got", conn.Subprotocol())
+	}
+	conn.Close()
+
+	// Client offers no preferred serializer.
+	dialer.Subprotocols = []string{cborWebsocketProtocol}
+	_, resp, err := dialer.Dial(fmt.Sprintf("ws://%s/", wsAddr), nil)
+	if err == nil {
+		t.Fatal("expected handshake failure")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected 400 Bad Request response")
+	}
+}
@@ -5,6 +5,11 @@ nearly any logging implementation.
 */
 package stdlog
 
+import (
+	"fmt"
+	"strings"
+)
+
 // StdLog is a minimal interface implemented by nearly every logging package.
 // The nexus package uses this interface for all logging, which allows nexus
 // to use any logging package desired.
@@ -20,3 +25,65 @@ type StdLog interface {
 	// fmt.Printf.
 	Printf(format string, v ...interface{})
 }
+
+// LeveledLog is implemented by logging packages that support log levels.  If
+// the logger given to nexus implements LeveledLog, then debug output is logged
+// using Debug and errors are logged using Error.  Otherwise, all output is
+// logged using the StdLog methods.
+//
+// Each method logs a message with arguments handled in the manner of
+// fmt.Print.
+type LeveledLog interface {
+	StdLog
+
+	Debug(v ...interface{})
+	Info(v ...interface{})
+	Warn(v ...interface{})
+	Error(v ...interface{})
+}
+
+// Debug logs a debug message.  Arguments are handled in the manner of
+// fmt.Println.
+func Debug(l StdLog, v ...interface{}) {
+	if ll, ok := l.(LeveledLog); ok {
+		ll.Debug(sprintln(v...))
+		return
+	}
+	l.Println(v...)
+}
+
+// Debugf logs a debug message.  Arguments are handled in the manner of
+// fmt.Printf.
+func Debugf(l StdLog, format string, v ...interface{}) {
+	if ll, ok := l.(LeveledLog); ok {
+		ll.Debug(fmt.Sprintf(format, v...))
+		return
+	}
+	l.Printf(format, v...)
+}
+
+// Error logs an error message.  Arguments are handled in the manner of
+// fmt.Println.
+func Error(l StdLog, v ...interface{}) {
+	if ll, ok := l.(LeveledLog); ok {
+		ll.Error(sprintln(v...))
+		return
+	}
+	l.Println(v...)
+}
+
+// Errorf logs an error message.  Arguments are handled in the manner of
+// fmt.Printf.
+func Errorf(l StdLog, format string, v ...interface{}) {
+	if ll, ok := l.(LeveledLog); ok {
+		ll.Error(fmt.Sprintf(format, v...))
+		return
+	}
+	l.Printf(format, v...)
+}
+
+// sprintln formats the arguments in the manner of fmt.Println, without the
+// trailing newline.
+func sprintln(v ...interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+}
@@ -31,11 +31,14 @@ func LinkedPeers() (wamp.Peer, wamp.Peer) {
 	return c, r
 }
 
-// IsLocal returns true is the wamp.Peer is a localPeer.  These do not need
-// authentication since they are part of the same process.
+// IsLocal returns true is the wamp.Peer is a localPeer or loopbackPeer.  These
+// do not need authentication since they are part of the same process.
 func IsLocal(p wamp.Peer) bool {
-	_, ok := p.(*localPeer)
-	return ok
+	switch p.(type) {
+	case *localPeer, *loopbackPeer:
+		return true
+	}
+	return false
 }
 
 // localPeer implements Peer
@@ -0,0 +1,110 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+var errLoopbackClosed = errors.New("loopback peer closed")
+
+// loopbackLink is the shared state of a pair of loopback peers.
+type loopbackLink struct {
+	aToB chan wamp.Message
+	bToA chan wamp.Message
+
+	// mu is held for reading while sending, so that the channels are not
+	// closed during a send.
+	mu        sync.RWMutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLoopbackPeers creates two connected in-memory peers.  A message sent on
+// one peer is received from the Recv channel of the other.  Each direction is
+// buffered to hold queueSize messages.
+//
+// Unlike LinkedPeers, closing either peer closes the link in both directions:
+// blocked senders on both ends are woken and return an error, and the Recv
+// channels of both peers are closed after any buffered messages are read.
+// This makes the pair suitable for embedding a client in the same process as
+// the router, and for tests.
+func NewLoopbackPeers(queueSize int) (wamp.Peer, wamp.Peer) {
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	link := &loopbackLink{
+		aToB: make(chan wamp.Message, queueSize),
+		bToA: make(chan wamp.Message, queueSize),
+		done: make(chan struct{}),
+	}
+	a := &loopbackPeer{link: link, rd: link.bToA, wr: link.aToB}
+	b := &loopbackPeer{link: link, rd: link.aToB, wr: link.bToA}
+	return a, b
+}
+
+func (l *loopbackLink) close() {
+	l.closeOnce.Do(func() {
+		// Wake any blocked senders so that they release the read lock.
+		close(l.done)
+		l.mu.Lock()
+		close(l.aToB)
+		close(l.bToA)
+		l.mu.Unlock()
+	})
+}
+
+// loopbackPeer implements wamp.Peer
+type loopbackPeer struct {
+	link *loopbackLink
+	rd   <-chan wamp.Message
+	wr   chan<- wamp.Message
+}
+
+// Recv returns the channel this peer reads incoming messages from.
+func (p *loopbackPeer) Recv() <-chan wamp.Message { return p.rd }
+
+// TrySend writes a message to the other peer, and returns an error if the
+// message cannot be written without blocking.
+func (p *loopbackPeer) TrySend(msg wamp.Message) error {
+	p.link.mu.RLock()
+	defer p.link.mu.RUnlock()
+	select {
+	case <-p.link.done:
+		return errLoopbackClosed
+	default:
+	}
+	return wamp.TrySend(p.wr, msg)
+}
+
+// SendCtx writes a message to the other peer, waiting until there is room in
+// the buffer, the context is canceled, or the link is closed.
+func (p *loopbackPeer) SendCtx(ctx context.Context, msg wamp.Message) error {
+	p.link.mu.RLock()
+	defer p.link.mu.RUnlock()
+	select {
+	case <-p.link.done:
+		return errLoopbackClosed
+	default:
+	}
+	select {
+	case p.wr <- msg:
+		return nil
+	case <-p.link.done:
+		return errLoopbackClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send writes a message to the other peer, waiting until there is room in the
+// buffer or the link is closed.
+func (p *loopbackPeer) Send(msg wamp.Message) error {
+	return p.SendCtx(context.Background(), msg)
+}
+
+// Close closes the link between the peers, closing the Recv channels of both
+// peers.
+func (p *loopbackPeer) Close() { p.link.close() }
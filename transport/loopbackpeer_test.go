@@ -0,0 +1,99 @@
+package transport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestLoopbackSendRecv(t *testing.T) {
+	a, b := NewLoopbackPeers(1)
+	if !IsLocal(a) || !IsLocal(b) {
+		t.Fatal("loopback peers should be local")
+	}
+
+	if err := a.Send(&wamp.Hello{}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := wamp.RecvTimeout(b, time.Second)
+	if err != nil {
+		t.Fatal("b did not receive msg:", err)
+	}
+	if msg.MessageType() != wamp.HELLO {
+		t.Fatal("expected HELLO, got", msg.MessageType())
+	}
+
+	if err = b.Send(&wamp.Welcome{}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = wamp.RecvTimeout(a, time.Second); err != nil {
+		t.Fatal("a did not receive msg:", err)
+	}
+	if msg.MessageType() != wamp.WELCOME {
+		t.Fatal("expected WELCOME, got", msg.MessageType())
+	}
+
+	// Buffer is full, so TrySend should fail and SendCtx should time out.
+	if err = a.TrySend(&wamp.Publish{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.TrySend(&wamp.Publish{}); err == nil {
+		t.Fatal("expected error from TrySend when buffer full")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = a.SendCtx(ctx, &wamp.Publish{}); err != context.DeadlineExceeded {
+		t.Fatal("expected deadline exceeded, got", err)
+	}
+}
+
+func TestLoopbackClose(t *testing.T) {
+	a, b := NewLoopbackPeers(1)
+
+	// Fill the buffer from b to a, and block another sender.
+	if err := b.Send(&wamp.Publish{}); err != nil {
+		t.Fatal(err)
+	}
+	errChan := make(chan error)
+	go func() { errChan <- b.Send(&wamp.Publish{}) }()
+	select {
+	case <-errChan:
+		t.Fatal("expected send to be blocked")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	a.Close()
+
+	// Blocked sender should be woken.
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Fatal("expected error from send after close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked sender was not woken by close")
+	}
+
+	// Buffered message can still be read, then the channel is closed.
+	if _, err := wamp.RecvTimeout(a, time.Second); err != nil {
+		t.Fatal("expected buffered message:", err)
+	}
+	if _, err := wamp.RecvTimeout(a, time.Second); err == nil {
+		t.Fatal("expected a receive channel to be closed")
+	}
+	if _, err := wamp.RecvTimeout(b, time.Second); err == nil {
+		t.Fatal("expected b receive channel to be closed")
+	}
+
+	// Sending after close returns error, and closing again is harmless.
+	if err := a.Send(&wamp.Hello{}); err == nil {
+		t.Fatal("expected error from send after close")
+	}
+	if err := b.TrySend(&wamp.Hello{}); err == nil {
+		t.Fatal("expected error from send after close")
+	}
+	b.Close()
+	a.Close()
+}
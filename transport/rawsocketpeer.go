@@ -210,6 +210,9 @@ func newRawSocketPeer(conn net.Conn, serializer serialize.Serializer, logger std
 
 func (rs *rawSocketPeer) Recv() <-chan wamp.Message { return rs.rd }
 
+// RemoteAddr returns the network address of the other end of the socket.
+func (rs *rawSocketPeer) RemoteAddr() string { return rs.conn.RemoteAddr().String() }
+
 func (rs *rawSocketPeer) TrySend(msg wamp.Message) error {
 	return wamp.TrySend(rs.wr, msg)
 }
@@ -333,6 +336,15 @@ MsgLoop:
 				rs.log.Println("Cannot deserialize peer message:", err)
 				continue MsgLoop
 			}
+			// A message that is missing required fields is a protocol
+			// violation.  Close the connection so that the session is ended.
+			if err = wamp.Validate(msg); err != nil {
+				rs.log.Println("Closing connection after protocol violation:", err)
+				rs.cancelSender()
+				<-rs.writerDone
+				rs.conn.Close()
+				return
+			}
 		case 1: // PING
 			header[0] = 0x02
 			if _, err = rs.conn.Write(header[:]); err != nil {
@@ -0,0 +1,187 @@
+package transport
+
+import (
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+var rsLogger = log.New(os.Stdout, "", log.LstdFlags)
+
+// handshake performs the client and server sides of a RawSocket handshake over
+// an in-memory connection.
+func handshake(t *testing.T, protocol byte, clientLimit, serverLimit int) (*rawSocketPeer, *rawSocketPeer) {
+	cConn, sConn := net.Pipe()
+	type result struct {
+		peer *rawSocketPeer
+		err  error
+	}
+	srvChan := make(chan result, 1)
+	go func() {
+		p, err := serverHandshake(sConn, rsLogger, serverLimit, 0)
+		srvChan <- result{p, err}
+	}()
+	client, err := clientHandshake(cConn, rsLogger, protocol, clientLimit)
+	if err != nil {
+		t.Fatal("client handshake failed:", err)
+	}
+	res := <-srvChan
+	if res.err != nil {
+		t.Fatal("server handshake failed:", res.err)
+	}
+	return client, res.peer
+}
+
+func TestRawSocketHandshake(t *testing.T) {
+	for _, protocol := range []byte{rawsocketJSON, rawsocketMsgpack, rawsocketCBOR} {
+		client, server := handshake(t, protocol, 1024, 4096)
+		if client.recvLimit != 1024 || server.sendLimit != 1024 {
+			t.Fatal("client receive limit not negotiated:", client.recvLimit,
+				server.sendLimit)
+		}
+		if server.recvLimit != 4096 || client.sendLimit != 4096 {
+			t.Fatal("server receive limit not negotiated:", server.recvLimit,
+				client.sendLimit)
+		}
+
+		client.Send(&wamp.Hello{Realm: "nexus.realm", Details: wamp.Dict{}})
+		msg, err := wamp.RecvTimeout(server, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hello, ok := msg.(*wamp.Hello)
+		if !ok {
+			t.Fatal("expected HELLO, got", msg.MessageType())
+		}
+		if hello.Realm != "nexus.realm" {
+			t.Fatal("wrong realm:", hello.Realm)
+		}
+
+		server.Send(&wamp.Welcome{ID: 123, Details: wamp.Dict{}})
+		if msg, err = wamp.RecvTimeout(client, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok = msg.(*wamp.Welcome); !ok {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestRawSocketInvalidMessage(t *testing.T) {
+	client, server := handshake(t, rawsocketJSON, 1024, 1024)
+	defer client.Close()
+	defer server.Close()
+
+	// A PUBLISH with no request ID or topic is a protocol violation, and the
+	// server stops receiving instead of delivering it.
+	client.Send(&wamp.Publish{Options: wamp.Dict{}})
+	select {
+	case msg, ok := <-server.Recv():
+		if ok {
+			t.Fatal("invalid message delivered:", msg.MessageType())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not close after invalid message")
+	}
+}
+
+func TestRawSocketRemoteAddr(t *testing.T) {
+	client, server := handshake(t, rawsocketJSON, 1024, 1024)
+	defer client.Close()
+	defer server.Close()
+
+	// net.Pipe connections report "pipe" as their address.
+	if addr, ok := wamp.PeerAddr(client); !ok || addr != "pipe" {
+		t.Fatal("wrong remote address:", addr)
+	}
+}
+
+func TestRawSocketBadHandshake(t *testing.T) {
+	// Wrong magic octet.
+	cConn, sConn := net.Pipe()
+	go cConn.Write([]byte{0x7e, 0xf1, 0, 0})
+	if _, err := serverHandshake(sConn, rsLogger, 0, 0); err == nil {
+		t.Fatal("expected error for bad magic octet")
+	}
+	cConn.Close()
+	sConn.Close()
+
+	// Unsupported serializer.
+	cConn, sConn = net.Pipe()
+	go serverHandshake(sConn, rsLogger, 0, 0)
+	if _, err := clientHandshake(cConn, rsLogger, 0x5, 0); err == nil {
+		t.Fatal("expected error for unsupported serializer")
+	}
+	cConn.Close()
+	sConn.Close()
+
+	// Reserved bytes used.
+	cConn, sConn = net.Pipe()
+	go func() {
+		cConn.Write([]byte{magic, 0xf1, 0, 1})
+		var buf [4]byte
+		cConn.Read(buf[:])
+	}()
+	if _, err := serverHandshake(sConn, rsLogger, 0, 0); err == nil {
+		t.Fatal("expected error for use of reserved bits")
+	}
+	cConn.Close()
+	sConn.Close()
+}
+
+func TestRawSocketRecvLimit(t *testing.T) {
+	client, server := handshake(t, rawsocketJSON, 0, 512)
+
+	// Write a frame header announcing a message larger than the limit.
+	lenBytes := intToBytes(1024)
+	_, err := client.conn.Write([]byte{0x0, lenBytes[0], lenBytes[1], lenBytes[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case _, ok := <-server.Recv():
+		if ok {
+			t.Fatal("expected server to close receive channel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not close after oversized frame")
+	}
+	server.Close()
+	client.conn.Close()
+}
+
+func TestRawSocketLengths(t *testing.T) {
+	if n := byteToLength(0); n != 512 {
+		t.Fatal("expected 512, got", n)
+	}
+	if n := byteToLength(0xf); n != 1<<24 {
+		t.Fatal("expected 16M, got", n)
+	}
+	for limit, expect := range map[int]byte{
+		0:       0xf,
+		-1:      0xf,
+		1:       0,
+		512:     0,
+		513:     1,
+		1 << 20: 11,
+		1 << 30: 0xf,
+	} {
+		if b := fitRecvLimit(limit); b != expect {
+			t.Errorf("fitRecvLimit(%d) = %d, expected %d", limit, b, expect)
+		}
+	}
+	for _, n := range []int{0, 1, 255, 256, 65535, 1<<24 - 1} {
+		b := intToBytes(n)
+		if m := bytesToInt(b[:]); m != n {
+			t.Errorf("intToBytes/bytesToInt(%d) = %d", n, m)
+		}
+	}
+}
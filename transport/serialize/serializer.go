@@ -153,7 +153,8 @@ func assignSlice(dst reflect.Value, src reflect.Value) error {
 }
 
 // msgToList converts a message to a list of interface{}. Trailing empty values
-// are not appended to the list.
+// are not appended to the list, and other nil dicts and lists are appended as
+// empty.
 func msgToList(msg wamp.Message) []interface{} {
 	val := reflect.ValueOf(msg)
 	if val.Kind() == reflect.Ptr {
@@ -174,7 +175,15 @@ func msgToList(msg wamp.Message) []interface{} {
 	ret := make([]interface{}, last+2)
 	ret[0] = int(msg.MessageType())
 	for i := 0; i <= last; i++ {
-		ret[i+1] = val.Field(i).Interface()
+		f := val.Field(i)
+		// A nil dict or list that is not omitted is encoded as empty, since
+		// WAMP does not allow null in place of a dict or list.
+		if f.Kind() == reflect.Map && f.IsNil() {
+			f = reflect.MakeMap(f.Type())
+		} else if f.Kind() == reflect.Slice && f.IsNil() {
+			f = reflect.MakeSlice(f.Type(), 0, 0)
+		}
+		ret[i+1] = f.Interface()
 	}
 	return ret
 }
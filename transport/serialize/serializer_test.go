@@ -122,7 +122,7 @@ func TestCBORSerialize(t *testing.T) {
 	}
 }
 
-func CBORDeserialize(t *testing.T) {
+func TestCBORDeserialize(t *testing.T) {
 	s := &CBORSerializer{}
 
 	// this is the CBOR representation of the message above
@@ -137,19 +137,26 @@ func CBORDeserialize(t *testing.T) {
 		0x62, 0x6c, 0x61, 0x63, 0x6b, 0x77, 0x68, 0x69, 0x74, 0x65, 0x5f, 0x6c,
 		0x69, 0x73, 0x74, 0x69, 0x6e, 0x67, 0xf5,
 	}
-	details := detailRolesFeatures()
-	expect := &wamp.Hello{Realm: "nexus.realm", Details: details}
-
 	msg, err := s.Deserialize(data)
 	if err != nil {
 		t.Fatalf("Error decoding good data: %s, %x", err, data)
 	}
-	if msg.MessageType() != expect.MessageType() {
+	hello, ok := msg.(*wamp.Hello)
+	if !ok {
 		t.Fatalf("Incorrect message type: have %s, want %s", msg.MessageType(),
-			expect.MessageType())
+			wamp.HELLO)
 	}
-	if !reflect.DeepEqual(msg, expect) {
-		t.Fatalf("got %+v, expected %+v", msg, expect)
+	if hello.Realm != "nexus.realm" {
+		t.Fatal("wrong realm:", hello.Realm)
+	}
+	// Nested dictionaries are not decoded as wamp.Dict, so check content.
+	for _, role := range []string{"publisher", "subscriber", "callee", "caller"} {
+		if !hasRole(hello.Details, role) {
+			t.Fatal("did not deserialize role", role)
+		}
+	}
+	if !hasFeature(hello.Details, "publisher", "subscriber_blackwhite_listing") {
+		t.Fatal("did not deserialize message details")
 	}
 }
 
@@ -478,3 +485,286 @@ func BenchmarkJSON(b *testing.B) {
 		}
 	}
 }
+
+// allMessages returns a populated message of every message type.
+func allMessages() []wamp.Message {
+	args := wamp.List{"a", 1, true}
+	kwargs := wamp.Dict{"k": "v", "n": 2}
+	opts := wamp.Dict{"acknowledge": true}
+	return []wamp.Message{
+		&wamp.Hello{Realm: "nexus.realm", Details: detailRolesFeatures()},
+		&wamp.Welcome{ID: 123, Details: wamp.Dict{"authrole": "user"}},
+		&wamp.Abort{Details: wamp.Dict{}, Reason: wamp.ErrNoSuchRealm},
+		&wamp.Challenge{AuthMethod: "ticket", Extra: wamp.Dict{}},
+		&wamp.Authenticate{Signature: "secret", Extra: wamp.Dict{}},
+		&wamp.Goodbye{Details: wamp.Dict{}, Reason: wamp.ErrCloseRealm},
+		&wamp.Error{Type: wamp.CALL, Request: 123, Details: wamp.Dict{},
+			Error: wamp.ErrNoSuchProcedure, Arguments: args, ArgumentsKw: kwargs},
+		&wamp.Publish{Request: 123, Options: opts, Topic: "a.topic",
+			Arguments: args, ArgumentsKw: kwargs},
+		&wamp.Published{Request: 123, Publication: 456},
+		&wamp.Subscribe{Request: 123, Options: wamp.Dict{}, Topic: "a.topic"},
+		&wamp.Subscribed{Request: 123, Subscription: 456},
+		&wamp.Unsubscribe{Request: 123, Subscription: 456},
+		&wamp.Unsubscribed{Request: 123},
+		&wamp.Event{Subscription: 456, Publication: 789, Details: wamp.Dict{},
+			Arguments: args, ArgumentsKw: kwargs},
+		&wamp.Call{Request: 123, Options: wamp.Dict{}, Procedure: "a.proc",
+			Arguments: args, ArgumentsKw: kwargs},
+		&wamp.Cancel{Request: 123, Options: wamp.Dict{"mode": "kill"}},
+		&wamp.Result{Request: 123, Details: wamp.Dict{}, Arguments: args,
+			ArgumentsKw: kwargs},
+		&wamp.Register{Request: 123, Options: wamp.Dict{}, Procedure: "a.proc"},
+		&wamp.Registered{Request: 123, Registration: 456},
+		&wamp.Unregister{Request: 123, Registration: 456},
+		&wamp.Unregistered{Request: 123},
+		&wamp.Invocation{Request: 123, Registration: 456, Details: wamp.Dict{},
+			Arguments: args, ArgumentsKw: kwargs},
+		&wamp.Interrupt{Request: 123, Options: wamp.Dict{"mode": "kill"}},
+		&wamp.Yield{Request: 123, Options: wamp.Dict{}, Arguments: args,
+			ArgumentsKw: kwargs},
+	}
+}
+
+func TestRoundTripAllMessages(t *testing.T) {
+	serializers := map[string]Serializer{
+		"json":    &JSONSerializer{},
+		"msgpack": &MessagePackSerializer{},
+		"cbor":    &CBORSerializer{},
+	}
+	for name, s := range serializers {
+		for _, msg := range allMessages() {
+			b, err := s.Serialize(msg)
+			if err != nil {
+				t.Fatalf("%s: error serializing %s: %s", name, msg.MessageType(), err)
+			}
+			out, err := s.Deserialize(b)
+			if err != nil {
+				t.Fatalf("%s: error deserializing %s: %s", name, msg.MessageType(), err)
+			}
+			if out.MessageType() != msg.MessageType() {
+				t.Fatalf("%s: expected %s, got %s", name, msg.MessageType(),
+					out.MessageType())
+			}
+			// Compare JSON encodings, since numeric and map types may differ
+			// after deserialization.
+			expect, err := json.Marshal(msgToList(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(msgToList(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(expect, got) {
+				t.Errorf("%s: %s did not round trip:\nexpected %s\ngot      %s",
+					name, msg.MessageType(), expect, got)
+			}
+		}
+	}
+}
+
+func TestCBORBinaryRoundTrip(t *testing.T) {
+	s := &CBORSerializer{}
+	data := []byte{0x00, 0x01, 0xfe, 0xff, 'w', 'a', 'm', 'p'}
+	call := &wamp.Call{
+		Request:     wamp.ID(1234567890123),
+		Options:     wamp.Dict{},
+		Procedure:   "a.proc",
+		Arguments:   wamp.List{data, 42},
+		ArgumentsKw: wamp.Dict{"bin": data},
+	}
+	b, err := s.Serialize(call)
+	if err != nil {
+		t.Fatal("Serialization error: ", err)
+	}
+	msg, err := s.Deserialize(b)
+	if err != nil {
+		t.Fatal("Deserialization error: ", err)
+	}
+	out, ok := msg.(*wamp.Call)
+	if !ok {
+		t.Fatal("expected CALL, got", msg.MessageType())
+	}
+	if out.Request != call.Request {
+		t.Fatal("request ID did not round trip, got", out.Request)
+	}
+	arg, ok := out.Arguments[0].([]byte)
+	if !ok {
+		t.Fatalf("expected []byte arg, got %T", out.Arguments[0])
+	}
+	if !bytes.Equal(arg, data) {
+		t.Fatal("binary arg did not round trip")
+	}
+	if n, ok := wamp.AsInt64(out.Arguments[1]); !ok || n != 42 {
+		t.Fatalf("integer arg did not stay integer, got %T %v",
+			out.Arguments[1], out.Arguments[1])
+	}
+	kwarg, ok := out.ArgumentsKw["bin"].([]byte)
+	if !ok {
+		t.Fatalf("expected []byte kwarg, got %T", out.ArgumentsKw["bin"])
+	}
+	if !bytes.Equal(kwarg, data) {
+		t.Fatal("binary kwarg did not round trip")
+	}
+}
+
+func TestDeserializeInvalid(t *testing.T) {
+	s := &JSONSerializer{}
+	for _, data := range []string{
+		`[16]`,                      // PUBLISH without request, options, topic
+		`[32,1,{}]`,                 // SUBSCRIBE without topic
+		`[48,0,{},"nexus.proc"]`,    // CALL with zero request ID
+		`[48,-5,{},"nexus.proc"]`,   // CALL with negative request ID
+		`[36,1]`,                    // EVENT without publication ID
+		`[8,36,1,{},"wamp.error"]`,  // ERROR for EVENT
+		`[1]`,                       // HELLO without realm
+		`[16,"abc",{},"nexus.tpc"]`, // PUBLISH with string request ID
+	} {
+		msg, err := s.Deserialize([]byte(data))
+		if err == nil {
+			err = wamp.Validate(msg)
+		}
+		if err == nil {
+			t.Error("invalid message not rejected:", data)
+		}
+	}
+}
+
+// edgeCaseMessages returns every message type filled with edge-case values:
+// the largest valid IDs, unicode URIs, and nil dicts and lists alongside
+// non-empty ones.
+func edgeCaseMessages() []wamp.Message {
+	const maxID = wamp.ID(1 << 53)
+	topic := wamp.URI("com.ünïcödé.тема.☃")
+	proc := wamp.URI("com.ünïcödé.процедура.日本")
+	kwargs := wamp.Dict{
+		"max":    int64(1 << 53),
+		"neg":    int64(-(1 << 53)),
+		"text":   "ünïcödé ☃ 日本",
+		"nested": wamp.List{wamp.Dict{"k": wamp.List{}}, wamp.List{}},
+	}
+	return []wamp.Message{
+		&wamp.Hello{Realm: "nexus.réalm", Details: detailRolesFeatures()},
+		&wamp.Welcome{ID: maxID},
+		&wamp.Abort{Reason: wamp.ErrNoSuchRealm},
+		&wamp.Challenge{AuthMethod: "ticket"},
+		&wamp.Authenticate{Signature: "sécret"},
+		&wamp.Goodbye{Reason: wamp.ErrCloseRealm},
+		&wamp.Error{Type: wamp.CALL, Request: maxID, Error: "com.érror",
+			ArgumentsKw: kwargs},
+		&wamp.Publish{Request: maxID, Topic: topic, ArgumentsKw: kwargs},
+		&wamp.Published{Request: maxID, Publication: maxID},
+		&wamp.Subscribe{Request: maxID, Topic: topic},
+		&wamp.Subscribed{Request: maxID, Subscription: maxID},
+		&wamp.Unsubscribe{Request: maxID, Subscription: maxID},
+		&wamp.Unsubscribed{Request: maxID},
+		&wamp.Event{Subscription: maxID, Publication: maxID,
+			Arguments: wamp.List{}, ArgumentsKw: kwargs},
+		&wamp.Call{Request: maxID, Procedure: proc, ArgumentsKw: kwargs},
+		&wamp.Cancel{Request: maxID},
+		&wamp.Result{Request: maxID, Arguments: wamp.List{nil},
+			ArgumentsKw: kwargs},
+		&wamp.Register{Request: maxID, Procedure: proc},
+		&wamp.Registered{Request: maxID, Registration: maxID},
+		&wamp.Unregister{Request: maxID, Registration: maxID},
+		&wamp.Unregistered{Request: maxID},
+		&wamp.Invocation{Request: maxID, Registration: maxID,
+			ArgumentsKw: kwargs},
+		&wamp.Interrupt{Request: maxID},
+		&wamp.Yield{Request: maxID, Arguments: wamp.List{}, ArgumentsKw: kwargs},
+	}
+}
+
+func TestJSONConformance(t *testing.T) {
+	s := &JSONSerializer{}
+	for _, msg := range edgeCaseMessages() {
+		b, err := s.Serialize(msg)
+		if err != nil {
+			t.Fatalf("error serializing %s: %s", msg.MessageType(), err)
+		}
+		// WAMP never has null in place of a message element.
+		var elems []interface{}
+		if err = json.Unmarshal(b, &elems); err != nil {
+			t.Fatalf("%s serialized as invalid JSON %s: %s", msg.MessageType(), b, err)
+		}
+		for i, elem := range elems {
+			if elem == nil {
+				t.Errorf("%s has null element %d: %s", msg.MessageType(), i, b)
+			}
+		}
+
+		out, err := s.Deserialize(b)
+		if err != nil {
+			t.Fatalf("error deserializing %s: %s", msg.MessageType(), err)
+		}
+		if err = wamp.Validate(out); err != nil {
+			t.Errorf("%s not valid after round trip: %s", msg.MessageType(), err)
+		}
+		// Compare encodings with sorted keys, since map order varies.
+		expect, err := json.Marshal(msgToList(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := json.Marshal(msgToList(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expect, got) {
+			t.Errorf("%s did not round trip:\nexpected %s\ngot      %s",
+				msg.MessageType(), expect, got)
+		}
+	}
+
+	// IDs must not lose precision, as they would if decoded as float64.
+	msg, err := s.Deserialize([]byte(`[36,9007199254740992,9007199254740991,{}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := msg.(*wamp.Event)
+	if event.Subscription != 1<<53 || event.Publication != 1<<53-1 {
+		t.Fatal("IDs lost precision:", event.Subscription, event.Publication)
+	}
+}
+
+func TestJSONNullVsEmptyArgs(t *testing.T) {
+	s := &JSONSerializer{}
+	// Each group of messages differ only in using null or empty for args,
+	// kwargs, or options, and must be treated the same.
+	for _, group := range [][]string{
+		{
+			`[48,1,{},"nexus.proc"]`,
+			`[48,1,{},"nexus.proc",[]]`,
+			`[48,1,{},"nexus.proc",null]`,
+			`[48,1,{},"nexus.proc",[],{}]`,
+			`[48,1,{},"nexus.proc",null,null]`,
+			`[48,1,null,"nexus.proc"]`,
+		},
+		{
+			`[48,1,{},"nexus.proc",[],{"a":1}]`,
+			`[48,1,{},"nexus.proc",null,{"a":1}]`,
+			`[48,1,null,"nexus.proc",null,{"a":1}]`,
+		},
+	} {
+		var expect []byte
+		for _, data := range group {
+			msg, err := s.Deserialize([]byte(data))
+			if err != nil {
+				t.Fatalf("error deserializing %s: %s", data, err)
+			}
+			call := msg.(*wamp.Call)
+			if len(call.Arguments) != 0 {
+				t.Fatalf("%s: expected no args, got %v", data, call.Arguments)
+			}
+			b, err := s.Serialize(msg)
+			if err != nil {
+				t.Fatalf("error serializing %s: %s", data, err)
+			}
+			if expect == nil {
+				expect = b
+			} else if !bytes.Equal(b, expect) {
+				t.Errorf("%s serialized as %s, expected %s", data, b, expect)
+			}
+		}
+	}
+}
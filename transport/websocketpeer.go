@@ -204,6 +204,9 @@ func NewWebsocketPeer(conn *websocket.Conn, serializer serialize.Serializer, pay
 
 func (w *websocketPeer) Recv() <-chan wamp.Message { return w.rd }
 
+// RemoteAddr returns the network address of the other end of the websocket.
+func (w *websocketPeer) RemoteAddr() string { return w.conn.RemoteAddr().String() }
+
 func (w *websocketPeer) TrySend(msg wamp.Message) error {
 	return wamp.TrySend(w.wr, msg)
 }
@@ -360,6 +363,19 @@ func (w *websocketPeer) recvHandler() {
 			w.log.Println("Cannot deserialize peer message:", err)
 			continue
 		}
+		// A message that is missing required fields is a protocol violation.
+		// Close the websocket with a protocol error, and stop receiving so
+		// that the session is ended.
+		if err = wamp.Validate(msg); err != nil {
+			w.log.Println("Closing websocket after protocol violation:", err)
+			w.cancelSender()
+			<-w.writerDone
+			closeMsg := websocket.FormatCloseMessage(websocket.CloseProtocolError,
+				err.Error())
+			w.conn.WriteControl(websocket.CloseMessage, closeMsg,
+				time.Now().Add(ctrlTimeout))
+			return
+		}
 		// It is OK for the router to block a client since routing should be
 		// very quick compared to the time to transfer a message over
 		// websocket, and a blocked client will not block other clients.
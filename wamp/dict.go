@@ -7,8 +7,9 @@ import (
 )
 
 // NormalizeDict takes a dict and creates a new normalized dict where all
-// map[string]xxx are converted to Dict.  Values that cannot
-// be converted, or are already the correct map type, remain the same.
+// map[string]xxx are converted to Dict, and all []interface{} are converted to
+// List, including those nested in lists.  Values that cannot be converted, or
+// are already the correct map type, remain the same.
 //
 // This is used for initial conversion of hello details.  The original dict is
 // not mutated.
@@ -25,26 +26,32 @@ func NormalizeDict(v interface{}) Dict {
 		if key.Kind() != reflect.String {
 			continue
 		}
-		cv := val.MapIndex(key)
-		newVal := NormalizeDict(cv.Interface())
-		if newVal == nil {
-			// If the value is interface{} representing []interface{}, then
-			// convert the slice to a List type.
-			if cv.Kind() == reflect.Interface && cv.Elem().Kind() == reflect.Slice {
-				cv = cv.Elem()
-				listType := reflect.TypeOf(List{})
-				if cv.Type().ConvertibleTo(listType) {
-					cv = cv.Convert(listType)
-				}
-			}
-			dict[key.String()] = cv.Interface()
-			continue
-		}
-		dict[key.String()] = newVal
+		dict[key.String()] = normalizeValue(val.MapIndex(key).Interface())
 	}
 	return dict
 }
 
+// normalizeValue returns a map value as a Dict and a []interface{} value as a
+// List, with the values nested in them normalized.  Other values are returned
+// unchanged.
+func normalizeValue(v interface{}) interface{} {
+	if dict := NormalizeDict(v); dict != nil {
+		return dict
+	}
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Slice || val.Type().Elem().Kind() != reflect.Interface {
+		return v
+	}
+	if val.IsNil() {
+		return List(nil)
+	}
+	list := make(List, val.Len())
+	for i := range list {
+		list[i] = normalizeValue(val.Index(i).Interface())
+	}
+	return list
+}
+
 // Return the child dictionary for the given key, or nil if not present.
 //
 // If the child is not a Dict, an attempt is made to convert
@@ -114,6 +121,78 @@ func DictFlag(dict Dict, path []string) (bool, error) {
 	return b, nil
 }
 
+// DictString returns the string at the path of keys in the dict.  False is
+// returned if the value is not present or is not a string.
+//
+// For example, DictString(details, "transport", "peer") returns the remote
+// address of a session's client.
+func DictString(dict Dict, keys ...string) (string, bool) {
+	v, ok := dictLookup(dict, keys)
+	if !ok {
+		return "", false
+	}
+	return AsString(v)
+}
+
+// DictInt returns the integer at the path of keys in the dict.  False is
+// returned if the value is not present or is not an integer.
+func DictInt(dict Dict, keys ...string) (int64, bool) {
+	v, ok := dictLookup(dict, keys)
+	if !ok {
+		return 0, false
+	}
+	return AsInt64(v)
+}
+
+// DictBool returns the bool at the path of keys in the dict.  False is
+// returned, as the second value, if the value is not present or is not a
+// boolean.
+func DictBool(dict Dict, keys ...string) (bool, bool) {
+	v, ok := dictLookup(dict, keys)
+	if !ok {
+		return false, false
+	}
+	return AsBool(v)
+}
+
+// DictList returns the list at the path of keys in the dict.  False is
+// returned if the value is not present or is not a list.
+func DictList(dict Dict, keys ...string) (List, bool) {
+	v, ok := dictLookup(dict, keys)
+	if !ok {
+		return nil, false
+	}
+	return AsList(v)
+}
+
+func dictLookup(dict Dict, keys []string) (interface{}, bool) {
+	if len(keys) == 0 {
+		return nil, false
+	}
+	v, err := DictValue(dict, keys)
+	return v, err == nil
+}
+
+// MergeDict merges the src dict into the dst dict, and returns dst.  When a
+// key has a dict value in both src and dst, the dicts are merged.  Otherwise,
+// the value from src replaces any value in dst.  Dicts from src are copied,
+// so that later changes to dst do not modify src.  If dst is nil, then a new
+// dict is created.
+func MergeDict(dst, src Dict) Dict {
+	if dst == nil {
+		dst = make(Dict, len(src))
+	}
+	for k, v := range src {
+		srcChild, ok := AsDict(v)
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		dst[k] = MergeDict(DictChild(dst, k), srcChild)
+	}
+	return dst
+}
+
 // SetOption sets a single option name-value pair in message options dict.
 func SetOption(dict Dict, name string, value interface{}) Dict {
 	if dict == nil {
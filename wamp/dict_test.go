@@ -247,3 +247,133 @@ func BenchmarkNotNormalized(b *testing.B) {
 		checkRoles(sess)
 	}
 }
+
+func TestDictGetters(t *testing.T) {
+	details := NormalizeDict(map[string]interface{}{
+		"authid": "jdoe",
+		"transport": map[string]interface{}{
+			"peer": "10.0.0.1:4321",
+			"auth": Dict{
+				"port":   8080,
+				"secure": true,
+				"protos": []string{"wamp.2.json"},
+			},
+		},
+	})
+
+	if s, ok := DictString(details, "transport", "peer"); !ok || s != "10.0.0.1:4321" {
+		t.Fatal("wrong nested string:", s)
+	}
+	if s, ok := DictString(details, "authid"); !ok || s != "jdoe" {
+		t.Fatal("wrong string:", s)
+	}
+	if n, ok := DictInt(details, "transport", "auth", "port"); !ok || n != 8080 {
+		t.Fatal("wrong nested int:", n)
+	}
+	if b, ok := DictBool(details, "transport", "auth", "secure"); !ok || !b {
+		t.Fatal("wrong nested bool")
+	}
+	if l, ok := DictList(details, "transport", "auth", "protos"); !ok || len(l) != 1 {
+		t.Fatal("wrong nested list:", l)
+	}
+
+	// Missing keys.
+	if _, ok := DictString(details, "transport", "nope"); ok {
+		t.Fatal("expected missing key")
+	}
+	if _, ok := DictString(details, "nope", "peer"); ok {
+		t.Fatal("expected missing parent key")
+	}
+	if _, ok := DictString(details); ok {
+		t.Fatal("expected no value for empty path")
+	}
+	if _, ok := DictInt(nil, "port"); ok {
+		t.Fatal("expected missing key in nil dict")
+	}
+
+	// Type mismatches.
+	if _, ok := DictInt(details, "authid"); ok {
+		t.Fatal("string should not be int")
+	}
+	if _, ok := DictBool(details, "transport", "auth", "port"); ok {
+		t.Fatal("int should not be bool")
+	}
+	if _, ok := DictList(details, "transport", "peer"); ok {
+		t.Fatal("string should not be list")
+	}
+	if _, ok := DictString(details, "authid", "peer"); ok {
+		t.Fatal("string should not have children")
+	}
+}
+
+func TestMergeDict(t *testing.T) {
+	dst := Dict{
+		"a": 1,
+		"b": Dict{"x": 1, "y": 2},
+		"c": "keep",
+	}
+	src := Dict{
+		"a": 2,
+		"b": map[string]interface{}{"y": 3, "z": Dict{"deep": true}},
+		"d": Dict{"new": "dict"},
+	}
+	merged := MergeDict(dst, src)
+
+	if n, _ := DictInt(merged, "a"); n != 2 {
+		t.Fatal("value not replaced")
+	}
+	if n, _ := DictInt(merged, "b", "x"); n != 1 {
+		t.Fatal("nested value lost")
+	}
+	if n, _ := DictInt(merged, "b", "y"); n != 3 {
+		t.Fatal("nested value not replaced")
+	}
+	if b, _ := DictBool(merged, "b", "z", "deep"); !b {
+		t.Fatal("deep value not merged")
+	}
+	if s, _ := DictString(merged, "c"); s != "keep" {
+		t.Fatal("value lost")
+	}
+
+	// Dicts from src are copied.
+	DictChild(merged, "d")["new"] = "changed"
+	if s, _ := DictString(src, "d", "new"); s != "dict" {
+		t.Fatal("src modified by change to merged dict")
+	}
+
+	if merged = MergeDict(nil, Dict{"a": 1}); merged["a"] != 1 {
+		t.Fatal("merge into nil dict failed")
+	}
+}
+
+func TestNormalizeDictNestedLists(t *testing.T) {
+	// As decoded from JSON, with maps inside lists.
+	details := NormalizeDict(map[string]interface{}{
+		"list": []interface{}{
+			map[string]interface{}{"k": "v"},
+			[]interface{}{map[string]interface{}{"n": 1}},
+		},
+		"empty": []interface{}{},
+		"null":  nil,
+	})
+	list, ok := details["list"].(List)
+	if !ok {
+		t.Fatalf("expected List, got %T", details["list"])
+	}
+	if d, ok := list[0].(Dict); !ok || d["k"] != "v" {
+		t.Fatalf("expected Dict in list, got %T", list[0])
+	}
+	inner, ok := list[1].(List)
+	if !ok {
+		t.Fatalf("expected List in list, got %T", list[1])
+	}
+	if _, ok = inner[0].(Dict); !ok {
+		t.Fatalf("expected Dict in nested list, got %T", inner[0])
+	}
+	if l, ok := details["empty"].(List); !ok || l == nil {
+		t.Fatalf("expected empty List, got %#v", details["empty"])
+	}
+	if v, ok := details["null"]; !ok || v != nil {
+		t.Fatalf("expected nil value, got %#v", v)
+	}
+}
@@ -32,7 +32,10 @@ var (
 )
 
 // ValidURI returns true if the URI complies with formatting rules determined
-// by the strict flag and match type.
+// by the strict flag and match type.  For exact matching, when match is empty
+// or "exact", all URI components must be non-empty.  For prefix matching, the
+// last component may be empty, allowing a trailing dot.  For wildcard
+// matching, any component may be empty.
 func (u URI) ValidURI(strict bool, match string) bool {
 	if strict {
 		if match == MatchWildcard {
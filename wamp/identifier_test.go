@@ -196,3 +196,36 @@ func TestValidURI(t *testing.T) {
 	}
 
 }
+
+func TestValidURIMatchModes(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		for _, match := range []string{"", MatchExact} {
+			if !URI("com.myapp.topic").ValidURI(strict, match) {
+				t.Error("expected exact URI to be valid, strict:", strict)
+			}
+			for _, uri := range []URI{"com..topic", "com.myapp.", ".com.myapp"} {
+				if uri.ValidURI(strict, match) {
+					t.Error("expected exact URI", uri, "to be invalid, strict:", strict)
+				}
+			}
+		}
+
+		for _, uri := range []URI{"com.myapp.", "com.myapp", "com."} {
+			if !uri.ValidURI(strict, MatchPrefix) {
+				t.Error("expected prefix URI", uri, "to be valid, strict:", strict)
+			}
+		}
+		if URI("com..topic").ValidURI(strict, MatchPrefix) {
+			t.Error("expected prefix URI com..topic to be invalid, strict:", strict)
+		}
+
+		for _, uri := range []URI{"com..topic", "com.myapp.", ".myapp.topic"} {
+			if !uri.ValidURI(strict, MatchWildcard) {
+				t.Error("expected wildcard URI", uri, "to be valid, strict:", strict)
+			}
+		}
+		if URI("com. .topic").ValidURI(strict, MatchWildcard) {
+			t.Error("expected wildcard URI with whitespace to be invalid, strict:", strict)
+		}
+	}
+}
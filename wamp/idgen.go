@@ -12,9 +12,9 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-// NewID generates a random WAMP ID.
+// NewID generates a random WAMP ID in the range [1, 2^53].
 func GlobalID() ID {
-	return ID(rand.Int63n(maxID))
+	return ID(rand.Int63n(maxID) + 1)
 }
 
 // ID generator for WAMP request IDs.  Create with new(IDGen).
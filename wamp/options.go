@@ -4,17 +4,29 @@ package wamp
 const (
 	// Message option keywords.
 	OptAcknowledge     = "acknowledge"
+	OptConcurrency     = "concurrency"
 	OptDiscloseCaller  = "disclose_caller"
 	OptDiscloseMe      = "disclose_me"
 	OptError           = "error"
 	OptExcludeMe       = "exclude_me"
+	OptGetRetained     = "get_retained"
+	OptHeartbeat       = "x_heartbeat"
 	OptInvoke          = "invoke"
 	OptMatch           = "match"
 	OptMode            = "mode"
+	OptNoPayload       = "x_no_payload"
+	OptPPTCipher       = "ppt_cipher"
+	OptPPTKeyID        = "ppt_keyid"
+	OptPPTScheme       = "ppt_scheme"
+	OptPPTSerializer   = "ppt_serializer"
 	OptProcedure       = "procedure"
 	OptProgress        = "progress"
 	OptReason          = "reason"
 	OptReceiveProgress = "receive_progress"
+	OptRetain          = "retain"
+	OptRetained        = "retained"
+	OptRKey            = "rkey"
+	OptRunMode         = "runmode"
 	OptTimeout         = "timeout"
 
 	// Values for URI matching mode.
@@ -33,6 +45,10 @@ const (
 	InvokeRandom     = "random"
 	InvokeFirst      = "first"
 	InvokeLast       = "last"
+	InvokePartition  = "partition"
+
+	// Values for call run mode.
+	RunModePartition = "partition"
 
 	// Options for subscriber filtering.
 	BlacklistKey = "exclude"
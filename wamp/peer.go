@@ -24,6 +24,19 @@ type Peer interface {
 	Recv() <-chan Message
 }
 
+// PeerAddr returns the network address of the remote end of the peer's
+// connection.  A peer provides its address by implementing a RemoteAddr()
+// string method.  If the peer does not provide an address, then false is
+// returned.
+func PeerAddr(p Peer) (string, bool) {
+	ap, ok := p.(interface{ RemoteAddr() string })
+	if !ok {
+		return "", false
+	}
+	addr := ap.RemoteAddr()
+	return addr, addr != ""
+}
+
 // RecvTimeout receives a message from a peer within the specified time.
 func RecvTimeout(p Peer, t time.Duration) (Message, error) {
 	select {
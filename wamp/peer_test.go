@@ -90,3 +90,24 @@ func TestSendCtx(t *testing.T) {
 	}
 	p.Close()
 }
+
+type addrPeer struct {
+	*testPeer
+	addr string
+}
+
+func (p *addrPeer) RemoteAddr() string { return p.addr }
+
+func TestPeerAddr(t *testing.T) {
+	p := newTestPeer()
+	if _, ok := PeerAddr(p); ok {
+		t.Fatal("expected no address from peer without RemoteAddr")
+	}
+	if _, ok := PeerAddr(&addrPeer{testPeer: p.(*testPeer)}); ok {
+		t.Fatal("expected no address from peer with empty RemoteAddr")
+	}
+	addr, ok := PeerAddr(&addrPeer{p.(*testPeer), "127.0.0.1:8080"})
+	if !ok || addr != "127.0.0.1:8080" {
+		t.Fatal("wrong address from peer:", addr)
+	}
+}
@@ -0,0 +1,140 @@
+package wamp
+
+import (
+	"context"
+	"sync"
+)
+
+// Record is a message recorded by a RecordingPeer.
+type Record struct {
+	// Sent is true if the message was sent to the peer, and false if the
+	// message was received from the peer.
+	Sent    bool
+	Message Message
+}
+
+// RecordingPeer wraps a Peer and records every message sent to and received
+// from the peer, in order, for later inspection when testing or debugging.  It
+// is safe for concurrent use.
+type RecordingPeer struct {
+	Peer
+
+	rd   chan Message
+	done chan struct{}
+	once sync.Once
+
+	mu      sync.Mutex
+	records []*Record
+}
+
+// NewRecordingPeer returns a RecordingPeer that wraps the given peer.  Closing
+// the RecordingPeer closes the wrapped peer.
+func NewRecordingPeer(peer Peer) *RecordingPeer {
+	p := &RecordingPeer{
+		Peer: peer,
+		rd:   make(chan Message),
+		done: make(chan struct{}),
+	}
+	go p.recvHandler()
+	return p
+}
+
+// Records returns a copy of the messages recorded so far, in the order they
+// were sent or received.
+func (p *RecordingPeer) Records() []Record {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	records := make([]Record, len(p.records))
+	for i := range p.records {
+		records[i] = *p.records[i]
+	}
+	return records
+}
+
+// Recv returns the channel of messages received from the wrapped peer.
+func (p *RecordingPeer) Recv() <-chan Message { return p.rd }
+
+// Send sends the message to the wrapped peer and records it.
+func (p *RecordingPeer) Send(msg Message) error {
+	rec := p.record(true, msg)
+	return p.check(rec, p.Peer.Send(msg))
+}
+
+// SendCtx sends the message to the wrapped peer and records it.
+func (p *RecordingPeer) SendCtx(ctx context.Context, msg Message) error {
+	rec := p.record(true, msg)
+	return p.check(rec, p.Peer.SendCtx(ctx, msg))
+}
+
+// TrySend sends the message to the wrapped peer, without blocking, and
+// records it.
+func (p *RecordingPeer) TrySend(msg Message) error {
+	rec := p.record(true, msg)
+	return p.check(rec, p.Peer.TrySend(msg))
+}
+
+// Close closes the wrapped peer.
+func (p *RecordingPeer) Close() {
+	p.once.Do(func() {
+		close(p.done)
+		p.Peer.Close()
+	})
+}
+
+// RemoteAddr returns the network address of the wrapped peer, if it has one.
+func (p *RecordingPeer) RemoteAddr() string {
+	addr, _ := PeerAddr(p.Peer)
+	return addr
+}
+
+// record adds a message to the recording.  A message is recorded before it is
+// sent, so that any reply to the message is recorded after it.
+func (p *RecordingPeer) record(sent bool, msg Message) *Record {
+	rec := &Record{Sent: sent, Message: msg}
+	p.mu.Lock()
+	p.records = append(p.records, rec)
+	p.mu.Unlock()
+	return rec
+}
+
+// check removes a recorded message from the recording if sending it failed.
+func (p *RecordingPeer) check(rec *Record, err error) error {
+	if err == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := len(p.records) - 1; i >= 0; i-- {
+		if p.records[i] == rec {
+			p.records = append(p.records[:i], p.records[i+1:]...)
+			break
+		}
+	}
+	return err
+}
+
+// recvHandler records the messages received from the wrapped peer and passes
+// them to the RecordingPeer's Recv channel.  The channel is closed when the
+// wrapped peer's channel is closed, or when the RecordingPeer is closed.
+func (p *RecordingPeer) recvHandler() {
+	defer close(p.rd)
+	recv := p.Peer.Recv()
+	for {
+		var msg Message
+		var open bool
+		select {
+		case msg, open = <-recv:
+			if !open {
+				return
+			}
+		case <-p.done:
+			return
+		}
+		p.record(false, msg)
+		select {
+		case p.rd <- msg:
+		case <-p.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package wamp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// pipePeer is one end of a connection made by pipePeers.
+type pipePeer struct {
+	rd <-chan Message
+	wr chan<- Message
+}
+
+// pipePeers returns two peers, where messages sent to one are received by the
+// other.
+func pipePeers() (Peer, Peer) {
+	aToB := make(chan Message, 1)
+	bToA := make(chan Message, 1)
+	return &pipePeer{rd: bToA, wr: aToB}, &pipePeer{rd: aToB, wr: bToA}
+}
+
+func (p *pipePeer) Recv() <-chan Message      { return p.rd }
+func (p *pipePeer) Send(msg Message) error    { p.wr <- msg; return nil }
+func (p *pipePeer) TrySend(msg Message) error { return TrySend(p.wr, msg) }
+func (p *pipePeer) Close()                    { close(p.wr) }
+
+func (p *pipePeer) SendCtx(ctx context.Context, msg Message) error {
+	return SendCtx(ctx, p.wr, msg)
+}
+
+func TestRecordingPeer(t *testing.T) {
+	client, server := pipePeers()
+	rec := NewRecordingPeer(client)
+
+	// Server replies to HELLO with WELCOME, and to GOODBYE with GOODBYE.
+	go func() {
+		for msg := range server.Recv() {
+			switch msg.(type) {
+			case *Hello:
+				server.Send(&Welcome{ID: 1, Details: Dict{}})
+			case *Goodbye:
+				server.Send(&Goodbye{Reason: ErrGoodbyeAndOut, Details: Dict{}})
+				server.Close()
+			}
+		}
+	}()
+
+	rec.Send(&Hello{Realm: "nexus.test.realm", Details: Dict{}})
+	if msg, err := RecvTimeout(rec, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*Welcome); !ok {
+		t.Fatal("expected WELCOME, got", msg.MessageType())
+	}
+	rec.Send(&Goodbye{Reason: CloseRealm, Details: Dict{}})
+	if msg, err := RecvTimeout(rec, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*Goodbye); !ok {
+		t.Fatal("expected GOODBYE, got", msg.MessageType())
+	}
+	// Recv channel is closed when the server closes.
+	if _, err := RecvTimeout(rec, time.Second); err == nil {
+		t.Fatal("expected receive channel to be closed")
+	}
+	rec.Close()
+	rec.Close()
+
+	expect := []Record{
+		{Sent: true, Message: &Hello{}},
+		{Sent: false, Message: &Welcome{}},
+		{Sent: true, Message: &Goodbye{}},
+		{Sent: false, Message: &Goodbye{}},
+	}
+	records := rec.Records()
+	if len(records) != len(expect) {
+		t.Fatalf("expected %d records, got %d", len(expect), len(records))
+	}
+	for i := range expect {
+		if records[i].Sent != expect[i].Sent ||
+			records[i].Message.MessageType() != expect[i].Message.MessageType() {
+			t.Errorf("record %d: expected sent=%v %v, got sent=%v %v", i,
+				expect[i].Sent, expect[i].Message.MessageType(),
+				records[i].Sent, records[i].Message.MessageType())
+		}
+	}
+
+	// A message that fails to send is not recorded.
+	client, _ = pipePeers()
+	rec = NewRecordingPeer(client)
+	defer rec.Close()
+	rec.Send(&Hello{})
+	if err := rec.TrySend(&Hello{}); err == nil {
+		t.Fatal("expected TrySend to fail")
+	}
+	if n := len(rec.Records()); n != 1 {
+		t.Fatal("expected 1 record, got", n)
+	}
+}
@@ -13,7 +13,9 @@ type Session struct {
 	Peer
 	// Unique session ID.
 	ID ID
-	// Details about session.
+	// Details about session.  Once the session is attached to a realm, the
+	// details may be read and modified from different goroutines, so they
+	// must only be accessed while holding the session lock.
 	Details Dict
 
 	// Roles and features supported by peer.
@@ -41,6 +43,20 @@ func NewSession(peer Peer, id ID, details Dict, greetDetails Dict) *Session {
 	return s
 }
 
+// SafeSession returns a session that has the same ID, details, and roles as
+// this session, but has no Peer.  This is given to user-supplied code, such as
+// authorizers and publish filters, to prevent access to the session's Peer.
+//
+// The returned session shares its Details with this session, so the caller
+// must hold this session's lock while the safe session is in use.
+func (s *Session) SafeSession() *Session {
+	return &Session{
+		ID:      s.ID,
+		Details: s.Details,
+		roles:   s.roles,
+	}
+}
+
 // Lock locks the session to protect against concurrent updates.
 func (s *Session) Lock() { s.mu.Lock() }
 
@@ -67,6 +83,20 @@ func (s *Session) HasFeature(role, feature string) bool {
 	return ok
 }
 
+// Roles returns the roles and features supported by the session, in the same
+// form as the roles in HELLO.Details.
+func (s *Session) Roles() Dict {
+	roles := make(Dict, len(s.roles))
+	for role, features := range s.roles {
+		featDict := make(Dict, len(features))
+		for f := range features {
+			featDict[f] = true
+		}
+		roles[role] = Dict{"features": featDict}
+	}
+	return roles
+}
+
 // RecvDone returns a channel that is closed when this session has been ended
 // by calling EndRecv.
 func (s *Session) RecvDone() <-chan struct{} {
@@ -0,0 +1,27 @@
+package wamp
+
+import "testing"
+
+func TestSafeSession(t *testing.T) {
+	sess := NewSession(&testPeer{}, 123, Dict{"authid": "jdoe"},
+		Dict{"roles": Dict{"subscriber": Dict{}}})
+
+	safe := sess.SafeSession()
+	if safe.Peer != nil {
+		t.Fatal("safe session should not have peer")
+	}
+	if safe.ID != sess.ID {
+		t.Fatal("wrong session ID")
+	}
+	if !safe.HasRole("subscriber") {
+		t.Fatal("safe session missing role")
+	}
+
+	// Details are shared with the original session.
+	sess.Lock()
+	safe.Details["authrole"] = "user"
+	sess.Unlock()
+	if sess.Details["authrole"] != "user" {
+		t.Fatal("safe session details not shared")
+	}
+}
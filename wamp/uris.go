@@ -52,6 +52,10 @@ const (
 	CloseGoodbyeAndOut = URI("wamp.close.goodbye_and_out")
 	ErrGoodbyeAndOut   = CloseGoodbyeAndOut
 
+	// The router ended a session that did not send any messages within the
+	// time allowed (non-standard).
+	CloseTimeout = URI("wamp.close.timeout")
+
 	// -- Authorization --
 
 	// A join, call, register, publish or subscribe failed, since the Peer is
@@ -104,6 +108,15 @@ const (
 	// A Peer received invalid WAMP protocol message.
 	ErrProtocolViolation = URI("wamp.error.protocol_violation")
 
+	// A Router rejected a message with a payload larger than the realm
+	// allows.  This is not a WAMP standard error.
+	ErrPayloadSizeExceeded = URI("wamp.error.payload_size_exceeded")
+
+	// A Dealer could not invoke a procedure because every callee already has
+	// the maximum number of concurrent invocations it registered for.  This
+	// is not a WAMP standard error.
+	ErrMaxConcurrencyReached = URI("wamp.error.max_concurrency_reached")
+
 	// -- Session Meta Events --
 
 	// Fired when a session joins a realm on the router.
@@ -139,6 +152,17 @@ const (
 	// Modify details of session identified by session ID (non-standard).
 	MetaProcSessionModifyDetails = URI("wamp.session.modify_details")
 
+	// Does nothing.  Called by a session to show that it is still alive when
+	// it has nothing else to send (non-standard).
+	MetaProcSessionHeartbeat = URI("wamp.session.heartbeat")
+
+	// -- Realm Meta Procedures --
+
+	// Drain the caller's realm: reject new sessions, subscriptions, and
+	// registrations, then GOODBYE all sessions after a grace period
+	// (non-standard).
+	MetaProcRealmDrain = URI("wamp.realm.drain")
+
 	// No session with the given ID exists on the router.
 	ErrNoSuchSession = URI("wamp.error.no_such_session")
 
@@ -217,7 +241,7 @@ const (
 	MetaProcSubListSubscribers = URI("wamp.subscription.list_subscribers")
 
 	// Obtains the number of sessions currently attached to the subscription.
-	MetaProcSubCountSubscribers = URI("wamp.subscription.count_suscribers")
+	MetaProcSubCountSubscribers = URI("wamp.subscription.count_subscribers")
 
 	// -- Testament Meta Procedures --
 
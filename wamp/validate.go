@@ -0,0 +1,121 @@
+package wamp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Validate checks that a message received from a peer has the fields required
+// by its message type.  IDs must be in the range [1, 2^53], and URIs that
+// identify a realm, topic, procedure, error, or reason must not be empty.  An
+// ERROR must be in response to a message type that can have an error.
+//
+// Deserializing a message that is missing trailing fields leaves those fields
+// empty, so Validate also rejects truncated messages.  Transports call
+// Validate on each message they receive, so that a malformed message is
+// treated as a protocol violation and never reaches the router or client.
+func Validate(msg Message) error {
+	var err error
+	switch msg := msg.(type) {
+	case *Hello:
+		err = checkURI("realm", msg.Realm)
+	case *Welcome:
+		err = checkID("session", msg.ID)
+	case *Abort:
+		err = checkURI("reason", msg.Reason)
+	case *Challenge:
+		if msg.AuthMethod == "" {
+			err = errors.New("missing authmethod")
+		}
+	case *Authenticate:
+	case *Goodbye:
+		err = checkURI("reason", msg.Reason)
+	case *Error:
+		switch msg.Type {
+		case SUBSCRIBE, UNSUBSCRIBE, PUBLISH, REGISTER, UNREGISTER, CALL, INVOCATION:
+		default:
+			return fmt.Errorf("ERROR for invalid message type %d", msg.Type)
+		}
+		if err = checkID("request", msg.Request); err == nil {
+			err = checkURI("error", msg.Error)
+		}
+	case *Publish:
+		if err = checkID("request", msg.Request); err == nil {
+			err = checkURI("topic", msg.Topic)
+		}
+	case *Published:
+		if err = checkID("request", msg.Request); err == nil {
+			err = checkID("publication", msg.Publication)
+		}
+	case *Subscribe:
+		if err = checkID("request", msg.Request); err == nil {
+			err = checkURI("topic", msg.Topic)
+		}
+	case *Subscribed:
+		if err = checkID("request", msg.Request); err == nil {
+			err = checkID("subscription", msg.Subscription)
+		}
+	case *Unsubscribe:
+		if err = checkID("request", msg.Request); err == nil {
+			err = checkID("subscription", msg.Subscription)
+		}
+	case *Unsubscribed:
+		err = checkID("request", msg.Request)
+	case *Event:
+		if err = checkID("subscription", msg.Subscription); err == nil {
+			err = checkID("publication", msg.Publication)
+		}
+	case *Call:
+		if err = checkID("request", msg.Request); err == nil {
+			err = checkURI("procedure", msg.Procedure)
+		}
+	case *Cancel:
+		err = checkID("request", msg.Request)
+	case *Result:
+		err = checkID("request", msg.Request)
+	case *Register:
+		if err = checkID("request", msg.Request); err == nil {
+			err = checkURI("procedure", msg.Procedure)
+		}
+	case *Registered:
+		if err = checkID("request", msg.Request); err == nil {
+			err = checkID("registration", msg.Registration)
+		}
+	case *Unregister:
+		if err = checkID("request", msg.Request); err == nil {
+			err = checkID("registration", msg.Registration)
+		}
+	case *Unregistered:
+		err = checkID("request", msg.Request)
+	case *Invocation:
+		if err = checkID("request", msg.Request); err == nil {
+			err = checkID("registration", msg.Registration)
+		}
+	case *Interrupt:
+		err = checkID("request", msg.Request)
+	case *Yield:
+		err = checkID("request", msg.Request)
+	case nil:
+		return errors.New("nil message")
+	default:
+		return fmt.Errorf("unsupported message type %d", msg.MessageType())
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s message: %s", msg.MessageType(), err)
+	}
+	return nil
+}
+
+func checkID(name string, id ID) error {
+	if id == 0 || id > ID(maxID) {
+		return fmt.Errorf("%s ID %d out of range", name, id)
+	}
+	return nil
+}
+
+func checkURI(name string, uri URI) error {
+	if uri == "" {
+		return fmt.Errorf("missing %s URI", name)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package wamp
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	valid := []Message{
+		&Hello{Realm: "nexus.realm", Details: Dict{}},
+		&Welcome{ID: 1, Details: Dict{}},
+		&Abort{Reason: ErrNoSuchRealm},
+		&Goodbye{Reason: CloseNormal},
+		&Error{Type: CALL, Request: 1, Details: Dict{}, Error: ErrCanceled},
+		&Publish{Request: 1, Topic: "nexus.topic"},
+		&Published{Request: 1, Publication: 2},
+		&Subscribe{Request: 1, Topic: "nexus.topic"},
+		&Event{Subscription: 1, Publication: 2},
+		&Call{Request: 1, Procedure: "nexus.proc"},
+		&Invocation{Request: 1, Registration: 2},
+		&Yield{Request: 1},
+		&Authenticate{},
+		&Subscribe{Request: ID(maxID), Topic: "nexus.topic"},
+	}
+	for _, msg := range valid {
+		if err := Validate(msg); err != nil {
+			t.Error("valid message rejected:", err)
+		}
+	}
+
+	// Messages as they would be deserialized when truncated, or with garbage
+	// values.
+	invalid := []Message{
+		nil,
+		&Hello{},
+		&Welcome{},
+		&Abort{Details: Dict{}},
+		&Goodbye{},
+		&Error{Request: 1, Error: ErrCanceled},
+		&Error{Type: EVENT, Request: 1, Error: ErrCanceled},
+		&Error{Type: CALL, Request: 1},
+		&Publish{Request: 1},
+		&Publish{Topic: "nexus.topic"},
+		&Subscribe{Request: ID(maxID + 1), Topic: "nexus.topic"},
+		&Subscribed{Request: 1},
+		&Unsubscribe{Request: 1},
+		&Event{Subscription: 1},
+		&Call{Request: 1, Options: Dict{}},
+		&Register{Request: 1},
+		&Invocation{Request: 1},
+		&Yield{},
+		&Challenge{},
+	}
+	for _, msg := range invalid {
+		if err := Validate(msg); err == nil {
+			t.Errorf("invalid message accepted: %+v", msg)
+		}
+	}
+}